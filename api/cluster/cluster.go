@@ -0,0 +1,702 @@
+// Package cluster spreads the objects of the buckets over the nodes of a
+// cluster. Every node accepts every request. Buckets exist on all the nodes,
+// and bucket changes are applied on each of them. Objects are stored on the
+// nodes owning their key on a consistent hash ring; writes are sent to all
+// the owners and reads to the owners answering first, and both succeed once
+// a quorum of them answered, so a node can be down. Deletes leave a marker
+// on the owners, so that an owner that missed one cannot bring the object
+// back.
+package cluster
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"encoding/xml"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/handlers"
+	"github.com/ab-dauletkhan/triple-s/api/util"
+)
+
+// HeaderSecret carries the cluster secret on the requests between the
+// nodes, which are served by the receiving node itself
+const HeaderSecret = "X-Triple-S-Cluster"
+
+// HeaderDeletedAt asks a node, on a listing between the nodes, when the
+// object named by the prefix was deleted, and carries the answer
+const HeaderDeletedAt = "X-Triple-S-Deleted-At"
+
+// Largest response body of a node kept in memory to relay it
+const maxRelayedBody = 1 << 20
+
+var (
+	ErrNoQuorum        = errors.New("not enough nodes of the cluster answered")
+	ErrInvalidSecret   = errors.New("invalid cluster secret")
+	ErrPartialBucketOp = errors.New("not every node of the cluster applied the change, repeat it once they are up")
+)
+
+// Coordinator serves the requests made to a node, sending them to the nodes
+// of the cluster they concern
+type Coordinator struct {
+	cfg           core.ClusterConfig
+	ring          *Ring
+	replicas      int
+	writeQuorum   int
+	readQuorum    int
+	local         *http.ServeMux
+	endpoints     bool // whether local serves the server endpoints, named like reserved buckets
+	client        *http.Client
+	markers       *deleteMarkers
+	spoolDir      string
+	maxObjectSize int64
+}
+
+// response is the answer of a node to a request, with its body read
+type response struct {
+	node   string
+	status int
+	header http.Header
+	body   []byte
+	err    error
+}
+
+// New returns the coordinator of the node configured in cfg, serving the
+// requests that concern it with local. It fails when the delete markers of
+// the data directory cannot be loaded.
+func New(cfg *core.Config, local *http.ServeMux) (*Coordinator, error) {
+	tlsConfig, err := newClientTLSConfig(cfg.Cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	markers, err := openDeleteMarkers(cfg.Dir, cfg.Metadata.Sync)
+	if err != nil {
+		return nil, err
+	}
+
+	write, read := cfg.Cluster.Quorums()
+	timeout := time.Duration(cfg.Cluster.Timeout)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: timeout}).DialContext
+	transport.ResponseHeaderTimeout = timeout
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return &Coordinator{
+		cfg:           cfg.Cluster,
+		ring:          NewRing(cfg.Cluster.Peers),
+		replicas:      cfg.Cluster.Replicas(),
+		writeQuorum:   write,
+		readQuorum:    read,
+		endpoints:     cfg.AdminPort == 0,
+		local:         local,
+		client:        &http.Client{Transport: transport},
+		markers:       markers,
+		spoolDir:      cfg.Dir,
+		maxObjectSize: cfg.Limits.MaxObjectSize,
+	}, nil
+}
+
+// Split serves the requests between the nodes of a cluster, which carry its
+// secret, with internal and the others with external
+func Split(cfg core.ClusterConfig, internal, external http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret := r.Header.Get(HeaderSecret)
+		switch {
+		case secret == "":
+			external.ServeHTTP(w, r)
+		case subtle.ConstantTimeCompare([]byte(secret), []byte(cfg.Secret)) == 1:
+			// Marked in place, the middlewares around read the route the mux
+			// records on r
+			*r = *r.WithContext(core.WithInternal(r.Context()))
+			internal.ServeHTTP(w, r)
+		default:
+			core.Logger(r.Context()).Warn("request with an invalid cluster secret")
+			handlers.XMLErrResponse(w, http.StatusForbidden, ErrInvalidSecret.Error())
+		}
+	})
+}
+
+// Internal serves the requests of the other nodes with local. It records a
+// delete marker when an object is deleted, removes it when the object is
+// written again, and reports it to the listings asking for it.
+func (c *Coordinator) Internal(local http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bucketName, objectKey, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		version := r.Header.Get(handlers.HeaderLastModified)
+		switch {
+		case objectKey == "" && r.Method == http.MethodGet && r.Header.Get(HeaderDeletedAt) != "":
+			if deletedAt := c.markers.get(bucketName, r.URL.Query().Get("prefix")); deletedAt != "" {
+				w.Header().Set(HeaderDeletedAt, deletedAt)
+			}
+			local.ServeHTTP(w, r)
+			return
+		case objectKey == "" || version == "" || r.URL.RawQuery != "" ||
+			(r.Method != http.MethodDelete && r.Method != http.MethodPut):
+			local.ServeHTTP(w, r)
+			return
+		}
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		local.ServeHTTP(sw, r)
+
+		var err error
+		switch {
+		case r.Method == http.MethodDelete && (sw.status == http.StatusNotFound || (sw.status >= 200 && sw.status <= 299)):
+			err = c.markers.add(bucketName, objectKey, version)
+		case r.Method == http.MethodPut && sw.status >= 200 && sw.status <= 299:
+			err = c.markers.clear(bucketName, objectKey, version)
+		}
+		if err != nil {
+			core.Logger(r.Context()).Error("failed to record delete marker", "bucket", bucketName, "key", objectKey, "error", err)
+		}
+	})
+}
+
+// statusWriter remembers the status of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// ServeHTTP serves a request made to this node by a client
+func (c *Coordinator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Only the nodes set the version of the objects they store
+	r.Header.Del(handlers.HeaderLastModified)
+
+	// The local mux is not reached, the pattern names the operation in the metrics
+	_, r.Pattern = c.local.Handler(r)
+
+	bucketName, objectKey, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+	switch {
+	case bucketName == "" || (c.endpoints && util.ReservedBucketName(bucketName)):
+		c.local.ServeHTTP(w, r)
+	case objectKey == "" && (r.Method == http.MethodPut || r.Method == http.MethodDelete):
+		c.broadcast(w, r)
+	case objectKey == "" && (query.Has("stats") || query.Has("events")):
+		// Statistics and change feeds are those of the objects of this node
+		c.local.ServeHTTP(w, r)
+	case objectKey == "":
+		c.listObjects(w, r)
+	case r.Method == http.MethodPut || r.Method == http.MethodDelete || r.Method == http.MethodPost:
+		// Restores are applied on every owner, any of them may serve the reads
+		c.write(w, r, bucketName, objectKey)
+	default:
+		c.read(w, r, bucketName, objectKey)
+	}
+}
+
+// broadcast applies a bucket change on every node. The answer of this node
+// is relayed when all of them succeeded, otherwise a failure.
+func (c *Coordinator) broadcast(w http.ResponseWriter, r *http.Request) {
+	logger := core.Logger(r.Context())
+	nodes := c.ring.Nodes()
+
+	responses := make(chan response, len(nodes))
+	for _, node := range nodes {
+		go func() {
+			responses <- c.send(r.Context(), r, node, nil, 0)
+		}()
+	}
+
+	var answer *response
+	unreachable := 0
+	for range nodes {
+		res := <-responses
+		switch {
+		case res.err != nil:
+			logger.Warn("node unreachable", "node", res.node, "error", res.err)
+			unreachable++
+		case res.status < 200 || res.status > 299:
+			if answer == nil || answer.status <= 299 {
+				answer = &res
+			}
+		case answer == nil || res.node == c.cfg.Node:
+			answer = &res
+		}
+	}
+
+	if unreachable > 0 {
+		handlers.XMLErrResponse(w, http.StatusServiceUnavailable, ErrPartialBucketOp.Error())
+		return
+	}
+	relay(w, *answer)
+}
+
+// write sends an object change to the owners of its key and answers once a
+// quorum of them acknowledged it; the other owners are still waited for in
+// the background. An object that is not found counts as deleted.
+func (c *Coordinator) write(w http.ResponseWriter, r *http.Request, bucketName, objectKey string) {
+	logger := core.Logger(r.Context())
+	owners := c.ring.Owners(bucketName+"/"+objectKey, c.replicas)
+
+	// Every owner stores the same version
+	r.Header.Set(handlers.HeaderLastModified, time.Now().UTC().Format(time.RFC3339Nano))
+
+	body, size, err := c.spool(r)
+	switch {
+	case errors.Is(err, handlers.ErrEntityTooLarge):
+		logger.Info("object too large", "max_size", c.maxObjectSize)
+		handlers.XMLErrResponse(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	case err != nil:
+		logger.Error("failed to spool request body", "error", err)
+		handlers.XMLErrResponse(w, http.StatusInternalServerError, handlers.ErrInternalServer.Error())
+		return
+	}
+
+	// Owners still being written to once the client is answered must not be
+	// canceled with its request
+	ctx := context.WithoutCancel(r.Context())
+	responses := make(chan response, len(owners))
+	for _, node := range owners {
+		go func() {
+			responses <- c.send(ctx, r, node, io.NewSectionReader(body, 0, size), size)
+		}()
+	}
+	var acks []response
+	var rejected *response
+	received := 0
+	for received < len(owners) && len(acks) < c.writeQuorum {
+		res := <-responses
+		received++
+		switch {
+		case res.err != nil:
+			logger.Warn("node unreachable", "node", res.node, "error", res.err)
+		case (res.status >= 200 && res.status <= 299) || (r.Method == http.MethodDelete && res.status == http.StatusNotFound):
+			acks = append(acks, res)
+		case rejected == nil:
+			rejected = &res
+		}
+	}
+
+	// The spooled body is removed once the last owner is done with it
+	go func() {
+		for ; received < len(owners); received++ {
+			if res := <-responses; res.err != nil {
+				slog.Warn("node unreachable", "node", res.node, "error", res.err)
+			}
+		}
+		body.Close()
+		os.Remove(body.Name())
+	}()
+
+	switch {
+	case len(acks) >= c.writeQuorum:
+		// A delete succeeded if any owner had the object
+		best := acks[0]
+		for _, res := range acks {
+			if res.status != http.StatusNotFound {
+				best = res
+				break
+			}
+		}
+		relay(w, best)
+	case rejected != nil:
+		relay(w, *rejected)
+	default:
+		logger.Warn("write quorum not reached", "acks", len(acks), "quorum", c.writeQuorum)
+		handlers.XMLErrResponse(w, http.StatusServiceUnavailable, ErrNoQuorum.Error())
+	}
+}
+
+// read asks the owners of an object for its version, and once a quorum of
+// them answered, serves the request from an owner of the latest version.
+// When the latest change is a delete, the object is not found and the
+// owners still holding an older version are made to delete it.
+func (c *Coordinator) read(w http.ResponseWriter, r *http.Request, bucketName, objectKey string) {
+	logger := core.Logger(r.Context())
+	owners := c.ring.Owners(bucketName+"/"+objectKey, c.replicas)
+
+	type version struct {
+		node      string
+		object    *core.Object // nil when the owner does not have the object
+		deletedAt string       // when the owner deleted the object, if it did
+	}
+	versions := make(chan version, len(owners))
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	for _, node := range owners {
+		go func() {
+			object, deletedAt, err := c.stat(ctx, node, bucketName, objectKey)
+			if err != nil {
+				logger.Warn("node unreachable", "node", node, "error", err)
+				node = ""
+			}
+			versions <- version{node: node, object: object, deletedAt: deletedAt}
+		}()
+	}
+
+	var answers []version
+	for range owners {
+		if v := <-versions; v.node != "" {
+			answers = append(answers, v)
+			if len(answers) == c.readQuorum {
+				break
+			}
+		}
+	}
+	if len(answers) < c.readQuorum {
+		logger.Warn("read quorum not reached", "answers", len(answers), "quorum", c.readQuorum)
+		handlers.XMLErrResponse(w, http.StatusServiceUnavailable, ErrNoQuorum.Error())
+		return
+	}
+
+	// Owners of the latest version first; without any, an owner answers
+	// that the bucket or the object is not found
+	slices.SortStableFunc(answers, func(a, b version) int {
+		switch {
+		case a.object == nil && b.object == nil:
+			return 0
+		case a.object == nil:
+			return 1
+		case b.object == nil:
+			return -1
+		}
+		return -compareVersions(a.object.LastModified, b.object.LastModified)
+	})
+
+	var deletedAt string
+	for _, v := range answers {
+		if v.deletedAt != "" && (deletedAt == "" || compareVersions(v.deletedAt, deletedAt) > 0) {
+			deletedAt = v.deletedAt
+		}
+	}
+	if latest := answers[0].object; deletedAt != "" && (latest == nil || compareVersions(deletedAt, latest.LastModified) >= 0) {
+		var stale []string
+		for _, v := range answers {
+			if v.object != nil {
+				stale = append(stale, v.node)
+			}
+		}
+		c.repairDelete(r, stale, deletedAt)
+		logger.Debug("object deleted across the cluster", "deleted_at", deletedAt)
+		handlers.XMLErrResponse(w, http.StatusNotFound, "Object not found")
+		return
+	}
+
+	for _, v := range answers {
+		if v.object != nil && answers[0].object != nil && v.object.LastModified != answers[0].object.LastModified {
+			break
+		}
+		if c.proxy(w, r, v.node) {
+			return
+		}
+	}
+	handlers.XMLErrResponse(w, http.StatusServiceUnavailable, ErrNoQuorum.Error())
+}
+
+// repairDelete deletes, in the background, the versions of an object older
+// than deletedAt left on nodes that missed its deletion
+func (c *Coordinator) repairDelete(r *http.Request, nodes []string, deletedAt string) {
+	logger := core.Logger(r.Context())
+	ctx := context.WithoutCancel(r.Context())
+	for _, node := range nodes {
+		go func() {
+			req, err := http.NewRequestWithContext(ctx, http.MethodDelete, node+r.URL.EscapedPath(), nil)
+			if err != nil {
+				return
+			}
+			req.Header.Set(HeaderSecret, c.cfg.Secret)
+			req.Header.Set(handlers.HeaderLastModified, deletedAt)
+
+			resp, err := c.client.Do(req)
+			if err != nil {
+				logger.Warn("node unreachable", "node", node, "error", err)
+				return
+			}
+			resp.Body.Close()
+			logger.Info("deleted stale object", "node", node, "deleted_at", deletedAt, "status", resp.StatusCode)
+		}()
+	}
+}
+
+// stat returns the record of an object on node, nil if the node does not
+// have it or its bucket, and when the node deleted it, if it did
+func (c *Coordinator) stat(ctx context.Context, node, bucketName, objectKey string) (*core.Object, string, error) {
+	objects, deletedAt, status, err := c.list(ctx, node, bucketName, objectKey, "", 1, true)
+	if err != nil || status == http.StatusNotFound {
+		return nil, deletedAt, err
+	}
+	if len(objects.List) == 0 || objects.List[0].Name != objectKey {
+		return nil, deletedAt, nil
+	}
+	return &objects.List[0], deletedAt, nil
+}
+
+// deletedSince reports whether one of nodes deleted an object at or after
+// lastModified
+func (c *Coordinator) deletedSince(ctx context.Context, nodes []string, bucketName, objectKey, lastModified string) bool {
+	markers := make(chan string, len(nodes))
+	for _, node := range nodes {
+		go func() {
+			_, deletedAt, _ := c.stat(ctx, node, bucketName, objectKey)
+			markers <- deletedAt
+		}()
+	}
+	deleted := false
+	for range nodes {
+		if deletedAt := <-markers; deletedAt != "" && compareVersions(deletedAt, lastModified) >= 0 {
+			deleted = true
+		}
+	}
+	return deleted
+}
+
+// list returns the objects of a bucket stored on node and, with
+// askDeleted, when the node deleted the object named prefix
+func (c *Coordinator) list(ctx context.Context, node, bucketName, prefix, marker string, maxKeys int, askDeleted bool) (core.Objects, string, int, error) {
+	var objects core.Objects
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, node+"/"+bucketName, nil)
+	if err != nil {
+		return objects, "", 0, err
+	}
+	query := req.URL.Query()
+	query.Set("prefix", prefix)
+	query.Set("marker", marker)
+	if maxKeys > 0 {
+		query.Set("max-keys", strconv.Itoa(maxKeys))
+	}
+	req.URL.RawQuery = query.Encode()
+	req.Header.Set(HeaderSecret, c.cfg.Secret)
+	if askDeleted {
+		req.Header.Set(HeaderDeletedAt, "?")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return objects, "", 0, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = xml.NewDecoder(resp.Body).Decode(&objects)
+	case http.StatusNotFound:
+	default:
+		err = errors.New("node responded " + resp.Status)
+	}
+	return objects, resp.Header.Get(HeaderDeletedAt), resp.StatusCode, err
+}
+
+// listObjects merges the listings of every node. Each object is on several
+// nodes, so as many nodes as there are replicas but one can be down. An
+// object missing from some of its owners is left out when one of them
+// deleted it, the others missed the delete.
+func (c *Coordinator) listObjects(w http.ResponseWriter, r *http.Request) {
+	logger := core.Logger(r.Context())
+	bucketName := strings.TrimPrefix(r.URL.Path, "/")
+	query := r.URL.Query()
+	maxKeys := 0
+	if s := query.Get("max-keys"); s != "" {
+		// Malformed values are rejected by the nodes
+		maxKeys, _ = strconv.Atoi(s)
+	}
+
+	type listing struct {
+		node    string
+		objects core.Objects
+		status  int
+		err     error
+	}
+	nodes := c.ring.Nodes()
+	listings := make(chan listing, len(nodes))
+	for _, node := range nodes {
+		go func() {
+			objects, _, status, err := c.list(r.Context(), node, bucketName, query.Get("prefix"), query.Get("marker"), maxKeys, false)
+			listings <- listing{node: node, objects: objects, status: status, err: err}
+		}()
+	}
+
+	merged := make(map[string]core.Object)
+	listedBy := make(map[string][]string)
+	answered := make(map[string]bool)
+	var limit string // keys past the last one of a truncated listing may be missing
+	found, failed := false, 0
+	for range nodes {
+		l := <-listings
+		switch {
+		case l.err != nil:
+			logger.Warn("node unreachable", "node", l.node, "error", l.err)
+			failed++
+			continue
+		case l.status == http.StatusNotFound:
+			continue
+		}
+		found = true
+		answered[l.node] = true
+		for _, object := range l.objects.List {
+			listedBy[object.Name] = append(listedBy[object.Name], l.node)
+			if old, ok := merged[object.Name]; !ok || compareVersions(object.LastModified, old.LastModified) > 0 {
+				merged[object.Name] = object
+			}
+		}
+		if n := len(l.objects.List); l.objects.IsTruncated && n > 0 && (limit == "" || l.objects.List[n-1].Name < limit) {
+			limit = l.objects.List[n-1].Name
+		}
+	}
+
+	switch {
+	case failed >= c.replicas:
+		logger.Warn("too many nodes unreachable to list", "unreachable", failed)
+		handlers.XMLErrResponse(w, http.StatusServiceUnavailable, ErrNoQuorum.Error())
+		return
+	case !found:
+		handlers.XMLErrResponse(w, http.StatusNotFound, handlers.ErrBucketNotFound.Error())
+		return
+	}
+
+	result := core.Objects{Prefix: query.Get("prefix"), Marker: query.Get("marker"), MaxKeys: maxKeys}
+	keys := make([]string, 0, len(merged))
+	for key := range merged {
+		if limit == "" || key <= limit {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	keys = slices.DeleteFunc(keys, func(key string) bool {
+		var missing []string
+		for _, owner := range c.ring.Owners(bucketName+"/"+key, c.replicas) {
+			if answered[owner] && !slices.Contains(listedBy[key], owner) {
+				missing = append(missing, owner)
+			}
+		}
+		return len(missing) > 0 && c.deletedSince(r.Context(), missing, bucketName, key, merged[key].LastModified)
+	})
+	result.IsTruncated = limit != ""
+	if maxKeys > 0 && len(keys) > maxKeys {
+		keys = keys[:maxKeys]
+		result.IsTruncated = true
+	}
+	for _, key := range keys {
+		result.List = append(result.List, merged[key])
+	}
+	if result.IsTruncated && len(keys) > 0 {
+		result.NextMarker = keys[len(keys)-1]
+	}
+
+	logger.Debug("objects listed across the cluster", "count", len(result.List))
+	handlers.XMLResponse(w, http.StatusOK, result)
+}
+
+// proxy serves r from node, streaming its response. It reports false when
+// the node could not be reached and nothing was written.
+func (c *Coordinator) proxy(w http.ResponseWriter, r *http.Request, node string) bool {
+	req, err := c.newRequest(r.Context(), r, node, nil, 0)
+	if err != nil {
+		return false
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		core.Logger(r.Context()).Warn("node unreachable", "node", node, "error", err)
+		return false
+	}
+	defer resp.Body.Close()
+
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+	return true
+}
+
+// send makes r on node with body and reads the response
+func (c *Coordinator) send(ctx context.Context, r *http.Request, node string, body io.Reader, size int64) response {
+	res := response{node: node}
+	req, err := c.newRequest(ctx, r, node, body, size)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	defer resp.Body.Close()
+
+	res.status = resp.StatusCode
+	res.header = resp.Header
+	res.body, res.err = io.ReadAll(io.LimitReader(resp.Body, maxRelayedBody))
+	return res
+}
+
+// newRequest copies r for node, authenticated with the cluster secret
+func (c *Coordinator) newRequest(ctx context.Context, r *http.Request, node string, body io.Reader, size int64) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, r.Method, node+r.URL.RequestURI(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = r.Header.Clone()
+	req.Header.Set(HeaderSecret, c.cfg.Secret)
+	req.Header.Del("Content-Length")
+	req.ContentLength = size
+	if body == nil {
+		req.ContentLength = 0
+	}
+	return req, nil
+}
+
+// spool copies the body of r to a temporary file of the data directory, so
+// that it can be sent to several nodes
+func (c *Coordinator) spool(r *http.Request) (*os.File, int64, error) {
+	body := io.Reader(r.Body)
+	if c.maxObjectSize > 0 {
+		if r.ContentLength > c.maxObjectSize {
+			return nil, 0, handlers.ErrEntityTooLarge
+		}
+		body = handlers.LimitReader(body, c.maxObjectSize, handlers.ErrEntityTooLarge)
+	}
+
+	f, err := os.CreateTemp(c.spoolDir, ".tmp-cluster-*")
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := io.Copy(f, body)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, 0, err
+	}
+	return f, size, nil
+}
+
+// compareVersions compares the LastModified times of two versions of an
+// object, which are RFC 3339 times
+func compareVersions(a, b string) int {
+	ta, errA := time.Parse(time.RFC3339Nano, a)
+	tb, errB := time.Parse(time.RFC3339Nano, b)
+	if errA != nil || errB != nil {
+		return cmp.Compare(a, b)
+	}
+	return ta.Compare(tb)
+}
+
+// relay writes the response of a node
+func relay(w http.ResponseWriter, res response) {
+	for name, values := range res.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(res.body)))
+	w.WriteHeader(res.status)
+	io.Copy(w, bytes.NewReader(res.body))
+}
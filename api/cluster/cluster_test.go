@@ -0,0 +1,56 @@
+package cluster
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+)
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		want   string // handler reached
+		status int
+	}{
+		{"client", "", "external", http.StatusOK},
+		{"node", "s3cret", "internal", http.StatusOK},
+		{"wrong secret", "guess", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reached string
+			var internal bool
+			handler := func(name string) http.Handler {
+				mux := http.NewServeMux()
+				mux.HandleFunc("DELETE /{BucketName}/{ObjectKey...}", func(w http.ResponseWriter, r *http.Request) {
+					reached = name
+					internal = core.Internal(r.Context())
+				})
+				return mux
+			}
+			split := Split(core.ClusterConfig{Secret: "s3cret"}, handler("internal"), handler("external"))
+
+			r := httptest.NewRequest(http.MethodDelete, "/photos/a.txt", nil)
+			if tt.secret != "" {
+				r.Header.Set(HeaderSecret, tt.secret)
+			}
+			w := httptest.NewRecorder()
+			split.ServeHTTP(w, r)
+
+			if reached != tt.want || w.Code != tt.status {
+				t.Fatalf("reached %q with %d, want %q with %d", reached, w.Code, tt.want, tt.status)
+			}
+			// Only the requests of the nodes may set object versions
+			if internal != (tt.want == "internal") {
+				t.Errorf("request marked internal: %v", internal)
+			}
+			// The metrics and the access log read the route from the request
+			if tt.want != "" && (r.Pattern == "" || r.PathValue("BucketName") != "photos") {
+				t.Errorf("route of the request = %q, bucket %q", r.Pattern, r.PathValue("BucketName"))
+			}
+		})
+	}
+}
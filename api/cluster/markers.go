@@ -0,0 +1,177 @@
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+)
+
+var ErrCorruptMarkers = errors.New("corrupt cluster delete markers")
+
+// marker is a line of the delete markers file. An empty DeletedAt removes
+// the marker of the key, a later version of the object was written.
+type marker struct {
+	Bucket    string `json:"bucket"`
+	Key       string `json:"key"`
+	DeletedAt string `json:"deleted_at,omitempty"`
+}
+
+type markerKey struct {
+	bucket, key string
+}
+
+// deleteMarkers remembers when the objects of this node were deleted
+// through the cluster. A read weighs them against the versions held by the
+// other owners, so an owner that missed a delete cannot bring the object
+// back. They are kept in an append-only file of JSON lines, rewritten
+// without the removed markers when opened.
+type deleteMarkers struct {
+	mu      sync.Mutex
+	f       *os.File
+	sync    bool
+	deleted map[markerKey]string
+}
+
+// openDeleteMarkers loads the delete markers of the data directory. A last
+// line without a newline is the remainder of a write cut short by a crash
+// and is dropped.
+func openDeleteMarkers(dir string, sync bool) (*deleteMarkers, error) {
+	path := filepath.Join(dir, core.ClusterMarkersFile)
+	m := &deleteMarkers{sync: sync, deleted: make(map[markerKey]string)}
+
+	f, err := os.Open(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		err = m.replay(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := m.rewrite(path); err != nil {
+		return nil, err
+	}
+	m.f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, core.FilePerm)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *deleteMarkers) replay(r io.Reader) error {
+	reader := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var entry marker
+		if err := json.Unmarshal(bytes.TrimSpace(line), &entry); err != nil {
+			return fmt.Errorf("%w: line %d: %v", ErrCorruptMarkers, n, err)
+		}
+		m.apply(entry)
+	}
+}
+
+// rewrite writes the markers held to a temporary file replacing path
+func (m *deleteMarkers) rewrite(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-markers-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	w := bufio.NewWriter(tmp)
+	for k, deletedAt := range m.deleted {
+		line, err := json.Marshal(marker{Bucket: k.bucket, Key: k.key, DeletedAt: deletedAt})
+		if err != nil {
+			return err
+		}
+		w.Write(append(line, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(core.FilePerm); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (m *deleteMarkers) apply(entry marker) {
+	k := markerKey{entry.Bucket, entry.Key}
+	if entry.DeletedAt == "" {
+		delete(m.deleted, k)
+	} else {
+		m.deleted[k] = entry.DeletedAt
+	}
+}
+
+// get returns when an object was deleted, "" if it has no marker
+func (m *deleteMarkers) get(bucketName, objectKey string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.deleted[markerKey{bucketName, objectKey}]
+}
+
+// add records the deletion of an object at deletedAt, unless it already
+// has a later marker
+func (m *deleteMarkers) add(bucketName, objectKey, deletedAt string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if old := m.deleted[markerKey{bucketName, objectKey}]; old != "" && compareVersions(old, deletedAt) >= 0 {
+		return nil
+	}
+	return m.append(marker{Bucket: bucketName, Key: objectKey, DeletedAt: deletedAt})
+}
+
+// clear removes the marker of an object written again at lastModified
+func (m *deleteMarkers) clear(bucketName, objectKey, lastModified string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if old := m.deleted[markerKey{bucketName, objectKey}]; old == "" || compareVersions(old, lastModified) >= 0 {
+		return nil
+	}
+	return m.append(marker{Bucket: bucketName, Key: objectKey})
+}
+
+// append writes entry and applies it. The caller holds the lock.
+func (m *deleteMarkers) append(entry marker) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := m.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if m.sync {
+		if err := m.f.Sync(); err != nil {
+			return err
+		}
+	}
+	m.apply(entry)
+	return nil
+}
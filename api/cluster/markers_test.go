@@ -0,0 +1,88 @@
+package cluster
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+)
+
+func TestDeleteMarkers(t *testing.T) {
+	dir := t.TempDir()
+	m, err := openDeleteMarkers(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		early = "2026-01-01T00:00:00Z"
+		mid   = "2026-01-02T00:00:00Z"
+		late  = "2026-01-03T00:00:00Z"
+	)
+	steps := []struct {
+		name string
+		do   func() error
+		key  string
+		want string
+	}{
+		{"added", func() error { return m.add("photos", "a", mid) }, "a", mid},
+		{"earlier delete ignored", func() error { return m.add("photos", "a", early) }, "a", mid},
+		{"later delete kept", func() error { return m.add("photos", "a", late) }, "a", late},
+		{"earlier write ignored", func() error { return m.clear("photos", "a", mid) }, "a", late},
+		{"other key", func() error { return m.add("photos", "b", early) }, "b", early},
+		{"later write clears", func() error { return m.clear("photos", "b", mid) }, "b", ""},
+		{"hostile key", func() error { return m.add("photos", "line\nbreak\"", mid) }, "line\nbreak\"", mid},
+	}
+	for _, step := range steps {
+		if err := step.do(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if got := m.get("photos", step.key); got != step.want {
+			t.Errorf("%s: get(%q) = %q, want %q", step.name, step.key, got, step.want)
+		}
+	}
+	m.f.Close()
+
+	// A write cut short by a crash is dropped, the rest is read back and
+	// rewritten without the cleared markers
+	path := filepath.Join(dir, core.ClusterMarkersFile)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"bucket":"photos","key":"c","dele`)
+	f.Close()
+
+	m, err = openDeleteMarkers(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.f.Close()
+	want := map[string]string{"a": late, "b": "", "c": "", "line\nbreak\"": mid}
+	for key, deletedAt := range want {
+		if got := m.get("photos", key); got != deletedAt {
+			t.Errorf("after reopening, get(%q) = %q, want %q", key, got, deletedAt)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 2 {
+		t.Errorf("rewritten file has %d lines, want 2:\n%s", lines, data)
+	}
+}
+
+func TestDeleteMarkersCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, core.ClusterMarkersFile)
+	if err := os.WriteFile(path, []byte("not json\n"), core.FilePerm); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openDeleteMarkers(dir, false); !errors.Is(err, ErrCorruptMarkers) {
+		t.Fatalf("openDeleteMarkers() = %v, want %v", err, ErrCorruptMarkers)
+	}
+}
@@ -0,0 +1,70 @@
+package cluster
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/binary"
+	"slices"
+	"strconv"
+)
+
+// Points of each node on the ring, which spread the keys evenly between the
+// nodes and move only the keys of a node when one is added or removed
+const virtualNodes = 128
+
+// Ring places keys on nodes by consistent hashing
+type Ring struct {
+	nodes  []string
+	points []point // sorted by hash
+}
+
+type point struct {
+	hash uint64
+	node int // index in nodes
+}
+
+// NewRing places the virtual nodes of every node on the ring. The order of
+// nodes does not matter.
+func NewRing(nodes []string) *Ring {
+	r := &Ring{nodes: slices.Clone(nodes)}
+	for i, node := range r.nodes {
+		for v := range virtualNodes {
+			r.points = append(r.points, point{hash: hash(node + "#" + strconv.Itoa(v)), node: i})
+		}
+	}
+	slices.SortFunc(r.points, func(a, b point) int { return cmp.Compare(a.hash, b.hash) })
+	return r
+}
+
+// Owners returns the n distinct nodes storing key, the ones closest to it
+// clockwise on the ring first
+func (r *Ring) Owners(key string, n int) []string {
+	n = min(n, len(r.nodes))
+	owners := make([]string, 0, n)
+	if n == 0 {
+		return owners
+	}
+
+	h := hash(key)
+	i, _ := slices.BinarySearchFunc(r.points, h, func(p point, h uint64) int { return cmp.Compare(p.hash, h) })
+
+	seen := make([]bool, len(r.nodes))
+	for j := 0; len(owners) < n; j++ {
+		p := r.points[(i+j)%len(r.points)]
+		if !seen[p.node] {
+			seen[p.node] = true
+			owners = append(owners, r.nodes[p.node])
+		}
+	}
+	return owners
+}
+
+// Nodes returns every node of the ring
+func (r *Ring) Nodes() []string {
+	return slices.Clone(r.nodes)
+}
+
+func hash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
@@ -0,0 +1,45 @@
+package cluster
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+)
+
+var ErrNoClusterCACerts = errors.New("no certificates found in cluster CA file")
+
+// newClientTLSConfig returns the TLS settings of the requests to the other
+// nodes, nil when the defaults apply. The key pair is loaded once, at
+// startup.
+func newClientTLSConfig(cfg core.ClusterConfig) (*tls.Config, error) {
+	if cfg.CA == "" && cfg.Cert == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CA != "" {
+		pem, err := os.ReadFile(cfg.CA)
+		if err != nil {
+			return nil, fmt.Errorf("error reading cluster CA file: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, ErrNoClusterCACerts
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+		if err != nil {
+			return nil, fmt.Errorf("error loading cluster key pair: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
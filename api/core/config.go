@@ -1,14 +1,680 @@
 package core
 
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
 const (
 	DirPerm  = 0o755
 	FilePerm = 0o644
 
-	BucketsFile = "buckets.csv"
-	ObjectsFile = "objects.csv"
+	BucketsFile        = "buckets.csv"
+	ObjectsFile        = "objects.csv"
+	DataDir            = "data"   // object files, inside each bucket directory
+	BlobsDir           = ".blobs" // deduplicated object data shared by all buckets
+	MetaLogFile        = "metadata.log"
+	JournalFile        = "journal.log"         // operations in progress, recovered on startup
+	FormatFile         = "format.json"         // format version of the data directory
+	BackupsDir         = ".backups"            // metadata copies taken before migrations
+	EventsDir          = ".events"             // event notifications waiting for delivery
+	ReplicationDir     = ".replication"        // changes waiting to be replicated
+	ErasureFile        = "erasure.json"        // erasure coding layout the objects were stored with
+	CatalogFile        = "catalog.json"        // data directories the buckets are placed on
+	ClusterMarkersFile = "cluster-markers.log" // when the objects of a cluster node were deleted
+
+	// Format version of the data directories written by this version, see
+	// the migrate package for what changed between versions
+	FormatVersion = 8
+
+	// Prefix of the environment variables overriding the configuration
+	EnvPrefix = "TRIPLES_"
 )
 
 var (
-	BucketsCSVHeader = []string{"Name", "Status", "CreationDate", "LastUpdated"}
-	ObjectsCSVHeader = []string{"ObjectKey", "ContentType", "ContentLength", "LastModified"}
+	BucketsCSVHeader = []string{"Name", "Status", "CreationDate", "LastUpdated", "QuotaBytes", "QuotaObjects", "Compression", "DeletedAt", "ObjectLock", "DefaultRetentionMode", "DefaultRetentionDays", "Notifications", "Replication", "Lifecycle"}
+	ObjectsCSVHeader = []string{"ObjectKey", "ContentType", "ContentLength", "LastModified", "Digest", "Storage", "ETag", "Encoding", "RetentionMode", "RetainUntilDate", "LegalHold", "ReplicationStatus", "StorageClass", "RestoreExpiryDate"}
 )
+
+// Config is the complete server configuration. It is assembled from the
+// defaults, an optional JSON file, TRIPLES_* environment variables and the
+// command line flags, in that order of precedence.
+type Config struct {
+	Port        int               `json:"port"`
+	AdminPort   int               `json:"admin_port"` // 0 serves the admin endpoints on Port
+	Dir         string            `json:"dir"`
+	TLS         TLSConfig         `json:"tls"`
+	Log         LogConfig         `json:"log"`
+	Health      HealthConfig      `json:"health"`
+	Limits      LimitsConfig      `json:"limits"`
+	Admin       AdminConfig       `json:"admin"`
+	RateLimit   RateLimitConfig   `json:"rate_limit"`
+	Storage     StorageConfig     `json:"storage"`
+	Metadata    MetadataConfig    `json:"metadata"`
+	Trash       TrashConfig       `json:"trash"`
+	Events      EventsConfig      `json:"events"`
+	Replication ReplicationConfig `json:"replication"`
+	Cluster     ClusterConfig     `json:"cluster"`
+}
+
+type TLSConfig struct {
+	Cert       string `json:"cert"`
+	Key        string `json:"key"`
+	ClientCA   string `json:"client_ca"`
+	SelfSigned bool   `json:"self_signed"`
+}
+
+type LogConfig struct {
+	Level  string `json:"level"`  // debug, info, warn or error
+	Format string `json:"format"` // text or json
+	Access bool   `json:"access"` // log one line per request
+}
+
+type HealthConfig struct {
+	// Readiness fails when less free space is left on the data disk
+	MinFreeBytes int64 `json:"min_free_bytes"`
+}
+
+type LimitsConfig struct {
+	MaxObjectSize int64 `json:"max_object_size"` // bytes, 0 means unlimited
+}
+
+// RateLimitConfig throttles clients, identified by remote IP. Zero values
+// disable a limit.
+type RateLimitConfig struct {
+	RequestsPerSecond    float64 `json:"requests_per_second"`    // per client
+	Burst                int     `json:"burst"`                  // requests allowed above the rate in a burst
+	BytesPerSecond       int64   `json:"bytes_per_second"`       // per client, uploads and downloads
+	MaxConcurrentUploads int     `json:"max_concurrent_uploads"` // across all clients
+
+	// Per-bucket overrides of the client limits above
+	Buckets map[string]BucketRateLimit `json:"buckets"`
+}
+
+type BucketRateLimit struct {
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+	BytesPerSecond    int64   `json:"bytes_per_second"`
+}
+
+type StorageConfig struct {
+	// Store each distinct object content once, keyed by its SHA-256 digest
+	Dedup bool `json:"dedup"`
+	// How often orphaned blobs are garbage collected, 0 disables the collector
+	GCInterval Duration `json:"gc_interval"`
+	// Further directories, one per disk, new buckets are placed on along
+	// with dir, the one with the most free space first
+	DataDirs []string `json:"data_dirs"`
+	// Spread new objects over several disks with erasure coding
+	Erasure ErasureConfig `json:"erasure"`
+	// Directory of the COLD storage class
+	Cold ColdConfig `json:"cold"`
+}
+
+// ErasureConfig splits every object into data shards and computes parity
+// shards from them, one shard per directory. An object can be read as long
+// as any DataShards of its shards are left.
+type ErasureConfig struct {
+	// Directories, one per disk, holding the shards; empty stores new
+	// objects in dir
+	Dirs []string `json:"dirs"`
+	// Shards holding the content, 0 for the directories not holding parity
+	DataShards int `json:"data_shards"`
+	// Shards computed from the data shards, the number of disks that can
+	// be lost
+	ParityShards int `json:"parity_shards"`
+	// How often every shard is verified and the missing or damaged ones
+	// rebuilt, 0 disables the healer
+	HealInterval Duration `json:"heal_interval"`
+}
+
+// ColdConfig sets where the objects of the COLD storage class are stored,
+// typically a cheaper and slower disk. Objects are put there by
+// x-amz-storage-class or moved there by the lifecycle rules of their bucket.
+type ColdConfig struct {
+	// Directory holding the cold objects, empty disables the COLD class
+	Dir string `json:"dir"`
+	// How often the lifecycle rules are applied and expired restores
+	// removed, 0 disables the transitions
+	TransitionInterval Duration `json:"transition_interval"`
+}
+
+type MetadataConfig struct {
+	// Number of logged changes after which they are written to the CSV
+	// snapshots and the log is cleared, 0 compacts only at startup
+	CompactThreshold int `json:"compact_threshold"`
+	// Sync the log to disk before acknowledging a change
+	Sync bool `json:"sync"`
+	// Migrate data directories in an older format on startup
+	AutoMigrate bool `json:"auto_migrate"`
+}
+
+type TrashConfig struct {
+	// How long deleted buckets are kept for restoring, 0 deletes them at once
+	Retention Duration `json:"retention"`
+	// How often buckets past their retention are purged
+	PurgeInterval Duration `json:"purge_interval"`
+}
+
+// EventsConfig controls the delivery of object event notifications
+type EventsConfig struct {
+	// Append every object event as a JSON line to this file, empty disables
+	// the event log
+	LogFile string `json:"log_file"`
+	// Deliveries to a webhook are attempted this often before they are
+	// moved to the failed directory of the outbox
+	MaxAttempts int `json:"max_attempts"`
+	// Wait before the first retry, doubled after every failed attempt
+	RetryInterval Duration `json:"retry_interval"`
+	// Time allowed for a webhook to respond
+	Timeout Duration `json:"timeout"`
+	// Number of latest events kept for the change feed of the buckets
+	FeedSize int `json:"feed_size"`
+}
+
+// ReplicationConfig controls the replication of objects to other instances
+type ReplicationConfig struct {
+	// Changes are attempted this often before they are moved to the failed
+	// directory of the replication queue and their objects marked FAILED
+	MaxAttempts int `json:"max_attempts"`
+	// Wait before the first retry, doubled after every failed attempt
+	RetryInterval Duration `json:"retry_interval"`
+	// Time allowed for copying one object
+	Timeout Duration `json:"timeout"`
+	// Shared secret sent with the copies to the destinations, and required
+	// from the instances replicating to this one; copies are refused when
+	// empty
+	Secret string `json:"secret"`
+}
+
+// ClusterConfig spreads the objects over several instances. Every node is
+// given the same peers, replication factor and secret.
+type ClusterConfig struct {
+	// Base URLs of every node of the cluster, this one included; empty runs
+	// a single node
+	Peers []string `json:"peers"`
+	// Base URL of this node, as listed in Peers
+	Node string `json:"node"`
+	// Shared secret authenticating the requests between the nodes
+	Secret string `json:"secret"`
+	// Number of nodes storing each object, 0 for 3 or the number of peers
+	// if there are fewer
+	ReplicationFactor int `json:"replication_factor"`
+	// Nodes that must acknowledge a write and answer a read, 0 for a
+	// majority of the replicas
+	WriteQuorum int `json:"write_quorum"`
+	ReadQuorum  int `json:"read_quorum"`
+	// Time allowed for a node to start responding
+	Timeout Duration `json:"timeout"`
+	// PEM CA bundle verifying the certificates of the other nodes, the
+	// system roots when empty
+	CA string `json:"ca"`
+	// PEM certificate and key presented to the other nodes, required when
+	// they verify client certificates (tls.client_ca)
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+type AdminConfig struct {
+	// Bearer token required by the admin API, which is disabled when empty
+	Token string `json:"token"`
+}
+
+var (
+	ErrIncorrectPort    = errors.New("incorrect port number, range must be between 1-65535")
+	ErrEmptyDir         = errors.New("empty directory path")
+	ErrTLSPair          = errors.New("cert and key must be provided together")
+	ErrTLSSelfSigned    = errors.New("self_signed cannot be combined with cert/key")
+	ErrTLSClientCANoTLS = errors.New("client_ca requires TLS to be enabled")
+	ErrLogLevel         = errors.New("must be one of debug, info, warn, error")
+	ErrLogFormat        = errors.New("must be one of text, json")
+	ErrAdminPortInUse   = errors.New("must differ from port")
+	ErrNegative         = errors.New("must not be negative")
+	ErrNotPositive      = errors.New("must be positive")
+	ErrPeerURL          = errors.New("must be an http or https URL")
+	ErrNodeNotPeer      = errors.New("must be one of cluster.peers")
+	ErrNoSecret         = errors.New("must be set in cluster mode")
+	ErrPlaintextPeer    = errors.New("must be an https URL, cluster traffic is never plaintext")
+	ErrClusterNoTLS     = errors.New("must be enabled in cluster mode")
+	ErrNoClusterCert    = errors.New("must be set when tls.client_ca requires client certificates")
+	ErrTooLarge         = errors.New("must not exceed")
+	ErrQuorumOverlap    = errors.New("plus cluster.write_quorum must exceed the replication factor")
+	ErrOverlappingDir   = errors.New("must neither be, contain nor sit inside dir or another storage directory")
+	ErrShardCount       = errors.New("data and parity shards must add up to the number of dirs")
+	ErrCombined         = errors.New("cannot be combined with")
+)
+
+// DefaultConfig returns the configuration used when nothing is overridden
+func DefaultConfig() *Config {
+	return &Config{
+		Port: 8080,
+		Dir:  "./data",
+		Storage: StorageConfig{
+			GCInterval: Duration(time.Hour),
+			Erasure: ErasureConfig{
+				ParityShards: 2,
+				HealInterval: Duration(24 * time.Hour),
+			},
+			Cold: ColdConfig{
+				TransitionInterval: Duration(time.Hour),
+			},
+		},
+		Metadata: MetadataConfig{
+			CompactThreshold: 10000,
+			Sync:             true,
+			AutoMigrate:      true,
+		},
+		Trash: TrashConfig{
+			PurgeInterval: Duration(time.Hour),
+		},
+		Events: EventsConfig{
+			MaxAttempts:   10,
+			RetryInterval: Duration(time.Second),
+			Timeout:       Duration(10 * time.Second),
+			FeedSize:      10000,
+		},
+		Replication: ReplicationConfig{
+			MaxAttempts:   20,
+			RetryInterval: Duration(5 * time.Second),
+			Timeout:       Duration(5 * time.Minute),
+		},
+		Cluster: ClusterConfig{
+			Timeout: Duration(10 * time.Second),
+		},
+		Health: HealthConfig{
+			MinFreeBytes: 64 << 20,
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+			Access: true,
+		},
+	}
+}
+
+// Validate checks every setting and reports all problems at once,
+// each prefixed with the path of the offending setting.
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.Port < 1 || c.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port: %w, got %d", ErrIncorrectPort, c.Port))
+	}
+
+	if c.AdminPort != 0 && (c.AdminPort < 1 || c.AdminPort > 65535) {
+		errs = append(errs, fmt.Errorf("admin_port: %w, got %d", ErrIncorrectPort, c.AdminPort))
+	} else if c.AdminPort != 0 && c.AdminPort == c.Port {
+		errs = append(errs, fmt.Errorf("admin_port: %w, got %d", ErrAdminPortInUse, c.AdminPort))
+	}
+
+	if c.Dir == "" {
+		errs = append(errs, fmt.Errorf("dir: %w", ErrEmptyDir))
+	}
+
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		errs = append(errs, fmt.Errorf("tls: %w", ErrTLSPair))
+	}
+
+	if c.TLS.SelfSigned && c.TLS.Cert != "" {
+		errs = append(errs, fmt.Errorf("tls.self_signed: %w", ErrTLSSelfSigned))
+	}
+
+	if c.TLS.ClientCA != "" && !c.TLS.Enabled() {
+		errs = append(errs, fmt.Errorf("tls.client_ca: %w", ErrTLSClientCANoTLS))
+	}
+
+	if c.Health.MinFreeBytes < 0 {
+		errs = append(errs, fmt.Errorf("health.min_free_bytes: %w, got %d", ErrNegative, c.Health.MinFreeBytes))
+	}
+
+	if c.Limits.MaxObjectSize < 0 {
+		errs = append(errs, fmt.Errorf("limits.max_object_size: %w, got %d", ErrNegative, c.Limits.MaxObjectSize))
+	}
+
+	errs = append(errs, c.RateLimit.validate()...)
+
+	if c.Storage.GCInterval < 0 {
+		errs = append(errs, fmt.Errorf("storage.gc_interval: %w, got %s", ErrNegative, time.Duration(c.Storage.GCInterval)))
+	}
+
+	if c.Storage.Erasure.Enabled() {
+		errs = append(errs, c.Storage.Erasure.validate(c.Dir)...)
+		if c.Storage.Dedup {
+			errs = append(errs, fmt.Errorf("storage.dedup: %w storage.erasure", ErrCombined))
+		}
+	}
+
+	if len(c.Storage.DataDirs) > 0 {
+		errs = append(errs, c.Storage.validateDataDirs(c.Dir)...)
+	}
+
+	errs = append(errs, c.Storage.validateCold()...)
+	errs = append(errs, c.validateStorageDirs()...)
+
+	if c.Trash.Retention < 0 {
+		errs = append(errs, fmt.Errorf("trash.retention: %w, got %s", ErrNegative, time.Duration(c.Trash.Retention)))
+	}
+
+	if c.Trash.Retention > 0 && c.Trash.PurgeInterval <= 0 {
+		errs = append(errs, fmt.Errorf("trash.purge_interval: %w, got %s", ErrNotPositive, time.Duration(c.Trash.PurgeInterval)))
+	}
+
+	if c.Events.MaxAttempts <= 0 {
+		errs = append(errs, fmt.Errorf("events.max_attempts: %w, got %d", ErrNotPositive, c.Events.MaxAttempts))
+	}
+
+	if c.Events.RetryInterval <= 0 {
+		errs = append(errs, fmt.Errorf("events.retry_interval: %w, got %s", ErrNotPositive, time.Duration(c.Events.RetryInterval)))
+	}
+
+	if c.Events.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("events.timeout: %w, got %s", ErrNotPositive, time.Duration(c.Events.Timeout)))
+	}
+
+	if c.Events.FeedSize <= 0 {
+		errs = append(errs, fmt.Errorf("events.feed_size: %w, got %d", ErrNotPositive, c.Events.FeedSize))
+	}
+
+	if c.Replication.MaxAttempts <= 0 {
+		errs = append(errs, fmt.Errorf("replication.max_attempts: %w, got %d", ErrNotPositive, c.Replication.MaxAttempts))
+	}
+	if c.Replication.RetryInterval <= 0 {
+		errs = append(errs, fmt.Errorf("replication.retry_interval: %w, got %s", ErrNotPositive, time.Duration(c.Replication.RetryInterval)))
+	}
+	if c.Replication.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("replication.timeout: %w, got %s", ErrNotPositive, time.Duration(c.Replication.Timeout)))
+	}
+
+	if c.Cluster.Enabled() {
+		errs = append(errs, c.Cluster.validate()...)
+		errs = append(errs, c.validateClusterTLS()...)
+	}
+
+	if c.Metadata.CompactThreshold < 0 {
+		errs = append(errs, fmt.Errorf("metadata.compact_threshold: %w, got %d", ErrNegative, c.Metadata.CompactThreshold))
+	}
+
+	if !validLogLevel(c.Log.Level) {
+		errs = append(errs, fmt.Errorf("log.level: %w, got %q", ErrLogLevel, c.Log.Level))
+	}
+
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		errs = append(errs, fmt.Errorf("log.format: %w, got %q", ErrLogFormat, c.Log.Format))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (rl RateLimitConfig) validate() []error {
+	var errs []error
+	if rl.MaxConcurrentUploads < 0 {
+		errs = append(errs, fmt.Errorf("rate_limit.max_concurrent_uploads: %w, got %d", ErrNegative, rl.MaxConcurrentUploads))
+	}
+
+	limits := map[string]BucketRateLimit{"rate_limit": {rl.RequestsPerSecond, rl.Burst, rl.BytesPerSecond}}
+	for bucket, limit := range rl.Buckets {
+		limits["rate_limit.buckets."+bucket] = limit
+	}
+	for path, limit := range limits {
+		if limit.RequestsPerSecond < 0 {
+			errs = append(errs, fmt.Errorf("%s.requests_per_second: %w, got %g", path, ErrNegative, limit.RequestsPerSecond))
+		}
+		if limit.Burst < 0 {
+			errs = append(errs, fmt.Errorf("%s.burst: %w, got %d", path, ErrNegative, limit.Burst))
+		}
+		if limit.BytesPerSecond < 0 {
+			errs = append(errs, fmt.Errorf("%s.bytes_per_second: %w, got %d", path, ErrNegative, limit.BytesPerSecond))
+		}
+	}
+	return errs
+}
+
+func (c ClusterConfig) validate() []error {
+	var errs []error
+	for i, peer := range c.Peers {
+		if u, err := url.Parse(peer); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("cluster.peers[%d]: %w, got %q", i, ErrPeerURL, peer))
+		}
+	}
+	if !slices.Contains(c.Peers, c.Node) {
+		errs = append(errs, fmt.Errorf("cluster.node: %w, got %q", ErrNodeNotPeer, c.Node))
+	}
+	if c.Secret == "" {
+		errs = append(errs, fmt.Errorf("cluster.secret: %w", ErrNoSecret))
+	}
+
+	if c.ReplicationFactor < 0 {
+		errs = append(errs, fmt.Errorf("cluster.replication_factor: %w, got %d", ErrNegative, c.ReplicationFactor))
+	} else if c.ReplicationFactor > len(c.Peers) {
+		errs = append(errs, fmt.Errorf("cluster.replication_factor: %w the number of peers (%d), got %d", ErrTooLarge, len(c.Peers), c.ReplicationFactor))
+	}
+	quorums := map[string]int{"cluster.write_quorum": c.WriteQuorum, "cluster.read_quorum": c.ReadQuorum}
+	quorumsValid := true
+	for path, quorum := range quorums {
+		if quorum < 0 {
+			errs = append(errs, fmt.Errorf("%s: %w, got %d", path, ErrNegative, quorum))
+			quorumsValid = false
+		} else if quorum > c.Replicas() {
+			errs = append(errs, fmt.Errorf("%s: %w the replication factor (%d), got %d", path, ErrTooLarge, c.Replicas(), quorum))
+			quorumsValid = false
+		}
+	}
+	// A read quorum must include an owner of the last write or delete
+	if write, read := c.Quorums(); quorumsValid && write+read <= c.Replicas() {
+		errs = append(errs, fmt.Errorf("cluster.read_quorum: %w (%d), got %d with cluster.write_quorum %d", ErrQuorumOverlap, c.Replicas(), read, write))
+	}
+	if c.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("cluster.timeout: %w, got %s", ErrNotPositive, time.Duration(c.Timeout)))
+	}
+	return errs
+}
+
+// validateClusterTLS checks that the traffic between the nodes is encrypted
+// and authenticated like the traffic of the clients. Storage traffic is
+// never plaintext, so a cluster requires TLS and https peers.
+func (c *Config) validateClusterTLS() []error {
+	var errs []error
+	if !c.TLS.Enabled() {
+		errs = append(errs, fmt.Errorf("tls: %w", ErrClusterNoTLS))
+	}
+	if (c.Cluster.Cert == "") != (c.Cluster.Key == "") {
+		errs = append(errs, fmt.Errorf("cluster: %w", ErrTLSPair))
+	}
+	if c.TLS.ClientCA != "" && c.Cluster.Cert == "" {
+		errs = append(errs, fmt.Errorf("cluster.cert: %w", ErrNoClusterCert))
+	}
+	for i, peer := range c.Cluster.Peers {
+		if u, err := url.Parse(peer); err == nil && u.Scheme == "http" {
+			errs = append(errs, fmt.Errorf("cluster.peers[%d]: %w, got %q", i, ErrPlaintextPeer, peer))
+		}
+	}
+	return errs
+}
+
+// validateStorageDirs rejects storage directories that overlap. Each of
+// them is swept of the files it should not hold, so none may hold another.
+func (c *Config) validateStorageDirs() []error {
+	type storageDir struct{ path, dir string }
+	dirs := []storageDir{{"dir", c.Dir}}
+	for i, d := range c.Storage.DataDirs {
+		dirs = append(dirs, storageDir{fmt.Sprintf("storage.data_dirs[%d]", i), d})
+	}
+	for i, d := range c.Storage.Erasure.Dirs {
+		dirs = append(dirs, storageDir{fmt.Sprintf("storage.erasure.dirs[%d]", i), d})
+	}
+	if c.Storage.Cold.Dir != "" {
+		dirs = append(dirs, storageDir{"storage.cold.dir", c.Storage.Cold.Dir})
+	}
+
+	var errs []error
+	for i, d := range dirs {
+		for _, other := range dirs[:i] {
+			if d.dir != "" && other.dir != "" && overlaps(d.dir, other.dir) {
+				errs = append(errs, fmt.Errorf("%s: %w, got %q and %s %q", d.path, ErrOverlappingDir, d.dir, other.path, other.dir))
+				break
+			}
+		}
+	}
+	return errs
+}
+
+// overlaps reports whether a and b are the same directory or one is inside
+// the other, comparing their absolute paths
+func overlaps(a, b string) bool {
+	a, errA := filepath.Abs(a)
+	b, errB := filepath.Abs(b)
+	if errA != nil || errB != nil {
+		return filepath.Clean(a) == filepath.Clean(b)
+	}
+	inside := func(dir, parent string) bool {
+		rel, err := filepath.Rel(parent, dir)
+		return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+	}
+	return inside(a, b) || inside(b, a)
+}
+
+func (s StorageConfig) validateDataDirs(dir string) []error {
+	var errs []error
+	for i, d := range s.DataDirs {
+		if d == "" {
+			errs = append(errs, fmt.Errorf("storage.data_dirs[%d]: %w", i, ErrEmptyDir))
+		}
+	}
+
+	// Blobs and shards are not placed by bucket
+	if s.Dedup {
+		errs = append(errs, fmt.Errorf("storage.data_dirs: %w storage.dedup", ErrCombined))
+	}
+	if s.Erasure.Enabled() {
+		errs = append(errs, fmt.Errorf("storage.data_dirs: %w storage.erasure", ErrCombined))
+	}
+	return errs
+}
+
+func (s StorageConfig) validateCold() []error {
+	var errs []error
+	if s.Cold.TransitionInterval < 0 {
+		errs = append(errs, fmt.Errorf("storage.cold.transition_interval: %w, got %s", ErrNegative, time.Duration(s.Cold.TransitionInterval)))
+	}
+	return errs
+}
+
+func (e ErasureConfig) validate(dir string) []error {
+	var errs []error
+	for i, d := range e.Dirs {
+		if d == "" {
+			errs = append(errs, fmt.Errorf("storage.erasure.dirs[%d]: %w", i, ErrEmptyDir))
+		}
+	}
+
+	if e.DataShards < 0 {
+		errs = append(errs, fmt.Errorf("storage.erasure.data_shards: %w, got %d", ErrNegative, e.DataShards))
+	}
+	if e.ParityShards <= 0 {
+		errs = append(errs, fmt.Errorf("storage.erasure.parity_shards: %w, got %d", ErrNotPositive, e.ParityShards))
+	}
+	if data, parity := e.Shards(); data <= 0 || data+parity != len(e.Dirs) {
+		errs = append(errs, fmt.Errorf("storage.erasure: %w (%d), got %d+%d", ErrShardCount, len(e.Dirs), data, parity))
+	}
+	if len(e.Dirs) > 256 {
+		errs = append(errs, fmt.Errorf("storage.erasure.dirs: %w 256 directories, got %d", ErrTooLarge, len(e.Dirs)))
+	}
+
+	if e.HealInterval < 0 {
+		errs = append(errs, fmt.Errorf("storage.erasure.heal_interval: %w, got %s", ErrNegative, time.Duration(e.HealInterval)))
+	}
+	return errs
+}
+
+// Enabled reports whether new objects are erasure coded
+func (e ErasureConfig) Enabled() bool {
+	return len(e.Dirs) > 0
+}
+
+// Shards returns the number of data and parity shards of every object
+func (e ErasureConfig) Shards() (data, parity int) {
+	data = e.DataShards
+	if data == 0 {
+		data = len(e.Dirs) - e.ParityShards
+	}
+	return data, e.ParityShards
+}
+
+// Enabled reports whether the server runs as a node of a cluster
+func (c ClusterConfig) Enabled() bool {
+	return len(c.Peers) > 0
+}
+
+// Replicas returns the number of nodes storing each object
+func (c ClusterConfig) Replicas() int {
+	if c.ReplicationFactor > 0 {
+		return c.ReplicationFactor
+	}
+	return min(3, len(c.Peers))
+}
+
+// Quorums returns the number of nodes that must acknowledge a write and
+// answer a read
+func (c ClusterConfig) Quorums() (write, read int) {
+	majority := c.Replicas()/2 + 1
+	write, read = c.WriteQuorum, c.ReadQuorum
+	if write == 0 {
+		write = majority
+	}
+	if read == 0 {
+		read = majority
+	}
+	return write, read
+}
+
+// Enabled reports whether the server should be served over TLS
+func (t TLSConfig) Enabled() bool {
+	return t.Cert != "" || t.SelfSigned
+}
+
+// Duration is a time.Duration written as a Go duration string ("30s", "24h")
+// in configuration files and environment variables.
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Redacted replaces the secrets of the configuration when it is printed
+const Redacted = "***"
+
+// String renders the configuration as indented JSON, without its secrets
+func (c *Config) String() string {
+	// Secrets are only shown as set or not, the output ends up in terminals and logs
+	redacted := *c
+	if redacted.Admin.Token != "" {
+		redacted.Admin.Token = Redacted
+	}
+	if redacted.Cluster.Secret != "" {
+		redacted.Cluster.Secret = Redacted
+	}
+	if redacted.Replication.Secret != "" {
+		redacted.Replication.Secret = Redacted
+	}
+
+	b, err := json.MarshalIndent(&redacted, "", "  ")
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
@@ -0,0 +1,92 @@
+package core
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigStringRedactsSecrets(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Admin.Token = "admin-token-value"
+	cfg.Cluster.Secret = "cluster-secret-value"
+	cfg.Replication.Secret = "replication-secret-value"
+
+	out := cfg.String()
+	for _, secret := range []string{cfg.Admin.Token, cfg.Cluster.Secret, cfg.Replication.Secret} {
+		if strings.Contains(out, secret) {
+			t.Errorf("String() shows %q:\n%s", secret, out)
+		}
+	}
+	if strings.Count(out, `"`+Redacted+`"`) != 3 {
+		t.Errorf("String() does not redact every secret:\n%s", out)
+	}
+	if cfg.Admin.Token != "admin-token-value" || cfg.Cluster.Secret != "cluster-secret-value" {
+		t.Error("String() changed the configuration")
+	}
+}
+
+func TestClusterQuorums(t *testing.T) {
+	tests := []struct {
+		name        string
+		factor      int
+		write, read int
+		wantErr     error
+	}{
+		{"majorities", 0, 0, 0, nil},
+		{"write all, read one", 3, 3, 1, nil},
+		{"write one, read all", 3, 1, 3, nil},
+		{"no overlap", 3, 1, 2, ErrQuorumOverlap},
+		{"default write, read one", 3, 0, 1, ErrQuorumOverlap},
+		{"quorum too large", 3, 4, 1, ErrTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := ClusterConfig{
+				Peers:             []string{"https://node1:8080", "https://node2:8080", "https://node3:8080"},
+				Node:              "https://node1:8080",
+				Secret:            "secret",
+				ReplicationFactor: tt.factor,
+				WriteQuorum:       tt.write,
+				ReadQuorum:        tt.read,
+				Timeout:           Duration(time.Second),
+			}
+			err := errors.Join(cfg.validate()...)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Errorf("validate() = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == ErrTooLarge && errors.Is(err, ErrQuorumOverlap) {
+				t.Errorf("validate() also reports %v for an invalid quorum", ErrQuorumOverlap)
+			}
+		})
+	}
+}
+
+func TestClusterTLS(t *testing.T) {
+	tests := []struct {
+		name    string
+		peers   []string
+		tls     TLSConfig
+		cluster ClusterConfig
+		wantErr error
+	}{
+		{"plaintext without TLS", []string{"http://node1:8080", "http://node2:8080"}, TLSConfig{}, ClusterConfig{}, ErrPlaintextPeer},
+		{"https without TLS", []string{"https://node1:8080", "https://node2:8080"}, TLSConfig{}, ClusterConfig{}, ErrClusterNoTLS},
+		{"https under TLS", []string{"https://node1:8080", "https://node2:8080"}, TLSConfig{SelfSigned: true}, ClusterConfig{}, nil},
+		{"plaintext under TLS", []string{"https://node1:8080", "http://node2:8080"}, TLSConfig{SelfSigned: true}, ClusterConfig{}, ErrPlaintextPeer},
+		{"cert without key", []string{"https://node1:8080", "https://node2:8080"}, TLSConfig{SelfSigned: true}, ClusterConfig{Cert: "node.pem"}, ErrTLSPair},
+		{"client CA without cert", []string{"https://node1:8080", "https://node2:8080"}, TLSConfig{SelfSigned: true, ClientCA: "ca.pem"}, ClusterConfig{}, ErrNoClusterCert},
+		{"client CA with cert", []string{"https://node1:8080", "https://node2:8080"}, TLSConfig{SelfSigned: true, ClientCA: "ca.pem"}, ClusterConfig{Cert: "node.pem", Key: "node.key"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{TLS: tt.tls, Cluster: tt.cluster}
+			cfg.Cluster.Peers = tt.peers
+			err := errors.Join(cfg.validateClusterTLS()...)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Errorf("validateClusterTLS() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
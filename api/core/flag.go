@@ -1,50 +1,176 @@
 package core
 
 import (
-	"errors"
 	"flag"
 	"fmt"
+	"os"
+	"strings"
 )
 
-var (
-	Port int
-	Dir  string
-	Help bool
-)
+// ParseFlags builds the configuration from the defaults, the config file,
+// the environment and the command line arguments, and validates the result.
+// printConfig reports whether --print-config was requested.
+// flag.ErrHelp is returned after printing the usage when --help is given.
+func ParseFlags(args []string) (cfg *Config, printConfig bool, err error) {
+	var (
+		configFile = os.Getenv(EnvPrefix + "CONFIG")
+		flags      = DefaultConfig()
+	)
 
-var (
-	ErrIncorrectPort = errors.New("incorrect port number, range must be between 1-65535")
-	ErrEmptyDir      = errors.New("empty directory path")
-)
+	fs := flag.NewFlagSet("triple-s", flag.ContinueOnError)
+	fs.StringVar(&configFile, "config", configFile, "path to the JSON configuration file")
+	fs.BoolVar(&printConfig, "print-config", false, "print the resolved configuration and exit")
+	fs.IntVar(&flags.Port, "port", flags.Port, "server port to listen on")
+	fs.IntVar(&flags.AdminPort, "admin-port", flags.AdminPort, "separate port for the metrics, health and version endpoints")
+	dirs := 0
+	fs.Func("dir", "directory to store buckets, repeated to place buckets on several disks", func(s string) error {
+		if dirs++; dirs == 1 {
+			flags.Dir = s
+		} else {
+			flags.Storage.DataDirs = append(flags.Storage.DataDirs, s)
+		}
+		return nil
+	})
+	fs.StringVar(&flags.TLS.Cert, "tls-cert", "", "path to the PEM encoded TLS certificate")
+	fs.StringVar(&flags.TLS.Key, "tls-key", "", "path to the PEM encoded TLS private key")
+	fs.StringVar(&flags.TLS.ClientCA, "tls-client-ca", "", "path to the PEM encoded CA bundle used to verify client certificates")
+	fs.BoolVar(&flags.TLS.SelfSigned, "tls-self-signed", false, "serve TLS with a generated self-signed certificate (development only)")
+	fs.Int64Var(&flags.Limits.MaxObjectSize, "max-object-size", flags.Limits.MaxObjectSize, "maximum object size in bytes, 0 for unlimited")
+	fs.Float64Var(&flags.RateLimit.RequestsPerSecond, "rate-limit", 0, "requests per second allowed per client, 0 for unlimited")
+	fs.Int64Var(&flags.RateLimit.BytesPerSecond, "bandwidth-limit", 0, "bytes per second allowed per client, 0 for unlimited")
+	fs.IntVar(&flags.RateLimit.MaxConcurrentUploads, "max-uploads", 0, "maximum number of concurrent uploads, 0 for unlimited")
+	fs.BoolVar(&flags.Storage.Dedup, "dedup", false, "store identical object contents once")
+	fs.Func("erasure-dirs", "comma separated directories, one per disk, to spread erasure coded objects over", func(s string) error {
+		flags.Storage.Erasure.Dirs = strings.Split(s, ",")
+		return nil
+	})
+	fs.StringVar(&flags.Storage.Cold.Dir, "cold-dir", "", "directory of the COLD storage class")
+	fs.TextVar(&flags.Trash.Retention, "trash-retention", flags.Trash.Retention, "keep deleted buckets this long for restoring, 0 deletes them at once")
+	fs.StringVar(&flags.Events.LogFile, "event-log", "", "append every object event as a JSON line to this file")
+	fs.Func("cluster-peers", "comma separated base URLs of the nodes of the cluster, this one included", func(s string) error {
+		flags.Cluster.Peers = strings.Split(s, ",")
+		return nil
+	})
+	fs.StringVar(&flags.Cluster.Node, "cluster-node", "", "base URL of this node, as listed in --cluster-peers")
+	fs.StringVar(&flags.Log.Level, "log-level", flags.Log.Level, "minimum log level: debug, info, warn or error")
+	fs.StringVar(&flags.Log.Format, "log-format", flags.Log.Format, "log output format: text or json")
+	fs.BoolVar(&flags.Log.Access, "access-log", flags.Log.Access, "log one line per request")
 
-// Parses the above three flags
-// Port number should be in range 1 and 65535 inclusively.
-func ParseFlags() error {
-	flag.IntVar(&Port, "port", 8080, "server port to listen on")
-	flag.StringVar(&Dir, "dir", "./data", "directory to store buckets")
-	flag.BoolVar(&Help, "help", false, "print help message")
+	fs.Usage = PrintUsage
+	if err := fs.Parse(args); err != nil {
+		return nil, false, err
+	}
 
-	flag.Usage = PrintUsage
-	flag.Parse()
+	cfg = DefaultConfig()
+	if configFile != "" {
+		if err := cfg.LoadFile(configFile); err != nil {
+			return nil, false, err
+		}
+	}
 
-	if Port < 1 || Port > 65535 {
-		return ErrIncorrectPort
+	if err := cfg.LoadEnv(); err != nil {
+		return nil, false, err
 	}
 
-	if Dir == "" {
-		return ErrEmptyDir
+	// Only flags given explicitly override the file and the environment
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			cfg.Port = flags.Port
+		case "admin-port":
+			cfg.AdminPort = flags.AdminPort
+		case "dir":
+			cfg.Dir = flags.Dir
+			if dirs > 1 {
+				cfg.Storage.DataDirs = flags.Storage.DataDirs
+			}
+		case "tls-cert":
+			cfg.TLS.Cert = flags.TLS.Cert
+		case "tls-key":
+			cfg.TLS.Key = flags.TLS.Key
+		case "tls-client-ca":
+			cfg.TLS.ClientCA = flags.TLS.ClientCA
+		case "tls-self-signed":
+			cfg.TLS.SelfSigned = flags.TLS.SelfSigned
+		case "max-object-size":
+			cfg.Limits.MaxObjectSize = flags.Limits.MaxObjectSize
+		case "rate-limit":
+			cfg.RateLimit.RequestsPerSecond = flags.RateLimit.RequestsPerSecond
+		case "bandwidth-limit":
+			cfg.RateLimit.BytesPerSecond = flags.RateLimit.BytesPerSecond
+		case "max-uploads":
+			cfg.RateLimit.MaxConcurrentUploads = flags.RateLimit.MaxConcurrentUploads
+		case "dedup":
+			cfg.Storage.Dedup = flags.Storage.Dedup
+		case "erasure-dirs":
+			cfg.Storage.Erasure.Dirs = flags.Storage.Erasure.Dirs
+		case "cold-dir":
+			cfg.Storage.Cold.Dir = flags.Storage.Cold.Dir
+		case "trash-retention":
+			cfg.Trash.Retention = flags.Trash.Retention
+		case "event-log":
+			cfg.Events.LogFile = flags.Events.LogFile
+		case "cluster-peers":
+			cfg.Cluster.Peers = flags.Cluster.Peers
+		case "cluster-node":
+			cfg.Cluster.Node = flags.Cluster.Node
+		case "log-level":
+			cfg.Log.Level = flags.Log.Level
+		case "log-format":
+			cfg.Log.Format = flags.Log.Format
+		case "access-log":
+			cfg.Log.Access = flags.Log.Access
+		}
+	})
+
+	if err := cfg.Validate(); err != nil {
+		return nil, false, fmt.Errorf("invalid configuration:\n%w", err)
 	}
 
-	return nil
+	return cfg, printConfig, nil
 }
 
 func PrintUsage() {
 	fmt.Println(`Simple Storage Service.
 Usage:
-	triple-s [-port <N>] [-dir <S>]
+	triple-s [--config <S>] [-port <N>] [--admin-port <N>] [-dir <S>]... [--tls-cert <S> --tls-key <S>] [--tls-client-ca <S>] [--tls-self-signed]
+		[--log-level <S>] [--log-format <S>] [--access-log=<B>] [--max-object-size <N>]
+		[--rate-limit <N>] [--bandwidth-limit <N>] [--max-uploads <N>] [--dedup] [--trash-retention <D>] [--event-log <S>]
+		[--erasure-dirs <S>] [--cold-dir <S>] [--cluster-peers <S> --cluster-node <S>]
+	triple-s fsck [--dir <S>] [--json] [--repair]
+	triple-s migrate [--dir <S>] [--dry-run] [--no-backup]
+	triple-s replication [--dir <S>] [--json]
+	triple-s --print-config
 	triple-s --help
 Options:
-	--help     Show this screen.
-	--port N   Port number
-	--dir S    Path to the directory`)
+	--help               Show this screen.
+	--config S           Path to the JSON configuration file (or TRIPLES_CONFIG)
+	--print-config       Print the resolved configuration and exit
+	--port N             Port number
+	--admin-port N       Serve the metrics, health, version and admin endpoints on a separate port
+	--dir S              Path to the directory; repeat to place new buckets on the disk with the most free space
+	--tls-cert S         Path to the TLS certificate (PEM), reloaded when it changes
+	--tls-key S          Path to the TLS private key (PEM), reloaded when it changes
+	--tls-client-ca S    Path to the CA bundle (PEM) for mutual TLS; client certificates become mandatory
+	--tls-self-signed    Generate a self-signed certificate on startup (development only)
+	--max-object-size N  Reject objects larger than N bytes (default 0, unlimited)
+	--rate-limit N       Requests per second per client (default 0, unlimited)
+	--bandwidth-limit N  Bytes per second per client (default 0, unlimited)
+	--max-uploads N      Concurrent uploads across all clients (default 0, unlimited)
+	--dedup              Store identical object contents once, shared between buckets
+	--erasure-dirs S     Comma separated directories, one per disk, to erasure code new objects across
+	--cold-dir S         Directory of the COLD storage class, where lifecycle rules move old objects
+	--trash-retention D  Keep deleted buckets this long (e.g. 72h) for restoring (default 0, delete at once)
+	--event-log S        Append every object event as a JSON line to this file
+	--cluster-peers S    Comma separated base URLs of the cluster nodes, this one included (cluster.secret is required)
+	--cluster-node S     Base URL of this node among the peers
+	--log-level S        Minimum log level: debug, info (default), warn, error
+	--log-format S       Log format: text (default) or json
+	--access-log=B       Log one line per request (default true)
+Commands:
+	fsck                 Check the data directory for inconsistencies, see triple-s fsck --help
+	migrate              Upgrade the data directory to the current format, see triple-s migrate --help
+	replication          Show the replication backlog of the data directory, see triple-s replication --help
+Every setting can also be given as an environment variable named after its
+path in the config file, e.g. TRIPLES_PORT, TRIPLES_DIR, TRIPLES_TLS_CERT.`)
 }
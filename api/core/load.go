@@ -0,0 +1,143 @@
+package core
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// LoadFile merges the JSON configuration file at path into c.
+// Unknown keys are rejected so typos do not go unnoticed.
+func (c *Config) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr):
+			line, col := position(data, syntaxErr.Offset)
+			return fmt.Errorf("config file %s:%d:%d: %v", path, line, col, err)
+		case errors.As(err, &typeErr):
+			line, col := position(data, typeErr.Offset)
+			return fmt.Errorf("config file %s:%d:%d: %s: expected %s, got %s", path, line, col, typeErr.Field, typeErr.Type, typeErr.Value)
+		default:
+			return fmt.Errorf("config file %s: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// position converts a byte offset into a 1-based line and column
+func position(data []byte, offset int64) (line, col int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line = bytes.Count(before, []byte("\n")) + 1
+	col = int(offset) - bytes.LastIndexByte(before, '\n')
+	return line, col
+}
+
+// LoadEnv overrides c with TRIPLES_* environment variables. The variable name
+// is derived from the JSON path of the setting, e.g. tls.client_ca is read
+// from TRIPLES_TLS_CLIENT_CA. Lists are comma separated.
+func (c *Config) LoadEnv() error {
+	return loadEnv(reflect.ValueOf(c).Elem(), EnvPrefix)
+}
+
+func loadEnv(v reflect.Value, prefix string) error {
+	var errs []error
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+
+		envName := prefix + strings.ToUpper(name)
+		fv := v.Field(i)
+
+		if fv.Kind() == reflect.Struct && !isTextUnmarshaler(fv) {
+			if err := loadEnv(fv, envName+"_"); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+
+		raw, ok := os.LookupEnv(envName)
+		if !ok {
+			continue
+		}
+
+		if err := setFromString(fv, raw); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", envName, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func isTextUnmarshaler(v reflect.Value) bool {
+	_, ok := v.Addr().Interface().(encoding.TextUnmarshaler)
+	return ok
+}
+
+// setFromString parses raw into the settable value v
+func setFromString(v reflect.Value, raw string) error {
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(raw))
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", raw)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", raw)
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", raw)
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported list type %s", v.Type())
+		}
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+
+	return nil
+}
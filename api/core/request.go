@@ -0,0 +1,19 @@
+package core
+
+import "context"
+
+type internalKey struct{}
+
+// WithInternal returns a copy of ctx marking the request as sent by another
+// node of the cluster, its secret checked
+func WithInternal(ctx context.Context) context.Context {
+	return context.WithValue(ctx, internalKey{}, true)
+}
+
+// Internal reports whether the request of ctx was sent by another node of
+// the cluster. Only such requests may set the version of the objects they
+// write or delete.
+func Internal(ctx context.Context) bool {
+	internal, _ := ctx.Value(internalKey{}).(bool)
+	return internal
+}
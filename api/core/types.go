@@ -5,11 +5,65 @@ import (
 )
 
 type Bucket struct {
-	XMLName      xml.Name `xml:"Bucket"`
+	XMLName      xml.Name `xml:"Bucket" json:"-"`
 	Name         string   `xml:"Name"`
 	CreationDate string   `xml:"CreationDate"`
 	LastUpdated  string   `xml:"LastUpdated"`
 	Status       string   `xml:"Status"`
+	QuotaBytes   int64    `xml:"QuotaBytes,omitempty"`
+	QuotaObjects int64    `xml:"QuotaObjects,omitempty"`
+	Compression  string   `xml:"Compression,omitempty"`
+	DeletedAt    string   `xml:"DeletedAt,omitempty"` // when the bucket was moved to the trash
+
+	// Object lock, which cannot be turned off once Enabled, and the retention
+	// applied to new objects that do not set their own
+	ObjectLock           string `xml:"ObjectLockEnabled,omitempty"`
+	DefaultRetentionMode string `xml:"DefaultRetentionMode,omitempty"`
+	DefaultRetentionDays int64  `xml:"DefaultRetentionDays,omitempty"`
+
+	// Webhooks notified of object events
+	Notifications []Webhook `xml:"-"`
+	// Rules replicating objects to other instances
+	Replication []ReplicationRule `xml:"-"`
+	// Rules moving objects to the COLD storage class as they age
+	Lifecycle []LifecycleRule `xml:"-"`
+
+	Stats *BucketStats `xml:"Stats,omitempty" json:"-"` // derived from the objects, never stored
+}
+
+// BucketStats summarizes the objects of a bucket
+type BucketStats struct {
+	XMLName       xml.Name           `xml:"Stats"`
+	Objects       int64              `xml:"Objects"`
+	Bytes         int64              `xml:"Bytes"`
+	LargestObject *LargestObject     `xml:"LargestObject,omitempty"`
+	ContentTypes  []ContentTypeStats `xml:"ContentTypes>ContentType"`
+}
+
+type LargestObject struct {
+	Key  string `xml:"Key"`
+	Size int64  `xml:"Size"`
+}
+
+// ContentTypeStats counts the objects of a bucket with one content type
+type ContentTypeStats struct {
+	Type    string `xml:"Type"`
+	Objects int64  `xml:"Objects"`
+	Bytes   int64  `xml:"Bytes"`
+}
+
+// Bucket states
+const (
+	BucketActive          = "Active"
+	BucketPendingDeletion = "PendingDeletion" // in the trash, purged after the retention
+	BucketDeleting        = "Deleting"        // its objects are being deleted by a job
+)
+
+// Quota limits the total size and the number of objects of a bucket, 0 means unlimited
+type Quota struct {
+	XMLName    xml.Name `xml:"Quota"`
+	MaxBytes   int64    `xml:"MaxBytes"`
+	MaxObjects int64    `xml:"MaxObjects"`
 }
 
 type Buckets struct {
@@ -18,16 +72,202 @@ type Buckets struct {
 }
 
 type Object struct {
-	XMLName       xml.Name `xml:"Object"`
+	XMLName       xml.Name `xml:"Object" json:"-"`
 	Name          string   `xml:"Name"`
 	ContentType   string   `xml:"ContentType"`
 	ContentLength string   `xml:"ContentLength"`
 	LastModified  string   `xml:"LastModified"`
+	ETag          string   `xml:"ETag,omitempty"`   // hex MD5 of the content
+	Digest        string   `xml:"Digest,omitempty"` // hex SHA-256 of the stored bytes
+	Storage       string   `xml:"-"`                // where the content is stored
+	Encoding      string   `xml:"-"`                // compression of the stored bytes
+
+	// Object lock: the object can neither be overwritten nor deleted until
+	// RetainUntilDate, nor while LegalHold is ON
+	RetentionMode   string `xml:"RetentionMode,omitempty"`
+	RetainUntilDate string `xml:"RetainUntilDate,omitempty"`
+	LegalHold       string `xml:"LegalHold,omitempty"`
+
+	// Progress of the replication of the object, or REPLICA for the copies
+	// written by replication
+	ReplicationStatus string `xml:"ReplicationStatus,omitempty"`
+
+	// STANDARD or COLD, empty for objects stored before storage classes.
+	// A COLD object is read once restored, until RestoreExpiryDate.
+	StorageClass      string `xml:"StorageClass,omitempty"`
+	RestoreExpiryDate string `xml:"RestoreExpiryDate,omitempty"`
 }
 
 type Objects struct {
-	XMLName xml.Name `xml:"Objects"`
-	List    []Object `xml:"Object"`
+	XMLName     xml.Name `xml:"Objects"`
+	Prefix      string   `xml:"Prefix,omitempty"`
+	Marker      string   `xml:"Marker,omitempty"`
+	MaxKeys     int      `xml:"MaxKeys,omitempty"`
+	IsTruncated bool     `xml:"IsTruncated,omitempty"`
+	NextMarker  string   `xml:"NextMarker,omitempty"`
+	List        []Object `xml:"Object"`
+}
+
+// Object lock settings
+const (
+	ObjectLockEnabled = "Enabled"
+	LockGovernance    = "GOVERNANCE" // can be lifted by privileged users
+	LockCompliance    = "COMPLIANCE" // cannot be lifted by anyone until it expires
+	LegalHoldOn       = "ON"
+	LegalHoldOff      = "OFF"
+)
+
+// ObjectLockConfiguration enables object lock on a bucket and sets the
+// default retention of its new objects
+type ObjectLockConfiguration struct {
+	XMLName           xml.Name        `xml:"ObjectLockConfiguration"`
+	ObjectLockEnabled string          `xml:"ObjectLockEnabled"`
+	Rule              *ObjectLockRule `xml:"Rule,omitempty"`
+}
+
+type ObjectLockRule struct {
+	DefaultRetention DefaultRetention `xml:"DefaultRetention"`
+}
+
+// DefaultRetention gives the retention period in either days or years
+type DefaultRetention struct {
+	Mode  string `xml:"Mode"`
+	Days  int64  `xml:"Days,omitempty"`
+	Years int64  `xml:"Years,omitempty"`
+}
+
+// Retention protects an object until RetainUntilDate
+type Retention struct {
+	XMLName         xml.Name `xml:"Retention"`
+	Mode            string   `xml:"Mode,omitempty"`
+	RetainUntilDate string   `xml:"RetainUntilDate,omitempty"`
+}
+
+// LegalHold protects an object until it is turned OFF again
+type LegalHold struct {
+	XMLName xml.Name `xml:"LegalHold"`
+	Status  string   `xml:"Status"`
+}
+
+// Event types of object notifications
+const (
+	EventObjectCreatedPut    = "ObjectCreated:Put"
+	EventObjectRemovedDelete = "ObjectRemoved:Delete"
+)
+
+// NotificationConfiguration lists the webhooks of a bucket
+type NotificationConfiguration struct {
+	XMLName  xml.Name  `xml:"NotificationConfiguration"`
+	Webhooks []Webhook `xml:"WebhookConfiguration"`
+}
+
+// Webhook receives the events of a bucket matching its event types, such
+// as s3:ObjectCreated:* or s3:ObjectRemoved:Delete, and its key filter
+type Webhook struct {
+	ID       string              `xml:"Id" json:"id"`
+	Endpoint string              `xml:"Endpoint" json:"endpoint"`
+	Events   []string            `xml:"Event" json:"events"`
+	Filter   *NotificationFilter `xml:"Filter,omitempty" json:"filter,omitempty"`
+}
+
+type NotificationFilter struct {
+	Rules []FilterRule `xml:"S3Key>FilterRule" json:"rules"`
+}
+
+// FilterRule matches keys by prefix or suffix
+type FilterRule struct {
+	Name  string `xml:"Name" json:"name"`
+	Value string `xml:"Value" json:"value"`
+}
+
+// CompressionConfiguration selects the compression of objects stored in a bucket
+type CompressionConfiguration struct {
+	XMLName   xml.Name `xml:"CompressionConfiguration"`
+	Algorithm string   `xml:"Algorithm"` // gzip, deflate or empty for none
+}
+
+// GCReport summarizes a blob garbage collection run
+type GCReport struct {
+	XMLName      xml.Name `xml:"GarbageCollection"`
+	Scanned      int      `xml:"Scanned"`
+	Removed      int      `xml:"Removed"`
+	FreedBytes   int64    `xml:"FreedBytes"`
+	FixedRefs    int      `xml:"FixedRefs"`
+	TempsRemoved int      `xml:"TempsRemoved"`
+}
+
+// HealReport summarizes a healing run over the erasure coded objects
+type HealReport struct {
+	XMLName        xml.Name     `xml:"Heal"`
+	Scanned        int          `xml:"Scanned"`
+	Healed         int          `xml:"Healed"`
+	RebuiltShards  int          `xml:"RebuiltShards"`
+	Unrecoverable  int          `xml:"Unrecoverable"`
+	OrphansRemoved int          `xml:"OrphansRemoved"`
+	Disks          []DiskStatus `xml:"Disk"`
+}
+
+// DiskStatus describes an erasure coding disk
+type DiskStatus struct {
+	Dir    string `xml:"Dir"`
+	Online bool   `xml:"Online"`
+}
+
+// DataDirectories lists the data directories buckets are placed on
+type DataDirectories struct {
+	XMLName xml.Name        `xml:"DataDirectories"`
+	List    []DataDirectory `xml:"Directory"`
+}
+
+type DataDirectory struct {
+	Dir        string `xml:"Dir"`
+	Draining   bool   `xml:"Draining"`
+	Buckets    int    `xml:"Buckets"`
+	FreeBytes  uint64 `xml:"FreeBytes"`
+	TotalBytes uint64 `xml:"TotalBytes"`
+}
+
+// RebalanceReport lists the buckets moved between data directories
+type RebalanceReport struct {
+	XMLName xml.Name     `xml:"Rebalance"`
+	Moves   []BucketMove `xml:"Move"`
+}
+
+type BucketMove struct {
+	Bucket string `xml:"Bucket"`
+	From   string `xml:"From"`
+	To     string `xml:"To"`
+	Files  int    `xml:"Files"`
+	Bytes  int64  `xml:"Bytes"`
+	Error  string `xml:"Error,omitempty"`
+}
+
+// Job states
+const (
+	JobRunning   = "Running"
+	JobCompleted = "Completed"
+	JobCanceled  = "Canceled"
+	JobFailed    = "Failed"
+)
+
+// DeleteJob reports the progress of a forced bucket deletion, and its
+// outcome once finished
+type DeleteJob struct {
+	XMLName        xml.Name `xml:"DeleteJob"`
+	ID             string   `xml:"ID"`
+	Bucket         string   `xml:"Bucket"`
+	Status         string   `xml:"Status"`
+	ObjectsTotal   int64    `xml:"ObjectsTotal"`
+	ObjectsDeleted int64    `xml:"ObjectsDeleted"`
+	BytesFreed     int64    `xml:"BytesFreed"`
+	StartedAt      string   `xml:"StartedAt"`
+	FinishedAt     string   `xml:"FinishedAt,omitempty"`
+	Error          string   `xml:"Error,omitempty"`
+}
+
+type DeleteJobs struct {
+	XMLName xml.Name    `xml:"DeleteJobs"`
+	List    []DeleteJob `xml:"DeleteJob"`
 }
 
 type Error struct {
@@ -35,3 +275,99 @@ type Error struct {
 	Message  string `xml:"Message"`
 	Resource string `xml:"Resource,omitempty"`
 }
+
+// Replication statuses of objects
+const (
+	ReplicationPending   = "PENDING"
+	ReplicationCompleted = "COMPLETED"
+	ReplicationFailed    = "FAILED"
+	ReplicationReplica   = "REPLICA"
+)
+
+// Statuses of replication rules and of their delete replication
+const (
+	RuleEnabled  = "Enabled"
+	RuleDisabled = "Disabled"
+)
+
+// ReplicationConfiguration lists the replication rules of a bucket
+type ReplicationConfiguration struct {
+	XMLName xml.Name          `xml:"ReplicationConfiguration"`
+	Rules   []ReplicationRule `xml:"Rule"`
+}
+
+// ReplicationRule copies the objects whose key starts with Prefix to a
+// bucket of another instance, and deletes them there too when
+// DeleteReplication is Enabled
+type ReplicationRule struct {
+	ID                string                 `xml:"ID" json:"id"`
+	Status            string                 `xml:"Status" json:"status"`
+	Prefix            string                 `xml:"Filter>Prefix" json:"prefix,omitempty"`
+	Destination       ReplicationDestination `xml:"Destination" json:"destination"`
+	DeleteReplication string                 `xml:"DeleteMarkerReplication>Status" json:"delete_replication,omitempty"`
+}
+
+type ReplicationDestination struct {
+	Endpoint string `xml:"Endpoint" json:"endpoint"` // base URL of the instance
+	Bucket   string `xml:"Bucket" json:"bucket"`
+}
+
+// ReplicationStatus reports the replication backlog of the buckets
+type ReplicationStatus struct {
+	XMLName xml.Name            `xml:"ReplicationStatus" json:"-"`
+	Buckets []BucketReplication `xml:"Bucket" json:"buckets"`
+}
+
+type BucketReplication struct {
+	Name    string `xml:"Name" json:"name"`
+	Pending int    `xml:"Pending" json:"pending"`
+	Failed  int    `xml:"Failed" json:"failed"`
+	// Objects replicated since the server started
+	Completed uint64 `xml:"Completed" json:"completed"`
+	// When the oldest pending change was made, and how long ago
+	OldestPending string  `xml:"OldestPending,omitempty" json:"oldest_pending,omitempty"`
+	LagSeconds    float64 `xml:"LagSeconds" json:"lag_seconds"`
+}
+
+// Storage classes of objects
+const (
+	StorageStandard = "STANDARD" // in the data directory of the bucket
+	StorageCold     = "COLD"     // in the cold directory, restored before it is read
+)
+
+// LifecycleConfiguration lists the lifecycle rules of a bucket
+type LifecycleConfiguration struct {
+	XMLName xml.Name        `xml:"LifecycleConfiguration"`
+	Rules   []LifecycleRule `xml:"Rule"`
+}
+
+// LifecycleRule moves the objects whose key starts with Prefix to another
+// storage class once they are older than the transition days
+type LifecycleRule struct {
+	ID         string              `xml:"ID" json:"id"`
+	Status     string              `xml:"Status" json:"status"`
+	Prefix     string              `xml:"Filter>Prefix" json:"prefix,omitempty"`
+	Transition LifecycleTransition `xml:"Transition" json:"transition"`
+}
+
+type LifecycleTransition struct {
+	Days         int64  `xml:"Days" json:"days"`
+	StorageClass string `xml:"StorageClass" json:"storage_class"`
+}
+
+// RestoreRequest makes a COLD object readable for a number of days
+type RestoreRequest struct {
+	XMLName xml.Name `xml:"RestoreRequest"`
+	Days    int64    `xml:"Days"`
+}
+
+// TransitionReport summarizes a run of the lifecycle rules
+type TransitionReport struct {
+	XMLName          xml.Name `xml:"Transition"`
+	Scanned          int      `xml:"Scanned"`
+	Transitioned     int      `xml:"Transitioned"`
+	TransitionedSize int64    `xml:"TransitionedBytes"`
+	Failed           int      `xml:"Failed"`
+	RestoresExpired  int      `xml:"RestoresExpired"`
+	OrphansRemoved   int      `xml:"OrphansRemoved"`
+}
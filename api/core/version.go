@@ -0,0 +1,41 @@
+package core
+
+import (
+	"encoding/xml"
+	"runtime"
+	"runtime/debug"
+)
+
+// Version is the release version, set at build time with
+// -ldflags "-X github.com/ab-dauletkhan/triple-s/api/core.Version=v1.2.3"
+var Version = "dev"
+
+type BuildInfo struct {
+	XMLName   xml.Name `xml:"BuildInfo"`
+	Version   string   `xml:"Version"`
+	Revision  string   `xml:"Revision,omitempty"`
+	BuildTime string   `xml:"BuildTime,omitempty"`
+	Modified  bool     `xml:"Modified"`
+	GoVersion string   `xml:"GoVersion"`
+}
+
+// ReadBuildInfo returns the version and the VCS details embedded by the Go toolchain
+func ReadBuildInfo() BuildInfo {
+	info := BuildInfo{Version: Version, GoVersion: runtime.Version()}
+
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	for _, setting := range bi.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			info.Revision = setting.Value
+		case "vcs.time":
+			info.BuildTime = setting.Value
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+	return info
+}
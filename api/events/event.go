@@ -0,0 +1,162 @@
+// Package events notifies downstream systems of object changes. Events are
+// encoded as S3 event records, appended to a bounded change feed that
+// clients follow and to an optional local event log, and delivered to the
+// webhooks configured on their bucket through an on-disk outbox, so that
+// deliveries survive restarts and failing targets.
+package events
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+)
+
+// Record is an S3 event notification record
+type Record struct {
+	EventVersion string `json:"eventVersion"`
+	EventSource  string `json:"eventSource"`
+	EventTime    string `json:"eventTime"`
+	EventName    string `json:"eventName"`
+	S3           S3     `json:"s3"`
+}
+
+type S3 struct {
+	SchemaVersion   string       `json:"s3SchemaVersion"`
+	ConfigurationID string       `json:"configurationId,omitempty"`
+	Bucket          BucketEntity `json:"bucket"`
+	Object          ObjectEntity `json:"object"`
+}
+
+type BucketEntity struct {
+	Name string `json:"name"`
+	ARN  string `json:"arn"`
+}
+
+type ObjectEntity struct {
+	Key       string `json:"key"` // URL encoded, as in S3
+	Size      int64  `json:"size,omitempty"`
+	ETag      string `json:"eTag,omitempty"`
+	Sequencer string `json:"sequencer"`
+}
+
+// Payload is the body of a notification, as posted to webhooks
+type Payload struct {
+	Records []Record `json:"Records"`
+}
+
+// NewRecord describes an event on object. sequence orders the events; it
+// is rendered as a fixed width hex string so that the sequencers compare
+// like the numbers.
+func NewRecord(eventName, bucket string, object core.Object, sequence uint64) Record {
+	size, _ := strconv.ParseInt(object.ContentLength, 10, 64)
+	return Record{
+		EventVersion: "2.1",
+		EventSource:  "triple-s:s3",
+		EventTime:    time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+		EventName:    eventName,
+		S3: S3{
+			SchemaVersion: "1.0",
+			Bucket:        BucketEntity{Name: bucket, ARN: "arn:aws:s3:::" + bucket},
+			Object: ObjectEntity{
+				Key:       url.QueryEscape(object.Name),
+				Size:      size,
+				ETag:      object.ETag,
+				Sequencer: fmt.Sprintf("%016X", sequence),
+			},
+		},
+	}
+}
+
+var (
+	ErrInvalidEndpoint   = errors.New("webhook endpoint must be an http or https URL")
+	ErrInvalidEvent      = errors.New("event must be one of s3:ObjectCreated:*, s3:ObjectCreated:Put, s3:ObjectRemoved:*, s3:ObjectRemoved:Delete")
+	ErrNoEvents          = errors.New("webhook needs at least one event")
+	ErrInvalidFilterRule = errors.New("filter rules must be a prefix or a suffix, each given at most once")
+	ErrDuplicateID       = errors.New("webhook ids must be unique")
+)
+
+// Event types accepted in webhook configurations
+var eventTypes = map[string]bool{
+	"s3:ObjectCreated:*":                  true,
+	"s3:" + core.EventObjectCreatedPut:    true,
+	"s3:ObjectRemoved:*":                  true,
+	"s3:" + core.EventObjectRemovedDelete: true,
+}
+
+// Validate checks the webhooks of a notification configuration and gives
+// the ones without an id a generated one
+func Validate(config *core.NotificationConfiguration) error {
+	ids := make(map[string]bool)
+	for i := range config.Webhooks {
+		webhook := &config.Webhooks[i]
+		if webhook.ID == "" {
+			webhook.ID = "webhook-" + strconv.Itoa(i+1)
+		}
+		if ids[webhook.ID] {
+			return fmt.Errorf("%w: %s", ErrDuplicateID, webhook.ID)
+		}
+		ids[webhook.ID] = true
+
+		u, err := url.Parse(webhook.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%s: %w", webhook.ID, ErrInvalidEndpoint)
+		}
+
+		if len(webhook.Events) == 0 {
+			return fmt.Errorf("%s: %w", webhook.ID, ErrNoEvents)
+		}
+		for _, event := range webhook.Events {
+			if !eventTypes[event] {
+				return fmt.Errorf("%s: %w, got %q", webhook.ID, ErrInvalidEvent, event)
+			}
+		}
+
+		if webhook.Filter != nil {
+			seen := make(map[string]bool)
+			for _, rule := range webhook.Filter.Rules {
+				name := strings.ToLower(rule.Name)
+				if (name != "prefix" && name != "suffix") || seen[name] {
+					return fmt.Errorf("%s: %w", webhook.ID, ErrInvalidFilterRule)
+				}
+				seen[name] = true
+			}
+		}
+	}
+	return nil
+}
+
+// Matches reports whether webhook wants to be notified of eventName on key
+func Matches(webhook core.Webhook, eventName, key string) bool {
+	category, _, _ := strings.Cut(eventName, ":")
+	wanted := false
+	for _, event := range webhook.Events {
+		if event == "s3:"+eventName || event == "s3:"+category+":*" {
+			wanted = true
+			break
+		}
+	}
+	if !wanted {
+		return false
+	}
+
+	if webhook.Filter != nil {
+		for _, rule := range webhook.Filter.Rules {
+			switch strings.ToLower(rule.Name) {
+			case "prefix":
+				if !strings.HasPrefix(key, rule.Value) {
+					return false
+				}
+			case "suffix":
+				if !strings.HasSuffix(key, rule.Value) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
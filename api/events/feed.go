@@ -0,0 +1,234 @@
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+)
+
+// Name of the change log of the feed, in the events directory
+const feedFile = "changes.log"
+
+var ErrFeedExpired = errors.New("events after the requested sequence are no longer retained")
+
+// Change is an event of the feed, numbered by a sequence shared by all buckets
+type Change struct {
+	Sequence uint64 `json:"seq"`
+	Record   Record `json:"record"`
+}
+
+// Feed is the bounded log of the latest events, which subscribers read
+// from any retained sequence number onwards. At least the configured number
+// of events is kept, in memory and in an append-only file, and both are cut
+// back to that number once they hold twice as many.
+type Feed struct {
+	path string
+	size int
+	sync bool
+
+	mu      sync.Mutex
+	f       *os.File
+	lines   int      // records in the file
+	changes []Change // retained, in sequence order
+	last    uint64
+	updated chan struct{} // closed on the next append
+}
+
+// OpenFeed loads the change log of the events directory dir, retaining the
+// latest size events
+func OpenFeed(dir string, size int, sync bool) (*Feed, error) {
+	feed := &Feed{
+		path:    filepath.Join(dir, feedFile),
+		size:    size,
+		sync:    sync,
+		updated: make(chan struct{}),
+	}
+
+	f, err := os.OpenFile(feed.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, core.FilePerm)
+	if err != nil {
+		return nil, err
+	}
+	feed.f = f
+
+	var valid int64
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		valid += int64(len(line))
+
+		var change Change
+		if err := json.Unmarshal(line, &change); err != nil || change.Sequence <= feed.last {
+			continue
+		}
+		feed.lines++
+		feed.retain(change)
+	}
+
+	// A last line without a newline was cut short by a crash
+	if err := f.Truncate(valid); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return feed, nil
+}
+
+// Close closes the change log
+func (feed *Feed) Close() error {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+	return feed.f.Close()
+}
+
+// Append numbers a new event, records it and wakes up the subscribers.
+// record builds the event from its sequence number. The event is retained
+// in memory even if writing it fails.
+func (feed *Feed) Append(record func(sequence uint64) Record) (Change, error) {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+
+	change := Change{Sequence: feed.last + 1}
+	change.Record = record(change.Sequence)
+	feed.retain(change)
+
+	close(feed.updated)
+	feed.updated = make(chan struct{})
+
+	return change, feed.write(change)
+}
+
+// retain adds change to the events in memory, dropping the oldest ones
+// once there are twice as many as need retaining
+func (feed *Feed) retain(change Change) {
+	feed.changes = append(feed.changes, change)
+	if len(feed.changes) >= 2*feed.size {
+		feed.changes = append(feed.changes[:0:0], feed.changes[len(feed.changes)-feed.size:]...)
+	}
+	feed.last = change.Sequence
+}
+
+// write appends change to the file, rewriting it with only the retained
+// events once it has grown to twice their number. The caller holds the lock.
+func (feed *Feed) write(change Change) error {
+	if feed.lines >= 2*feed.size {
+		return feed.rewrite()
+	}
+
+	line, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	if _, err := feed.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	feed.lines++
+	if feed.sync {
+		return feed.f.Sync()
+	}
+	return nil
+}
+
+// rewrite replaces the file with the latest events
+func (feed *Feed) rewrite() error {
+	tmp, err := os.CreateTemp(filepath.Dir(feed.path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	latest := feed.changes[max(len(feed.changes)-feed.size, 0):]
+	for _, change := range latest {
+		line, err := json.Marshal(change)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		w.Write(append(line, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), feed.path); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(feed.path, os.O_RDWR|os.O_APPEND, core.FilePerm)
+	if err != nil {
+		return err
+	}
+	feed.f.Close()
+	feed.f = f
+	feed.lines = len(latest)
+	return nil
+}
+
+// Last returns the sequence number of the latest event, 0 if there is none
+func (feed *Feed) Last() uint64 {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+	return feed.last
+}
+
+// Since returns up to limit events of bucket, whose key starts with prefix,
+// numbered after the sequence after. next is the sequence to pass as after
+// to continue, past events of other buckets that were skipped, and updated
+// is closed when the next event is appended. It fails with ErrFeedExpired
+// when events after after are no longer retained. A limit of 0 means no
+// limit.
+func (feed *Feed) Since(after uint64, bucket, prefix string, limit int) (changes []Change, next uint64, updated <-chan struct{}, err error) {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+
+	if len(feed.changes) > 0 && after+1 < feed.changes[0].Sequence {
+		return nil, after, nil, ErrFeedExpired
+	}
+
+	i := sort.Search(len(feed.changes), func(i int) bool {
+		return feed.changes[i].Sequence > after
+	})
+
+	next = after
+	for _, change := range feed.changes[i:] {
+		if limit > 0 && len(changes) == limit {
+			break
+		}
+		if change.Record.S3.Bucket.Name == bucket && strings.HasPrefix(objectKey(change.Record), prefix) {
+			changes = append(changes, change)
+		}
+		next = change.Sequence
+	}
+	return changes, next, feed.updated, nil
+}
+
+// objectKey returns the decoded key of the object of record
+func objectKey(record Record) string {
+	key, err := url.QueryUnescape(record.S3.Object.Key)
+	if err != nil {
+		return record.S3.Object.Key
+	}
+	return key
+}
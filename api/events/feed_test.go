@@ -0,0 +1,138 @@
+package events
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+)
+
+func openTestFeed(t *testing.T, dir string, size int) *Feed {
+	t.Helper()
+	feed, err := OpenFeed(dir, size, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { feed.Close() })
+	return feed
+}
+
+// appendEvents appends an event on each key of bucket
+func appendEvents(t *testing.T, feed *Feed, bucket string, keys ...string) {
+	t.Helper()
+	for _, key := range keys {
+		_, err := feed.Append(func(sequence uint64) Record {
+			return NewRecord(core.EventObjectCreatedPut, bucket, core.Object{Name: key}, sequence)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func sequences(changes []Change) []uint64 {
+	seqs := []uint64{}
+	for _, change := range changes {
+		seqs = append(seqs, change.Sequence)
+	}
+	return seqs
+}
+
+func TestFeedSince(t *testing.T) {
+	feed := openTestFeed(t, t.TempDir(), 100)
+	appendEvents(t, feed, "photos", "a/1", "b/1")
+	appendEvents(t, feed, "videos", "a/1")
+	appendEvents(t, feed, "photos", "a/2", "a/3")
+
+	tests := []struct {
+		name   string
+		after  uint64
+		prefix string
+		limit  int
+		want   []uint64
+		next   uint64
+	}{
+		{"from the start", 0, "", 0, []uint64{1, 2, 4, 5}, 5},
+		{"resumed", 2, "", 0, []uint64{4, 5}, 5},
+		{"up to date", 5, "", 0, []uint64{}, 5},
+		{"prefix", 0, "a/", 0, []uint64{1, 4, 5}, 5},
+		// The cursor stops at the last event returned, the rest follow
+		{"limited", 0, "", 2, []uint64{1, 2}, 2},
+		{"limited past other buckets", 2, "", 1, []uint64{4}, 4},
+		{"limited after skipped keys", 1, "a/", 1, []uint64{4}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changes, next, updated, err := feed.Since(tt.after, "photos", tt.prefix, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sequences(changes); !slices.Equal(got, tt.want) || next != tt.next {
+				t.Errorf("Since() = %v, next %d, want %v, next %d", got, next, tt.want, tt.next)
+			}
+			select {
+			case <-updated:
+				t.Error("updated closed without a new event")
+			default:
+			}
+		})
+	}
+
+	// Waiting subscribers are woken up by the next event
+	_, _, updated, _ := feed.Since(5, "photos", "", 0)
+	appendEvents(t, feed, "videos", "b")
+	select {
+	case <-updated:
+	default:
+		t.Error("updated not closed by a new event")
+	}
+}
+
+func TestFeedExpired(t *testing.T) {
+	feed := openTestFeed(t, t.TempDir(), 2)
+	appendEvents(t, feed, "photos", "1", "2", "3", "4", "5")
+
+	// Cut back to 2 once there were 4, events 3 to 5 are retained
+	for after := uint64(0); after <= 5; after++ {
+		changes, _, _, err := feed.Since(after, "photos", "", 0)
+		if after < 2 && !errors.Is(err, ErrFeedExpired) {
+			t.Errorf("Since(%d) = %v, want %v", after, err, ErrFeedExpired)
+		}
+		if after >= 2 && (err != nil || len(changes) != int(5-after)) {
+			t.Errorf("Since(%d) = %v, %v, want %d events", after, sequences(changes), err, 5-after)
+		}
+	}
+}
+
+func TestFeedReopen(t *testing.T) {
+	dir := t.TempDir()
+	feed := openTestFeed(t, dir, 3)
+	appendEvents(t, feed, "photos", "1", "2", "3", "4", "5", "6", "7")
+	feed.Close()
+
+	// A record cut short by a crash is dropped
+	f, err := os.OpenFile(filepath.Join(dir, feedFile), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":8,"rec`)
+	f.Close()
+
+	feed = openTestFeed(t, dir, 3)
+	if last := feed.Last(); last != 7 {
+		t.Fatalf("Last() = %d, want 7", last)
+	}
+	// A client resumes where it left off, and numbering goes on
+	changes, next, _, err := feed.Since(5, "photos", "", 0)
+	if err != nil || !slices.Equal(sequences(changes), []uint64{6, 7}) || next != 7 {
+		t.Errorf("Since(5) = %v, %d, %v, want [6 7]", sequences(changes), next, err)
+	}
+	appendEvents(t, feed, "photos", "8")
+	changes, _, _, _ = feed.Since(7, "photos", "", 0)
+	if !slices.Equal(sequences(changes), []uint64{8}) || objectKey(changes[0].Record) != "8" {
+		t.Errorf("Since(7) = %v, want the new event 8", changes)
+	}
+}
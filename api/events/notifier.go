@@ -0,0 +1,334 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+)
+
+// Subdirectories of the events directory
+const (
+	outboxDir = "outbox" // deliveries still to be attempted
+	failedDir = "failed" // deliveries that ran out of attempts, kept for inspection
+)
+
+// Longest wait between two attempts of a delivery
+const maxRetryInterval = time.Hour
+
+// Notifier publishes object events. It is safe for concurrent use.
+type Notifier struct {
+	dir    string
+	cfg    core.EventsConfig
+	sync   bool
+	client *http.Client
+
+	logMu    sync.Mutex
+	eventLog *os.File
+
+	feed  *Feed
+	names atomic.Uint64 // makes outbox file names unique
+	wake  chan struct{}
+}
+
+// delivery is a notification waiting in the outbox for a webhook
+type delivery struct {
+	Bucket      string          `json:"bucket"`
+	Webhook     string          `json:"webhook"`
+	Endpoint    string          `json:"endpoint"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	LastError   string          `json:"last_error,omitempty"`
+	Payload     json.RawMessage `json:"payload"`
+}
+
+// Open prepares the outbox of the data directory dir and opens the change
+// feed and the event log, if one is configured. Outbox files and the feed
+// are synced to disk when sync is set.
+func Open(dir string, cfg core.EventsConfig, sync bool) (*Notifier, error) {
+	n := &Notifier{
+		dir:    filepath.Join(dir, core.EventsDir),
+		cfg:    cfg,
+		sync:   sync,
+		client: &http.Client{Timeout: time.Duration(cfg.Timeout)},
+		wake:   make(chan struct{}, 1),
+	}
+	for _, sub := range []string{outboxDir, failedDir} {
+		if err := os.MkdirAll(filepath.Join(n.dir, sub), core.DirPerm); err != nil {
+			return nil, err
+		}
+	}
+
+	feed, err := OpenFeed(n.dir, cfg.FeedSize, sync)
+	if err != nil {
+		return nil, fmt.Errorf("event feed: %w", err)
+	}
+	n.feed = feed
+
+	if cfg.LogFile != "" {
+		f, err := os.OpenFile(cfg.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, core.FilePerm)
+		if err != nil {
+			feed.Close()
+			return nil, fmt.Errorf("event log: %w", err)
+		}
+		n.eventLog = f
+	}
+	return n, nil
+}
+
+// Close closes the change feed and the event log
+func (n *Notifier) Close() error {
+	err := n.feed.Close()
+	if n.eventLog != nil {
+		err = errors.Join(err, n.eventLog.Close())
+	}
+	return err
+}
+
+// Feed returns the change feed of the events
+func (n *Notifier) Feed() *Feed {
+	return n.feed
+}
+
+// Publish records an event on object of bucket in the change feed and the
+// event log, and queues its delivery to the matching webhooks of the
+// bucket. The sequence number of the event in the feed is its sequencer.
+// The event happened already, so an error only means it was not recorded
+// everywhere.
+func (n *Notifier) Publish(bucket core.Bucket, eventName string, object core.Object) error {
+	var errs []error
+	change, err := n.feed.Append(func(sequence uint64) Record {
+		return NewRecord(eventName, bucket.Name, object, sequence)
+	})
+	if err != nil {
+		errs = append(errs, fmt.Errorf("event feed: %w", err))
+	}
+	record := change.Record
+
+	if err := n.appendLog(record); err != nil {
+		errs = append(errs, fmt.Errorf("event log: %w", err))
+	}
+
+	queued := false
+	for _, webhook := range bucket.Notifications {
+		if !Matches(webhook, eventName, object.Name) {
+			continue
+		}
+		record.S3.ConfigurationID = webhook.ID
+		payload, err := json.Marshal(Payload{Records: []Record{record}})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		d := delivery{
+			Bucket:      bucket.Name,
+			Webhook:     webhook.ID,
+			Endpoint:    webhook.Endpoint,
+			NextAttempt: time.Now(),
+			Payload:     payload,
+		}
+		name := fmt.Sprintf("%020d-%06d.json", time.Now().UnixNano(), n.names.Add(1)%1000000)
+		if err := n.writeDelivery(filepath.Join(n.dir, outboxDir, name), d); err != nil {
+			errs = append(errs, fmt.Errorf("webhook %s: %w", webhook.ID, err))
+			continue
+		}
+		queued = true
+	}
+
+	if queued {
+		select {
+		case n.wake <- struct{}{}:
+		default:
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (n *Notifier) appendLog(record Record) error {
+	if n.eventLog == nil {
+		return nil
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	n.logMu.Lock()
+	defer n.logMu.Unlock()
+	_, err = n.eventLog.Write(append(line, '\n'))
+	return err
+}
+
+// Run delivers the notifications of the outbox, including the ones left by
+// a previous run, until the process exits. Deliveries that fail are retried
+// with an exponential backoff, and moved to the failed directory after the
+// configured number of attempts. Notifications may arrive out of order; the
+// sequencer of their records orders the events of a key.
+func (n *Notifier) Run() {
+	timer := time.NewTimer(0)
+	for {
+		next := n.deliverDue()
+
+		wait := maxRetryInterval
+		if !next.IsZero() {
+			wait = max(time.Until(next), 0)
+		}
+		// Reset discards a pending expiry since Go 1.23
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-n.wake:
+		}
+	}
+}
+
+// deliverDue attempts every delivery that is due and returns the time the
+// next one is, zero if the outbox is empty
+func (n *Notifier) deliverDue() (next time.Time) {
+	outbox := filepath.Join(n.dir, outboxDir)
+	entries, err := os.ReadDir(outbox)
+	if err != nil {
+		slog.Error("reading the event outbox failed", "error", err)
+		return time.Now().Add(time.Duration(n.cfg.RetryInterval))
+	}
+
+	// Names start with the time of the event, so this is the order they happened in
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".json") {
+			names = append(names, entry.Name())
+		}
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		path := filepath.Join(outbox, name)
+		d, err := readDelivery(path)
+		if err != nil {
+			slog.Error("moving unreadable event delivery aside", "path", path, "error", err)
+			os.Rename(path, filepath.Join(n.dir, failedDir, name))
+			continue
+		}
+
+		if d.NextAttempt.After(time.Now()) {
+			if next.IsZero() || d.NextAttempt.Before(next) {
+				next = d.NextAttempt
+			}
+			continue
+		}
+
+		if retry := n.attempt(path, name, d); !retry.IsZero() && (next.IsZero() || retry.Before(next)) {
+			next = retry
+		}
+	}
+	return next
+}
+
+// attempt posts a delivery to its webhook and returns when it is to be
+// retried, zero when it is done with
+func (n *Notifier) attempt(path, name string, d delivery) time.Time {
+	logger := slog.With("bucket", d.Bucket, "webhook", d.Webhook, "endpoint", d.Endpoint)
+
+	err := n.post(d)
+	if err == nil {
+		if err := os.Remove(path); err != nil {
+			logger.Error("removing delivered event failed", "error", err)
+		}
+		logger.Debug("event delivered", "attempts", d.Attempts+1)
+		return time.Time{}
+	}
+
+	d.Attempts++
+	d.LastError = err.Error()
+	if d.Attempts >= n.cfg.MaxAttempts {
+		logger.Error("event delivery failed, giving up", "attempts", d.Attempts, "error", err)
+		if err := n.writeDelivery(filepath.Join(n.dir, failedDir, name), d); err != nil {
+			logger.Error("recording failed event delivery failed", "error", err)
+			return time.Now().Add(time.Duration(n.cfg.RetryInterval))
+		}
+		os.Remove(path)
+		return time.Time{}
+	}
+
+	backoff := time.Duration(n.cfg.RetryInterval)
+	for i := 1; i < d.Attempts && backoff < maxRetryInterval; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, maxRetryInterval)
+	d.NextAttempt = time.Now().Add(backoff)
+	logger.Warn("event delivery failed, retrying", "attempts", d.Attempts, "retry_in", backoff, "error", err)
+	if err := n.writeDelivery(path, d); err != nil {
+		logger.Error("updating event delivery failed", "error", err)
+	}
+	return d.NextAttempt
+}
+
+func (n *Notifier) post(d delivery) error {
+	req, err := http.NewRequest(http.MethodPost, d.Endpoint, bytes.NewReader(d.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "triple-s/"+core.Version)
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("webhook responded " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
+
+// writeDelivery replaces the file at path with d atomically
+func (n *Notifier) writeDelivery(path string, d delivery) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if n.sync {
+		if err := tmp.Sync(); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func readDelivery(path string) (delivery, error) {
+	var d delivery
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return d, err
+	}
+	return d, json.Unmarshal(data, &d)
+}
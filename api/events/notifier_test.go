@@ -0,0 +1,205 @@
+package events
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+)
+
+// webhook records the payloads posted to it, failing the first fail posts
+type webhook struct {
+	*httptest.Server
+	mu       sync.Mutex
+	fail     int
+	posts    int
+	payloads []Payload
+}
+
+func newWebhook(t *testing.T, fail int) *webhook {
+	t.Helper()
+	wh := &webhook{fail: fail}
+	wh.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wh.mu.Lock()
+		defer wh.mu.Unlock()
+		wh.posts++
+		if wh.posts <= wh.fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var payload Payload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("webhook got an invalid payload: %v", err)
+		}
+		wh.payloads = append(wh.payloads, payload)
+	}))
+	t.Cleanup(wh.Close)
+	return wh
+}
+
+func openTestNotifier(t *testing.T, dir string, maxAttempts int, retry time.Duration) *Notifier {
+	t.Helper()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	n, err := Open(dir, core.EventsConfig{MaxAttempts: maxAttempts, RetryInterval: core.Duration(retry), Timeout: core.Duration(time.Second), FeedSize: 10}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { n.Close() })
+	return n
+}
+
+func publish(t *testing.T, n *Notifier, endpoint string) {
+	t.Helper()
+	bucket := core.Bucket{Name: "photos", Notifications: []core.Webhook{
+		{ID: "uploads", Endpoint: endpoint, Events: []string{"s3:ObjectCreated:*"}},
+		{ID: "deletes", Endpoint: endpoint, Events: []string{"s3:ObjectRemoved:*"}},
+	}}
+	if err := n.Publish(bucket, core.EventObjectCreatedPut, core.Object{Name: "a.txt", ContentLength: "4"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// queued returns the deliveries in a directory of the outbox
+func queued(t *testing.T, n *Notifier, sub string) []delivery {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(n.dir, sub, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var deliveries []delivery
+	for _, path := range paths {
+		d, err := readDelivery(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries
+}
+
+// drain delivers until the outbox is empty
+func drain(t *testing.T, n *Notifier) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		next := n.deliverDue()
+		if next.IsZero() {
+			return
+		}
+		time.Sleep(time.Until(next))
+	}
+	t.Fatal("outbox not drained")
+}
+
+func TestDeliveryRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		fail      int // failed posts before the webhook recovers
+		delivered bool
+	}{
+		{"first attempt", 0, true},
+		{"after retries", 2, true},
+		{"out of attempts", 3, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wh := newWebhook(t, tt.fail)
+			n := openTestNotifier(t, t.TempDir(), 3, time.Millisecond)
+			publish(t, n, wh.URL)
+			if d := queued(t, n, outboxDir); len(d) != 1 || d[0].Webhook != "uploads" {
+				t.Fatalf("outbox = %+v, want the delivery of the matching webhook", d)
+			}
+
+			drain(t, n)
+
+			failed := queued(t, n, failedDir)
+			if tt.delivered {
+				if len(wh.payloads) != 1 || len(failed) != 0 {
+					t.Fatalf("delivered %d payloads, %d failed, want 1 delivered", len(wh.payloads), len(failed))
+				}
+				record := wh.payloads[0].Records[0]
+				if record.S3.ConfigurationID != "uploads" || record.S3.Object.Key != "a.txt" || record.EventName != "ObjectCreated:Put" {
+					t.Errorf("record = %+v", record)
+				}
+				return
+			}
+			if len(wh.payloads) != 0 || len(failed) != 1 {
+				t.Fatalf("delivered %d payloads, %d failed, want 1 failed", len(wh.payloads), len(failed))
+			}
+			if failed[0].Attempts != 3 || failed[0].LastError != "webhook responded 503" {
+				t.Errorf("failed delivery = %+v", failed[0])
+			}
+		})
+	}
+}
+
+func TestDeliveryBackoff(t *testing.T) {
+	wh := newWebhook(t, 100)
+	n := openTestNotifier(t, t.TempDir(), 100, time.Minute)
+	publish(t, n, wh.URL)
+
+	// The wait doubles after every failed attempt, up to maxRetryInterval
+	for attempts, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 16 * time.Minute, 32 * time.Minute, time.Hour, time.Hour} {
+		paths, _ := filepath.Glob(filepath.Join(n.dir, outboxDir, "*.json"))
+		if len(paths) != 1 {
+			t.Fatalf("%d deliveries queued, want 1", len(paths))
+		}
+		d, err := readDelivery(paths[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Attempts != attempts {
+			t.Fatalf("Attempts = %d, want %d", d.Attempts, attempts)
+		}
+
+		start := time.Now()
+		next := n.attempt(paths[0], filepath.Base(paths[0]), d)
+		if wait := next.Sub(start); wait < want || wait > want+time.Second {
+			t.Errorf("retry %d in %s, want %s", attempts+1, wait, want)
+		}
+	}
+}
+
+func TestDeliveryNotDue(t *testing.T) {
+	wh := newWebhook(t, 1)
+	n := openTestNotifier(t, t.TempDir(), 3, time.Hour)
+	publish(t, n, wh.URL)
+
+	next := n.deliverDue()
+	if until := time.Until(next); until < 59*time.Minute {
+		t.Fatalf("next attempt in %s, want an hour", until)
+	}
+	// Nothing is due before then
+	if again := n.deliverDue(); !again.Equal(next) || wh.posts != 1 {
+		t.Errorf("deliverDue() = %s after %d posts, want %s after 1", again, wh.posts, next)
+	}
+}
+
+func TestDeliveryAcrossRestarts(t *testing.T) {
+	// Deliveries queued before a restart are delivered by the next run, and
+	// unreadable ones are moved aside
+	dir := t.TempDir()
+	wh := newWebhook(t, 0)
+	n := openTestNotifier(t, dir, 3, time.Millisecond)
+	publish(t, n, wh.URL)
+	if err := os.WriteFile(filepath.Join(n.dir, outboxDir, "00000000000000000000-000000.json"), []byte("{"), core.FilePerm); err != nil {
+		t.Fatal(err)
+	}
+	n.Close()
+
+	n = openTestNotifier(t, dir, 3, time.Millisecond)
+	drain(t, n)
+	if len(wh.payloads) != 1 {
+		t.Errorf("delivered %d payloads, want 1", len(wh.payloads))
+	}
+	if _, err := os.Stat(filepath.Join(n.dir, failedDir, "00000000000000000000-000000.json")); err != nil {
+		t.Errorf("unreadable delivery not moved aside: %v", err)
+	}
+}
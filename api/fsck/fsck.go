@@ -0,0 +1,429 @@
+// Package fsck checks that the metadata of a data directory matches the
+// files in it, and reconciles the two.
+package fsck
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/meta"
+	"github.com/ab-dauletkhan/triple-s/api/storage"
+	"github.com/ab-dauletkhan/triple-s/api/util"
+)
+
+// Kinds of inconsistencies
+const (
+	KindInterrupted   = "interrupted_operation" // journaled operation that did not finish
+	KindOrphanBucket  = "orphan_bucket"         // bucket directory without a bucket record
+	KindMissingBucket = "missing_bucket_dir"    // bucket record without its directory
+	KindMissingData   = "missing_data"          // object record without its data
+	KindUnreachable   = "unreachable_data"      // object data on a directory missing or offline
+	KindUnreadable    = "unreadable_data"       // object data that cannot be read back
+	KindSizeMismatch  = "size_mismatch"         // ContentLength differs from the stored content
+	KindOrphanFile    = "orphan_file"           // object file without an object record
+	KindStaleFile     = "stale_file"            // object file of an object stored elsewhere
+	KindStaleTemp     = "stale_temp"            // temporary file left by an interrupted write
+	KindUnknownFile   = "unknown_file"          // file that triple-s did not write
+	KindReservedName  = "reserved_bucket_name"  // bucket named like a server endpoint
+)
+
+var ErrNoDir = errors.New("data directory does not exist")
+
+// Issue is one inconsistency found in the data directory
+type Issue struct {
+	Kind     string `json:"kind"`
+	Bucket   string `json:"bucket,omitempty"`
+	Key      string `json:"key,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Detail   string `json:"detail"`
+	Repaired bool   `json:"repaired"`
+}
+
+// Report is the outcome of a check
+type Report struct {
+	Dir     string  `json:"dir"`
+	Repair  bool    `json:"repair"`
+	Buckets int     `json:"buckets"`
+	Objects int     `json:"objects"`
+	Issues  []Issue `json:"issues"`
+}
+
+// Unresolved returns the number of issues that were not repaired
+func (r *Report) Unresolved() int {
+	n := 0
+	for _, issue := range r.Issues {
+		if !issue.Repaired {
+			n++
+		}
+	}
+	return n
+}
+
+// WriteText writes the report in a human readable form
+func (r *Report) WriteText(w io.Writer) error {
+	for _, issue := range r.Issues {
+		location := issue.Path
+		if location == "" {
+			location = issue.Bucket
+			if issue.Key != "" {
+				location += "/" + issue.Key
+			}
+		}
+
+		status := ""
+		if issue.Repaired {
+			status = " (repaired)"
+		}
+		if _, err := fmt.Fprintf(w, "%s: %s: %s%s\n", location, issue.Kind, issue.Detail, status); err != nil {
+			return err
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "checked %d buckets and %d objects in %s: %d issues, %d repaired\n",
+		r.Buckets, r.Objects, r.Dir, len(r.Issues), len(r.Issues)-r.Unresolved())
+	return err
+}
+
+// checker holds the state of one run
+type checker struct {
+	dir    string
+	repair bool
+	meta   *meta.Store
+	store  *storage.Store
+	report *Report
+}
+
+// Check scans dir and reports every inconsistency between the metadata and
+// the files. With repair, the data directory must not be in use: interrupted
+// operations are recovered first, then the issues are fixed where possible.
+// Orphan files and bucket directories are indexed, records without data are
+// dropped and wrong sizes are corrected. Records whose data directory is
+// missing or offline are only reported.
+func Check(dir string, repair bool) (*Report, error) {
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("%w: %s", ErrNoDir, dir)
+	}
+
+	// Erasure coded objects are read from the disks recorded in the data
+	// directory
+	store, err := storage.New(&core.Config{Dir: dir})
+	if err != nil {
+		return nil, err
+	}
+
+	c := &checker{
+		dir:    dir,
+		repair: repair,
+		store:  store,
+		report: &Report{Dir: dir, Repair: repair, Issues: []Issue{}},
+	}
+
+	if repair {
+		// Recovers the journal, the operations are not reported
+		if err := util.InitDir(dir); err != nil {
+			return nil, err
+		}
+		c.meta, err = meta.Open(dir, core.MetadataConfig{Sync: true})
+	} else {
+		err = c.checkJournal()
+		if err == nil {
+			c.meta, err = meta.Load(dir)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Closing writes the repaired metadata to the snapshots
+	if err := errors.Join(c.run(), c.meta.Close()); err != nil {
+		return nil, err
+	}
+	return c.report, nil
+}
+
+func (c *checker) run() error {
+	if err := c.checkBucketDirs(); err != nil {
+		return err
+	}
+	for _, bucket := range c.meta.Buckets() {
+		c.report.Buckets++
+		if err := c.checkObjects(bucket.Name); err != nil {
+			return err
+		}
+		if err := c.checkDataFiles(bucket.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *checker) add(issue Issue) {
+	c.report.Issues = append(c.report.Issues, issue)
+}
+
+// fix runs a repair step when repairing and records the issue
+func (c *checker) fix(issue Issue, repair func() error) {
+	if c.repair {
+		if err := repair(); err != nil {
+			issue.Detail += ", repair failed: " + err.Error()
+		} else {
+			issue.Repaired = true
+		}
+	}
+	c.add(issue)
+}
+
+func (c *checker) checkJournal() error {
+	pending, err := util.PendingOperations(c.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range pending {
+		c.add(Issue{
+			Kind:   KindInterrupted,
+			Bucket: entry.Bucket,
+			Key:    entry.Key,
+			Detail: entry.Op + " did not finish, it is recovered on the next start",
+		})
+	}
+	return nil
+}
+
+// checkBucketDirs compares the top level of the data directory with the bucket records
+func (c *checker) checkBucketDirs() error {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+
+	onDisk := make(map[string]bool)
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(c.dir, name)
+		switch {
+		case name == core.BucketsFile || name == core.MetaLogFile || name == core.JournalFile ||
+			name == core.FormatFile || name == core.BlobsDir || name == core.BackupsDir || name == core.EventsDir ||
+			name == core.ReplicationDir || name == core.ErasureFile || name == core.CatalogFile ||
+			name == core.ClusterMarkersFile:
+			continue
+		case strings.HasPrefix(name, ".tmp-") || strings.HasPrefix(name, ".readyz-"):
+			c.fix(Issue{Kind: KindStaleTemp, Path: path, Detail: "temporary file"}, func() error {
+				return os.Remove(path)
+			})
+			continue
+		case !entry.IsDir() || (util.ValidateBucketName(name) != nil && !util.ReservedBucketName(name)):
+			c.add(Issue{Kind: KindUnknownFile, Path: path, Detail: "not a bucket directory"})
+			continue
+		}
+
+		onDisk[name] = true
+		if _, ok := c.meta.Bucket(name); !ok {
+			c.fix(Issue{Kind: KindOrphanBucket, Bucket: name, Detail: "directory has no bucket record"}, func() error {
+				return c.indexBucket(name)
+			})
+		}
+	}
+
+	for _, bucket := range c.meta.Buckets() {
+		if util.ReservedBucketName(bucket.Name) {
+			// Renaming the bucket is left to its owner, who knows its clients
+			c.add(Issue{Kind: KindReservedName, Bucket: bucket.Name,
+				Detail: "bucket name is reserved by the server, the bucket is only reachable with admin_port set"})
+		}
+		if !onDisk[bucket.Name] {
+			c.fix(Issue{Kind: KindMissingBucket, Bucket: bucket.Name, Detail: "bucket directory is missing"}, func() error {
+				return util.InitObjectFile(c.dir, bucket.Name)
+			})
+		}
+	}
+	return nil
+}
+
+// indexBucket records an orphan bucket directory as a bucket, along with
+// the objects listed in its objects.csv
+func (c *checker) indexBucket(name string) error {
+	info, err := os.Stat(filepath.Join(c.dir, name))
+	if err != nil {
+		return err
+	}
+
+	var batch meta.Batch
+	batch.PutBucket(core.Bucket{
+		Name:         name,
+		Status:       core.BucketActive,
+		CreationDate: info.ModTime().Format(time.RFC3339Nano),
+		LastUpdated:  time.Now().Format(time.RFC3339Nano),
+	})
+	objectsData, err := meta.ReadObjectsFile(c.dir, name)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for _, object := range objectsData.List {
+		batch.PutObject(name, object)
+	}
+
+	if err := c.meta.Apply(&batch); err != nil {
+		return err
+	}
+	return util.InitObjectFile(c.dir, name)
+}
+
+// checkObjects reads back the data of every object record of a bucket
+func (c *checker) checkObjects(bucket string) error {
+	objects, _, err := c.meta.List(bucket, "", "", 0)
+	if err != nil {
+		return err
+	}
+
+	for _, object := range objects {
+		c.report.Objects++
+		size, err := c.contentSize(bucket, object)
+		if err != nil {
+			// An unmounted directory is not repaired, its objects are
+			// still there
+			if unreachable := c.store.Reachable(bucket, object); unreachable != nil {
+				c.add(Issue{Kind: KindUnreachable, Bucket: bucket, Key: object.Name, Detail: unreachable.Error()})
+				continue
+			}
+		}
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			c.fix(Issue{Kind: KindMissingData, Bucket: bucket, Key: object.Name, Detail: "object data is missing"}, func() error {
+				_, err := c.meta.DeleteObject(bucket, object.Name)
+				return err
+			})
+		case err != nil:
+			c.add(Issue{Kind: KindUnreadable, Bucket: bucket, Key: object.Name, Detail: err.Error()})
+		case strconv.FormatInt(size, 10) != object.ContentLength:
+			detail := fmt.Sprintf("ContentLength is %q, content has %d bytes", object.ContentLength, size)
+			c.fix(Issue{Kind: KindSizeMismatch, Bucket: bucket, Key: object.Name, Detail: detail}, func() error {
+				object.ContentLength = strconv.FormatInt(size, 10)
+				_, _, err := c.meta.PutObject(bucket, object)
+				return err
+			})
+		}
+	}
+	return nil
+}
+
+// contentSize returns the size of the content of an object as uploaded
+func (c *checker) contentSize(bucket string, object core.Object) (int64, error) {
+	r, err := c.store.Open(bucket, object)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	return io.Copy(io.Discard, r)
+}
+
+// checkDataFiles looks for object files that no record points at
+func (c *checker) checkDataFiles(bucket string) error {
+	dataDir := util.ObjectDataDir(c.store.BucketDir(bucket), bucket)
+	err := filepath.WalkDir(dataDir, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) && path == dataDir {
+			return filepath.SkipDir
+		}
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+
+		remove := func() error {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			util.RemoveEmptyDirs(filepath.Dir(path), dataDir)
+			return nil
+		}
+
+		if strings.HasPrefix(d.Name(), ".upload-") {
+			c.fix(Issue{Kind: KindStaleTemp, Bucket: bucket, Path: path, Detail: "interrupted upload"}, remove)
+			return nil
+		}
+
+		// Restored copies of cold objects are named after the key and digest
+		rel, _ := filepath.Rel(dataDir, path)
+		rel, digest, restoredCopy := strings.Cut(rel, ".")
+		key, err := util.ObjectKeyFromPath(rel)
+		if err != nil {
+			c.add(Issue{Kind: KindUnknownFile, Bucket: bucket, Path: path, Detail: err.Error()})
+			return nil
+		}
+
+		object, err := c.meta.Object(bucket, key)
+		switch {
+		case errors.Is(err, meta.ErrNoSuchKey) && restoredCopy:
+			c.fix(Issue{Kind: KindStaleFile, Bucket: bucket, Key: key, Detail: "restored copy of a deleted object"}, remove)
+		case errors.Is(err, meta.ErrNoSuchKey):
+			c.fix(Issue{Kind: KindOrphanFile, Bucket: bucket, Key: key, Detail: "object file has no record"}, func() error {
+				return c.indexFile(bucket, key, path)
+			})
+		case err != nil:
+			return err
+		case restoredCopy:
+			if object.Storage != storage.KindCold || object.RestoreExpiryDate == "" || !strings.HasPrefix(object.Digest, digest) {
+				c.fix(Issue{Kind: KindStaleFile, Bucket: bucket, Key: key, Detail: "object is not restored"}, remove)
+			}
+		case object.Storage == storage.KindBlob:
+			c.fix(Issue{Kind: KindStaleFile, Bucket: bucket, Key: key, Detail: "object is stored as a blob"}, remove)
+		case object.Storage == storage.KindCold:
+			c.fix(Issue{Kind: KindStaleFile, Bucket: bucket, Key: key, Detail: "object is stored in the cold directory"}, remove)
+		}
+		return nil
+	})
+	if errors.Is(err, filepath.SkipDir) {
+		return nil
+	}
+	return err
+}
+
+// indexFile records an orphan object file as an uncompressed object
+func (c *checker) indexFile(bucket, key, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	md5Hash, sha256Hash := md5.New(), sha256.New()
+	size, err := io.Copy(io.MultiWriter(md5Hash, sha256Hash), f)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = c.meta.PutObject(bucket, core.Object{
+		Name:          key,
+		ContentType:   http.DetectContentType(head[:n]),
+		ContentLength: strconv.FormatInt(size, 10),
+		LastModified:  info.ModTime().Format(time.RFC3339Nano),
+		ETag:          hex.EncodeToString(md5Hash.Sum(nil)),
+		Digest:        hex.EncodeToString(sha256Hash.Sum(nil)),
+		Storage:       storage.KindFile,
+	})
+	return err
+}
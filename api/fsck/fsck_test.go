@@ -0,0 +1,288 @@
+package fsck
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/meta"
+	"github.com/ab-dauletkhan/triple-s/api/storage"
+	"github.com/ab-dauletkhan/triple-s/api/util"
+)
+
+// newDataDir returns a data directory holding the bucket photos, its files
+// placed in bucketDir, with the object kept.txt
+func newDataDir(t *testing.T, bucketDir string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := util.InitDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if bucketDir == "" {
+		bucketDir = dir
+	} else if err := util.WriteCatalog(dir, util.Catalog{Buckets: map[string]string{"photos": bucketDir}}); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := meta.Open(dir, core.MetadataConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.PutBucket(core.Bucket{Name: "photos", Status: core.BucketActive}); err != nil {
+		t.Fatal(err)
+	}
+	if err := util.InitObjectFile(dir, "photos"); err != nil {
+		t.Fatal(err)
+	}
+	putFile(t, store, bucketDir, "kept.txt", "kept")
+	return dir
+}
+
+// putFile stores content as an object file and records it
+func putFile(t *testing.T, store *meta.Store, bucketDir, key, content string) {
+	t.Helper()
+	writeObjectFile(t, bucketDir, key, content)
+	object := core.Object{Name: key, ContentType: "text/plain", ContentLength: strconv.Itoa(len(content)), Storage: storage.KindFile}
+	if _, _, err := store.PutObject("photos", object); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeObjectFile(t *testing.T, bucketDir, key, content string) {
+	t.Helper()
+	path := util.ObjectPath(bucketDir, "photos", key)
+	if err := os.MkdirAll(filepath.Dir(path), core.DirPerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), core.FilePerm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, dir string, store *meta.Store)
+		kind  string
+		// state after a repair, checked on the metadata
+		check func(t *testing.T, store *meta.Store)
+	}{
+		{
+			name: "orphan file",
+			setup: func(t *testing.T, dir string, store *meta.Store) {
+				writeObjectFile(t, dir, "a/orphan.txt", "orphan")
+			},
+			kind: KindOrphanFile,
+			check: func(t *testing.T, store *meta.Store) {
+				object, err := store.Object("photos", "a/orphan.txt")
+				if err != nil || object.ContentLength != "6" || object.ETag == "" || object.Storage != storage.KindFile {
+					t.Errorf("indexed object = %+v, %v", object, err)
+				}
+			},
+		},
+		{
+			name: "orphan bucket",
+			setup: func(t *testing.T, dir string, store *meta.Store) {
+				if err := util.InitObjectFile(dir, "videos"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			kind: KindOrphanBucket,
+			check: func(t *testing.T, store *meta.Store) {
+				if bucket, ok := store.Bucket("videos"); !ok || bucket.Status != core.BucketActive {
+					t.Errorf("indexed bucket = %+v, %v", bucket, ok)
+				}
+			},
+		},
+		{
+			name: "dangling record",
+			setup: func(t *testing.T, dir string, store *meta.Store) {
+				putFile(t, store, dir, "gone.txt", "gone")
+				os.Remove(util.ObjectPath(dir, "photos", "gone.txt"))
+			},
+			kind: KindMissingData,
+			check: func(t *testing.T, store *meta.Store) {
+				if _, err := store.Object("photos", "gone.txt"); err == nil {
+					t.Error("record without data kept")
+				}
+			},
+		},
+		{
+			name: "size mismatch",
+			setup: func(t *testing.T, dir string, store *meta.Store) {
+				writeObjectFile(t, dir, "kept.txt", "longer")
+			},
+			kind: KindSizeMismatch,
+			check: func(t *testing.T, store *meta.Store) {
+				if object, err := store.Object("photos", "kept.txt"); err != nil || object.ContentLength != "6" {
+					t.Errorf("ContentLength = %q, %v, want 6", object.ContentLength, err)
+				}
+			},
+		},
+		{
+			name: "stale upload",
+			setup: func(t *testing.T, dir string, store *meta.Store) {
+				if err := os.WriteFile(filepath.Join(util.ObjectDataDir(dir, "photos"), ".upload-1"), nil, core.FilePerm); err != nil {
+					t.Fatal(err)
+				}
+			},
+			kind:  KindStaleTemp,
+			check: func(t *testing.T, store *meta.Store) {},
+		},
+	}
+	for _, tt := range tests {
+		for _, repair := range []bool{false, true} {
+			name := tt.name
+			if repair {
+				name += " repaired"
+			}
+			t.Run(name, func(t *testing.T) {
+				dir := newDataDir(t, "")
+				store, err := meta.Open(dir, core.MetadataConfig{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				tt.setup(t, dir, store)
+				if err := store.Close(); err != nil {
+					t.Fatal(err)
+				}
+
+				report, err := Check(dir, repair)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(report.Issues) != 1 || report.Issues[0].Kind != tt.kind || report.Issues[0].Repaired != repair {
+					t.Fatalf("issues = %+v, want one %s repaired %v", report.Issues, tt.kind, repair)
+				}
+				if !repair {
+					return
+				}
+
+				store, err = meta.Load(dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				tt.check(t, store)
+				if _, err := store.Object("photos", "kept.txt"); err != nil {
+					t.Errorf("intact object lost: %v", err)
+				}
+
+				// Nothing is left to repair
+				report, err = Check(dir, false)
+				if err != nil || len(report.Issues) != 0 {
+					t.Errorf("check after repair = %+v, %v", report.Issues, err)
+				}
+			})
+		}
+	}
+}
+
+func TestCheckUnreachableDir(t *testing.T) {
+	// The bucket is placed on a directory that is not mounted
+	disk := filepath.Join(t.TempDir(), "disk2")
+	dir := newDataDir(t, disk)
+	if err := os.RemoveAll(disk); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Check(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Issues) != 1 || report.Issues[0].Kind != KindUnreachable || report.Issues[0].Repaired {
+		t.Fatalf("issues = %+v, want one unrepaired %s", report.Issues, KindUnreachable)
+	}
+
+	store, err := meta.Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Object("photos", "kept.txt"); err != nil {
+		t.Errorf("record of an unreachable object dropped: %v", err)
+	}
+
+	// Once the directory is back, the missing file is a dangling record
+	if err := os.MkdirAll(util.ObjectDataDir(disk, "photos"), core.DirPerm); err != nil {
+		t.Fatal(err)
+	}
+	report, err = Check(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Issues) != 1 || report.Issues[0].Kind != KindMissingData {
+		t.Errorf("issues = %+v, want one %s", report.Issues, KindMissingData)
+	}
+}
+
+func TestCheckUnreachableColdDir(t *testing.T) {
+	dir := newDataDir(t, "")
+	cold := filepath.Join(t.TempDir(), "cold")
+	if err := util.WriteCatalog(dir, util.Catalog{Cold: cold}); err != nil {
+		t.Fatal(err)
+	}
+	store, err := meta.Open(dir, core.MetadataConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	object := core.Object{Name: "archived.txt", ContentLength: "4", Digest: "0123456789abcdef", Storage: storage.KindCold, StorageClass: core.StorageCold}
+	if _, _, err := store.PutObject("photos", object); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Check(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Issues) != 1 || report.Issues[0].Kind != KindUnreachable || report.Issues[0].Key != "archived.txt" || report.Issues[0].Repaired {
+		t.Fatalf("issues = %+v, want one unrepaired %s", report.Issues, KindUnreachable)
+	}
+}
+
+func TestCheckReservedBucket(t *testing.T) {
+	dir := newDataDir(t, "")
+	// Created before the name was reserved
+	store, err := meta.Open(dir, core.MetadataConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutBucket(core.Bucket{Name: "metrics", Status: core.BucketActive}); err != nil {
+		t.Fatal(err)
+	}
+	if err := util.InitObjectFile(dir, "metrics"); err != nil {
+		t.Fatal(err)
+	}
+	object := core.Object{Name: "a.txt", ContentType: "text/plain", ContentLength: "7", Storage: storage.KindFile}
+	if _, _, err := store.PutObject("metrics", object); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := util.ObjectPath(dir, "metrics", "a.txt")
+	if err := os.MkdirAll(filepath.Dir(path), core.DirPerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("content"), core.FilePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, repair := range []bool{false, true} {
+		report, err := Check(dir, repair)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Only the name is reported, its directory and objects are those of a bucket
+		if len(report.Issues) != 1 || report.Issues[0].Kind != KindReservedName || report.Issues[0].Repaired {
+			t.Errorf("repair %v: issues = %+v, want one unrepaired %s", repair, report.Issues, KindReservedName)
+		}
+		if report.Buckets != 2 || report.Objects != 2 {
+			t.Errorf("repair %v: checked %d buckets and %d objects, want 2 of each", repair, report.Buckets, report.Objects)
+		}
+	}
+}
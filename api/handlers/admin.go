@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/meta"
+	"github.com/ab-dauletkhan/triple-s/api/storage"
+)
+
+var ErrInvalidQuota = errors.New("quota limits must not be negative")
+
+// GetBucketQuota returns the quota of a bucket
+func (h *Handler) GetBucketQuota(w http.ResponseWriter, r *http.Request) {
+	bucketName := r.PathValue("BucketName")
+	logger := core.Logger(r.Context()).With("bucket", bucketName)
+
+	bucket, ok := h.meta.Bucket(bucketName)
+	if !ok {
+		logger.Info("bucket not found")
+		XMLErrResponse(w, http.StatusNotFound, ErrBucketNotFound.Error())
+		return
+	}
+	XMLResponse(w, http.StatusOK, core.Quota{MaxBytes: bucket.QuotaBytes, MaxObjects: bucket.QuotaObjects})
+}
+
+// PutBucketQuota sets the quota of a bucket from a Quota XML document.
+// Objects already stored are kept even if they exceed the new quota.
+func (h *Handler) PutBucketQuota(w http.ResponseWriter, r *http.Request) {
+	bucketName := r.PathValue("BucketName")
+	logger := core.Logger(r.Context()).With("bucket", bucketName)
+
+	var quota core.Quota
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&quota); err != nil {
+		logger.Info("invalid quota document", "error", err)
+		XMLErrResponse(w, http.StatusBadRequest, "Malformed quota XML")
+		return
+	}
+
+	if quota.MaxBytes < 0 || quota.MaxObjects < 0 {
+		logger.Info("invalid quota", "max_bytes", quota.MaxBytes, "max_objects", quota.MaxObjects)
+		XMLErrResponse(w, http.StatusBadRequest, ErrInvalidQuota.Error())
+		return
+	}
+
+	h.setBucketQuota(w, r, quota)
+}
+
+// DeleteBucketQuota removes the quota of a bucket
+func (h *Handler) DeleteBucketQuota(w http.ResponseWriter, r *http.Request) {
+	h.setBucketQuota(w, r, core.Quota{})
+}
+
+func (h *Handler) setBucketQuota(w http.ResponseWriter, r *http.Request, quota core.Quota) {
+	bucketName := r.PathValue("BucketName")
+	logger := core.Logger(r.Context()).With("bucket", bucketName)
+
+	_, err := h.meta.UpdateBucket(bucketName, func(bucket *core.Bucket) {
+		bucket.QuotaBytes = quota.MaxBytes
+		bucket.QuotaObjects = quota.MaxObjects
+	})
+	if !h.bucketUpdated(w, logger, err) {
+		return
+	}
+
+	logger.Info("bucket quota updated", "max_bytes", quota.MaxBytes, "max_objects", quota.MaxObjects)
+	if r.Method == http.MethodDelete {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	XMLResponse(w, http.StatusOK, quota)
+}
+
+// GetBucketCompression returns the compression applied to new objects of a bucket
+func (h *Handler) GetBucketCompression(w http.ResponseWriter, r *http.Request) {
+	bucketName := r.PathValue("BucketName")
+	logger := core.Logger(r.Context()).With("bucket", bucketName)
+
+	bucket, ok := h.meta.Bucket(bucketName)
+	if !ok {
+		logger.Info("bucket not found")
+		XMLErrResponse(w, http.StatusNotFound, ErrBucketNotFound.Error())
+		return
+	}
+
+	XMLResponse(w, http.StatusOK, core.CompressionConfiguration{Algorithm: bucket.Compression})
+}
+
+// PutBucketCompression enables compression at rest for objects uploaded to
+// a bucket from now on. Stored objects are left as they are.
+func (h *Handler) PutBucketCompression(w http.ResponseWriter, r *http.Request) {
+	logger := core.Logger(r.Context()).With("bucket", r.PathValue("BucketName"))
+
+	var config core.CompressionConfiguration
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&config); err != nil {
+		logger.Info("invalid compression document", "error", err)
+		XMLErrResponse(w, http.StatusBadRequest, "Malformed compression XML")
+		return
+	}
+
+	if !storage.ValidCompression(config.Algorithm) {
+		logger.Info("invalid compression algorithm", "algorithm", config.Algorithm)
+		XMLErrResponse(w, http.StatusBadRequest, storage.ErrUnknownCompression.Error())
+		return
+	}
+
+	h.setBucketCompression(w, r, config)
+}
+
+// DeleteBucketCompression stops compressing new objects of a bucket
+func (h *Handler) DeleteBucketCompression(w http.ResponseWriter, r *http.Request) {
+	h.setBucketCompression(w, r, core.CompressionConfiguration{})
+}
+
+func (h *Handler) setBucketCompression(w http.ResponseWriter, r *http.Request, config core.CompressionConfiguration) {
+	bucketName := r.PathValue("BucketName")
+	logger := core.Logger(r.Context()).With("bucket", bucketName)
+
+	_, err := h.meta.UpdateBucket(bucketName, func(bucket *core.Bucket) {
+		bucket.Compression = config.Algorithm
+	})
+	if !h.bucketUpdated(w, logger, err) {
+		return
+	}
+
+	logger.Info("bucket compression updated", "algorithm", config.Algorithm)
+	if r.Method == http.MethodDelete {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	XMLResponse(w, http.StatusOK, config)
+}
+
+// bucketUpdated reports whether a bucket record was updated, writing the
+// error response when it was not
+func (h *Handler) bucketUpdated(w http.ResponseWriter, logger *slog.Logger, err error) bool {
+	switch {
+	case errors.Is(err, meta.ErrNoSuchBucket):
+		logger.Info("bucket not found")
+		XMLErrResponse(w, http.StatusNotFound, ErrBucketNotFound.Error())
+		return false
+	case err != nil:
+		logger.Error("error updating bucket record", "error", err)
+		XMLErrResponse(w, http.StatusInternalServerError, ErrInternalServer.Error())
+		return false
+	}
+	return true
+}
@@ -2,7 +2,7 @@ package handlers
 
 import (
 	"errors"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/meta"
 	"github.com/ab-dauletkhan/triple-s/api/util"
 )
 
@@ -18,119 +19,210 @@ var (
 	ErrBucketAlreadyExists = errors.New("bucket already exists")
 	ErrBucketNotEmpty      = errors.New("bucket is not empty")
 	ErrInternalServer      = errors.New("internal server error")
+	ErrQuotaExceeded       = errors.New("bucket quota exceeded")
+	ErrLengthRequired      = errors.New("MissingContentLength: uploads to a bucket with a size quota need a Content-Length")
+	ErrEntityTooLarge      = errors.New("object exceeds the maximum allowed size")
 )
 
 // CreateBucket creates a new bucket
 // 1. Extract the bucket name from the URL path
 // 2. Validate the bucket name
-// 3. Read the buckets file
-// 4. Check if the bucket already exists
-// 5. Create a new bucket
-// 6. Write the updated buckets data to the file
+// 3. Check if the bucket already exists
+// 4. Create a new bucket
+// 5. Journal the operation
+// 6. Record the bucket in the metadata store
 // 7. Create a directory for the new bucket
 // 8. Initialize the object file for the new bucket
-func CreateBucket(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) CreateBucket(w http.ResponseWriter, r *http.Request) {
 	bucketName := strings.TrimPrefix(r.URL.Path, "/")
+	logger := core.Logger(r.Context()).With("bucket", bucketName)
 
 	if err := util.ValidateBucketName(bucketName); err != nil {
-		log.Printf("Error validating bucket name %s: %v\n", bucketName, err)
+		logger.Info("invalid bucket name", "error", err)
 		XMLErrResponse(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	bucketsData, err := ReadBucketsFile()
-	if err != nil {
-		log.Printf("Error reading buckets file: %v\n", err)
-		XMLErrResponse(w, http.StatusInternalServerError, ErrInternalServer.Error())
-		return
-	}
-
-	if FindBucketIndex(bucketsData.List, bucketName) != -1 {
-		log.Printf("Bucket %s already exists\n", bucketName)
+	// The name of a bucket in the trash stays taken until it is purged
+	if existing, ok := h.meta.Bucket(bucketName); ok {
+		logger.Info("bucket already exists", "status", existing.Status)
 		XMLErrResponse(w, http.StatusConflict, ErrBucketAlreadyExists.Error())
 		return
 	}
 
 	newBucket := core.Bucket{
 		Name:         bucketName,
-		Status:       "Active",
+		Status:       core.BucketActive,
 		CreationDate: time.Now().Format(time.RFC3339Nano),
 		LastUpdated:  time.Now().Format(time.RFC3339Nano),
 	}
-	bucketsData.List = append(bucketsData.List, newBucket)
+	if strings.EqualFold(r.Header.Get(headerBucketLock), "true") {
+		newBucket.ObjectLock = core.ObjectLockEnabled
+	}
 
-	if err := WriteBucketsFile(bucketsData); err != nil {
-		log.Printf("Error writing buckets file: %v\n", err)
-		XMLErrResponse(w, http.StatusInternalServerError, ErrInternalServer.Error())
+	opID, ok := h.beginOp(w, logger, util.JournalEntry{Op: util.JournalCreateBucket, Bucket: bucketName})
+	if !ok {
 		return
 	}
+	defer h.journal.End(opID)
 
-	if err := CreateBucketDirectory(bucketName); err != nil {
-		log.Printf("Error creating bucket directory: %v\n", err)
+	if err := h.meta.PutBucket(newBucket); err != nil {
+		logger.Error("error recording bucket", "error", err)
 		XMLErrResponse(w, http.StatusInternalServerError, ErrInternalServer.Error())
 		return
 	}
 
-	if err := util.InitObjectFile(bucketName); err != nil {
-		log.Printf("Error initializing object file: %v\n", err)
+	if err := CreateBucketDirectory(h.cfg.Dir, bucketName); err != nil {
+		logger.Error("error creating bucket directory", "error", err)
+		h.forgetBucket(logger, bucketName)
 		XMLErrResponse(w, http.StatusInternalServerError, ErrInternalServer.Error())
 		return
 	}
 
-	log.Printf("Bucket %s created successfully", bucketName)
-	XMLResponse(w, http.StatusOK, newBucket)
-}
+	if err := util.InitObjectFile(h.cfg.Dir, bucketName); err != nil {
+		logger.Error("error initializing object file", "error", err)
+		h.forgetBucket(logger, bucketName)
+		XMLErrResponse(w, http.StatusInternalServerError, ErrInternalServer.Error())
+		return
+	}
 
-func ListBuckets(w http.ResponseWriter, r *http.Request) {
-	bucketsData, err := ReadBucketsFile()
+	dir, err := h.store.PlaceBucket(bucketName)
 	if err != nil {
-		log.Printf("error reading buckets file: %s", err)
-		XMLErrResponse(w, http.StatusInternalServerError, "Internal server error")
+		logger.Error("error placing bucket", "error", err)
+		h.forgetBucket(logger, bucketName)
+		XMLErrResponse(w, http.StatusInternalServerError, ErrInternalServer.Error())
 		return
 	}
 
-	log.Println("Buckets listed successfully")
+	logger.Debug("bucket created", "dir", dir)
+	XMLResponse(w, http.StatusOK, newBucket)
+}
+
+func (h *Handler) ListBuckets(w http.ResponseWriter, r *http.Request) {
+	logger := core.Logger(r.Context())
+
+	var bucketsData core.Buckets
+	for _, bucket := range h.meta.Buckets() {
+		if bucket.Status != core.BucketActive {
+			continue
+		}
+		if stats, err := h.meta.Stats(bucket.Name); err == nil {
+			bucket.Stats = &stats
+		}
+		bucketsData.List = append(bucketsData.List, bucket)
+	}
+	logger.Debug("buckets listed", "count", len(bucketsData.List))
 	XMLResponse(w, http.StatusOK, bucketsData)
 }
 
-func DeleteBucket(w http.ResponseWriter, r *http.Request) {
+// DeleteBucket deletes an empty bucket. With a trash retention configured,
+// the bucket is moved to the trash instead, and purged once it expires.
+func (h *Handler) DeleteBucket(w http.ResponseWriter, r *http.Request) {
 	bucketName := strings.TrimPrefix(r.URL.Path, "/")
+	logger := core.Logger(r.Context()).With("bucket", bucketName)
 
-	bucketsData, err := ReadBucketsFile()
-	if err != nil {
-		log.Printf("Error reading buckets file: %v\n", err)
-		XMLErrResponse(w, http.StatusInternalServerError, ErrInternalServer.Error())
+	if _, ok := h.activeBucket(bucketName); !ok {
+		logger.Info("bucket not found")
+		XMLErrResponse(w, http.StatusNotFound, ErrBucketNotFound.Error())
 		return
 	}
 
-	bucketIndex := FindBucketIndex(bucketsData.List, bucketName)
-	if bucketIndex == -1 {
-		log.Printf("Bucket %s not found\n", bucketName)
-		XMLErrResponse(w, http.StatusNotFound, ErrBucketNotFound.Error())
+	if h.cfg.Trash.Retention > 0 {
+		h.trashBucket(w, logger, bucketName)
 		return
 	}
 
-	if err := CheckBucketEmpty(bucketName); err != nil {
-		log.Printf("Error checking if bucket %s is empty: %v\n", bucketName, err)
+	err := h.removeBucket(bucketName)
+	switch {
+	case errors.Is(err, meta.ErrNoSuchBucket):
+		logger.Info("bucket not found")
+		XMLErrResponse(w, http.StatusNotFound, ErrBucketNotFound.Error())
+		return
+	case errors.Is(err, meta.ErrBucketNotEmpty):
+		logger.Info("bucket is not empty")
 		XMLErrResponse(w, http.StatusConflict, ErrBucketNotEmpty.Error())
 		return
+	case err != nil:
+		logger.Error("error deleting bucket", "error", err)
+		XMLErrResponse(w, http.StatusInternalServerError, ErrInternalServer.Error())
+		return
+	}
+
+	logger.Debug("bucket deleted")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// BucketStats reports the object count, total size, largest object and
+// content types of a bucket, for GET /{bucket}?stats
+func (h *Handler) BucketStats(w http.ResponseWriter, r *http.Request) {
+	bucketName := strings.TrimPrefix(r.URL.Path, "/")
+	logger := core.Logger(r.Context()).With("bucket", bucketName)
+
+	if _, ok := h.activeBucket(bucketName); !ok {
+		logger.Info("bucket not found")
+		XMLErrResponse(w, http.StatusNotFound, ErrBucketNotFound.Error())
+		return
 	}
 
-	bucketsData.List = RemoveBucket(bucketsData.List, bucketIndex)
+	stats, err := h.meta.Stats(bucketName)
+	if err != nil {
+		logger.Info("bucket not found")
+		XMLErrResponse(w, http.StatusNotFound, ErrBucketNotFound.Error())
+		return
+	}
+	XMLResponse(w, http.StatusOK, stats)
+}
 
-	if err := WriteBucketsFile(bucketsData); err != nil {
-		log.Printf("Error writing buckets file: %v\n", err)
-		XMLErrResponse(w, http.StatusInternalServerError, ErrInternalServer.Error())
+// trashBucket moves an empty bucket to the trash
+func (h *Handler) trashBucket(w http.ResponseWriter, logger *slog.Logger, bucketName string) {
+	_, count, err := h.meta.Usage(bucketName)
+	if err == nil && count > 0 {
+		logger.Info("bucket is not empty")
+		XMLErrResponse(w, http.StatusConflict, ErrBucketNotEmpty.Error())
 		return
 	}
 
-	bucketDirPath := filepath.Join(core.Dir, bucketName)
-	if err := os.RemoveAll(bucketDirPath); err != nil {
-		log.Printf("Error deleting bucket directory %s: %v\n", bucketDirPath, err)
-		XMLErrResponse(w, http.StatusInternalServerError, ErrInternalServer.Error())
+	_, err = h.meta.UpdateBucket(bucketName, func(bucket *core.Bucket) {
+		now := time.Now().Format(time.RFC3339Nano)
+		bucket.Status = core.BucketPendingDeletion
+		bucket.DeletedAt = now
+		bucket.LastUpdated = now
+	})
+	if !h.bucketUpdated(w, logger, err) {
 		return
 	}
 
-	log.Printf("Bucket %s deleted successfully", bucketName)
+	logger.Info("bucket moved to the trash", "retention", time.Duration(h.cfg.Trash.Retention))
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// removeBucket deletes the record and the directory of an empty bucket
+func (h *Handler) removeBucket(bucketName string) error {
+	opID, err := h.journal.Begin(util.JournalEntry{Op: util.JournalDeleteBucket, Bucket: bucketName})
+	if err != nil {
+		return err
+	}
+	defer h.journal.End(opID)
+
+	if err := h.meta.DeleteBucket(bucketName); err != nil {
+		return err
+	}
+	if err := h.store.RemoveBucket(bucketName); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(h.cfg.Dir, bucketName))
+}
+
+// activeBucket looks up a bucket that is neither in the trash nor being
+// deleted
+func (h *Handler) activeBucket(bucketName string) (core.Bucket, bool) {
+	bucket, ok := h.meta.Bucket(bucketName)
+	return bucket, ok && bucket.Status == core.BucketActive
+}
+
+// forgetBucket removes the record of a bucket whose creation failed
+func (h *Handler) forgetBucket(logger *slog.Logger, bucketName string) {
+	if err := h.meta.DeleteBucket(bucketName); err != nil {
+		logger.Warn("error removing bucket record", "error", err)
+	}
+}
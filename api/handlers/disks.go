@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/metrics"
+	"github.com/ab-dauletkhan/triple-s/api/storage"
+	"github.com/ab-dauletkhan/triple-s/api/util"
+)
+
+// ListDataDirs lists the data directories with the number of buckets placed
+// on them and their free space
+func (h *Handler) ListDataDirs(w http.ResponseWriter, r *http.Request) {
+	var dirs core.DataDirectories
+	for _, disk := range h.dataDisks() {
+		dir := core.DataDirectory{Dir: disk.Dir, Draining: disk.Draining, Buckets: disk.Buckets}
+		dir.FreeBytes, dir.TotalBytes, _ = util.DiskUsage(disk.Dir)
+		dirs.List = append(dirs.List, dir)
+	}
+	XMLResponse(w, http.StatusOK, dirs)
+}
+
+// DrainDataDir marks the data directory given with the dir query parameter
+// as drained: it takes no new buckets and its buckets are read-only until
+// they are moved by a rebalance. DELETE puts it back in use.
+func (h *Handler) DrainDataDir(w http.ResponseWriter, r *http.Request) {
+	dir := r.URL.Query().Get("dir")
+	logger := core.Logger(r.Context()).With("dir", dir)
+
+	drain := r.Method == http.MethodPost
+	err := h.store.Drain(dir, drain)
+	switch {
+	case errors.Is(err, storage.ErrUnknownDisk) || errors.Is(err, storage.ErrDrainPrimary):
+		logger.Info("cannot drain directory", "error", err)
+		XMLErrResponse(w, http.StatusBadRequest, err.Error())
+		return
+	case err != nil:
+		logger.Error("failed to record draining", "error", err)
+		XMLErrResponse(w, http.StatusInternalServerError, ErrInternalServer.Error())
+		return
+	}
+
+	logger.Info("data directory draining updated", "draining", drain)
+	h.ListDataDirs(w, r)
+}
+
+// Rebalance moves the bucket given with the bucket query parameter to the
+// data directory given with to, or the one with the most free space. Without
+// a bucket, every bucket on a drained directory is moved.
+func (h *Handler) Rebalance(w http.ResponseWriter, r *http.Request) {
+	bucketName, to := r.URL.Query().Get("bucket"), r.URL.Query().Get("to")
+	logger := core.Logger(r.Context()).With("bucket", bucketName, "to", to)
+
+	var names []string
+	if bucketName != "" {
+		bucket, ok := h.meta.Bucket(bucketName)
+		if !ok {
+			logger.Info("bucket not found")
+			XMLErrResponse(w, http.StatusNotFound, ErrBucketNotFound.Error())
+			return
+		}
+		if bucket.Status == core.BucketDeleting {
+			logger.Info("bucket is being deleted")
+			XMLErrResponse(w, http.StatusConflict, ErrBucketNotActive.Error())
+			return
+		}
+		names = append(names, bucketName)
+	} else {
+		for _, bucket := range h.meta.Buckets() {
+			if bucket.Status != core.BucketDeleting && h.store.Drained(bucket.Name) {
+				names = append(names, bucket.Name)
+			}
+		}
+	}
+
+	var report core.RebalanceReport
+	for _, name := range names {
+		move, err := h.store.MoveBucket(name, to)
+		if err != nil && bucketName != "" {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, storage.ErrUnknownDisk):
+				status = http.StatusBadRequest
+			case errors.Is(err, storage.ErrReadOnly) || errors.Is(err, storage.ErrNoDisk) || errors.Is(err, storage.ErrDiskDraining):
+				status = http.StatusConflict
+			}
+			logger.Warn("failed to move bucket", "error", err)
+			XMLErrResponse(w, status, err.Error())
+			return
+		}
+
+		entry := core.BucketMove{Bucket: move.Bucket, From: move.From, To: move.To, Files: move.Files, Bytes: move.Bytes}
+		if err != nil {
+			logger.Warn("failed to move bucket", "bucket", name, "error", err)
+			entry.Error = err.Error()
+		} else if move.From != move.To {
+			logger.Info("bucket moved", "bucket", name, "from", move.From, "to", move.To, "files", move.Files, "bytes", move.Bytes)
+		}
+		report.Moves = append(report.Moves, entry)
+	}
+
+	XMLResponse(w, http.StatusOK, report)
+}
+
+// beginWrite registers a change of the objects of a bucket, writing the
+// error response while the bucket is read-only
+func (h *Handler) beginWrite(w http.ResponseWriter, logger *slog.Logger, bucketName string) (func(), bool) {
+	release, err := h.store.BeginWrite(bucketName)
+	if err != nil {
+		logger.Info("bucket is read-only", "error", err)
+		XMLErrResponse(w, http.StatusServiceUnavailable, err.Error())
+		return nil, false
+	}
+	return release, true
+}
+
+// dataDisks returns the data directories with the buckets placed on them
+func (h *Handler) dataDisks() []storage.DataDisk {
+	var names []string
+	for _, bucket := range h.meta.Buckets() {
+		names = append(names, bucket.Name)
+	}
+	return h.store.DataDisks(names)
+}
+
+// writeDataDirMetrics reports the buckets and free space of every data
+// directory when there are several
+func (h *Handler) writeDataDirMetrics(mw *metrics.Writer) {
+	disks := h.dataDisks()
+	if len(disks) < 2 {
+		return
+	}
+	mw.Header("triples_data_dir_buckets", "Number of buckets placed on the data directory.", "gauge")
+	for _, disk := range disks {
+		mw.Sample("triples_data_dir_buckets", float64(disk.Buckets), "dir", disk.Dir)
+	}
+	mw.Header("triples_data_dir_free_bytes", "Free bytes on the filesystem of the data directory.", "gauge")
+	for _, disk := range disks {
+		if free, _, err := util.DiskUsage(disk.Dir); err == nil {
+			mw.Sample("triples_data_dir_free_bytes", float64(free), "dir", disk.Dir)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/events"
+)
+
+// Limits of the change feed requests
+const (
+	defaultPollTimeout = 30 * time.Second
+	maxPollTimeout     = 5 * time.Minute
+	defaultMaxEvents   = 1000
+	heartbeatInterval  = 15 * time.Second
+)
+
+var ErrInvalidEventsQuery = errors.New("after and max-events must be non-negative integers, timeout a duration in seconds")
+
+// eventsPage is a long-poll response of the change feed
+type eventsPage struct {
+	Records []events.Record `json:"Records"`
+	// Sequence to pass as after to continue
+	NextSequence uint64 `json:"NextSequence"`
+}
+
+// BucketEvents serves the change feed of a bucket, for GET /{bucket}?events.
+// Clients accepting text/event-stream get server-sent events with the
+// sequence number as event id, others long-poll a JSON page of records.
+// The after query parameter, or the Last-Event-ID header, resumes after a
+// sequence number; without it only events from now on are returned. prefix
+// selects keys, and max-events and timeout (in seconds) bound long-polls.
+func (h *Handler) BucketEvents(w http.ResponseWriter, r *http.Request) {
+	bucketName := strings.TrimPrefix(r.URL.Path, "/")
+	logger := core.Logger(r.Context()).With("bucket", bucketName)
+
+	if _, ok := h.activeBucket(bucketName); !ok {
+		logger.Info("bucket not found")
+		XMLErrResponse(w, http.StatusNotFound, ErrBucketNotFound.Error())
+		return
+	}
+
+	query := r.URL.Query()
+	feed := h.events.Feed()
+	after := feed.Last()
+	maxEvents := defaultMaxEvents
+	timeout := defaultPollTimeout
+	var err error
+
+	if s := query.Get("after"); s != "" {
+		after, err = strconv.ParseUint(s, 10, 64)
+	} else if s := r.Header.Get("Last-Event-ID"); s != "" {
+		after, err = strconv.ParseUint(s, 10, 64)
+	}
+	if s := query.Get("max-events"); s != "" && err == nil {
+		maxEvents, err = strconv.Atoi(s)
+		if maxEvents < 0 {
+			err = ErrInvalidEventsQuery
+		}
+	}
+	if s := query.Get("timeout"); s != "" && err == nil {
+		var seconds int
+		seconds, err = strconv.Atoi(s)
+		if seconds < 0 {
+			err = ErrInvalidEventsQuery
+		}
+		timeout = min(time.Duration(seconds)*time.Second, maxPollTimeout)
+	}
+	if err != nil {
+		logger.Info("invalid events query", "error", err)
+		XMLErrResponse(w, http.StatusBadRequest, ErrInvalidEventsQuery.Error())
+		return
+	}
+
+	prefix := query.Get("prefix")
+	if _, _, _, err := feed.Since(after, bucketName, prefix, 1); errors.Is(err, events.ErrFeedExpired) {
+		logger.Info("events expired", "after", after)
+		XMLErrResponse(w, http.StatusGone, err.Error())
+		return
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		h.streamEvents(w, r, logger, feed, bucketName, prefix, after)
+		return
+	}
+	h.pollEvents(w, r, logger, feed, bucketName, prefix, after, maxEvents, timeout)
+}
+
+// pollEvents responds once events are available or the timeout passes
+func (h *Handler) pollEvents(w http.ResponseWriter, r *http.Request, logger *slog.Logger, feed *events.Feed,
+	bucketName, prefix string, after uint64, maxEvents int, timeout time.Duration,
+) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	page := eventsPage{Records: []events.Record{}, NextSequence: after}
+	for {
+		changes, next, updated, err := feed.Since(page.NextSequence, bucketName, prefix, maxEvents)
+		if err != nil {
+			logger.Info("events expired", "after", page.NextSequence)
+			XMLErrResponse(w, http.StatusGone, err.Error())
+			return
+		}
+		page.NextSequence = next
+		for _, change := range changes {
+			page.Records = append(page.Records, change.Record)
+		}
+		if len(page.Records) > 0 {
+			break
+		}
+
+		select {
+		case <-updated:
+			continue
+		case <-deadline.C:
+		case <-r.Context().Done():
+			return
+		}
+		break
+	}
+
+	logger.Debug("events polled", "count", len(page.Records), "next", page.NextSequence)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(page)
+}
+
+// streamEvents sends server-sent events until the client disconnects
+func (h *Handler) streamEvents(w http.ResponseWriter, r *http.Request, logger *slog.Logger, feed *events.Feed,
+	bucketName, prefix string, after uint64,
+) {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	logger.Debug("event stream opened", "after", after)
+	for {
+		changes, next, updated, err := feed.Since(after, bucketName, prefix, defaultMaxEvents)
+		if err != nil {
+			// The client fell too far behind, it has to start over
+			fmt.Fprintf(w, "event: expired\ndata: %s\n\n", err)
+			rc.Flush()
+			return
+		}
+		after = next
+
+		for _, change := range changes {
+			data, err := json.Marshal(change.Record)
+			if err != nil {
+				logger.Error("failed to encode event", "error", err)
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", change.Sequence, change.Record.EventName, data)
+		}
+		if err := rc.Flush(); err != nil {
+			logger.Debug("event stream closed", "error", err)
+			return
+		}
+		if len(changes) == defaultMaxEvents {
+			continue
+		}
+
+		select {
+		case <-updated:
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case <-r.Context().Done():
+			logger.Debug("event stream closed")
+			return
+		}
+	}
+}
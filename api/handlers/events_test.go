@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+)
+
+// putObjects creates the bucket photos with an object for each key, one
+// event each
+func putObjects(t *testing.T, h *Handler, keys ...string) {
+	t.Helper()
+	if _, ok := h.meta.Bucket("photos"); !ok {
+		mustServe(t, h.CreateBucket, newRequest(http.MethodPut, "/photos", ""), http.StatusOK)
+	}
+	for _, key := range keys {
+		mustServe(t, h.CreateObject, newRequest(http.MethodPut, "/photos/"+key, key), http.StatusOK)
+	}
+}
+
+// poll long-polls the change feed of photos with query and returns the
+// keys of the records and the next sequence
+func poll(t *testing.T, h *Handler, query string, status int) ([]string, uint64) {
+	t.Helper()
+	w := mustServe(t, h.ListObjects, newRequest(http.MethodGet, "/photos?events&"+query, ""), status)
+	if status != http.StatusOK {
+		return nil, 0
+	}
+	var page eventsPage
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for _, record := range page.Records {
+		keys = append(keys, record.S3.Object.Key)
+	}
+	return keys, page.NextSequence
+}
+
+func TestPollEventsResume(t *testing.T) {
+	h := newTestHandler(t, func(cfg *core.Config) {
+		cfg.Events.FeedSize = 2
+	})
+	putObjects(t, h, "a", "b", "c")
+
+	// The bucket creation is not an object event, the feed starts at 1
+	tests := []struct {
+		name  string
+		query string
+		keys  []string
+		next  uint64
+	}{
+		{"resumed", "after=1&timeout=0", []string{"b", "c"}, 3},
+		{"limited", "after=1&max-events=1&timeout=0", []string{"b"}, 2},
+		{"continued", "after=2&timeout=0", []string{"c"}, 3},
+		{"up to date", "after=3&timeout=0", []string{}, 3},
+		{"from now on", "timeout=0", []string{}, 3},
+		{"other prefix", "after=1&prefix=x&timeout=0", []string{}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, next := poll(t, h, tt.query, http.StatusOK)
+			if !slices.Equal(keys, tt.keys) || next != tt.next {
+				t.Errorf("poll(%s) = %v, %d, want %v, %d", tt.query, keys, next, tt.keys, tt.next)
+			}
+		})
+	}
+
+	// Events that are no longer retained cannot be resumed
+	putObjects(t, h, "d", "e")
+	poll(t, h, "after=1&timeout=0", http.StatusGone)
+	poll(t, h, "after=x", http.StatusBadRequest)
+}
+
+// putLater uploads key to photos shortly, once a subscriber waits
+func putLater(t *testing.T, h *Handler, key string) {
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		if w := serve(t, h.CreateObject, newRequest(http.MethodPut, "/photos/"+key, key)); w.Code != http.StatusOK {
+			t.Errorf("PUT %s = %d", key, w.Code)
+		}
+	}()
+}
+
+func TestPollEventsWait(t *testing.T) {
+	h := newTestHandler(t, nil)
+	putObjects(t, h, "a")
+
+	// A poll that is up to date waits for the next event
+	putLater(t, h, "b")
+	start := time.Now()
+	keys, next := poll(t, h, "after=1&timeout=10", http.StatusOK)
+	if !slices.Equal(keys, []string{"b"}) || next != 2 {
+		t.Errorf("poll = %v, %d, want [b], 2", keys, next)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("poll answered after %s, not woken up by the event", elapsed)
+	}
+}
+
+// streamIDs reads the ids of the server-sent events of the change feed of
+// photos until it has n of them
+func streamIDs(t *testing.T, url, lastEventID string, n int) []string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/photos?events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %s", ct)
+	}
+
+	ids := []string{}
+	scanner := bufio.NewScanner(resp.Body)
+	for len(ids) < n && scanner.Scan() {
+		if id, ok := strings.CutPrefix(scanner.Text(), "id: "); ok {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) < n {
+		t.Fatalf("stream ended after events %v: %v", ids, scanner.Err())
+	}
+	return ids
+}
+
+func TestStreamEventsResume(t *testing.T) {
+	h := newTestHandler(t, nil)
+	putObjects(t, h, "a", "b", "c")
+	srv := httptest.NewServer(http.HandlerFunc(h.ListObjects))
+	defer srv.Close()
+
+	// A reconnecting client gets what it missed, then new events
+	putLater(t, h, "d")
+	if ids := streamIDs(t, srv.URL, "1", 3); !slices.Equal(ids, []string{"2", "3", "4"}) {
+		t.Errorf("event ids = %v, want [2 3 4]", ids)
+	}
+}
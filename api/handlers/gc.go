@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/storage"
+)
+
+// Blobs younger than this are never collected, an upload may be about to
+// reference them
+const gcGracePeriod = 15 * time.Minute
+
+// CollectGarbage deletes blobs no object points at any more and corrects
+// the reference counts of the others
+func (h *Handler) CollectGarbage() (storage.GCResult, error) {
+	refs := make(map[string]int)
+
+	h.meta.Walk(func(bucket string, object core.Object) {
+		if object.Storage == storage.KindBlob {
+			refs[object.Digest]++
+		}
+	})
+
+	return h.store.Sweep(refs, gcGracePeriod)
+}
+
+// runGC collects garbage periodically
+func (h *Handler) runGC() {
+	for range time.Tick(time.Duration(h.cfg.Storage.GCInterval)) {
+		result, err := h.CollectGarbage()
+		if err != nil {
+			slog.Error("garbage collection failed", "error", err)
+			continue
+		}
+		slog.Info("garbage collection finished", "scanned", result.Scanned, "removed", result.Removed,
+			"freed_bytes", result.FreedBytes, "fixed_refs", result.FixedRefs, "temps_removed", result.TempsRemoved)
+	}
+}
+
+// RunGC runs a garbage collection on demand and reports what it did
+func (h *Handler) RunGC(w http.ResponseWriter, r *http.Request) {
+	logger := core.Logger(r.Context())
+
+	result, err := h.CollectGarbage()
+	if err != nil {
+		logger.Error("garbage collection failed", "error", err)
+		XMLErrResponse(w, http.StatusInternalServerError, ErrInternalServer.Error())
+		return
+	}
+
+	logger.Info("garbage collection finished", "removed", result.Removed, "freed_bytes", result.FreedBytes)
+	XMLResponse(w, http.StatusOK, core.GCReport{
+		Scanned:      result.Scanned,
+		Removed:      result.Removed,
+		FreedBytes:   result.FreedBytes,
+		FixedRefs:    result.FixedRefs,
+		TempsRemoved: result.TempsRemoved,
+	})
+}
@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/events"
+	"github.com/ab-dauletkhan/triple-s/api/meta"
+	"github.com/ab-dauletkhan/triple-s/api/metrics"
+	"github.com/ab-dauletkhan/triple-s/api/replication"
+	"github.com/ab-dauletkhan/triple-s/api/storage"
+	"github.com/ab-dauletkhan/triple-s/api/util"
+)
+
+// Handler serves the S3 API on top of the configured data directory
+type Handler struct {
+	cfg     *core.Config
+	metrics *metrics.Metrics
+	meta    *meta.Store
+	journal *util.Journal
+	store   *storage.Store
+	jobs    *jobRegistry
+	quotas  *quotaReservations
+	keys    *keyLocks
+	events  *events.Notifier
+
+	replication *replication.Replicator
+}
+
+// New opens the object store and the metadata of the data directory,
+// replaying the changes logged before the last shutdown, the journal of the
+// operations in progress, the event outbox and the replication queue
+func New(cfg *core.Config, m *metrics.Metrics) (*Handler, error) {
+	store, err := storage.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	metaStore, err := meta.Open(cfg.Dir, cfg.Metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	journal, err := util.OpenJournal(cfg.Dir, cfg.Metadata.Sync)
+	if err != nil {
+		metaStore.Close()
+		return nil, err
+	}
+
+	notifier, err := events.Open(cfg.Dir, cfg.Events, cfg.Metadata.Sync)
+	if err != nil {
+		journal.Close()
+		metaStore.Close()
+		return nil, err
+	}
+
+	h := &Handler{
+		cfg:     cfg,
+		metrics: m,
+		meta:    metaStore,
+		journal: journal,
+		store:   store,
+		jobs:    newJobRegistry(),
+		quotas:  newQuotaReservations(),
+		keys:    newKeyLocks(),
+		events:  notifier,
+	}
+
+	h.replication, err = replication.Open(cfg.Dir, cfg.Replication, cfg.Metadata.Sync, replicationSource{h})
+	if err != nil {
+		notifier.Close()
+		journal.Close()
+		metaStore.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// StartWorkers starts the background jobs of the handler
+func (h *Handler) StartWorkers() {
+	if h.cfg.Storage.GCInterval > 0 {
+		go h.runGC()
+	}
+	if h.cfg.Trash.Retention > 0 {
+		go h.runPurge()
+	}
+	if h.cfg.Storage.Erasure.HealInterval > 0 && h.store.Disks() != nil {
+		go h.runHeal()
+	}
+	if h.cfg.Storage.Cold.TransitionInterval > 0 && h.store.ColdEnabled() {
+		go h.runTransitions()
+	}
+	go h.events.Run()
+	h.requeuePending()
+	go h.replication.Run()
+	h.resumeDeleteJobs()
+}
+
+// ReservedBuckets returns the names of the buckets that were created before
+// their name was reserved for a server endpoint
+func (h *Handler) ReservedBuckets() []string {
+	var names []string
+	for _, bucket := range h.meta.Buckets() {
+		if util.ReservedBucketName(bucket.Name) {
+			names = append(names, bucket.Name)
+		}
+	}
+	return names
+}
+
+// publish notifies the subscribers of an event on object. Failures are
+// logged, the change itself was made already.
+func (h *Handler) publish(logger *slog.Logger, bucketName, eventName string, object core.Object) {
+	bucket, _ := h.meta.Bucket(bucketName)
+	bucket.Name = bucketName
+	if err := h.events.Publish(bucket, eventName, object); err != nil {
+		logger.Error("failed to publish event", "event", eventName, "error", err)
+	}
+}
+
+// beginOp journals an operation before its first step, writing the error
+// response when that fails. The operation is ended with h.journal.End.
+func (h *Handler) beginOp(w http.ResponseWriter, logger *slog.Logger, entry util.JournalEntry) (uint64, bool) {
+	id, err := h.journal.Begin(entry)
+	if err != nil {
+		logger.Error("error writing journal", "error", err)
+		XMLErrResponse(w, http.StatusInternalServerError, ErrInternalServer.Error())
+		return 0, false
+	}
+	return id, true
+}
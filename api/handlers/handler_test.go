@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/metrics"
+	"github.com/ab-dauletkhan/triple-s/api/util"
+)
+
+// newTestHandler opens a handler over a fresh data directory, its
+// configuration changed by configure when given. The background workers are
+// not started.
+func newTestHandler(t *testing.T, configure func(*core.Config)) *Handler {
+	t.Helper()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	cfg := core.DefaultConfig()
+	cfg.Dir = t.TempDir()
+	cfg.Health.MinFreeBytes = 0
+	if configure != nil {
+		configure(cfg)
+	}
+	if err := util.InitDir(cfg.Dir); err != nil {
+		t.Fatal(err)
+	}
+	h, err := New(cfg, metrics.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		h.events.Close()
+		h.journal.Close()
+		h.meta.Close()
+	})
+	return h
+}
+
+// serve runs handler on a request and returns its response
+func serve(t *testing.T, handler http.HandlerFunc, r *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func newRequest(method, path, body string) *http.Request {
+	return httptest.NewRequest(method, path, strings.NewReader(body))
+}
+
+// adminRequest returns a request to an admin endpoint of a bucket
+func adminRequest(method, path, bucketName, body string) *http.Request {
+	r := newRequest(method, path, body)
+	r.SetPathValue("BucketName", bucketName)
+	return r
+}
+
+// mustServe runs handler and fails unless it answers with status
+func mustServe(t *testing.T, handler http.HandlerFunc, r *http.Request, status int) *httptest.ResponseRecorder {
+	t.Helper()
+	w := serve(t, handler, r)
+	if w.Code != status {
+		t.Fatalf("%s %s = %d %s, want %d", r.Method, r.URL, w.Code, w.Body, status)
+	}
+	return w
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/metrics"
+	"github.com/ab-dauletkhan/triple-s/api/storage"
+)
+
+// Heal rebuilds the missing and damaged shards of the erasure coded objects
+// and deletes the shards no object points at
+func (h *Handler) Heal() (storage.HealResult, error) {
+	objects := make(map[string][]core.Object)
+
+	h.meta.Walk(func(bucket string, object core.Object) {
+		if object.Storage == storage.KindErasure {
+			objects[bucket] = append(objects[bucket], object)
+		}
+	})
+
+	return h.store.Heal(objects, gcGracePeriod)
+}
+
+// runHeal heals the erasure coded objects periodically
+func (h *Handler) runHeal() {
+	for range time.Tick(time.Duration(h.cfg.Storage.Erasure.HealInterval)) {
+		result, err := h.Heal()
+		if err != nil {
+			slog.Error("healing failed", "error", err)
+			continue
+		}
+		log := slog.Info
+		if result.Unrecoverable > 0 || result.DisksOffline > 0 {
+			log = slog.Warn
+		}
+		log("healing finished", "scanned", result.Scanned, "healed", result.Healed,
+			"rebuilt_shards", result.RebuiltShards, "unrecoverable", result.Unrecoverable,
+			"orphans_removed", result.OrphansRemoved, "disks_offline", result.DisksOffline)
+	}
+}
+
+// RunHeal runs a healing pass on demand and reports what it did
+func (h *Handler) RunHeal(w http.ResponseWriter, r *http.Request) {
+	logger := core.Logger(r.Context())
+
+	result, err := h.Heal()
+	if err != nil {
+		logger.Error("healing failed", "error", err)
+		XMLErrResponse(w, http.StatusInternalServerError, ErrInternalServer.Error())
+		return
+	}
+
+	report := core.HealReport{
+		Scanned:        result.Scanned,
+		Healed:         result.Healed,
+		RebuiltShards:  result.RebuiltShards,
+		Unrecoverable:  result.Unrecoverable,
+		OrphansRemoved: result.OrphansRemoved,
+	}
+	for _, disk := range h.store.Disks() {
+		report.Disks = append(report.Disks, core.DiskStatus{Dir: disk.Dir, Online: disk.Online})
+	}
+
+	logger.Info("healing finished", "healed", result.Healed, "unrecoverable", result.Unrecoverable)
+	XMLResponse(w, http.StatusOK, report)
+}
+
+// writeDiskMetrics reports whether each erasure coding disk is online
+func (h *Handler) writeDiskMetrics(mw *metrics.Writer) {
+	disks := h.store.Disks()
+	if disks == nil {
+		return
+	}
+	mw.Header("triples_erasure_disk_online", "Whether the erasure coding disk is online.", "gauge")
+	for _, disk := range disks {
+		online := 0.0
+		if disk.Online {
+			online = 1
+		}
+		mw.Sample("triples_erasure_disk_online", online, "dir", disk.Dir)
+	}
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/meta"
+	"github.com/ab-dauletkhan/triple-s/api/util"
+)
+
+var ErrLowDiskSpace = errors.New("free disk space below the minimum")
+
+// Healthz reports that the process is alive and serving requests
+func (h *Handler) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// Readyz reports whether the server can take traffic:
+// 1. The data directory is writable
+// 2. The buckets meta-file is readable
+// 3. The data disk has at least the configured free space
+// 4. Enough erasure coding disks are online to store objects
+func (h *Handler) Readyz(w http.ResponseWriter, r *http.Request) {
+	checks := []struct {
+		name  string
+		check func() error
+	}{
+		{"dir_writable", h.checkDirWritable},
+		{"buckets_readable", h.checkBucketsReadable},
+		{"disk_space", h.checkDiskSpace},
+		{"erasure_disks", h.store.CheckDisks},
+	}
+
+	var report strings.Builder
+	status := http.StatusOK
+	for _, c := range checks {
+		if err := c.check(); err != nil {
+			core.Logger(r.Context()).Warn("readiness check failed", "check", c.name, "error", err)
+			fmt.Fprintf(&report, "%s: failed: %v\n", c.name, err)
+			status = http.StatusServiceUnavailable
+			continue
+		}
+		fmt.Fprintf(&report, "%s: ok\n", c.name)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(report.String()))
+}
+
+// Version reports the build version of the server
+func (h *Handler) Version(w http.ResponseWriter, r *http.Request) {
+	XMLResponse(w, http.StatusOK, core.ReadBuildInfo())
+}
+
+// checkDirWritable writes and syncs a probe file, which fails on a read-only disk
+func (h *Handler) checkDirWritable() error {
+	f, err := os.CreateTemp(h.cfg.Dir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.WriteString("ok"); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func (h *Handler) checkBucketsReadable() error {
+	_, err := meta.ReadBucketsFile(h.cfg.Dir)
+	return err
+}
+
+func (h *Handler) checkDiskSpace() error {
+	free, _, err := util.DiskUsage(h.cfg.Dir)
+	if errors.Is(err, util.ErrDiskUsageUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if int64(free) < h.cfg.Health.MinFreeBytes {
+		return fmt.Errorf("%w: %d < %d bytes", ErrLowDiskSpace, free, h.cfg.Health.MinFreeBytes)
+	}
+	return nil
+}
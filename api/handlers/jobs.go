@@ -0,0 +1,318 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/meta"
+)
+
+// Objects deleted per metadata batch by a delete job
+const deleteBatchSize = 1000
+
+var (
+	ErrJobNotFound     = errors.New("job not found")
+	ErrJobFinished     = errors.New("job has already finished")
+	ErrBucketNotActive = errors.New("bucket is in the trash or already being deleted")
+)
+
+// deleteJob deletes a bucket with all of its objects in the background
+type deleteJob struct {
+	cancel context.CancelFunc
+	// Whether governance retentions are lifted, as asked when it started
+	bypassGovernance bool
+
+	mu     sync.Mutex
+	report core.DeleteJob
+}
+
+func (j *deleteJob) snapshot() core.DeleteJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.report
+}
+
+func (j *deleteJob) update(fn func(*core.DeleteJob)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fn(&j.report)
+}
+
+// jobRegistry keeps the delete jobs of the process, finished ones included
+type jobRegistry struct {
+	mu   sync.Mutex
+	jobs map[string]*deleteJob
+}
+
+func newJobRegistry() *jobRegistry {
+	return &jobRegistry{jobs: make(map[string]*deleteJob)}
+}
+
+func (r *jobRegistry) get(id string) (*deleteJob, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	job, ok := r.jobs[id]
+	return job, ok
+}
+
+func (r *jobRegistry) add(job *deleteJob) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.jobs[job.report.ID] = job
+}
+
+func (r *jobRegistry) list() []core.DeleteJob {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reports := make([]core.DeleteJob, 0, len(r.jobs))
+	for _, job := range r.jobs {
+		reports = append(reports, job.snapshot())
+	}
+	slices.SortFunc(reports, func(a, b core.DeleteJob) int {
+		return strings.Compare(a.StartedAt, b.StartedAt)
+	})
+	return reports
+}
+
+// ForceDeleteBucket starts a job deleting a bucket with all of its objects.
+// The bucket is hidden from the S3 API right away. Buckets holding objects
+// protected by object lock are refused.
+func (h *Handler) ForceDeleteBucket(w http.ResponseWriter, r *http.Request) {
+	bucketName := r.PathValue("BucketName")
+	logger := core.Logger(r.Context()).With("bucket", bucketName)
+
+	bucket, ok := h.meta.Bucket(bucketName)
+	if !ok {
+		logger.Info("bucket not found")
+		XMLErrResponse(w, http.StatusNotFound, ErrBucketNotFound.Error())
+		return
+	}
+	if bucket.Status != core.BucketActive {
+		logger.Info("bucket is not active", "status", bucket.Status)
+		XMLErrResponse(w, http.StatusConflict, ErrBucketNotActive.Error())
+		return
+	}
+
+	// Governance retentions are lifted on request, the caller is an admin
+	if locked := h.lockedObjects(bucketName, strings.EqualFold(r.Header.Get(headerBypassGovernance), "true")); locked > 0 {
+		logger.Info("bucket holds locked objects", "locked", locked)
+		XMLErrResponse(w, http.StatusConflict, ErrBucketHasLocked.Error())
+		return
+	}
+
+	_, err := h.meta.UpdateBucket(bucketName, func(bucket *core.Bucket) {
+		bucket.Status = core.BucketDeleting
+		bucket.LastUpdated = time.Now().Format(time.RFC3339Nano)
+	})
+	if !h.bucketUpdated(w, logger, err) {
+		return
+	}
+
+	job := h.startDeleteJob(bucketName, strings.EqualFold(r.Header.Get(headerBypassGovernance), "true"))
+	logger.Info("bucket deletion started", "job", job.report.ID)
+	XMLResponse(w, http.StatusAccepted, job.snapshot())
+}
+
+// ListJobs lists the delete jobs started since the server started
+func (h *Handler) ListJobs(w http.ResponseWriter, r *http.Request) {
+	XMLResponse(w, http.StatusOK, core.DeleteJobs{List: h.jobs.list()})
+}
+
+// GetJob reports the progress of a delete job
+func (h *Handler) GetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := h.jobs.get(r.PathValue("JobID"))
+	if !ok {
+		XMLErrResponse(w, http.StatusNotFound, ErrJobNotFound.Error())
+		return
+	}
+	XMLResponse(w, http.StatusOK, job.snapshot())
+}
+
+// CancelJob stops a running delete job. The objects deleted so far stay
+// deleted, the bucket is made available again with the rest.
+func (h *Handler) CancelJob(w http.ResponseWriter, r *http.Request) {
+	jobID := r.PathValue("JobID")
+	logger := core.Logger(r.Context()).With("job", jobID)
+
+	job, ok := h.jobs.get(jobID)
+	if !ok {
+		logger.Info("job not found")
+		XMLErrResponse(w, http.StatusNotFound, ErrJobNotFound.Error())
+		return
+	}
+	if job.snapshot().Status != core.JobRunning {
+		logger.Info("job has already finished")
+		XMLErrResponse(w, http.StatusConflict, ErrJobFinished.Error())
+		return
+	}
+
+	job.cancel()
+	logger.Info("job cancellation requested")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// resumeDeleteJobs restarts the deletion of the buckets a previous run of
+// the server left in the Deleting state. Governance retentions are no
+// longer lifted, the request that asked for it is gone.
+func (h *Handler) resumeDeleteJobs() {
+	for _, bucket := range h.meta.Buckets() {
+		if bucket.Status == core.BucketDeleting {
+			job := h.startDeleteJob(bucket.Name, false)
+			slog.Info("bucket deletion resumed", "bucket", bucket.Name, "job", job.report.ID)
+		}
+	}
+}
+
+func (h *Handler) startDeleteJob(bucketName string, bypassGovernance bool) *deleteJob {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &deleteJob{
+		cancel:           cancel,
+		bypassGovernance: bypassGovernance,
+		report: core.DeleteJob{
+			ID:        hex.EncodeToString(id),
+			Bucket:    bucketName,
+			Status:    core.JobRunning,
+			StartedAt: time.Now().Format(time.RFC3339Nano),
+		},
+	}
+	if _, count, err := h.meta.Usage(bucketName); err == nil {
+		job.report.ObjectsTotal = count
+	}
+
+	h.jobs.add(job)
+	go h.runDeleteJob(ctx, job)
+	return job
+}
+
+func (h *Handler) runDeleteJob(ctx context.Context, job *deleteJob) {
+	defer job.cancel()
+	bucketName := job.report.Bucket
+	logger := slog.With("bucket", bucketName, "job", job.report.ID)
+
+	var err error
+	for {
+		if err = h.deleteAllObjects(ctx, job); err == nil {
+			err = h.removeBucket(bucketName)
+		}
+		// An upload accepted before the deletion started may land after the
+		// last batch, delete it too
+		if !errors.Is(err, meta.ErrBucketNotEmpty) {
+			break
+		}
+	}
+
+	status := core.JobCompleted
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, ErrBucketHasLocked):
+		// Objects locked since the job started are kept with their bucket
+		status = core.JobCanceled
+		if errors.Is(err, ErrBucketHasLocked) {
+			status = core.JobFailed
+		}
+		_, err := h.meta.UpdateBucket(bucketName, func(bucket *core.Bucket) {
+			bucket.Status = core.BucketActive
+			bucket.LastUpdated = time.Now().Format(time.RFC3339Nano)
+		})
+		if err != nil {
+			logger.Error("error reactivating bucket", "error", err)
+		}
+	case err != nil:
+		// The bucket stays in the Deleting state, the job is resumed on
+		// the next start
+		status = core.JobFailed
+	}
+
+	job.update(func(report *core.DeleteJob) {
+		report.Status = status
+		report.FinishedAt = time.Now().Format(time.RFC3339Nano)
+		if err != nil && status == core.JobFailed {
+			report.Error = err.Error()
+		}
+	})
+	report := job.snapshot()
+	logger.Info("bucket deletion finished", "status", report.Status, "objects_deleted", report.ObjectsDeleted,
+		"bytes_freed", report.BytesFreed, "error", report.Error)
+}
+
+// deleteAllObjects deletes the objects of the bucket of a job in batches,
+// checking for cancellation between them. Objects locked since the job
+// started, by an upload or a lock accepted before the bucket was hidden, are
+// kept and reported with ErrBucketHasLocked once the others are deleted.
+func (h *Handler) deleteAllObjects(ctx context.Context, job *deleteJob) error {
+	bucketName := job.report.Bucket
+	logger := slog.With("bucket", bucketName, "job", job.report.ID)
+	marker := ""
+	locked := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		listed, _, err := h.meta.List(bucketName, "", marker, deleteBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(listed) == 0 {
+			if locked > 0 {
+				return fmt.Errorf("%w, %d left", ErrBucketHasLocked, locked)
+			}
+			return nil
+		}
+
+		var batch meta.Batch
+		var objects []core.Object
+		lockedHere := 0
+		for _, object := range listed {
+			if checkObjectLock(object, job.bypassGovernance) != nil {
+				logger.Info("object is locked, keeping it", "key", object.Name)
+				lockedHere++
+				continue
+			}
+			batch.DeleteObjectIf(bucketName, object.Name, func(object core.Object) error {
+				return checkObjectLock(object, job.bypassGovernance)
+			})
+			objects = append(objects, object)
+		}
+		err = h.meta.Apply(&batch)
+		if errors.Is(err, ErrObjectLocked) {
+			// Locked since it was listed, the page is listed again
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		marker = listed[len(listed)-1].Name
+		locked += lockedHere
+
+		// The records are gone, so failing to delete the data only leaves
+		// files that go with the bucket directory and blob references the
+		// garbage collector corrects
+		var freed int64
+		for _, object := range objects {
+			if err := h.store.Delete(bucketName, object); err != nil {
+				logger.Warn("failed to delete object data", "key", object.Name, "error", err)
+			}
+			freed += parseContentLength(object)
+			h.publish(logger, bucketName, core.EventObjectRemovedDelete, object)
+		}
+
+		job.update(func(report *core.DeleteJob) {
+			report.ObjectsDeleted += int64(len(objects))
+			report.BytesFreed += freed
+		})
+	}
+}
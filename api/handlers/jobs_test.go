@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"encoding/xml"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+)
+
+// lockObject sets the object lock of an object directly in the metadata
+func lockObject(t *testing.T, h *Handler, bucketName, objectKey, mode, legalHold string) {
+	t.Helper()
+	_, err := h.meta.UpdateObject(bucketName, objectKey, func(object *core.Object) {
+		if mode != "" {
+			object.RetentionMode = mode
+			object.RetainUntilDate = time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+		}
+		object.LegalHold = legalHold
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitJob waits for a delete job to finish and returns its report
+func waitJob(t *testing.T, h *Handler, id string) core.DeleteJob {
+	t.Helper()
+	job, ok := h.jobs.get(id)
+	if !ok {
+		t.Fatalf("job %s not found", id)
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if report := job.snapshot(); report.Status != core.JobRunning {
+			return report
+		}
+	}
+	t.Fatalf("job %s still running", id)
+	return core.DeleteJob{}
+}
+
+func TestForceDeleteBucket(t *testing.T) {
+	tests := []struct {
+		name      string
+		mode      string // retention of a.txt
+		legalHold string
+		bypass    bool
+		status    int
+	}{
+		{"no lock", "", "", false, http.StatusAccepted},
+		{"governance", core.LockGovernance, "", false, http.StatusConflict},
+		{"governance bypassed", core.LockGovernance, "", true, http.StatusAccepted},
+		{"compliance bypassed", core.LockCompliance, "", true, http.StatusConflict},
+		{"legal hold bypassed", "", core.LegalHoldOn, true, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(t, nil)
+			mustServe(t, h.CreateBucket, newRequest(http.MethodPut, "/photos", ""), http.StatusOK)
+			for _, key := range []string{"a.txt", "b.txt", "c/d.txt"} {
+				mustServe(t, h.CreateObject, newRequest(http.MethodPut, "/photos/"+key, key), http.StatusOK)
+			}
+			lockObject(t, h, "photos", "a.txt", tt.mode, tt.legalHold)
+
+			r := adminRequest(http.MethodPost, "/admin/buckets/photos/force-delete", "photos", "")
+			if tt.bypass {
+				r.Header.Set(headerBypassGovernance, "true")
+			}
+			w := mustServe(t, h.ForceDeleteBucket, r, tt.status)
+
+			if tt.status != http.StatusAccepted {
+				// Nothing was deleted
+				if bucket, ok := h.meta.Bucket("photos"); !ok || bucket.Status != core.BucketActive {
+					t.Errorf("bucket = %+v, %v, want it active", bucket, ok)
+				}
+				if _, count, _ := h.meta.Usage("photos"); count != 3 {
+					t.Errorf("%d objects left, want 3", count)
+				}
+				return
+			}
+
+			var job core.DeleteJob
+			if err := xml.Unmarshal(w.Body.Bytes(), &job); err != nil {
+				t.Fatal(err)
+			}
+			report := waitJob(t, h, job.ID)
+			if report.Status != core.JobCompleted || report.ObjectsDeleted != 3 || report.BytesFreed != int64(len("a.txtb.txtc/d.txt")) {
+				t.Errorf("job = %+v, want 3 objects deleted", report)
+			}
+			if _, ok := h.meta.Bucket("photos"); ok {
+				t.Error("bucket left")
+			}
+		})
+	}
+}
+
+func TestForceDeleteLockedMeanwhile(t *testing.T) {
+	// An object locked after the request was accepted is kept, along with
+	// its bucket
+	h := newTestHandler(t, nil)
+	mustServe(t, h.CreateBucket, newRequest(http.MethodPut, "/photos", ""), http.StatusOK)
+	for _, key := range []string{"a.txt", "b.txt"} {
+		mustServe(t, h.CreateObject, newRequest(http.MethodPut, "/photos/"+key, key), http.StatusOK)
+	}
+	if _, err := h.meta.UpdateBucket("photos", func(bucket *core.Bucket) {
+		bucket.Status = core.BucketDeleting
+	}); err != nil {
+		t.Fatal(err)
+	}
+	lockObject(t, h, "photos", "b.txt", "", core.LegalHoldOn)
+
+	report := waitJob(t, h, h.startDeleteJob("photos", true).report.ID)
+	if report.Status != core.JobFailed || report.ObjectsDeleted != 1 || report.Error == "" {
+		t.Errorf("job = %+v, want it failed with 1 object deleted", report)
+	}
+	if bucket, ok := h.meta.Bucket("photos"); !ok || bucket.Status != core.BucketActive {
+		t.Errorf("bucket = %+v, %v, want it active again", bucket, ok)
+	}
+	if _, err := h.meta.Object("photos", "b.txt"); err != nil {
+		t.Errorf("locked object deleted: %v", err)
+	}
+	if _, err := h.meta.Object("photos", "a.txt"); err == nil {
+		t.Error("unlocked object kept")
+	}
+}
@@ -0,0 +1,48 @@
+package handlers
+
+import "sync"
+
+// keyLock is held while the data of an object is replaced or its object
+// lock changed
+type keyLock struct {
+	mu      sync.Mutex
+	holders int
+}
+
+// keyLocks serializes the writes to the same object that must see each
+// other's effect, such as an overwrite and a retention being set, which the
+// metadata store alone cannot order since the data is replaced before the
+// record. Locks are kept only while held or waited for.
+type keyLocks struct {
+	mu   sync.Mutex
+	keys map[string]*keyLock
+}
+
+func newKeyLocks() *keyLocks {
+	return &keyLocks{keys: make(map[string]*keyLock)}
+}
+
+// lock takes the lock of an object and returns the function releasing it
+func (k *keyLocks) lock(bucketName, objectKey string) func() {
+	id := bucketName + "/" + objectKey
+
+	k.mu.Lock()
+	l, ok := k.keys[id]
+	if !ok {
+		l = &keyLock{}
+		k.keys[id] = l
+	}
+	l.holders++
+	k.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		l.holders--
+		if l.holders == 0 {
+			delete(k.keys, id)
+		}
+	}
+}
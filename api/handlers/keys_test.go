@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeyLocks(t *testing.T) {
+	k := newKeyLocks()
+	unlock := k.lock("photos", "a.txt")
+
+	// Another object is not held up
+	k.lock("photos", "b.txt")()
+
+	acquired, released := make(chan struct{}), make(chan struct{})
+	go func() {
+		unlock := k.lock("photos", "a.txt")
+		close(acquired)
+		unlock()
+		close(released)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("lock of a held object acquired")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlock()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("lock not acquired once released")
+	}
+	<-released
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if len(k.keys) != 0 {
+		t.Errorf("%d locks kept after release", len(k.keys))
+	}
+}
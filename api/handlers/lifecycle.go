@@ -0,0 +1,403 @@
+package handlers
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/meta"
+	"github.com/ab-dauletkhan/triple-s/api/storage"
+	"github.com/ab-dauletkhan/triple-s/api/util"
+)
+
+var (
+	ErrDuplicateLifecycleID = errors.New("lifecycle rule IDs must be unique")
+	ErrInvalidLifecycleRule = errors.New("rule status must be Enabled or Disabled")
+	ErrInvalidTransition    = errors.New("transition needs the COLD storage class and non-negative days")
+	ErrInvalidRestoreDays   = errors.New("restore days must be a positive number")
+	ErrInvalidObjectState   = errors.New("InvalidObjectState: the object is in the COLD storage class and must be restored first")
+	ErrNotRestorable        = errors.New("InvalidObjectState: only objects of the COLD storage class can be restored")
+	ErrRestoreRequest       = errors.New("POST on an object needs the restore query parameter")
+)
+
+const (
+	headerStorageClass = "x-amz-storage-class"
+	headerRestore      = "x-amz-restore"
+)
+
+// GetBucketLifecycle returns the lifecycle rules of a bucket
+func (h *Handler) GetBucketLifecycle(w http.ResponseWriter, r *http.Request) {
+	bucketName := r.PathValue("BucketName")
+	logger := core.Logger(r.Context()).With("bucket", bucketName)
+
+	bucket, ok := h.meta.Bucket(bucketName)
+	if !ok {
+		logger.Info("bucket not found")
+		XMLErrResponse(w, http.StatusNotFound, ErrBucketNotFound.Error())
+		return
+	}
+	XMLResponse(w, http.StatusOK, core.LifecycleConfiguration{Rules: bucket.Lifecycle})
+}
+
+// PutBucketLifecycle replaces the lifecycle rules of a bucket with the ones
+// of a LifecycleConfiguration XML document. The objects already old enough
+// are moved by the next transition run.
+func (h *Handler) PutBucketLifecycle(w http.ResponseWriter, r *http.Request) {
+	logger := core.Logger(r.Context()).With("bucket", r.PathValue("BucketName"))
+
+	var config core.LifecycleConfiguration
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&config); err != nil {
+		logger.Info("invalid lifecycle document", "error", err)
+		XMLErrResponse(w, http.StatusBadRequest, "Malformed lifecycle XML")
+		return
+	}
+
+	if !h.store.ColdEnabled() {
+		logger.Info("no cold directory configured")
+		XMLErrResponse(w, http.StatusBadRequest, storage.ErrNoColdDir.Error())
+		return
+	}
+	if err := validateLifecycle(&config); err != nil {
+		logger.Info("invalid lifecycle configuration", "error", err)
+		XMLErrResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.setBucketLifecycle(w, r, config)
+}
+
+// DeleteBucketLifecycle removes the lifecycle rules of a bucket. Objects
+// already moved stay in the COLD storage class.
+func (h *Handler) DeleteBucketLifecycle(w http.ResponseWriter, r *http.Request) {
+	h.setBucketLifecycle(w, r, core.LifecycleConfiguration{})
+}
+
+func (h *Handler) setBucketLifecycle(w http.ResponseWriter, r *http.Request, config core.LifecycleConfiguration) {
+	bucketName := r.PathValue("BucketName")
+	logger := core.Logger(r.Context()).With("bucket", bucketName)
+
+	_, err := h.meta.UpdateBucket(bucketName, func(bucket *core.Bucket) {
+		bucket.Lifecycle = config.Rules
+	})
+	if !h.bucketUpdated(w, logger, err) {
+		return
+	}
+
+	logger.Info("bucket lifecycle updated", "rules", len(config.Rules))
+	if r.Method == http.MethodDelete {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	XMLResponse(w, http.StatusOK, config)
+}
+
+// validateLifecycle checks the rules of config, naming the rules without
+// an ID after their position
+func validateLifecycle(config *core.LifecycleConfiguration) error {
+	ids := make(map[string]bool)
+	for i := range config.Rules {
+		rule := &config.Rules[i]
+		if rule.ID == "" {
+			rule.ID = "rule-" + strconv.Itoa(i+1)
+		}
+		if ids[rule.ID] {
+			return fmt.Errorf("%w: %s", ErrDuplicateLifecycleID, rule.ID)
+		}
+		ids[rule.ID] = true
+
+		if rule.Status != core.RuleEnabled && rule.Status != core.RuleDisabled {
+			return fmt.Errorf("%s: %w", rule.ID, ErrInvalidLifecycleRule)
+		}
+		if rule.Transition.StorageClass != core.StorageCold || rule.Transition.Days < 0 {
+			return fmt.Errorf("%s: %w", rule.ID, ErrInvalidTransition)
+		}
+	}
+	return nil
+}
+
+// transitionDue reports whether an enabled rule of bucket moves object to
+// the COLD storage class at now
+func transitionDue(bucket core.Bucket, object core.Object, now time.Time) bool {
+	modified, err := time.Parse(time.RFC3339Nano, object.LastModified)
+	if err != nil {
+		return false
+	}
+	for _, rule := range bucket.Lifecycle {
+		if rule.Status == core.RuleEnabled && strings.HasPrefix(object.Name, rule.Prefix) &&
+			now.Sub(modified) >= time.Duration(rule.Transition.Days)*24*time.Hour {
+			return true
+		}
+	}
+	return false
+}
+
+// restored reports whether a COLD object can be read at now
+func restored(object core.Object, now time.Time) bool {
+	expiry, err := time.Parse(time.RFC3339Nano, object.RestoreExpiryDate)
+	return err == nil && now.Before(expiry)
+}
+
+// setStorageClassHeaders describes the storage class of an object, and the
+// restore of a COLD one, like S3 does
+func setStorageClassHeaders(w http.ResponseWriter, object core.Object) {
+	if object.StorageClass != core.StorageCold {
+		return
+	}
+	w.Header().Set(headerStorageClass, object.StorageClass)
+	if object.RestoreExpiryDate != "" {
+		w.Header().Set(headerRestore, fmt.Sprintf(`ongoing-request="false", expiry-date="%s"`, httpDate(object.RestoreExpiryDate)))
+	}
+}
+
+// RestoreObject makes an object of the COLD storage class readable for the
+// days given by a RestoreRequest XML document, copying it back to the data
+// directory of its bucket. Restoring it again changes when the restore
+// expires. 202 Accepted is returned for a new restore, 200 OK otherwise.
+func (h *Handler) RestoreObject(w http.ResponseWriter, r *http.Request) {
+	bucketName, objectKey := ParsePath(r.URL.Path)
+	logger := core.Logger(r.Context()).With("bucket", bucketName, "key", objectKey)
+	if !r.URL.Query().Has("restore") {
+		logger.Info("unsupported object POST")
+		XMLErrResponse(w, http.StatusBadRequest, ErrRestoreRequest.Error())
+		return
+	}
+	if bucketName == "" || objectKey == "" {
+		logger.Info("invalid bucket or object key")
+		XMLErrResponse(w, http.StatusBadRequest, "Invalid bucket or object key")
+		return
+	}
+
+	if err := util.ValidateObjectKey(objectKey); err != nil {
+		logger.Info("invalid object key", "error", err)
+		XMLErrResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if _, ok := h.activeBucket(bucketName); !ok {
+		logger.Info("bucket not found")
+		XMLErrResponse(w, http.StatusNotFound, "Bucket not found")
+		return
+	}
+
+	var request core.RestoreRequest
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&request); err != nil {
+		logger.Info("invalid restore document", "error", err)
+		XMLErrResponse(w, http.StatusBadRequest, "Malformed restore XML")
+		return
+	}
+	if request.Days <= 0 {
+		logger.Info("invalid restore days", "days", request.Days)
+		XMLErrResponse(w, http.StatusBadRequest, ErrInvalidRestoreDays.Error())
+		return
+	}
+
+	object, err := h.meta.Object(bucketName, objectKey)
+	if err != nil {
+		logger.Info("object not found")
+		XMLErrResponse(w, http.StatusNotFound, "Object not found")
+		return
+	}
+	if object.Storage != storage.KindCold {
+		logger.Info("object is not cold", "storage_class", object.StorageClass)
+		XMLErrResponse(w, http.StatusForbidden, ErrNotRestorable.Error())
+		return
+	}
+
+	release, ok := h.beginWrite(w, logger, bucketName)
+	if !ok {
+		return
+	}
+	defer release()
+
+	now := time.Now()
+	status := http.StatusOK
+	if !restored(object, now) {
+		if err := h.store.Restore(bucketName, object); err != nil {
+			logger.Error("failed to restore object", "error", err)
+			XMLErrResponse(w, http.StatusInternalServerError, "Failed to restore object")
+			return
+		}
+		status = http.StatusAccepted
+	}
+
+	expiry := now.Add(time.Duration(request.Days) * 24 * time.Hour).UTC().Format(time.RFC3339Nano)
+	updated, err := h.meta.UpdateObject(bucketName, objectKey, func(o *core.Object) {
+		if o.LastModified == object.LastModified && o.Digest == object.Digest {
+			o.RestoreExpiryDate = expiry
+		}
+	})
+	switch {
+	case errors.Is(err, meta.ErrNoSuchKey) || (err == nil && updated.RestoreExpiryDate != expiry):
+		logger.Info("object replaced during the restore")
+		if updated.Storage != storage.KindCold || updated.Digest != object.Digest {
+			h.store.Unrestore(bucketName, object)
+		}
+		XMLErrResponse(w, http.StatusConflict, "Object was replaced during the restore")
+		return
+	case err != nil:
+		logger.Error("failed to record restore", "error", err)
+		XMLErrResponse(w, http.StatusInternalServerError, ErrInternalServer.Error())
+		return
+	}
+
+	logger.Info("object restored", "days", request.Days, "expiry", expiry)
+	setStorageClassHeaders(w, updated)
+	w.WriteHeader(status)
+}
+
+// pendingObject is an object of a bucket a transition run acts on
+type pendingObject struct {
+	bucket string
+	object core.Object
+}
+
+// Transition moves the objects matching the lifecycle rules of their bucket
+// to the COLD storage class, removes the restored copies that expired and
+// deletes the files of the cold directory no object points at
+func (h *Handler) Transition() (core.TransitionReport, error) {
+	var report core.TransitionReport
+	now := time.Now()
+
+	buckets := make(map[string]core.Bucket)
+	for _, bucket := range h.meta.Buckets() {
+		buckets[bucket.Name] = bucket
+	}
+
+	cold := make(map[string][]core.Object)
+	var due, expired []pendingObject
+	h.meta.Walk(func(bucketName string, object core.Object) {
+		if object.Storage == storage.KindCold {
+			cold[bucketName] = append(cold[bucketName], object)
+			if object.RestoreExpiryDate != "" && !restored(object, now) {
+				expired = append(expired, pendingObject{bucketName, object})
+			}
+			return
+		}
+		bucket := buckets[bucketName]
+		if bucket.Status != core.BucketActive || len(bucket.Lifecycle) == 0 {
+			return
+		}
+		report.Scanned++
+		if transitionDue(bucket, object, now) {
+			due = append(due, pendingObject{bucketName, object})
+		}
+	})
+
+	if h.store.ColdEnabled() {
+		for _, p := range due {
+			if err := h.transitionObject(p.bucket, p.object); err != nil {
+				slog.Warn("transition failed", "bucket", p.bucket, "key", p.object.Name, "error", err)
+				report.Failed++
+				continue
+			}
+			report.Transitioned++
+			report.TransitionedSize += parseContentLength(p.object)
+		}
+	}
+
+	for _, p := range expired {
+		if err := h.expireRestore(p.bucket, p.object); err != nil {
+			slog.Warn("failed to remove expired restore", "bucket", p.bucket, "key", p.object.Name, "error", err)
+			continue
+		}
+		report.RestoresExpired++
+	}
+
+	removed, err := h.store.SweepCold(cold, gcGracePeriod)
+	report.OrphansRemoved = removed
+	return report, err
+}
+
+// transitionObject moves an object to the cold directory. An object
+// changed meanwhile is left as it is, and the cold copy is removed by the
+// sweep of a later run.
+func (h *Handler) transitionObject(bucketName string, object core.Object) error {
+	release, err := h.store.BeginWrite(bucketName)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	cold, err := h.store.Transition(bucketName, object)
+	if err != nil {
+		return err
+	}
+
+	updated, err := h.meta.UpdateObject(bucketName, object.Name, func(o *core.Object) {
+		if o.LastModified == object.LastModified && o.Storage == object.Storage && o.Digest == object.Digest {
+			o.Digest = cold.Digest
+			o.Storage = cold.Storage
+			o.StorageClass = cold.StorageClass
+			o.RestoreExpiryDate = ""
+		}
+	})
+	if errors.Is(err, meta.ErrNoSuchKey) || errors.Is(err, meta.ErrNoSuchBucket) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if updated.Storage != storage.KindCold || updated.LastModified != object.LastModified {
+		return nil
+	}
+	return h.store.Delete(bucketName, object)
+}
+
+// expireRestore removes the restored copy of a COLD object once the restore
+// expired, unless the object was restored again meanwhile
+func (h *Handler) expireRestore(bucketName string, object core.Object) error {
+	release, err := h.store.BeginWrite(bucketName)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	updated, err := h.meta.UpdateObject(bucketName, object.Name, func(o *core.Object) {
+		if o.LastModified == object.LastModified && o.RestoreExpiryDate == object.RestoreExpiryDate {
+			o.RestoreExpiryDate = ""
+		}
+	})
+	if errors.Is(err, meta.ErrNoSuchKey) || errors.Is(err, meta.ErrNoSuchBucket) {
+		return nil
+	}
+	if err != nil || updated.RestoreExpiryDate != "" {
+		return err
+	}
+	return h.store.Unrestore(bucketName, updated)
+}
+
+// runTransitions applies the lifecycle rules periodically
+func (h *Handler) runTransitions() {
+	for range time.Tick(time.Duration(h.cfg.Storage.Cold.TransitionInterval)) {
+		report, err := h.Transition()
+		if err != nil {
+			slog.Error("transition failed", "error", err)
+			continue
+		}
+		slog.Info("transition finished", "scanned", report.Scanned, "transitioned", report.Transitioned,
+			"transitioned_bytes", report.TransitionedSize, "failed", report.Failed,
+			"restores_expired", report.RestoresExpired, "orphans_removed", report.OrphansRemoved)
+	}
+}
+
+// RunTransition applies the lifecycle rules on demand and reports what it did
+func (h *Handler) RunTransition(w http.ResponseWriter, r *http.Request) {
+	logger := core.Logger(r.Context())
+
+	report, err := h.Transition()
+	if err != nil {
+		logger.Error("transition failed", "error", err)
+		XMLErrResponse(w, http.StatusInternalServerError, ErrInternalServer.Error())
+		return
+	}
+
+	logger.Info("transition finished", "transitioned", report.Transitioned, "failed", report.Failed)
+	XMLResponse(w, http.StatusOK, report)
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/storage"
+)
+
+const lifecycle = `<LifecycleConfiguration><Rule><ID>archive</ID><Status>Enabled</Status>` +
+	`<Filter><Prefix>logs/</Prefix></Filter><Transition><Days>0</Days><StorageClass>COLD</StorageClass></Transition></Rule></LifecycleConfiguration>`
+
+// newColdHandler opens a handler with a cold directory and the bucket
+// photos, whose objects under logs/ move to the COLD class right away
+func newColdHandler(t *testing.T) *Handler {
+	t.Helper()
+	h := newTestHandler(t, func(cfg *core.Config) {
+		cfg.Storage.Cold.Dir = filepath.Join(t.TempDir(), "cold")
+	})
+	mustServe(t, h.CreateBucket, newRequest(http.MethodPut, "/photos", ""), http.StatusOK)
+	mustServe(t, h.PutBucketLifecycle, adminRequest(http.MethodPut, "/photos?lifecycle", "photos", lifecycle), http.StatusOK)
+	return h
+}
+
+func TestTransition(t *testing.T) {
+	h := newColdHandler(t)
+	for _, key := range []string{"logs/a.txt", "logs/b.txt", "a.txt"} {
+		mustServe(t, h.CreateObject, newRequest(http.MethodPut, "/photos/"+key, "content of "+key), http.StatusOK)
+	}
+
+	report, err := h.Transition()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Scanned != 3 || report.Transitioned != 2 || report.Failed != 0 {
+		t.Errorf("Transition() = %+v, want 2 of 3 objects moved", report)
+	}
+
+	tests := []struct {
+		key    string
+		class  string
+		status int // of a GET, cold objects must be restored first
+	}{
+		{"logs/a.txt", core.StorageCold, http.StatusForbidden},
+		{"logs/b.txt", core.StorageCold, http.StatusForbidden},
+		{"a.txt", core.StorageStandard, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			object, err := h.meta.Object("photos", tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if object.StorageClass != tt.class {
+				t.Errorf("storage class = %q, want %q", object.StorageClass, tt.class)
+			}
+			w := mustServe(t, h.GetObject, newRequest(http.MethodGet, "/photos/"+tt.key, ""), tt.status)
+			if tt.status == http.StatusOK && w.Body.String() != "content of "+tt.key {
+				t.Errorf("GET = %q", w.Body)
+			}
+		})
+	}
+
+	// Cold objects are not scanned again
+	if report, err := h.Transition(); err != nil || report.Scanned != 1 || report.Transitioned != 0 {
+		t.Errorf("second Transition() = %+v, %v", report, err)
+	}
+}
+
+func TestRestoreObject(t *testing.T) {
+	h := newColdHandler(t)
+	mustServe(t, h.CreateObject, newRequest(http.MethodPut, "/photos/logs/a.txt", "a"), http.StatusOK)
+	mustServe(t, h.CreateObject, newRequest(http.MethodPut, "/photos/a.txt", "a"), http.StatusOK)
+	if _, err := h.Transition(); err != nil {
+		t.Fatal(err)
+	}
+
+	restore := `<RestoreRequest><Days>1</Days></RestoreRequest>`
+	tests := []struct {
+		name   string
+		path   string
+		body   string
+		status int
+	}{
+		{"new restore", "/photos/logs/a.txt?restore", restore, http.StatusAccepted},
+		{"restored again", "/photos/logs/a.txt?restore", restore, http.StatusOK},
+		{"not cold", "/photos/a.txt?restore", restore, http.StatusForbidden},
+		{"no days", "/photos/logs/a.txt?restore", `<RestoreRequest><Days>0</Days></RestoreRequest>`, http.StatusBadRequest},
+		{"malformed", "/photos/logs/a.txt?restore", "<RestoreRequest>", http.StatusBadRequest},
+		{"no restore parameter", "/photos/logs/a.txt", restore, http.StatusBadRequest},
+		{"unknown key", "/photos/logs/b.txt?restore", restore, http.StatusNotFound},
+		{"unknown bucket", "/videos/a.txt?restore", restore, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := mustServe(t, h.RestoreObject, newRequest(http.MethodPost, tt.path, tt.body), tt.status)
+			if tt.status < 300 && w.Header().Get(headerRestore) == "" {
+				t.Errorf("%s header missing", headerRestore)
+			}
+		})
+	}
+
+	w := mustServe(t, h.GetObject, newRequest(http.MethodGet, "/photos/logs/a.txt", ""), http.StatusOK)
+	if w.Body.String() != "a" || w.Header().Get(headerStorageClass) != core.StorageCold {
+		t.Errorf("GET of the restored object = %q, storage class %q", w.Body, w.Header().Get(headerStorageClass))
+	}
+
+	// An expired restore is removed by the next run, the object staying cold
+	_, err := h.meta.UpdateObject("photos", "logs/a.txt", func(o *core.Object) {
+		o.RestoreExpiryDate = time.Now().Add(-time.Minute).UTC().Format(time.RFC3339Nano)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := h.Transition()
+	if err != nil || report.RestoresExpired != 1 {
+		t.Fatalf("Transition() = %+v, %v, want the restore expired", report, err)
+	}
+	updated, _ := h.meta.Object("photos", "logs/a.txt")
+	if updated.RestoreExpiryDate != "" || updated.Storage != storage.KindCold {
+		t.Errorf("object after the restore expired = %+v", updated)
+	}
+	mustServe(t, h.GetObject, newRequest(http.MethodGet, "/photos/logs/a.txt", ""), http.StatusForbidden)
+}
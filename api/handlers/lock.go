@@ -0,0 +1,424 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/xml"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/meta"
+	"github.com/ab-dauletkhan/triple-s/api/util"
+)
+
+var (
+	ErrObjectLocked          = errors.New("object is protected by object lock")
+	ErrBucketHasLocked       = errors.New("bucket holds objects protected by object lock")
+	ErrObjectLockDisabled    = errors.New("object lock is not enabled on the bucket")
+	ErrObjectLockNotFound    = errors.New("object lock configuration not found")
+	ErrNoRetention           = errors.New("object has no retention")
+	ErrInvalidLockMode       = errors.New("retention mode must be GOVERNANCE or COMPLIANCE")
+	ErrInvalidRetainUntil    = errors.New("retain until date must be an RFC 3339 time in the future")
+	ErrInvalidRetention      = errors.New("retention mode and retain until date must be given together")
+	ErrInvalidRetentionTerm  = errors.New("default retention needs either a positive number of days or of years")
+	ErrInvalidLockEnabled    = errors.New("ObjectLockEnabled must be Enabled, object lock cannot be turned off")
+	ErrInvalidLegalHold      = errors.New("legal hold status must be ON or OFF")
+	ErrLegalHoldUnprivileged = errors.New("turning a legal hold off requires the admin token")
+)
+
+// Headers of the S3 object lock API
+const (
+	headerLockMode         = "x-amz-object-lock-mode"
+	headerLockRetainUntil  = "x-amz-object-lock-retain-until-date"
+	headerLockLegalHold    = "x-amz-object-lock-legal-hold"
+	headerBucketLock       = "x-amz-bucket-object-lock-enabled"
+	headerBypassGovernance = "x-amz-bypass-governance-retention"
+)
+
+// checkObjectLock fails with ErrObjectLocked when object may not be
+// overwritten or deleted. A governance retention is lifted by bypass, a
+// compliance retention and a legal hold are not.
+func checkObjectLock(object core.Object, bypass bool) error {
+	if object.LegalHold == core.LegalHoldOn {
+		return ErrObjectLocked
+	}
+	if !retentionActive(object) {
+		return nil
+	}
+	if object.RetentionMode == core.LockGovernance && bypass {
+		return nil
+	}
+	return ErrObjectLocked
+}
+
+// writable reports whether the object being uploaded may replace the
+// current one, writing the error response when it may not
+func (h *Handler) writable(w http.ResponseWriter, logger *slog.Logger, r *http.Request, bucketName, objectKey string) bool {
+	old, err := h.meta.Object(bucketName, objectKey)
+	if err != nil {
+		return true
+	}
+	if err := checkObjectLock(old, h.bypassGovernance(r)); err != nil {
+		logger.Info("object is locked", "mode", old.RetentionMode, "retain_until", old.RetainUntilDate, "legal_hold", old.LegalHold)
+		XMLErrResponse(w, http.StatusForbidden, err.Error())
+		return false
+	}
+	return true
+}
+
+// retentionActive reports whether the retention of object has not expired
+func retentionActive(object core.Object) bool {
+	until, err := time.Parse(time.RFC3339, object.RetainUntilDate)
+	return object.RetentionMode != "" && err == nil && until.After(time.Now())
+}
+
+// privileged reports whether the request carries the admin token
+func (h *Handler) privileged(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && h.cfg.Admin.Token != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(h.cfg.Admin.Token)) == 1
+}
+
+// bypassGovernance reports whether the request asks to lift governance
+// retentions and is allowed to
+func (h *Handler) bypassGovernance(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get(headerBypassGovernance), "true") && h.privileged(r)
+}
+
+// parseRetention validates a retention, normalizing its date to UTC. An
+// empty retention is valid and means none.
+func parseRetention(retention core.Retention) (core.Retention, error) {
+	if retention.Mode == "" && retention.RetainUntilDate == "" {
+		return retention, nil
+	}
+	if retention.Mode == "" || retention.RetainUntilDate == "" {
+		return retention, ErrInvalidRetention
+	}
+	if retention.Mode != core.LockGovernance && retention.Mode != core.LockCompliance {
+		return retention, ErrInvalidLockMode
+	}
+	until, err := time.Parse(time.RFC3339, retention.RetainUntilDate)
+	if err != nil || !until.After(time.Now()) {
+		return retention, ErrInvalidRetainUntil
+	}
+	retention.RetainUntilDate = until.UTC().Format(time.RFC3339)
+	return retention, nil
+}
+
+// applyObjectLockHeaders sets the retention and legal hold of a new object
+// from the request headers, or the default retention of its bucket
+func applyObjectLockHeaders(r *http.Request, bucket core.Bucket, object *core.Object) error {
+	retention := core.Retention{
+		Mode:            r.Header.Get(headerLockMode),
+		RetainUntilDate: r.Header.Get(headerLockRetainUntil),
+	}
+	legalHold := r.Header.Get(headerLockLegalHold)
+
+	if bucket.ObjectLock != core.ObjectLockEnabled {
+		if retention.Mode != "" || retention.RetainUntilDate != "" || legalHold != "" {
+			return ErrObjectLockDisabled
+		}
+		return nil
+	}
+
+	retention, err := parseRetention(retention)
+	if err != nil {
+		return err
+	}
+	if retention.Mode == "" && bucket.DefaultRetentionMode != "" {
+		retention.Mode = bucket.DefaultRetentionMode
+		retention.RetainUntilDate = time.Now().UTC().AddDate(0, 0, int(bucket.DefaultRetentionDays)).Format(time.RFC3339)
+	}
+	object.RetentionMode = retention.Mode
+	object.RetainUntilDate = retention.RetainUntilDate
+
+	switch legalHold {
+	case "", core.LegalHoldOff:
+		object.LegalHold = ""
+	case core.LegalHoldOn:
+		object.LegalHold = core.LegalHoldOn
+	default:
+		return ErrInvalidLegalHold
+	}
+	return nil
+}
+
+// GetObjectLockConfiguration returns the object lock configuration of a bucket
+func (h *Handler) GetObjectLockConfiguration(w http.ResponseWriter, r *http.Request) {
+	bucketName := r.PathValue("BucketName")
+	logger := core.Logger(r.Context()).With("bucket", bucketName)
+
+	bucket, ok := h.meta.Bucket(bucketName)
+	if !ok {
+		logger.Info("bucket not found")
+		XMLErrResponse(w, http.StatusNotFound, ErrBucketNotFound.Error())
+		return
+	}
+	if bucket.ObjectLock != core.ObjectLockEnabled {
+		logger.Info("object lock not enabled")
+		XMLErrResponse(w, http.StatusNotFound, ErrObjectLockNotFound.Error())
+		return
+	}
+
+	config := core.ObjectLockConfiguration{ObjectLockEnabled: bucket.ObjectLock}
+	if bucket.DefaultRetentionMode != "" {
+		config.Rule = &core.ObjectLockRule{DefaultRetention: core.DefaultRetention{
+			Mode: bucket.DefaultRetentionMode,
+			Days: bucket.DefaultRetentionDays,
+		}}
+	}
+	XMLResponse(w, http.StatusOK, config)
+}
+
+// PutObjectLockConfiguration enables object lock on a bucket and sets or
+// removes its default retention. Years are counted as 365 days. Objects
+// already stored keep their retention.
+func (h *Handler) PutObjectLockConfiguration(w http.ResponseWriter, r *http.Request) {
+	bucketName := r.PathValue("BucketName")
+	logger := core.Logger(r.Context()).With("bucket", bucketName)
+
+	var config core.ObjectLockConfiguration
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&config); err != nil {
+		logger.Info("invalid object lock document", "error", err)
+		XMLErrResponse(w, http.StatusBadRequest, "Malformed object lock XML")
+		return
+	}
+
+	if config.ObjectLockEnabled != core.ObjectLockEnabled {
+		logger.Info("invalid object lock state", "enabled", config.ObjectLockEnabled)
+		XMLErrResponse(w, http.StatusBadRequest, ErrInvalidLockEnabled.Error())
+		return
+	}
+
+	var mode string
+	var days int64
+	if config.Rule != nil {
+		retention := config.Rule.DefaultRetention
+		if retention.Mode != core.LockGovernance && retention.Mode != core.LockCompliance {
+			logger.Info("invalid default retention mode", "mode", retention.Mode)
+			XMLErrResponse(w, http.StatusBadRequest, ErrInvalidLockMode.Error())
+			return
+		}
+		if (retention.Days > 0) == (retention.Years > 0) || retention.Days < 0 || retention.Years < 0 {
+			logger.Info("invalid default retention term", "days", retention.Days, "years", retention.Years)
+			XMLErrResponse(w, http.StatusBadRequest, ErrInvalidRetentionTerm.Error())
+			return
+		}
+		mode, days = retention.Mode, retention.Days+retention.Years*365
+	}
+
+	_, err := h.meta.UpdateBucket(bucketName, func(bucket *core.Bucket) {
+		bucket.ObjectLock = core.ObjectLockEnabled
+		bucket.DefaultRetentionMode = mode
+		bucket.DefaultRetentionDays = days
+	})
+	if !h.bucketUpdated(w, logger, err) {
+		return
+	}
+
+	logger.Info("bucket object lock updated", "default_mode", mode, "default_days", days)
+	XMLResponse(w, http.StatusOK, config)
+}
+
+// GetObjectRetention returns the retention of an object, for
+// GET /{bucket}/{key}?retention
+func (h *Handler) GetObjectRetention(w http.ResponseWriter, r *http.Request) {
+	_, object, logger, ok := h.lockTarget(w, r)
+	if !ok {
+		return
+	}
+	if object.RetentionMode == "" {
+		logger.Info("object has no retention")
+		XMLErrResponse(w, http.StatusNotFound, ErrNoRetention.Error())
+		return
+	}
+	XMLResponse(w, http.StatusOK, core.Retention{Mode: object.RetentionMode, RetainUntilDate: object.RetainUntilDate})
+}
+
+// PutObjectRetention sets the retention of an object, for
+// PUT /{bucket}/{key}?retention. A retention can always be extended, or
+// turned from governance to compliance. Shortening or removing a governance
+// retention needs the governance bypass, a compliance retention cannot be
+// weakened before it expires.
+func (h *Handler) PutObjectRetention(w http.ResponseWriter, r *http.Request) {
+	// Held from the read of the object to its update, as uploads do
+	defer h.keys.lock(ParsePath(r.URL.Path))()
+	bucket, object, logger, ok := h.lockTarget(w, r)
+	if !ok {
+		return
+	}
+	if bucket.ObjectLock != core.ObjectLockEnabled {
+		logger.Info("object lock not enabled")
+		XMLErrResponse(w, http.StatusBadRequest, ErrObjectLockDisabled.Error())
+		return
+	}
+
+	var retention core.Retention
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&retention); err != nil {
+		logger.Info("invalid retention document", "error", err)
+		XMLErrResponse(w, http.StatusBadRequest, "Malformed retention XML")
+		return
+	}
+	retention, err := parseRetention(retention)
+	if err != nil {
+		logger.Info("invalid retention", "error", err)
+		XMLErrResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if weakensRetention(object, retention) && (object.RetentionMode == core.LockCompliance || !h.bypassGovernance(r)) {
+		logger.Info("retention cannot be weakened", "mode", object.RetentionMode, "retain_until", object.RetainUntilDate)
+		XMLErrResponse(w, http.StatusForbidden, ErrObjectLocked.Error())
+		return
+	}
+
+	_, err = h.meta.UpdateObject(bucket.Name, object.Name, func(object *core.Object) {
+		object.RetentionMode = retention.Mode
+		object.RetainUntilDate = retention.RetainUntilDate
+	})
+	if !h.objectUpdated(w, logger, err) {
+		return
+	}
+
+	logger.Info("object retention updated", "mode", retention.Mode, "retain_until", retention.RetainUntilDate)
+	XMLResponse(w, http.StatusOK, retention)
+}
+
+// weakensRetention reports whether replacing the active retention of
+// object with retention shortens or relaxes it
+func weakensRetention(object core.Object, retention core.Retention) bool {
+	if !retentionActive(object) {
+		return false
+	}
+	if retention.Mode == "" || (object.RetentionMode == core.LockCompliance && retention.Mode != core.LockCompliance) {
+		return true
+	}
+	oldUntil, _ := time.Parse(time.RFC3339, object.RetainUntilDate)
+	newUntil, _ := time.Parse(time.RFC3339, retention.RetainUntilDate)
+	return newUntil.Before(oldUntil)
+}
+
+// GetObjectLegalHold returns the legal hold status of an object, for
+// GET /{bucket}/{key}?legal-hold
+func (h *Handler) GetObjectLegalHold(w http.ResponseWriter, r *http.Request) {
+	_, object, _, ok := h.lockTarget(w, r)
+	if !ok {
+		return
+	}
+	status := core.LegalHoldOff
+	if object.LegalHold == core.LegalHoldOn {
+		status = core.LegalHoldOn
+	}
+	XMLResponse(w, http.StatusOK, core.LegalHold{Status: status})
+}
+
+// PutObjectLegalHold turns the legal hold of an object on or off, for
+// PUT /{bucket}/{key}?legal-hold. Only privileged users can turn it off.
+func (h *Handler) PutObjectLegalHold(w http.ResponseWriter, r *http.Request) {
+	// Held from the read of the object to its update, as uploads do
+	defer h.keys.lock(ParsePath(r.URL.Path))()
+	bucket, object, logger, ok := h.lockTarget(w, r)
+	if !ok {
+		return
+	}
+	if bucket.ObjectLock != core.ObjectLockEnabled {
+		logger.Info("object lock not enabled")
+		XMLErrResponse(w, http.StatusBadRequest, ErrObjectLockDisabled.Error())
+		return
+	}
+
+	var legalHold core.LegalHold
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&legalHold); err != nil {
+		logger.Info("invalid legal hold document", "error", err)
+		XMLErrResponse(w, http.StatusBadRequest, "Malformed legal hold XML")
+		return
+	}
+	if legalHold.Status != core.LegalHoldOn && legalHold.Status != core.LegalHoldOff {
+		logger.Info("invalid legal hold status", "status", legalHold.Status)
+		XMLErrResponse(w, http.StatusBadRequest, ErrInvalidLegalHold.Error())
+		return
+	}
+	if legalHold.Status == core.LegalHoldOff && object.LegalHold == core.LegalHoldOn && !h.privileged(r) {
+		logger.Warn("rejected legal hold removal")
+		XMLErrResponse(w, http.StatusForbidden, ErrLegalHoldUnprivileged.Error())
+		return
+	}
+
+	_, err := h.meta.UpdateObject(bucket.Name, object.Name, func(object *core.Object) {
+		object.LegalHold = ""
+		if legalHold.Status == core.LegalHoldOn {
+			object.LegalHold = core.LegalHoldOn
+		}
+	})
+	if !h.objectUpdated(w, logger, err) {
+		return
+	}
+
+	logger.Info("object legal hold updated", "status", legalHold.Status)
+	XMLResponse(w, http.StatusOK, legalHold)
+}
+
+// lockTarget looks up the bucket and object of an object lock request,
+// writing the error response when either does not exist
+func (h *Handler) lockTarget(w http.ResponseWriter, r *http.Request) (core.Bucket, core.Object, *slog.Logger, bool) {
+	bucketName, objectKey := ParsePath(r.URL.Path)
+	logger := core.Logger(r.Context()).With("bucket", bucketName, "key", objectKey)
+
+	if err := util.ValidateObjectKey(objectKey); err != nil {
+		logger.Info("invalid object key", "error", err)
+		XMLErrResponse(w, http.StatusBadRequest, err.Error())
+		return core.Bucket{}, core.Object{}, logger, false
+	}
+
+	bucket, ok := h.activeBucket(bucketName)
+	if !ok {
+		logger.Info("bucket not found")
+		XMLErrResponse(w, http.StatusNotFound, "Bucket not found")
+		return core.Bucket{}, core.Object{}, logger, false
+	}
+
+	object, err := h.meta.Object(bucketName, objectKey)
+	if err != nil {
+		logger.Info("object not found")
+		XMLErrResponse(w, http.StatusNotFound, "Object not found")
+		return core.Bucket{}, core.Object{}, logger, false
+	}
+	return bucket, object, logger, true
+}
+
+// objectUpdated reports whether an object record was updated, writing the
+// error response when it was not
+func (h *Handler) objectUpdated(w http.ResponseWriter, logger *slog.Logger, err error) bool {
+	switch {
+	case errors.Is(err, meta.ErrNoSuchBucket):
+		logger.Info("bucket not found")
+		XMLErrResponse(w, http.StatusNotFound, "Bucket not found")
+		return false
+	case errors.Is(err, meta.ErrNoSuchKey):
+		logger.Info("object not found")
+		XMLErrResponse(w, http.StatusNotFound, "Object not found")
+		return false
+	case err != nil:
+		logger.Error("error updating object record", "error", err)
+		XMLErrResponse(w, http.StatusInternalServerError, ErrInternalServer.Error())
+		return false
+	}
+	return true
+}
+
+// lockedObjects counts the objects of a bucket that may not be deleted
+func (h *Handler) lockedObjects(bucketName string, bypass bool) int {
+	objects, _, _ := h.meta.List(bucketName, "", "", 0)
+
+	locked := 0
+	for _, object := range objects {
+		if checkObjectLock(object, bypass) != nil {
+			locked++
+		}
+	}
+	return locked
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/metrics"
+	"github.com/ab-dauletkhan/triple-s/api/util"
+)
+
+// Metrics serves the Prometheus metrics: request counters, per-bucket
+// object counts, sizes and replication backlog, the erasure coding disks
+// online, the buckets placed on each data directory and the disk space of
+// the data directory.
+func (h *Handler) Metrics(w http.ResponseWriter, r *http.Request) {
+	logger := core.Logger(r.Context())
+
+	w.Header().Set("Content-Type", metrics.ContentType)
+	mw := metrics.NewWriter(w)
+	h.metrics.Write(mw)
+	h.writeBucketMetrics(mw)
+	h.writeReplicationMetrics(mw)
+	h.writeDiskMetrics(mw)
+	h.writeDataDirMetrics(mw)
+
+	free, total, err := util.DiskUsage(h.cfg.Dir)
+	if err != nil {
+		logger.Warn("error reading disk usage", "error", err)
+	} else {
+		mw.Header("triples_disk_free_bytes", "Free bytes on the filesystem of the data directory.", "gauge")
+		mw.Sample("triples_disk_free_bytes", float64(free))
+		mw.Header("triples_disk_total_bytes", "Size in bytes of the filesystem of the data directory.", "gauge")
+		mw.Sample("triples_disk_total_bytes", float64(total))
+	}
+
+	if err := mw.Flush(); err != nil {
+		logger.Warn("error writing metrics", "error", err)
+	}
+}
+
+// writeBucketMetrics reports the object count and total size of every bucket
+func (h *Handler) writeBucketMetrics(mw *metrics.Writer) {
+	type bucketStats struct {
+		name    string
+		objects int64
+		size    int64
+	}
+	var stats []bucketStats
+	for _, bucket := range h.meta.Buckets() {
+		size, objects, err := h.meta.Usage(bucket.Name)
+		if err != nil {
+			continue // deleted meanwhile
+		}
+		stats = append(stats, bucketStats{name: bucket.Name, objects: objects, size: size})
+	}
+
+	mw.Header("triples_bucket_objects", "Number of objects stored in the bucket.", "gauge")
+	for _, s := range stats {
+		mw.Sample("triples_bucket_objects", float64(s.objects), "bucket", s.name)
+	}
+	mw.Header("triples_bucket_size_bytes", "Total size in bytes of the objects stored in the bucket.", "gauge")
+	for _, s := range stats {
+		mw.Sample("triples_bucket_size_bytes", float64(s.size), "bucket", s.name)
+	}
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/events"
+)
+
+// GetBucketNotification returns the webhooks of a bucket
+func (h *Handler) GetBucketNotification(w http.ResponseWriter, r *http.Request) {
+	bucketName := r.PathValue("BucketName")
+	logger := core.Logger(r.Context()).With("bucket", bucketName)
+
+	bucket, ok := h.meta.Bucket(bucketName)
+	if !ok {
+		logger.Info("bucket not found")
+		XMLErrResponse(w, http.StatusNotFound, ErrBucketNotFound.Error())
+		return
+	}
+	XMLResponse(w, http.StatusOK, core.NotificationConfiguration{Webhooks: bucket.Notifications})
+}
+
+// PutBucketNotification replaces the webhooks of a bucket with the ones of a
+// NotificationConfiguration XML document. Events already queued are still
+// delivered to the webhooks they were queued for.
+func (h *Handler) PutBucketNotification(w http.ResponseWriter, r *http.Request) {
+	logger := core.Logger(r.Context()).With("bucket", r.PathValue("BucketName"))
+
+	var config core.NotificationConfiguration
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&config); err != nil {
+		logger.Info("invalid notification document", "error", err)
+		XMLErrResponse(w, http.StatusBadRequest, "Malformed notification XML")
+		return
+	}
+
+	if err := events.Validate(&config); err != nil {
+		logger.Info("invalid notification configuration", "error", err)
+		XMLErrResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.setBucketNotification(w, r, config)
+}
+
+// DeleteBucketNotification removes the webhooks of a bucket
+func (h *Handler) DeleteBucketNotification(w http.ResponseWriter, r *http.Request) {
+	h.setBucketNotification(w, r, core.NotificationConfiguration{})
+}
+
+func (h *Handler) setBucketNotification(w http.ResponseWriter, r *http.Request, config core.NotificationConfiguration) {
+	bucketName := r.PathValue("BucketName")
+	logger := core.Logger(r.Context()).With("bucket", bucketName)
+
+	_, err := h.meta.UpdateBucket(bucketName, func(bucket *core.Bucket) {
+		bucket.Notifications = config.Webhooks
+	})
+	if !h.bucketUpdated(w, logger, err) {
+		return
+	}
+
+	logger.Info("bucket notification updated", "webhooks", len(config.Webhooks))
+	if r.Method == http.MethodDelete {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	XMLResponse(w, http.StatusOK, config)
+}
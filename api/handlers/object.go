@@ -1,199 +1,488 @@
 package handlers
 
 import (
-	"fmt"
+	"errors"
 	"io"
-	"log"
 	"net/http"
-	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/meta"
+	"github.com/ab-dauletkhan/triple-s/api/replication"
+	"github.com/ab-dauletkhan/triple-s/api/storage"
+	"github.com/ab-dauletkhan/triple-s/api/util"
 )
 
-func CreateObject(w http.ResponseWriter, r *http.Request) {
+// HeaderLastModified sets the LastModified time of the objects written by the
+// coordinator of a cluster, so that all of their replicas are the same version.
+// It is ignored on requests that do not come from another node.
+const HeaderLastModified = "X-Triple-S-Last-Modified"
+
+// CreateObject stores an object, replacing the one stored under the same
+// key unless object lock protects it. With the retention or legal-hold query
+// parameter the object lock of the object is set instead.
+func (h *Handler) CreateObject(w http.ResponseWriter, r *http.Request) {
+	switch query := r.URL.Query(); {
+	case query.Has("retention"):
+		h.PutObjectRetention(w, r)
+		return
+	case query.Has("legal-hold"):
+		h.PutObjectLegalHold(w, r)
+		return
+	}
+
 	bucketName, objectKey := ParsePath(r.URL.Path)
+	logger := core.Logger(r.Context()).With("bucket", bucketName, "key", objectKey)
 	if bucketName == "" || objectKey == "" {
-		log.Println("Invalid bucket or object key")
+		logger.Info("invalid bucket or object key")
 		XMLErrResponse(w, http.StatusBadRequest, "Invalid bucket or object key")
 		return
 	}
 
-	bucketPath := filepath.Join(core.Dir, bucketName)
-	if _, err := os.Stat(bucketPath); os.IsNotExist(err) {
-		log.Printf("Bucket not found: %s\n", bucketName)
+	if err := util.ValidateObjectKey(objectKey); err != nil {
+		logger.Info("invalid object key", "error", err)
+		XMLErrResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	bucket, ok := h.activeBucket(bucketName)
+	if !ok {
+		logger.Info("bucket not found")
 		XMLErrResponse(w, http.StatusNotFound, "Bucket not found")
 		return
 	}
 
-	objects, err := ReadObjectsFile(bucketName)
-	fmt.Println(objects)
-	if err != nil {
-		log.Printf("Failed to read objects file for bucket %s: %v\n", bucketName, err)
-		XMLErrResponse(w, http.StatusInternalServerError, ErrInternalServer.Error())
+	// Checked before the upload is read to fail early, and again once it is
+	// staged
+	if !h.writable(w, logger, r, bucketName, objectKey) {
 		return
 	}
 
-	objectIndex := FindObjectIndex(objects.List, objectKey)
-	if objectIndex != -1 {
-		objects.List = RemoveObject(objects.List, objectIndex)
+	// Limits are checked against Content-Length up front, and again while
+	// streaming since the header may be absent or wrong
+	body := io.Reader(r.Body)
+	if maxSize := h.cfg.Limits.MaxObjectSize; maxSize > 0 {
+		if r.ContentLength > maxSize {
+			logger.Info("object too large", "size", r.ContentLength, "max_size", maxSize)
+			XMLErrResponse(w, http.StatusRequestEntityTooLarge, ErrEntityTooLarge.Error())
+			return
+		}
+		body = LimitReader(body, maxSize, ErrEntityTooLarge)
+	}
+
+	if bucket.QuotaBytes > 0 || bucket.QuotaObjects > 0 {
+		// The bytes and the object slot stay reserved until the object is
+		// recorded, concurrent uploads see them as used
+		limit, release, err := h.quotas.reserve(bucketName, bucket, r.ContentLength, func() (int64, int64, bool, error) {
+			usedBytes, usedObjects, err := h.meta.Usage(bucketName)
+			if err != nil {
+				return 0, 0, false, err
+			}
+			old, err := h.meta.Object(bucketName, objectKey)
+			if err != nil {
+				return usedBytes, usedObjects, false, nil
+			}
+			// The object is replaced, its size does not count against the quota
+			return usedBytes - parseContentLength(old), usedObjects - 1, true, nil
+		})
+		switch {
+		case errors.Is(err, ErrQuotaExceeded):
+			logger.Info("bucket quota exceeded", "quota_bytes", bucket.QuotaBytes, "quota_objects", bucket.QuotaObjects)
+			XMLErrResponse(w, http.StatusForbidden, ErrQuotaExceeded.Error())
+			return
+		case errors.Is(err, ErrLengthRequired):
+			logger.Info("upload without Content-Length to a bucket with a size quota", "quota_bytes", bucket.QuotaBytes)
+			XMLErrResponse(w, http.StatusLengthRequired, ErrLengthRequired.Error())
+			return
+		case err != nil:
+			logger.Info("bucket not found")
+			XMLErrResponse(w, http.StatusNotFound, "Bucket not found")
+			return
+		}
+		defer release()
+		if limit >= 0 {
+			body = LimitReader(body, limit, ErrQuotaExceeded)
+		}
 	}
 
-	objectPath := filepath.Join(bucketPath, objectKey)
-	file, err := os.Create(objectPath)
+	defer h.metrics.UploadStarted()()
+
+	newObject := core.Object{
+		Name:         objectKey,
+		ContentType:  r.Header.Get("Content-Type"),
+		LastModified: time.Now().Format(time.RFC3339Nano),
+		StorageClass: r.Header.Get(headerStorageClass),
+	}
+	if newObject.ContentType == "" {
+		newObject.ContentType = "application/octet-stream"
+	}
+	if newObject.StorageClass == "" {
+		newObject.StorageClass = core.StorageStandard
+	}
+	switch {
+	case !storage.ValidStorageClass(newObject.StorageClass):
+		logger.Info("invalid storage class", "storage_class", newObject.StorageClass)
+		XMLErrResponse(w, http.StatusBadRequest, storage.ErrUnknownStorageClass.Error())
+		return
+	case newObject.StorageClass == core.StorageCold && !h.store.ColdEnabled():
+		logger.Info("no cold directory configured")
+		XMLErrResponse(w, http.StatusBadRequest, storage.ErrNoColdDir.Error())
+		return
+	}
+	if core.Internal(r.Context()) {
+		if t, err := time.Parse(time.RFC3339Nano, r.Header.Get(HeaderLastModified)); err == nil {
+			newObject.LastModified = t.Format(time.RFC3339Nano)
+		}
+	}
+	if err := applyObjectLockHeaders(r, bucket, &newObject); err != nil {
+		logger.Info("invalid object lock headers", "error", err)
+		XMLErrResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// Copies written by the replication of another instance are not
+	// replicated again
+	replica, err := replication.Replica(r, h.cfg.Replication.Secret)
 	if err != nil {
-		log.Printf("Failed to create object %s in bucket %s: %v\n", objectKey, bucketName, err)
-		XMLErrResponse(w, http.StatusInternalServerError, "Failed to create object")
+		logger.Warn("replica write without the replication secret")
+		XMLErrResponse(w, http.StatusForbidden, err.Error())
 		return
 	}
-	defer file.Close()
+	if replica {
+		newObject.ReplicationStatus = core.ReplicationReplica
+	} else if _, ok := replication.Match(bucket, objectKey); ok {
+		newObject.ReplicationStatus = core.ReplicationPending
+	}
 
-	_, err = io.Copy(file, r.Body)
-	if err != nil {
-		log.Printf("Failed to write object data for %s in bucket %s: %v\n", objectKey, bucketName, err)
+	release, ok := h.beginWrite(w, logger, bucketName)
+	if !ok {
+		return
+	}
+	defer release()
+
+	tmp, err := h.store.Stage(bucketName, &newObject, body, bucket.Compression)
+	switch {
+	case errors.Is(err, ErrEntityTooLarge):
+		logger.Info("object too large", "max_size", h.cfg.Limits.MaxObjectSize)
+		XMLErrResponse(w, http.StatusRequestEntityTooLarge, ErrEntityTooLarge.Error())
+		return
+	case errors.Is(err, ErrQuotaExceeded):
+		logger.Info("bucket size quota exceeded", "quota_bytes", bucket.QuotaBytes)
+		XMLErrResponse(w, http.StatusForbidden, ErrQuotaExceeded.Error())
+		return
+	case err != nil:
+		logger.Error("failed to write object data", "error", err)
 		XMLErrResponse(w, http.StatusInternalServerError, "Failed to write object data")
 		return
 	}
 
-	newObject := core.Object{
-		Name:          objectKey,
-		ContentType:   r.Header.Get("Content-Type"),
-		ContentLength: strconv.FormatInt(r.ContentLength, 10),
-		LastModified:  time.Now().Format(time.RFC3339Nano),
+	// The object lock cannot change from the check to the record, nor can
+	// another upload replace the data in between
+	unlock := h.keys.lock(bucketName, objectKey)
+	defer unlock()
+	if !h.writable(w, logger, r, bucketName, objectKey) {
+		h.store.Discard(tmp)
+		return
 	}
-	if newObject.ContentType == "" {
-		newObject.ContentType = "application/octet-stream"
+
+	// The journal entry is written before the staged data replaces the old
+	// one, so an interrupted upload is completed or discarded on startup
+	relTmp, err := filepath.Rel(h.cfg.Dir, tmp)
+	if err != nil {
+		// Staged on another data directory
+		relTmp, _ = filepath.Abs(tmp)
+	}
+	opID, ok := h.beginOp(w, logger, util.JournalEntry{
+		Op: util.JournalPutObject, Bucket: bucketName, Key: objectKey, Object: &newObject, Temp: relTmp,
+	})
+	if !ok {
+		h.store.Discard(tmp)
+		return
+	}
+	defer h.journal.End(opID)
+
+	err = h.store.Commit(bucketName, newObject, tmp)
+	if errors.Is(err, storage.ErrWriteQuorum) {
+		logger.Warn("too few disks online", "error", err)
+		XMLErrResponse(w, http.StatusServiceUnavailable, "Too few disks online to store the object")
+		return
+	}
+	if err != nil {
+		logger.Error("failed to write object data", "error", err)
+		XMLErrResponse(w, http.StatusInternalServerError, "Failed to write object data")
+		return
 	}
 
-	objects.List = append(objects.List, newObject)
-	fmt.Println(objects)
-	err = WriteObjectsFile(bucketName, objects)
+	oldObject, replaced, err := h.meta.PutObject(bucketName, newObject)
 	if err != nil {
-		log.Printf("Failed to update objects file for bucket %s: %v\n", bucketName, err)
+		logger.Error("failed to record object", "error", err)
 		XMLErrResponse(w, http.StatusInternalServerError, ErrInternalServer.Error())
 		return
 	}
 
-	log.Printf("Object %s created successfully in bucket %s\n", objectKey, bucketName)
+	if replaced {
+		if err := h.store.Replaced(bucketName, oldObject, newObject); err != nil {
+			logger.Warn("failed to release replaced object data", "error", err)
+		}
+	}
+
+	h.publish(logger, bucketName, core.EventObjectCreatedPut, newObject)
+	if !replica {
+		h.replicate(logger, bucket, replication.OpPut, newObject)
+	}
+
+	logger.Debug("object created")
+	w.Header().Set("ETag", `"`+newObject.ETag+`"`)
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Object created successfully"))
 }
 
-func ListObjects(w http.ResponseWriter, r *http.Request) {
+// ListObjects lists the objects of a bucket in key order. The prefix,
+// marker and max-keys query parameters select a range of keys. The stats
+// and events query parameters return the statistics and the change feed of
+// the bucket instead.
+func (h *Handler) ListObjects(w http.ResponseWriter, r *http.Request) {
+	switch query := r.URL.Query(); {
+	case query.Has("stats"):
+		h.BucketStats(w, r)
+		return
+	case query.Has("events"):
+		h.BucketEvents(w, r)
+		return
+	}
+
 	bucketName := strings.TrimPrefix(r.URL.Path, "/")
+	logger := core.Logger(r.Context()).With("bucket", bucketName)
 
-	objectsData, err := ReadObjectsFile(bucketName)
-	if err != nil {
-		if os.IsNotExist(err) {
-			log.Printf("Bucket not found: %s\n", bucketName)
-			XMLErrResponse(w, http.StatusNotFound, "Bucket not found")
-		} else {
-			log.Printf("Error reading objects file for bucket %s: %v\n", bucketName, err)
-			XMLErrResponse(w, http.StatusInternalServerError, "Internal server error")
+	if _, ok := h.activeBucket(bucketName); !ok {
+		logger.Info("bucket not found")
+		XMLErrResponse(w, http.StatusNotFound, "Bucket not found")
+		return
+	}
+
+	query := r.URL.Query()
+	objectsData := core.Objects{
+		Prefix: query.Get("prefix"),
+		Marker: query.Get("marker"),
+	}
+	if maxKeys := query.Get("max-keys"); maxKeys != "" {
+		n, err := strconv.Atoi(maxKeys)
+		if err != nil || n < 0 {
+			logger.Info("invalid max-keys", "max_keys", maxKeys)
+			XMLErrResponse(w, http.StatusBadRequest, "Invalid max-keys")
+			return
 		}
+		objectsData.MaxKeys = n
+	}
+
+	objects, truncated, err := h.meta.List(bucketName, objectsData.Prefix, objectsData.Marker, objectsData.MaxKeys)
+	if err != nil {
+		logger.Info("bucket not found")
+		XMLErrResponse(w, http.StatusNotFound, "Bucket not found")
 		return
 	}
+	objectsData.List = objects
+	if truncated {
+		objectsData.IsTruncated = true
+		objectsData.NextMarker = objects[len(objects)-1].Name
+	}
 
-	log.Printf("Objects listed successfully for bucket %s\n", bucketName)
+	logger.Debug("objects listed", "count", len(objectsData.List))
 	XMLResponse(w, http.StatusOK, objectsData)
 }
 
-func GetObject(w http.ResponseWriter, r *http.Request) {
+// GetObject returns the content of an object. With the retention or
+// legal-hold query parameter its object lock is returned instead.
+func (h *Handler) GetObject(w http.ResponseWriter, r *http.Request) {
+	switch query := r.URL.Query(); {
+	case query.Has("retention"):
+		h.GetObjectRetention(w, r)
+		return
+	case query.Has("legal-hold"):
+		h.GetObjectLegalHold(w, r)
+		return
+	}
+
 	bucketName, objectKey := ParsePath(r.URL.Path)
+	logger := core.Logger(r.Context()).With("bucket", bucketName, "key", objectKey)
 	if bucketName == "" || objectKey == "" {
-		log.Println("Invalid bucket or object key")
+		logger.Info("invalid bucket or object key")
 		XMLErrResponse(w, http.StatusBadRequest, "Invalid bucket or object key")
 		return
 	}
 
-	bucketPath := filepath.Join(core.Dir, bucketName)
-	if _, err := os.Stat(bucketPath); os.IsNotExist(err) {
-		log.Printf("Bucket not found: %s\n", bucketName)
+	if err := util.ValidateObjectKey(objectKey); err != nil {
+		logger.Info("invalid object key", "error", err)
+		XMLErrResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if _, ok := h.activeBucket(bucketName); !ok {
+		logger.Info("bucket not found")
 		XMLErrResponse(w, http.StatusNotFound, "Bucket not found")
 		return
 	}
 
-	objectPath := filepath.Join(bucketPath, objectKey)
-	file, err := os.Open(objectPath)
-	if err != nil {
-		log.Printf("Object not found: %s in bucket %s\n", objectKey, bucketName)
+	object, err := h.meta.Object(bucketName, objectKey)
+	switch {
+	case errors.Is(err, meta.ErrNoSuchBucket):
+		logger.Info("bucket not found")
+		XMLErrResponse(w, http.StatusNotFound, "Bucket not found")
+		return
+	case err != nil:
+		logger.Info("object not found")
 		XMLErrResponse(w, http.StatusNotFound, "Object not found")
 		return
 	}
-	defer file.Close()
 
-	contentType, err := GetContentType(bucketPath, objectKey)
+	if object.Storage == storage.KindCold && !restored(object, time.Now()) {
+		logger.Info("object is not restored")
+		XMLErrResponse(w, http.StatusForbidden, ErrInvalidObjectState.Error())
+		return
+	}
+
+	file, err := h.store.Open(bucketName, object)
 	if err != nil {
-		log.Printf("Failed to get content type for %s in bucket %s: %v\n", objectKey, bucketName, err)
-		XMLErrResponse(w, http.StatusInternalServerError, "Failed to get content type")
+		logger.Error("failed to open object data", "error", err)
+		XMLErrResponse(w, http.StatusInternalServerError, "Failed to read object data")
 		return
 	}
+	defer file.Close()
 
-	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Type", object.ContentType)
+	w.Header().Set("Content-Length", object.ContentLength)
+	w.Header().Set("Last-Modified", httpDate(object.LastModified))
+	if object.ETag != "" {
+		w.Header().Set("ETag", `"`+object.ETag+`"`)
+	}
+	if object.RetentionMode != "" {
+		w.Header().Set(headerLockMode, object.RetentionMode)
+		w.Header().Set(headerLockRetainUntil, object.RetainUntilDate)
+	}
+	if object.LegalHold != "" {
+		w.Header().Set(headerLockLegalHold, object.LegalHold)
+	}
+	if object.ReplicationStatus != "" {
+		w.Header().Set(replication.HeaderStatus, object.ReplicationStatus)
+	}
+	setStorageClassHeaders(w, object)
 	_, err = io.Copy(w, file)
 	if err != nil {
-		log.Printf("Failed to read object data for %s in bucket %s: %v\n", objectKey, bucketName, err)
+		logger.Error("failed to read object data", "error", err)
 		XMLErrResponse(w, http.StatusInternalServerError, "Failed to read object data")
 		return
 	}
 
-	log.Printf("Object %s retrieved successfully from bucket %s\n", objectKey, bucketName)
+	logger.Debug("object retrieved")
 }
 
-func DeleteObject(w http.ResponseWriter, r *http.Request) {
+// DeleteObject deletes an object unless object lock protects it
+func (h *Handler) DeleteObject(w http.ResponseWriter, r *http.Request) {
 	bucketName, objectKey := ParsePath(r.URL.Path)
+	logger := core.Logger(r.Context()).With("bucket", bucketName, "key", objectKey)
 	if bucketName == "" || objectKey == "" {
-		log.Println("Invalid bucket or object key")
+		logger.Info("invalid bucket or object key")
 		XMLErrResponse(w, http.StatusBadRequest, "Invalid bucket or object key")
 		return
 	}
 
-	bucketPath := filepath.Join(core.Dir, bucketName)
-	if _, err := os.Stat(bucketPath); os.IsNotExist(err) {
-		log.Printf("Bucket not found: %s\n", bucketName)
-		XMLErrResponse(w, http.StatusNotFound, "Bucket not found")
+	if err := util.ValidateObjectKey(objectKey); err != nil {
+		logger.Info("invalid object key", "error", err)
+		XMLErrResponse(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	objectPath := filepath.Join(bucketPath, objectKey)
-	if _, err := os.Stat(objectPath); os.IsNotExist(err) {
-		log.Printf("Object not found: %s in bucket %s\n", objectKey, bucketName)
-		XMLErrResponse(w, http.StatusNotFound, "Object not found")
+	bucket, ok := h.activeBucket(bucketName)
+	if !ok {
+		logger.Info("bucket not found")
+		XMLErrResponse(w, http.StatusNotFound, "Bucket not found")
 		return
 	}
 
-	objects, err := ReadObjectsFile(bucketName)
+	replica, err := replication.Replica(r, h.cfg.Replication.Secret)
 	if err != nil {
-		log.Printf("Failed to read objects file for bucket %s: %v\n", bucketName, err)
-		XMLErrResponse(w, http.StatusInternalServerError, ErrInternalServer.Error())
+		logger.Warn("replica delete without the replication secret")
+		XMLErrResponse(w, http.StatusForbidden, err.Error())
 		return
 	}
 
-	objectIndex := FindObjectIndex(objects.List, objectKey)
-	if objectIndex == -1 {
-		log.Printf("Object %s not found in bucket %s\n", objectKey, bucketName)
-		XMLErrResponse(w, http.StatusNotFound, "Object not found")
+	// A delete made in a cluster before the object was written again,
+	// reaching this node late, leaves the later version alone
+	if old, err := h.meta.Object(bucketName, objectKey); err == nil &&
+		core.Internal(r.Context()) && newerThan(old, r.Header.Get(HeaderLastModified)) {
+		logger.Debug("object written after the delete, kept", "last_modified", old.LastModified)
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
-	objects.List = RemoveObject(objects.List, objectIndex)
-	err = WriteObjectsFile(bucketName, objects)
-	if err != nil {
-		log.Printf("Failed to update objects file for bucket %s: %v\n", bucketName, err)
+	release, ok := h.beginWrite(w, logger, bucketName)
+	if !ok {
+		return
+	}
+	defer release()
+
+	opID, ok := h.beginOp(w, logger, util.JournalEntry{Op: util.JournalDeleteObject, Bucket: bucketName, Key: objectKey})
+	if !ok {
+		return
+	}
+	defer h.journal.End(opID)
+
+	// The object lock is checked in the same commit as the delete, so a
+	// retention or legal hold set meanwhile is not missed
+	bypass := h.bypassGovernance(r)
+	object, err := h.meta.DeleteObjectIf(bucketName, objectKey, func(old core.Object) error {
+		return checkObjectLock(old, bypass)
+	})
+	switch {
+	case errors.Is(err, ErrObjectLocked):
+		logger.Info("object is locked", "mode", object.RetentionMode, "retain_until", object.RetainUntilDate, "legal_hold", object.LegalHold)
+		XMLErrResponse(w, http.StatusForbidden, err.Error())
+		return
+	case errors.Is(err, meta.ErrNoSuchBucket):
+		logger.Info("bucket not found")
+		XMLErrResponse(w, http.StatusNotFound, "Bucket not found")
+		return
+	case errors.Is(err, meta.ErrNoSuchKey):
+		logger.Info("object not found")
+		XMLErrResponse(w, http.StatusNotFound, "Object not found")
+		return
+	case err != nil:
+		logger.Error("failed to remove object record", "error", err)
 		XMLErrResponse(w, http.StatusInternalServerError, ErrInternalServer.Error())
 		return
 	}
 
-	err = os.Remove(objectPath)
+	err = h.store.Delete(bucketName, object)
 	if err != nil {
-		log.Printf("Failed to delete object %s in bucket %s: %v\n", objectKey, bucketName, err)
+		logger.Error("failed to delete object", "error", err)
 		XMLErrResponse(w, http.StatusInternalServerError, "Failed to delete object")
 		return
 	}
 
-	log.Printf("Object %s deleted successfully from bucket %s\n", objectKey, bucketName)
+	h.publish(logger, bucketName, core.EventObjectRemovedDelete, object)
+	if !replica {
+		h.replicate(logger, bucket, replication.OpDelete, object)
+	}
+
+	logger.Debug("object deleted")
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// newerThan reports whether object was last modified after version, an
+// RFC 3339 time. A missing or malformed version is never later.
+func newerThan(object core.Object, version string) bool {
+	t, err := time.Parse(time.RFC3339Nano, version)
+	if err != nil {
+		return false
+	}
+	modified, err := time.Parse(time.RFC3339Nano, object.LastModified)
+	return err == nil && modified.After(t)
+}
+
+// parseContentLength returns the size of an object, 0 if it is malformed
+func parseContentLength(object core.Object) int64 {
+	n, _ := strconv.ParseInt(object.ContentLength, 10, 64)
+	return n
+}
@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+)
+
+func TestObjectVersionHeader(t *testing.T) {
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339Nano)
+	tests := []struct {
+		name     string
+		internal bool // sent by another node of the cluster
+	}{
+		{"client", false},
+		{"node", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(t, nil)
+			mustServe(t, h.CreateBucket, newRequest(http.MethodPut, "/photos", ""), http.StatusOK)
+
+			send := func(method, version string) *http.Request {
+				r := newRequest(method, "/photos/a.txt", "content")
+				r.Header.Set(HeaderLastModified, version)
+				if tt.internal {
+					r = r.WithContext(core.WithInternal(r.Context()))
+				}
+				return r
+			}
+
+			mustServe(t, h.CreateObject, send(http.MethodPut, past), http.StatusOK)
+			object, err := h.meta.Object("photos", "a.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := object.LastModified == past; got != tt.internal {
+				t.Errorf("LastModified = %s, version %s honored: %v", object.LastModified, past, got)
+			}
+
+			// A delete older than the object keeps it only between nodes
+			older := time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339Nano)
+			mustServe(t, h.DeleteObject, send(http.MethodDelete, older), http.StatusNoContent)
+			if _, err := h.meta.Object("photos", "a.txt"); (err == nil) != tt.internal {
+				t.Errorf("object kept: %v, want %v", err == nil, tt.internal)
+			}
+		})
+	}
+}
+
+func TestGetCompressedObject(t *testing.T) {
+	content := strings.Repeat("2024-01-01 GET /index.html 200\n", 1000)
+	sum := md5.Sum([]byte(content))
+	tests := []struct {
+		name        string
+		contentType string
+		header      http.Header // of the upload
+	}{
+		{"compressed", "text/plain", nil},
+		{"already compressed type", "image/png", nil},
+		// The Content-Encoding of an upload does not change what is returned
+		{"encoded by the client", "text/plain", http.Header{"Content-Encoding": {"gzip"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(t, nil)
+			mustServe(t, h.CreateBucket, newRequest(http.MethodPut, "/logs", ""), http.StatusOK)
+			mustServe(t, h.PutBucketCompression, adminRequest(http.MethodPut, "/admin/buckets/logs/compression", "logs",
+				"<CompressionConfiguration><Algorithm>gzip</Algorithm></CompressionConfiguration>"), http.StatusOK)
+
+			r := newRequest(http.MethodPut, "/logs/access.log", content)
+			r.Header.Set("Content-Type", tt.contentType)
+			for name, values := range tt.header {
+				r.Header[name] = values
+			}
+			mustServe(t, h.CreateObject, r, http.StatusOK)
+
+			// Even a client accepting gzip gets the content as uploaded, the
+			// compression at rest is not a Content-Encoding
+			r = newRequest(http.MethodGet, "/logs/access.log", "")
+			r.Header.Set("Accept-Encoding", "gzip")
+			w := mustServe(t, h.GetObject, r, http.StatusOK)
+			if w.Body.String() != content {
+				t.Errorf("GET returned %d bytes, want the %d uploaded", w.Body.Len(), len(content))
+			}
+			if got := w.Header().Get("Content-Encoding"); got != "" {
+				t.Errorf("Content-Encoding = %q, want none", got)
+			}
+			if got := w.Header().Get("Content-Length"); got != strconv.Itoa(len(content)) {
+				t.Errorf("Content-Length = %s, want %d", got, len(content))
+			}
+			if got := w.Header().Get("ETag"); got != `"`+hex.EncodeToString(sum[:])+`"` {
+				t.Errorf("ETag = %s, want the MD5 of the content", got)
+			}
+		})
+	}
+}
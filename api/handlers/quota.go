@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"sync"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+)
+
+// bucketReservation holds the bytes and object slots taken by the uploads
+// in progress to a bucket, which its recorded usage does not show yet
+type bucketReservation struct {
+	mu      sync.Mutex
+	bytes   int64
+	objects int64
+	uploads int
+}
+
+// quotaReservations keeps the reservations of the buckets with uploads in
+// progress, so that concurrent uploads cannot exceed a quota together
+type quotaReservations struct {
+	mu      sync.Mutex
+	buckets map[string]*bucketReservation
+}
+
+func newQuotaReservations() *quotaReservations {
+	return &quotaReservations{buckets: make(map[string]*bucketReservation)}
+}
+
+// acquire returns the reservation of a bucket, counting the caller as one
+// of its uploads until the matching call to put
+func (q *quotaReservations) acquire(bucketName string) *bucketReservation {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	res, ok := q.buckets[bucketName]
+	if !ok {
+		res = &bucketReservation{}
+		q.buckets[bucketName] = res
+	}
+	res.uploads++
+	return res
+}
+
+func (q *quotaReservations) put(bucketName string, res *bucketReservation) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	res.uploads--
+	if res.uploads == 0 {
+		delete(q.buckets, bucketName)
+	}
+}
+
+// reserve checks an upload of size bytes, -1 when unknown, against the
+// quotas of bucket and takes what it needs until release is called. usage
+// reports the recorded usage of the bucket, the object being replaced left
+// out, and whether the upload replaces an object and so needs no new slot.
+// It is called under the lock of the bucket. A size quota needs the size of
+// the upload, reserving all the bytes remaining for an unknown one would
+// block every other upload to the bucket meanwhile. The upload must not
+// exceed the returned limit, -1 without a size quota.
+func (q *quotaReservations) reserve(bucketName string, bucket core.Bucket, size int64, usage func() (bytes, objects int64, replaces bool, err error)) (limit int64, release func(), err error) {
+	res := q.acquire(bucketName)
+	res.mu.Lock()
+	defer res.mu.Unlock()
+
+	usedBytes, usedObjects, replaces, err := usage()
+	if err != nil {
+		q.put(bucketName, res)
+		return 0, nil, err
+	}
+	usedBytes += res.bytes
+	usedObjects += res.objects
+
+	var slot int64
+	if !replaces {
+		slot = 1
+	}
+	if bucket.QuotaObjects > 0 && usedObjects+slot > bucket.QuotaObjects {
+		q.put(bucketName, res)
+		return 0, nil, ErrQuotaExceeded
+	}
+
+	limit = -1
+	var bytes int64
+	if bucket.QuotaBytes > 0 {
+		if size < 0 {
+			q.put(bucketName, res)
+			return 0, nil, ErrLengthRequired
+		}
+		if size > max(bucket.QuotaBytes-usedBytes, 0) {
+			q.put(bucketName, res)
+			return 0, nil, ErrQuotaExceeded
+		}
+		bytes, limit = size, size
+	}
+
+	res.bytes += bytes
+	res.objects += slot
+	var once sync.Once
+	return limit, func() {
+		once.Do(func() {
+			res.mu.Lock()
+			res.bytes -= bytes
+			res.objects -= slot
+			res.mu.Unlock()
+			q.put(bucketName, res)
+		})
+	}, nil
+}
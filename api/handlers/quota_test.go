@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+)
+
+func TestQuotaReservations(t *testing.T) {
+	unused := func() (int64, int64, bool, error) { return 0, 0, false, nil }
+	replacing := func() (int64, int64, bool, error) { return 0, 0, true, nil }
+
+	tests := []struct {
+		name   string
+		bucket core.Bucket
+		first  int64 // size of the upload in progress, -1 when unknown
+		second int64
+		usage  func() (int64, int64, bool, error)
+		want   error // for the second upload
+	}{
+		{"bytes fit", core.Bucket{QuotaBytes: 10}, 4, 6, unused, nil},
+		{"bytes reserved", core.Bucket{QuotaBytes: 10}, 6, 5, unused, ErrQuotaExceeded},
+		{"unknown size without size quota", core.Bucket{QuotaObjects: 2}, -1, -1, unused, nil},
+		{"slot reserved", core.Bucket{QuotaObjects: 1}, 1, 1, unused, ErrQuotaExceeded},
+		{"replacing needs no slot", core.Bucket{QuotaObjects: 1}, 1, 1, replacing, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newQuotaReservations()
+			_, release, err := q.reserve("photos", tt.bucket, tt.first, unused)
+			if err != nil {
+				t.Fatalf("first reserve: %v", err)
+			}
+
+			_, releaseSecond, err := q.reserve("photos", tt.bucket, tt.second, tt.usage)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("second reserve = %v, want %v", err, tt.want)
+			}
+			if err == nil {
+				releaseSecond()
+			}
+
+			// Once released, the reservation no longer counts
+			release()
+			release()
+			_, release, err = q.reserve("photos", tt.bucket, tt.second, tt.usage)
+			if err != nil {
+				t.Fatalf("reserve after release: %v", err)
+			}
+			release()
+			if len(q.buckets) != 0 {
+				t.Errorf("%d buckets left with reservations", len(q.buckets))
+			}
+		})
+	}
+}
+
+func TestQuotaReservationLimit(t *testing.T) {
+	q := newQuotaReservations()
+	usage := func() (int64, int64, bool, error) { return 7, 1, false, nil }
+
+	limit, release, err := q.reserve("photos", core.Bucket{QuotaBytes: 10}, 3, usage)
+	if err != nil || limit != 3 {
+		t.Fatalf("reserve = %d, %v, want 3", limit, err)
+	}
+	release()
+
+	if _, _, err := q.reserve("photos", core.Bucket{QuotaBytes: 10}, -1, usage); !errors.Is(err, ErrLengthRequired) {
+		t.Fatalf("reserve of an unknown size = %v, want %v", err, ErrLengthRequired)
+	}
+	if len(q.buckets) != 0 {
+		t.Errorf("%d buckets left with reservations", len(q.buckets))
+	}
+
+	limit, release, err = q.reserve("photos", core.Bucket{QuotaObjects: 5}, 100, usage)
+	if err != nil || limit != -1 {
+		t.Fatalf("reserve without size quota = %d, %v, want -1", limit, err)
+	}
+	release()
+}
+
+func TestCreateObjectQuota(t *testing.T) {
+	h := newTestHandler(t, nil)
+	mustServe(t, h.CreateBucket, newRequest(http.MethodPut, "/photos", ""), http.StatusOK)
+	if _, err := h.meta.UpdateBucket("photos", func(b *core.Bucket) { b.QuotaBytes = 10 }); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		key     string
+		body    string
+		chunked bool // sent without a Content-Length
+		status  int
+	}{
+		{"fits", "a.txt", "12345", false, http.StatusOK},
+		{"over the quota", "b.txt", "123456", false, http.StatusForbidden},
+		{"replacing fits", "a.txt", "1234567890", false, http.StatusOK},
+		{"no length", "c.txt", "", true, http.StatusLengthRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRequest(http.MethodPut, "/photos/"+tt.key, tt.body)
+			if tt.chunked {
+				r.ContentLength = -1
+			}
+			mustServe(t, h.CreateObject, r, tt.status)
+		})
+	}
+	if len(h.quotas.buckets) != 0 {
+		t.Errorf("%d buckets left with reservations", len(h.quotas.buckets))
+	}
+}
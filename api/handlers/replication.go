@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/meta"
+	"github.com/ab-dauletkhan/triple-s/api/metrics"
+	"github.com/ab-dauletkhan/triple-s/api/replication"
+)
+
+// GetBucketReplication returns the replication rules of a bucket
+func (h *Handler) GetBucketReplication(w http.ResponseWriter, r *http.Request) {
+	bucketName := r.PathValue("BucketName")
+	logger := core.Logger(r.Context()).With("bucket", bucketName)
+
+	bucket, ok := h.meta.Bucket(bucketName)
+	if !ok {
+		logger.Info("bucket not found")
+		XMLErrResponse(w, http.StatusNotFound, ErrBucketNotFound.Error())
+		return
+	}
+	XMLResponse(w, http.StatusOK, core.ReplicationConfiguration{Rules: bucket.Replication})
+}
+
+// PutBucketReplication replaces the replication rules of a bucket with the
+// ones of a ReplicationConfiguration XML document. Changes already queued
+// are still replicated to the destination they were queued for, and objects
+// stored before are not replicated.
+func (h *Handler) PutBucketReplication(w http.ResponseWriter, r *http.Request) {
+	logger := core.Logger(r.Context()).With("bucket", r.PathValue("BucketName"))
+
+	var config core.ReplicationConfiguration
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&config); err != nil {
+		logger.Info("invalid replication document", "error", err)
+		XMLErrResponse(w, http.StatusBadRequest, "Malformed replication XML")
+		return
+	}
+
+	if err := replication.Validate(&config); err != nil {
+		logger.Info("invalid replication configuration", "error", err)
+		XMLErrResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.setBucketReplication(w, r, config)
+}
+
+// DeleteBucketReplication removes the replication rules of a bucket
+func (h *Handler) DeleteBucketReplication(w http.ResponseWriter, r *http.Request) {
+	h.setBucketReplication(w, r, core.ReplicationConfiguration{})
+}
+
+func (h *Handler) setBucketReplication(w http.ResponseWriter, r *http.Request, config core.ReplicationConfiguration) {
+	bucketName := r.PathValue("BucketName")
+	logger := core.Logger(r.Context()).With("bucket", bucketName)
+
+	_, err := h.meta.UpdateBucket(bucketName, func(bucket *core.Bucket) {
+		bucket.Replication = config.Rules
+	})
+	if !h.bucketUpdated(w, logger, err) {
+		return
+	}
+
+	logger.Info("bucket replication updated", "rules", len(config.Rules))
+	if r.Method == http.MethodDelete {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	XMLResponse(w, http.StatusOK, config)
+}
+
+// ReplicationStatus reports the changes waiting to be replicated, given up
+// on and replicated of every bucket, and how far behind replication is
+func (h *Handler) ReplicationStatus(w http.ResponseWriter, r *http.Request) {
+	XMLResponse(w, http.StatusOK, h.replication.Status())
+}
+
+// RetryReplication queues the changes that ran out of attempts again, of the
+// bucket given with the bucket query parameter or of every bucket
+func (h *Handler) RetryReplication(w http.ResponseWriter, r *http.Request) {
+	bucketName := r.URL.Query().Get("bucket")
+	logger := core.Logger(r.Context()).With("bucket", bucketName)
+
+	queued, err := h.replication.Retry(bucketName)
+	if err != nil {
+		logger.Error("failed to retry replication", "error", err)
+		XMLErrResponse(w, http.StatusInternalServerError, ErrInternalServer.Error())
+		return
+	}
+
+	logger.Info("replication retried", "queued", queued)
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(strconv.Itoa(queued) + " changes queued\n"))
+}
+
+// replicate queues the replication of a change of object. Failures are
+// logged, the change itself was made already.
+func (h *Handler) replicate(logger *slog.Logger, bucket core.Bucket, op string, object core.Object) {
+	if _, err := h.replication.Enqueue(bucket, op, object); err != nil {
+		logger.Error("failed to queue replication", "op", op, "error", err)
+	}
+}
+
+// requeuePending queues the objects left PENDING without a queued change by
+// a crash between recording them and queuing their replication
+func (h *Handler) requeuePending() {
+	queued := h.replication.Queued()
+	missing := make(map[string][]core.Object)
+	h.meta.Walk(func(bucket string, object core.Object) {
+		if object.ReplicationStatus == core.ReplicationPending && !queued[bucket+"/"+object.Name] {
+			missing[bucket] = append(missing[bucket], object)
+		}
+	})
+
+	for bucketName, objects := range missing {
+		bucket, _ := h.meta.Bucket(bucketName)
+		bucket.Name = bucketName
+		for _, object := range objects {
+			h.replicate(slog.With("bucket", bucketName, "key", object.Name), bucket, replication.OpPut, object)
+		}
+		slog.Info("replication queued again", "bucket", bucketName, "objects", len(objects))
+	}
+}
+
+// writeReplicationMetrics reports the replication backlog of every bucket
+func (h *Handler) writeReplicationMetrics(mw *metrics.Writer) {
+	status := h.replication.Status()
+
+	mw.Header("triples_replication_pending", "Number of object changes waiting to be replicated.", "gauge")
+	for _, b := range status.Buckets {
+		mw.Sample("triples_replication_pending", float64(b.Pending), "bucket", b.Name)
+	}
+	mw.Header("triples_replication_failed", "Number of object changes whose replication was given up on.", "gauge")
+	for _, b := range status.Buckets {
+		mw.Sample("triples_replication_failed", float64(b.Failed), "bucket", b.Name)
+	}
+	mw.Header("triples_replication_completed_total", "Number of object changes replicated.", "counter")
+	for _, b := range status.Buckets {
+		mw.Sample("triples_replication_completed_total", float64(b.Completed), "bucket", b.Name)
+	}
+	mw.Header("triples_replication_lag_seconds", "Age of the oldest object change waiting to be replicated.", "gauge")
+	for _, b := range status.Buckets {
+		mw.Sample("triples_replication_lag_seconds", b.LagSeconds, "bucket", b.Name)
+	}
+}
+
+// replicationSource gives the replicator access to the objects of the handler
+type replicationSource struct {
+	h *Handler
+}
+
+func (s replicationSource) Open(bucketName, key string) (core.Object, io.ReadCloser, error) {
+	object, err := s.h.meta.Object(bucketName, key)
+	if errors.Is(err, meta.ErrNoSuchBucket) || errors.Is(err, meta.ErrNoSuchKey) {
+		return object, nil, replication.ErrObjectGone
+	}
+	if err != nil {
+		return object, nil, err
+	}
+	file, err := s.h.store.Open(bucketName, object)
+	if err != nil {
+		return object, nil, err
+	}
+	return object, file, nil
+}
+
+func (s replicationSource) SetStatus(bucketName, key, lastModified, status string) {
+	_, err := s.h.meta.UpdateObject(bucketName, key, func(object *core.Object) {
+		if object.LastModified == lastModified {
+			object.ReplicationStatus = status
+		}
+	})
+	if err != nil && !errors.Is(err, meta.ErrNoSuchBucket) && !errors.Is(err, meta.ErrNoSuchKey) {
+		slog.Error("failed to record replication status", "bucket", bucketName, "key", key, "status", status, "error", err)
+	}
+}
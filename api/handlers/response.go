@@ -2,7 +2,7 @@ package handlers
 
 import (
 	"encoding/xml"
-	"log"
+	"log/slog"
 	"net/http"
 
 	"github.com/ab-dauletkhan/triple-s/api/core"
@@ -18,6 +18,6 @@ func XMLResponse(w http.ResponseWriter, status int, v interface{}) {
 	w.Header().Set("Content-Type", "application/xml")
 	w.WriteHeader(status)
 	if err := xml.NewEncoder(w).Encode(v); err != nil {
-		log.Printf("Error encoding XML response: %v\n", err)
+		slog.Error("error encoding XML response", "error", err)
 	}
 }
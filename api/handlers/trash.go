@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/meta"
+)
+
+var ErrBucketNotTrashed = errors.New("bucket is not in the trash")
+
+// ListTrash lists the buckets in the trash
+func (h *Handler) ListTrash(w http.ResponseWriter, r *http.Request) {
+	var bucketsData core.Buckets
+	for _, bucket := range h.meta.Buckets() {
+		if bucket.Status == core.BucketPendingDeletion {
+			bucketsData.List = append(bucketsData.List, bucket)
+		}
+	}
+
+	core.Logger(r.Context()).Debug("trash listed", "count", len(bucketsData.List))
+	XMLResponse(w, http.StatusOK, bucketsData)
+}
+
+// RestoreBucket moves a bucket out of the trash
+func (h *Handler) RestoreBucket(w http.ResponseWriter, r *http.Request) {
+	bucketName := r.PathValue("BucketName")
+	logger := core.Logger(r.Context()).With("bucket", bucketName)
+
+	if !h.trashedBucket(w, logger, bucketName) {
+		return
+	}
+
+	bucket, err := h.meta.UpdateBucket(bucketName, func(bucket *core.Bucket) {
+		bucket.Status = core.BucketActive
+		bucket.DeletedAt = ""
+		bucket.LastUpdated = time.Now().Format(time.RFC3339Nano)
+	})
+	if !h.bucketUpdated(w, logger, err) {
+		return
+	}
+
+	logger.Info("bucket restored from the trash")
+	XMLResponse(w, http.StatusOK, bucket)
+}
+
+// PurgeBucket deletes a bucket in the trash right away
+func (h *Handler) PurgeBucket(w http.ResponseWriter, r *http.Request) {
+	bucketName := r.PathValue("BucketName")
+	logger := core.Logger(r.Context()).With("bucket", bucketName)
+
+	if !h.trashedBucket(w, logger, bucketName) {
+		return
+	}
+
+	if err := h.removeBucket(bucketName); err != nil {
+		logger.Error("error purging bucket", "error", err)
+		XMLErrResponse(w, http.StatusInternalServerError, ErrInternalServer.Error())
+		return
+	}
+
+	logger.Info("bucket purged from the trash")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// trashedBucket reports whether the bucket is in the trash, writing the
+// error response when it is not
+func (h *Handler) trashedBucket(w http.ResponseWriter, logger *slog.Logger, bucketName string) bool {
+	bucket, ok := h.meta.Bucket(bucketName)
+	if !ok {
+		logger.Info("bucket not found")
+		XMLErrResponse(w, http.StatusNotFound, ErrBucketNotFound.Error())
+		return false
+	}
+	if bucket.Status != core.BucketPendingDeletion {
+		logger.Info("bucket is not in the trash", "status", bucket.Status)
+		XMLErrResponse(w, http.StatusConflict, ErrBucketNotTrashed.Error())
+		return false
+	}
+	return true
+}
+
+// PurgeExpired deletes the buckets that have been in the trash for longer
+// than the retention and returns how many it deleted
+func (h *Handler) PurgeExpired() (int, error) {
+	retention := time.Duration(h.cfg.Trash.Retention)
+	purged := 0
+	var errs []error
+	for _, bucket := range h.meta.Buckets() {
+		if bucket.Status != core.BucketPendingDeletion {
+			continue
+		}
+
+		deletedAt, err := time.Parse(time.RFC3339Nano, bucket.DeletedAt)
+		if err == nil && time.Since(deletedAt) < retention {
+			continue
+		}
+		// A bucket without a valid deletion time has been in the trash
+		// for as long as anyone can tell
+
+		err = h.removeBucket(bucket.Name)
+		if errors.Is(err, meta.ErrNoSuchBucket) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		slog.Info("bucket purged from the trash", "bucket", bucket.Name, "deleted_at", bucket.DeletedAt)
+		purged++
+	}
+	return purged, errors.Join(errs...)
+}
+
+// runPurge purges expired buckets periodically
+func (h *Handler) runPurge() {
+	for range time.Tick(time.Duration(h.cfg.Trash.PurgeInterval)) {
+		if _, err := h.PurgeExpired(); err != nil {
+			slog.Error("purging the trash failed", "error", err)
+		}
+	}
+}
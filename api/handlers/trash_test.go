@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+)
+
+func withTrash(cfg *core.Config) {
+	cfg.Trash.Retention = core.Duration(time.Hour)
+}
+
+func TestTrashRestore(t *testing.T) {
+	h := newTestHandler(t, withTrash)
+	mustServe(t, h.CreateBucket, newRequest(http.MethodPut, "/photos", ""), http.StatusOK)
+	mustServe(t, h.DeleteBucket, newRequest(http.MethodDelete, "/photos", ""), http.StatusNoContent)
+
+	// In the trash, the bucket is hidden but its name stays taken
+	if w := mustServe(t, h.ListBuckets, newRequest(http.MethodGet, "/", ""), http.StatusOK); strings.Contains(w.Body.String(), "photos") {
+		t.Errorf("trashed bucket listed: %s", w.Body)
+	}
+	if w := mustServe(t, h.ListTrash, newRequest(http.MethodGet, "/admin/trash", ""), http.StatusOK); !strings.Contains(w.Body.String(), "<Name>photos</Name>") {
+		t.Errorf("bucket missing from the trash: %s", w.Body)
+	}
+	mustServe(t, h.CreateObject, newRequest(http.MethodPut, "/photos/a.txt", "a"), http.StatusNotFound)
+	mustServe(t, h.CreateBucket, newRequest(http.MethodPut, "/photos", ""), http.StatusConflict)
+
+	mustServe(t, h.RestoreBucket, adminRequest(http.MethodPost, "/admin/trash/photos/restore", "photos", ""), http.StatusOK)
+	bucket, _ := h.meta.Bucket("photos")
+	if bucket.Status != core.BucketActive || bucket.DeletedAt != "" {
+		t.Errorf("restored bucket = %+v", bucket)
+	}
+	mustServe(t, h.CreateObject, newRequest(http.MethodPut, "/photos/a.txt", "a"), http.StatusOK)
+
+	tests := []struct {
+		name   string
+		bucket string
+		status int
+	}{
+		{"active bucket", "photos", http.StatusConflict},
+		{"unknown bucket", "videos", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mustServe(t, h.RestoreBucket, adminRequest(http.MethodPost, "/admin/trash/"+tt.bucket+"/restore", tt.bucket, ""), tt.status)
+			mustServe(t, h.PurgeBucket, adminRequest(http.MethodDelete, "/admin/trash/"+tt.bucket, tt.bucket, ""), tt.status)
+		})
+	}
+}
+
+func TestTrashPurgeExpired(t *testing.T) {
+	h := newTestHandler(t, withTrash)
+	deletedAt := map[string]string{
+		"expired": time.Now().Add(-2 * time.Hour).Format(time.RFC3339Nano),
+		"recent":  time.Now().Add(-time.Minute).Format(time.RFC3339Nano),
+		"invalid": "yesterday",
+	}
+	for _, name := range []string{"expired", "recent", "invalid", "active"} {
+		mustServe(t, h.CreateBucket, newRequest(http.MethodPut, "/"+name, ""), http.StatusOK)
+		if name == "active" {
+			continue
+		}
+		mustServe(t, h.DeleteBucket, newRequest(http.MethodDelete, "/"+name, ""), http.StatusNoContent)
+		if _, err := h.meta.UpdateBucket(name, func(bucket *core.Bucket) {
+			bucket.DeletedAt = deletedAt[name]
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	purged, err := h.PurgeExpired()
+	if err != nil || purged != 2 {
+		t.Fatalf("PurgeExpired() = %d, %v, want 2 buckets purged", purged, err)
+	}
+	for name, kept := range map[string]bool{"expired": false, "invalid": false, "recent": true, "active": true} {
+		_, ok := h.meta.Bucket(name)
+		_, err := os.Stat(filepath.Join(h.cfg.Dir, name))
+		if ok != kept || (err == nil) != kept {
+			t.Errorf("bucket %s: recorded %v, directory %v, want kept %v", name, ok, err == nil, kept)
+		}
+	}
+
+	// A purged name can be taken again
+	mustServe(t, h.CreateBucket, newRequest(http.MethodPut, "/expired", ""), http.StatusOK)
+
+	// Purging a trashed bucket right away
+	mustServe(t, h.PurgeBucket, adminRequest(http.MethodDelete, "/admin/trash/recent", "recent", ""), http.StatusNoContent)
+	if _, ok := h.meta.Bucket("recent"); ok {
+		t.Error("purged bucket kept")
+	}
+}
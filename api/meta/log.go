@@ -0,0 +1,170 @@
+package meta
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+)
+
+// Kinds of metadata changes recorded in the log
+const (
+	OpPutBucket    = "put_bucket"
+	OpDeleteBucket = "delete_bucket"
+	OpPutObject    = "put_object"
+	OpDeleteObject = "delete_object"
+)
+
+// Op is a single metadata change. Put operations carry the complete new
+// record, so replaying an operation twice has no further effect.
+type Op struct {
+	Type       string       `json:"op"`
+	Bucket     string       `json:"bucket"`
+	BucketInfo *core.Bucket `json:"bucket_info,omitempty"`
+	Object     *core.Object `json:"object,omitempty"`
+	Key        string       `json:"key,omitempty"`
+	// When an object change was made, kept as the LastUpdated of its bucket
+	Time string `json:"time,omitempty"`
+
+	// Checked against the record being deleted before the batch is
+	// committed, not logged
+	cond func(core.Object) error
+}
+
+// Batch collects changes that are logged and applied together
+type Batch struct {
+	ops []Op
+}
+
+func (b *Batch) PutBucket(bucket core.Bucket) {
+	b.ops = append(b.ops, Op{Type: OpPutBucket, Bucket: bucket.Name, BucketInfo: &bucket})
+}
+
+func (b *Batch) DeleteBucket(name string) {
+	b.ops = append(b.ops, Op{Type: OpDeleteBucket, Bucket: name})
+}
+
+func (b *Batch) PutObject(bucket string, object core.Object) {
+	b.ops = append(b.ops, Op{Type: OpPutObject, Bucket: bucket, Object: &object, Time: now()})
+}
+
+func (b *Batch) DeleteObject(bucket, key string) {
+	b.ops = append(b.ops, Op{Type: OpDeleteObject, Bucket: bucket, Key: key, Time: now()})
+}
+
+// DeleteObjectIf deletes an object only if cond accepts its current record.
+// The error of cond fails the whole batch.
+func (b *Batch) DeleteObjectIf(bucket, key string, cond func(core.Object) error) {
+	b.ops = append(b.ops, Op{Type: OpDeleteObject, Bucket: bucket, Key: key, Time: now(), cond: cond})
+}
+
+// Len returns the number of changes in the batch
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+func now() string {
+	return time.Now().Format(time.RFC3339Nano)
+}
+
+var ErrCorruptLog = errors.New("corrupt metadata log")
+
+// changeLog is the append-only file of the changes made since the last
+// snapshot. Every line holds the JSON array of the operations of one batch.
+type changeLog struct {
+	f       *os.File
+	size    int64
+	records int
+	sync    bool
+}
+
+// openLog opens the log and passes every complete record to apply. A last
+// line without a newline is the remainder of a write cut short by a crash;
+// it was never acknowledged, so it is cut off.
+func openLog(path string, sync bool, apply func([]Op)) (*changeLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, core.FilePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &changeLog{f: f, sync: sync}
+	l.size, l.records, err = replayLog(f, apply)
+	if err == nil {
+		err = l.truncate(l.size)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// replayLog passes every complete record of r to apply and returns the
+// size and number of those records
+func replayLog(r io.Reader, apply func([]Op)) (size int64, records int, err error) {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return size, records, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+
+		var ops []Op
+		if err := json.Unmarshal(bytes.TrimSpace(line), &ops); err != nil {
+			return 0, 0, fmt.Errorf("%w: record %d at offset %d: %v", ErrCorruptLog, records+1, size, err)
+		}
+		apply(ops)
+		size += int64(len(line))
+		records++
+	}
+}
+
+// append writes one record. A failed write is rolled back, so that the
+// records following it can still be read.
+func (l *changeLog) append(ops []Op) error {
+	line, err := json.Marshal(ops)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if _, err := l.f.WriteAt(line, l.size); err != nil {
+		l.f.Truncate(l.size)
+		return err
+	}
+	if l.sync {
+		if err := l.f.Sync(); err != nil {
+			l.f.Truncate(l.size)
+			return err
+		}
+	}
+
+	l.size += int64(len(line))
+	l.records++
+	return nil
+}
+
+// truncate cuts the log to size bytes
+func (l *changeLog) truncate(size int64) error {
+	if err := l.f.Truncate(size); err != nil {
+		return err
+	}
+	if size == 0 {
+		l.records = 0
+	}
+	l.size = size
+	return l.f.Sync()
+}
+
+func (l *changeLog) close() error {
+	return l.f.Close()
+}
@@ -0,0 +1,301 @@
+package meta
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+)
+
+// ErrCorruptBuckets reports a column of the buckets meta-file that cannot be
+// decoded. Dropping it would silently lose the settings it holds.
+var ErrCorruptBuckets = errors.New("corrupt buckets meta-file")
+
+// ReadBucketsFile reads the buckets meta-file and returns the bucket data
+func ReadBucketsFile(dir string) (core.Buckets, error) {
+	bucketsFilePath := filepath.Join(dir, core.BucketsFile)
+	slog.Debug("reading buckets meta-file", "path", bucketsFilePath)
+
+	records, err := readCSVFile(bucketsFilePath)
+	if err != nil {
+		return core.Buckets{}, err
+	}
+
+	return convertRecordsToBuckets(records)
+}
+
+// WriteBucketsFile writes the bucket data to the buckets meta-file
+func WriteBucketsFile(dir string, bucketsData core.Buckets) error {
+	bucketsFilePath := filepath.Join(dir, core.BucketsFile)
+	records := convertBucketsToRecords(bucketsData)
+
+	return writeCSVFile(bucketsFilePath, core.BucketsCSVHeader, records)
+}
+
+// ReadObjectsFile reads the objects file for a bucket and returns the object data
+func ReadObjectsFile(dir, bucketName string) (core.Objects, error) {
+	objectsFilePath := filepath.Join(dir, bucketName, core.ObjectsFile)
+	slog.Debug("reading objects file", "path", objectsFilePath)
+
+	records, err := readCSVFile(objectsFilePath)
+	if err != nil {
+		return core.Objects{}, err
+	}
+
+	return convertRecordsToObjects(records), nil
+}
+
+// WriteObjectsFile writes the object data to the objects file for a bucket
+func WriteObjectsFile(dir, bucketName string, objectsData core.Objects) error {
+	objectsFilePath := filepath.Join(dir, bucketName, core.ObjectsFile)
+	records := convertObjectsToRecords(objectsData)
+
+	return writeCSVFile(objectsFilePath, core.ObjectsCSVHeader, records)
+}
+
+// Reads a CSV file and returns the records without the header
+func readCSVFile(filePath string) ([][]string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1 // rows written before a column was added are shorter
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) > 0 {
+		return records[1:], nil // Skip header
+	}
+	return [][]string{}, nil
+}
+
+// Writes a CSV file with the given header and records. The records go to a
+// temporary file first, so a crash never leaves a half written file behind.
+func writeCSVFile(filePath string, header []string, records [][]string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), ".tmp-*.csv")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	writer := csv.NewWriter(tmp)
+	if header != nil {
+		if err := writer.Write(header); err != nil {
+			return err
+		}
+	}
+	if err := writer.WriteAll(records); err != nil {
+		return err
+	}
+
+	if err := tmp.Chmod(core.FilePerm); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filePath)
+}
+
+// field returns the i-th column of a record, or "" for rows written
+// before the column was added
+func field(record []string, i int) string {
+	if i < len(record) {
+		return record[i]
+	}
+	return ""
+}
+
+// parseInt parses a numeric column, treating empty or malformed values as 0
+func parseInt(s string) int64 {
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return n
+}
+
+// parseWebhooks decodes the JSON list of webhooks of a bucket
+func parseWebhooks(s string) ([]core.Webhook, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var webhooks []core.Webhook
+	if err := json.Unmarshal([]byte(s), &webhooks); err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+func formatWebhooks(webhooks []core.Webhook) string {
+	if len(webhooks) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(webhooks)
+	return string(b)
+}
+
+// parseReplication decodes the JSON list of replication rules of a bucket
+func parseReplication(s string) ([]core.ReplicationRule, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var rules []core.ReplicationRule
+	if err := json.Unmarshal([]byte(s), &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func formatReplication(rules []core.ReplicationRule) string {
+	if len(rules) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(rules)
+	return string(b)
+}
+
+// parseLifecycle decodes the JSON list of lifecycle rules of a bucket
+func parseLifecycle(s string) ([]core.LifecycleRule, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var rules []core.LifecycleRule
+	if err := json.Unmarshal([]byte(s), &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func formatLifecycle(rules []core.LifecycleRule) string {
+	if len(rules) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(rules)
+	return string(b)
+}
+
+func convertRecordsToBuckets(records [][]string) (core.Buckets, error) {
+	var bucketsData core.Buckets
+	for _, record := range records {
+		notifications, err := parseWebhooks(field(record, 11))
+		if err != nil {
+			return core.Buckets{}, fmt.Errorf("%w: bucket %q: notifications: %v", ErrCorruptBuckets, field(record, 0), err)
+		}
+		replication, err := parseReplication(field(record, 12))
+		if err != nil {
+			return core.Buckets{}, fmt.Errorf("%w: bucket %q: replication: %v", ErrCorruptBuckets, field(record, 0), err)
+		}
+		lifecycle, err := parseLifecycle(field(record, 13))
+		if err != nil {
+			return core.Buckets{}, fmt.Errorf("%w: bucket %q: lifecycle: %v", ErrCorruptBuckets, field(record, 0), err)
+		}
+
+		bucket := core.Bucket{
+			Name:         field(record, 0),
+			Status:       field(record, 1),
+			CreationDate: field(record, 2),
+			LastUpdated:  field(record, 3),
+			QuotaBytes:   parseInt(field(record, 4)),
+			QuotaObjects: parseInt(field(record, 5)),
+			Compression:  field(record, 6),
+			DeletedAt:    field(record, 7),
+
+			ObjectLock:           field(record, 8),
+			DefaultRetentionMode: field(record, 9),
+			DefaultRetentionDays: parseInt(field(record, 10)),
+			Notifications:        notifications,
+			Replication:          replication,
+			Lifecycle:            lifecycle,
+		}
+		bucketsData.List = append(bucketsData.List, bucket)
+	}
+	return bucketsData, nil
+}
+
+func convertBucketsToRecords(bucketsData core.Buckets) [][]string {
+	var records [][]string
+	for _, bucket := range bucketsData.List {
+		record := []string{
+			bucket.Name,
+			bucket.Status,
+			bucket.CreationDate,
+			bucket.LastUpdated,
+			strconv.FormatInt(bucket.QuotaBytes, 10),
+			strconv.FormatInt(bucket.QuotaObjects, 10),
+			bucket.Compression,
+			bucket.DeletedAt,
+			bucket.ObjectLock,
+			bucket.DefaultRetentionMode,
+			strconv.FormatInt(bucket.DefaultRetentionDays, 10),
+			formatWebhooks(bucket.Notifications),
+			formatReplication(bucket.Replication),
+			formatLifecycle(bucket.Lifecycle),
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func convertObjectsToRecords(objectsData core.Objects) [][]string {
+	var records [][]string
+	for _, object := range objectsData.List {
+		record := []string{
+			object.Name,
+			object.ContentType,
+			object.ContentLength,
+			object.LastModified,
+			object.Digest,
+			object.Storage,
+			object.ETag,
+			object.Encoding,
+			object.RetentionMode,
+			object.RetainUntilDate,
+			object.LegalHold,
+			object.ReplicationStatus,
+			object.StorageClass,
+			object.RestoreExpiryDate,
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func convertRecordsToObjects(records [][]string) core.Objects {
+	var objectsData core.Objects
+	for _, record := range records {
+		object := core.Object{
+			Name:          field(record, 0),
+			ContentType:   field(record, 1),
+			ContentLength: field(record, 2),
+			LastModified:  field(record, 3),
+			Digest:        field(record, 4),
+			Storage:       field(record, 5),
+			ETag:          field(record, 6),
+			Encoding:      field(record, 7),
+
+			RetentionMode:   field(record, 8),
+			RetainUntilDate: field(record, 9),
+			LegalHold:       field(record, 10),
+
+			ReplicationStatus: field(record, 11),
+
+			StorageClass:      field(record, 12),
+			RestoreExpiryDate: field(record, 13),
+		}
+		objectsData.List = append(objectsData.List, object)
+	}
+	return objectsData
+}
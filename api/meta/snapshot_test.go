@@ -0,0 +1,71 @@
+package meta
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+)
+
+func TestReadBucketsFileMalformedColumns(t *testing.T) {
+	tests := []struct {
+		name   string
+		column int
+		value  string
+		want   error
+	}{
+		{"no notifications", 11, "", nil},
+		{"notifications", 11, `[{"id":"hook","endpoint":"http://localhost/hook","events":["s3:ObjectCreated:*"]}]`, nil},
+		{"malformed notifications", 11, `[{"id":`, ErrCorruptBuckets},
+		{"notifications not a list", 11, `{"id":"hook"}`, ErrCorruptBuckets},
+		{"replication", 12, `[{"id":"all","status":"Enabled","destination":{"endpoint":"http://localhost:9000","bucket":"backup"}}]`, nil},
+		{"malformed replication", 12, `[{"id":"all"`, ErrCorruptBuckets},
+		{"lifecycle", 13, `[{"id":"archive","status":"Enabled","transition":{"days":30,"storage_class":"COLD"}}]`, nil},
+		{"malformed lifecycle", 13, `[{"id":"archive","transition":{"days":"thirty"}}]`, ErrCorruptBuckets},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			record := make([]string, len(core.BucketsCSVHeader))
+			record[0], record[1] = "photos", core.BucketActive
+			record[tt.column] = tt.value
+			if err := writeCSVFile(filepath.Join(dir, core.BucketsFile), core.BucketsCSVHeader, [][]string{record}); err != nil {
+				t.Fatal(err)
+			}
+
+			buckets, err := ReadBucketsFile(dir)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("ReadBucketsFile() = %v, want %v", err, tt.want)
+			}
+			if err != nil && !strings.Contains(err.Error(), `"photos"`) {
+				t.Errorf("error %q does not name the bucket", err)
+			}
+			if err == nil && len(buckets.List) != 1 {
+				t.Errorf("ReadBucketsFile() read %d buckets, want 1", len(buckets.List))
+			}
+		})
+	}
+}
+
+func TestOpenMalformedBuckets(t *testing.T) {
+	dir := t.TempDir()
+	record := make([]string, len(core.BucketsCSVHeader))
+	record[0], record[1], record[11] = "photos", core.BucketActive, "not json"
+	if err := writeCSVFile(filepath.Join(dir, core.BucketsFile), core.BucketsCSVHeader, [][]string{record}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "photos"), core.DirPerm); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := Open(dir, core.DefaultConfig().Metadata)
+	if err == nil {
+		store.Close()
+	}
+	if !errors.Is(err, ErrCorruptBuckets) {
+		t.Fatalf("Open() = %v, want %v", err, ErrCorruptBuckets)
+	}
+}
@@ -0,0 +1,612 @@
+// Package meta keeps the bucket and object metadata. It is held in memory,
+// indexed for lookups and ordered scans, and made durable by an append-only
+// log of changes. Once the log grows past a threshold it is folded into the
+// CSV snapshots, buckets.csv and the objects.csv of every bucket, and cleared.
+package meta
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+)
+
+var (
+	ErrNoSuchBucket   = errors.New("bucket not found")
+	ErrNoSuchKey      = errors.New("object not found")
+	ErrBucketNotEmpty = errors.New("bucket is not empty")
+	ErrReadOnly       = errors.New("metadata opened read-only")
+)
+
+// Store is the metadata of all buckets and objects. It is safe for
+// concurrent use.
+type Store struct {
+	dir       string
+	compactAt int
+
+	mu      sync.RWMutex
+	buckets map[string]*bucketIndex
+	names   []string // sorted bucket names
+	log     *changeLog
+
+	// Snapshots that no longer match the memory state
+	bucketsDirty bool
+	dirty        map[string]bool
+}
+
+// bucketIndex holds the objects of a bucket by key, and the keys in order,
+// along with statistics kept up to date as objects change
+type bucketIndex struct {
+	bucket  core.Bucket
+	objects map[string]core.Object
+	keys    []string
+	size    int64
+	largest string // key of the largest object
+	types   map[string]core.ContentTypeStats
+}
+
+// Open loads the snapshots of dir, replays the changes logged since and
+// compacts them into new snapshots. Directories written before the log
+// existed are just snapshots without a log, so they need no conversion.
+func Open(dir string, cfg core.MetadataConfig) (*Store, error) {
+	s := &Store{
+		dir:       dir,
+		compactAt: cfg.CompactThreshold,
+		buckets:   make(map[string]*bucketIndex),
+		dirty:     make(map[string]bool),
+	}
+
+	if err := s.loadSnapshots(); err != nil {
+		return nil, err
+	}
+
+	log, err := openLog(filepath.Join(dir, core.MetaLogFile), cfg.Sync, s.apply)
+	if err != nil {
+		return nil, err
+	}
+	s.log = log
+
+	if log.records > 0 {
+		slog.Info("replayed metadata log", "records", log.records)
+		if err := s.compact(); err != nil {
+			log.close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Load reads the metadata of dir like Open, but leaves every file as it is.
+// The returned store cannot be changed.
+func Load(dir string) (*Store, error) {
+	s := &Store{
+		dir:     dir,
+		buckets: make(map[string]*bucketIndex),
+		dirty:   make(map[string]bool),
+	}
+
+	if err := s.loadSnapshots(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filepath.Join(dir, core.MetaLogFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if _, _, err := replayLog(f, s.apply); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close writes the pending changes to the snapshots and closes the log
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.log == nil {
+		return nil
+	}
+
+	err := s.compact()
+	return errors.Join(err, s.log.close())
+}
+
+func (s *Store) loadSnapshots() error {
+	bucketsData, err := ReadBucketsFile(s.dir)
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	for _, bucket := range bucketsData.List {
+		idx := s.putBucket(bucket)
+		objectsData, err := ReadObjectsFile(s.dir, bucket.Name)
+		if os.IsNotExist(err) {
+			missing = append(missing, bucket.Name)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, object := range objectsData.List {
+			idx.put(object)
+		}
+	}
+
+	// Only the objects files that do not exist yet need writing
+	s.bucketsDirty = false
+	clear(s.dirty)
+	for _, name := range missing {
+		s.dirty[name] = true
+	}
+	return nil
+}
+
+// Buckets returns all buckets ordered by name
+func (s *Store) Buckets() []core.Bucket {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	buckets := make([]core.Bucket, 0, len(s.names))
+	for _, name := range s.names {
+		buckets = append(buckets, s.buckets[name].bucket)
+	}
+	return buckets
+}
+
+// Bucket looks up a bucket by name
+func (s *Store) Bucket(name string) (core.Bucket, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	idx, ok := s.buckets[name]
+	if !ok {
+		return core.Bucket{}, false
+	}
+	return idx.bucket, true
+}
+
+// Usage returns the total content length and the number of objects of a bucket
+func (s *Store) Usage(bucket string) (size, count int64, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	idx, ok := s.buckets[bucket]
+	if !ok {
+		return 0, 0, ErrNoSuchBucket
+	}
+	return idx.size, int64(len(idx.keys)), nil
+}
+
+// Stats returns the statistics of a bucket, with the content types ordered
+// by name
+func (s *Store) Stats(bucket string) (core.BucketStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	idx, ok := s.buckets[bucket]
+	if !ok {
+		return core.BucketStats{}, ErrNoSuchBucket
+	}
+
+	stats := core.BucketStats{
+		Objects:      int64(len(idx.keys)),
+		Bytes:        idx.size,
+		ContentTypes: make([]core.ContentTypeStats, 0, len(idx.types)),
+	}
+	if idx.largest != "" {
+		stats.LargestObject = &core.LargestObject{
+			Key:  idx.largest,
+			Size: contentLength(idx.objects[idx.largest]),
+		}
+	}
+	for _, typeStats := range idx.types {
+		stats.ContentTypes = append(stats.ContentTypes, typeStats)
+	}
+	slices.SortFunc(stats.ContentTypes, func(a, b core.ContentTypeStats) int {
+		return strings.Compare(a.Type, b.Type)
+	})
+	return stats, nil
+}
+
+// Object looks up an object of a bucket by key
+func (s *Store) Object(bucket, key string) (core.Object, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	idx, ok := s.buckets[bucket]
+	if !ok {
+		return core.Object{}, ErrNoSuchBucket
+	}
+	object, ok := idx.objects[key]
+	if !ok {
+		return core.Object{}, ErrNoSuchKey
+	}
+	return object, nil
+}
+
+// List returns, in key order, up to limit objects of a bucket whose key
+// starts with prefix and sorts after the key after. A limit of 0 means no
+// limit. truncated reports whether more objects match.
+func (s *Store) List(bucket, prefix, after string, limit int) (objects []core.Object, truncated bool, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	idx, ok := s.buckets[bucket]
+	if !ok {
+		return nil, false, ErrNoSuchBucket
+	}
+
+	start := max(after, prefix)
+	i, found := slices.BinarySearch(idx.keys, start)
+	if found && start == after {
+		i++
+	}
+	for ; i < len(idx.keys) && strings.HasPrefix(idx.keys[i], prefix); i++ {
+		if limit > 0 && len(objects) == limit {
+			return objects, true, nil
+		}
+		objects = append(objects, idx.objects[idx.keys[i]])
+	}
+	return objects, false, nil
+}
+
+// Walk calls fn for every object of every bucket, with the store locked
+// for reading
+func (s *Store) Walk(fn func(bucket string, object core.Object)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, name := range s.names {
+		idx := s.buckets[name]
+		for _, key := range idx.keys {
+			fn(name, idx.objects[key])
+		}
+	}
+}
+
+// PutBucket creates a bucket or replaces its record
+func (s *Store) PutBucket(bucket core.Bucket) error {
+	var b Batch
+	b.PutBucket(bucket)
+	return s.Apply(&b)
+}
+
+// UpdateBucket changes the record of an existing bucket with fn
+func (s *Store) UpdateBucket(name string, fn func(*core.Bucket)) (core.Bucket, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	idx, ok := s.buckets[name]
+	if !ok {
+		return core.Bucket{}, ErrNoSuchBucket
+	}
+	bucket := idx.bucket
+	fn(&bucket)
+	bucket.Name = name
+
+	return bucket, s.commit([]Op{{Type: OpPutBucket, Bucket: name, BucketInfo: &bucket}})
+}
+
+// DeleteBucket removes an empty bucket
+func (s *Store) DeleteBucket(name string) error {
+	var b Batch
+	b.DeleteBucket(name)
+	return s.Apply(&b)
+}
+
+// PutObject stores the record of an object and returns the record it
+// replaced, if any
+func (s *Store) PutObject(bucket string, object core.Object) (old core.Object, replaced bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if idx, ok := s.buckets[bucket]; ok {
+		old, replaced = idx.objects[object.Name]
+	}
+	err = s.commit([]Op{{Type: OpPutObject, Bucket: bucket, Object: &object, Time: now()}})
+	return old, replaced, err
+}
+
+// UpdateObject changes the record of an existing object with fn
+func (s *Store) UpdateObject(bucket, key string, fn func(*core.Object)) (core.Object, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	idx, ok := s.buckets[bucket]
+	if !ok {
+		return core.Object{}, ErrNoSuchBucket
+	}
+	object, ok := idx.objects[key]
+	if !ok {
+		return core.Object{}, ErrNoSuchKey
+	}
+	fn(&object)
+	object.Name = key
+
+	return object, s.commit([]Op{{Type: OpPutObject, Bucket: bucket, Object: &object, Time: now()}})
+}
+
+// DeleteObject removes the record of an object and returns it
+func (s *Store) DeleteObject(bucket, key string) (core.Object, error) {
+	return s.DeleteObjectIf(bucket, key, nil)
+}
+
+// DeleteObjectIf removes the record of an object and returns it, if cond
+// accepts the record. cond runs under the lock of the store, so the record
+// cannot change between the check and the delete. Its error is returned as
+// is and nothing is deleted.
+func (s *Store) DeleteObjectIf(bucket, key string, cond func(core.Object) error) (core.Object, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	idx, ok := s.buckets[bucket]
+	if !ok {
+		return core.Object{}, ErrNoSuchBucket
+	}
+	object, ok := idx.objects[key]
+	if !ok {
+		return core.Object{}, ErrNoSuchKey
+	}
+	return object, s.commit([]Op{{Type: OpDeleteObject, Bucket: bucket, Key: key, Time: now(), cond: cond}})
+}
+
+// Apply logs and applies the changes of a batch, all of them or none
+func (s *Store) Apply(b *Batch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commit(b.ops)
+}
+
+// commit checks, logs and applies ops. The caller holds the write lock.
+func (s *Store) commit(ops []Op) error {
+	if s.log == nil {
+		return ErrReadOnly
+	}
+	if err := s.check(ops); err != nil {
+		return err
+	}
+	if err := s.log.append(ops); err != nil {
+		return err
+	}
+	s.apply(ops)
+
+	if s.compactAt > 0 && s.log.records >= s.compactAt {
+		// The changes are in the log already, a failed compaction only
+		// means it keeps growing until the next attempt
+		if err := s.compact(); err != nil {
+			slog.Error("metadata compaction failed", "error", err)
+		}
+	}
+	return nil
+}
+
+// check rejects a batch that refers to missing buckets, deletes a bucket
+// that still has objects or deletes an object its condition refuses, taking
+// the earlier operations of the batch into account. Conditions see the
+// records as they were before the batch.
+func (s *Store) check(ops []Op) error {
+	exists := make(map[string]bool)
+	filled := make(map[string]bool)
+	for _, op := range ops {
+		known, ok := exists[op.Bucket]
+		if !ok {
+			_, known = s.buckets[op.Bucket]
+		}
+
+		switch op.Type {
+		case OpPutBucket:
+			exists[op.Bucket] = true
+		case OpDeleteBucket:
+			if !known {
+				return ErrNoSuchBucket
+			}
+			if idx := s.buckets[op.Bucket]; filled[op.Bucket] || (idx != nil && len(idx.keys) > 0) {
+				return ErrBucketNotEmpty
+			}
+			exists[op.Bucket] = false
+		case OpPutObject:
+			if !known {
+				return ErrNoSuchBucket
+			}
+			filled[op.Bucket] = true
+		case OpDeleteObject:
+			if !known {
+				return ErrNoSuchBucket
+			}
+			if op.cond == nil {
+				break
+			}
+			if idx := s.buckets[op.Bucket]; idx != nil {
+				if object, ok := idx.objects[op.Key]; ok {
+					if err := op.cond(object); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// apply changes the memory state. It is also used to replay the log, so
+// operations on missing buckets are skipped rather than failing.
+func (s *Store) apply(ops []Op) {
+	for _, op := range ops {
+		switch op.Type {
+		case OpPutBucket:
+			if op.BucketInfo != nil {
+				s.putBucket(*op.BucketInfo)
+			}
+		case OpDeleteBucket:
+			if _, ok := s.buckets[op.Bucket]; ok {
+				delete(s.buckets, op.Bucket)
+				i, _ := slices.BinarySearch(s.names, op.Bucket)
+				s.names = slices.Delete(s.names, i, i+1)
+				delete(s.dirty, op.Bucket)
+				s.bucketsDirty = true
+			}
+		case OpPutObject:
+			if idx, ok := s.buckets[op.Bucket]; ok && op.Object != nil {
+				idx.put(*op.Object)
+				s.touch(idx, op.Time)
+			}
+		case OpDeleteObject:
+			if idx, ok := s.buckets[op.Bucket]; ok {
+				idx.delete(op.Key)
+				s.touch(idx, op.Time)
+			}
+		}
+	}
+}
+
+// touch marks the objects of a bucket changed at t. Operations logged
+// before they carried a time leave LastUpdated as it was.
+func (s *Store) touch(idx *bucketIndex, t string) {
+	s.dirty[idx.bucket.Name] = true
+	if t != "" {
+		idx.bucket.LastUpdated = t
+		s.bucketsDirty = true
+	}
+}
+
+func (s *Store) putBucket(bucket core.Bucket) *bucketIndex {
+	s.bucketsDirty = true
+	if idx, ok := s.buckets[bucket.Name]; ok {
+		idx.bucket = bucket
+		return idx
+	}
+
+	idx := &bucketIndex{
+		bucket:  bucket,
+		objects: make(map[string]core.Object),
+		types:   make(map[string]core.ContentTypeStats),
+	}
+	s.buckets[bucket.Name] = idx
+	i, _ := slices.BinarySearch(s.names, bucket.Name)
+	s.names = slices.Insert(s.names, i, bucket.Name)
+	s.dirty[bucket.Name] = true
+	return idx
+}
+
+func (idx *bucketIndex) put(object core.Object) {
+	old, replaced := idx.objects[object.Name]
+	if replaced {
+		idx.forget(old)
+	} else {
+		i, _ := slices.BinarySearch(idx.keys, object.Name)
+		idx.keys = slices.Insert(idx.keys, i, object.Name)
+	}
+	idx.objects[object.Name] = object
+
+	size := contentLength(object)
+	idx.size += size
+	idx.count(object.ContentType, 1, size)
+	if idx.largest == "" || size > contentLength(idx.objects[idx.largest]) {
+		idx.largest = object.Name
+	} else if replaced && idx.largest == object.Name {
+		// The largest object shrank
+		idx.findLargest()
+	}
+}
+
+func (idx *bucketIndex) delete(key string) {
+	old, ok := idx.objects[key]
+	if !ok {
+		return
+	}
+	delete(idx.objects, key)
+	i, _ := slices.BinarySearch(idx.keys, key)
+	idx.keys = slices.Delete(idx.keys, i, i+1)
+	idx.forget(old)
+	if idx.largest == key {
+		idx.findLargest()
+	}
+}
+
+// forget takes an object out of the size and content type statistics
+func (idx *bucketIndex) forget(object core.Object) {
+	size := contentLength(object)
+	idx.size -= size
+	idx.count(object.ContentType, -1, -size)
+}
+
+func (idx *bucketIndex) count(contentType string, objects, bytes int64) {
+	typeStats := idx.types[contentType]
+	typeStats.Type = contentType
+	typeStats.Objects += objects
+	typeStats.Bytes += bytes
+	if typeStats.Objects == 0 {
+		delete(idx.types, contentType)
+		return
+	}
+	idx.types[contentType] = typeStats
+}
+
+// findLargest scans the objects for the largest one, which is only needed
+// when the previous largest object was deleted or shrank
+func (idx *bucketIndex) findLargest() {
+	idx.largest = ""
+	var largest int64
+	for _, key := range idx.keys {
+		if size := contentLength(idx.objects[key]); idx.largest == "" || size > largest {
+			idx.largest, largest = key, size
+		}
+	}
+}
+
+// compact writes the snapshots that changed since the last compaction and
+// clears the log. A crash in between leaves the log in place, and since its
+// operations carry complete records, replaying them over the newer
+// snapshots gives the same state. The caller holds the write lock.
+func (s *Store) compact() error {
+	for name := range s.dirty {
+		idx := s.buckets[name]
+		if err := os.MkdirAll(filepath.Join(s.dir, name), core.DirPerm); err != nil {
+			return err
+		}
+
+		objectsData := core.Objects{List: make([]core.Object, 0, len(idx.keys))}
+		for _, key := range idx.keys {
+			objectsData.List = append(objectsData.List, idx.objects[key])
+		}
+		if err := WriteObjectsFile(s.dir, name, objectsData); err != nil {
+			return err
+		}
+		delete(s.dirty, name)
+	}
+
+	if s.bucketsDirty {
+		var bucketsData core.Buckets
+		for _, name := range s.names {
+			bucketsData.List = append(bucketsData.List, s.buckets[name].bucket)
+		}
+		if err := WriteBucketsFile(s.dir, bucketsData); err != nil {
+			return err
+		}
+		s.bucketsDirty = false
+	}
+
+	return s.log.truncate(0)
+}
+
+func contentLength(object core.Object) int64 {
+	n, _ := strconv.ParseInt(object.ContentLength, 10, 64)
+	return n
+}
@@ -0,0 +1,456 @@
+package meta
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+)
+
+// openTestStore opens the metadata of dir, created empty when missing
+func openTestStore(t *testing.T, dir string, compactAt int) *Store {
+	t.Helper()
+	path := filepath.Join(dir, core.BucketsFile)
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		if err := writeCSVFile(path, core.BucketsCSVHeader, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := Open(dir, core.MetadataConfig{CompactThreshold: compactAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// crash drops a store without writing its snapshots, as a killed process
+func crash(s *Store) {
+	s.log.close()
+}
+
+func testObject(key string, size int) core.Object {
+	return core.Object{Name: key, ContentType: "text/plain", ContentLength: strconv.Itoa(size), LastModified: "2024-01-01T00:00:00Z"}
+}
+
+// state returns the buckets and objects held by s
+func state(s *Store) map[string][]core.Object {
+	got := make(map[string][]core.Object)
+	for _, bucket := range s.Buckets() {
+		objects, _, _ := s.List(bucket.Name, "", "", 0)
+		got[bucket.Name] = objects
+	}
+	return got
+}
+
+func logSize(t *testing.T, dir string) int64 {
+	t.Helper()
+	info, err := os.Stat(filepath.Join(dir, core.MetaLogFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+// populate creates two buckets and changes their objects
+func populate(t *testing.T, s *Store) {
+	t.Helper()
+	for _, name := range []string{"photos", "videos"} {
+		if err := s.PutBucket(core.Bucket{Name: name, Status: core.BucketActive}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range 5 {
+		if _, _, err := s.PutObject("photos", testObject(fmt.Sprintf("p%d", i), i*10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := s.PutObject("photos", testObject("p1", 99)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.DeleteObject("photos", "p3"); err != nil {
+		t.Fatal(err)
+	}
+	var b Batch
+	b.PutObject("videos", testObject("v", 7))
+	b.PutBucket(core.Bucket{Name: "empty", Status: core.BucketActive})
+	b.DeleteBucket("empty")
+	if err := s.Apply(&b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoreReplay(t *testing.T) {
+	tests := []struct {
+		name string
+		tail string // bytes left after the last record by the crash
+		want error
+	}{
+		{"clean", "", nil},
+		{"torn record", `[{"op":"put_object","bucket":"photos","object":{"Na`, nil},
+		{"torn record without its bracket", `[`, nil},
+		{"corrupt record", "not json\n", ErrCorruptLog},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := openTestStore(t, dir, 0)
+			populate(t, s)
+			want := state(s)
+			crash(s)
+
+			f, err := os.OpenFile(filepath.Join(dir, core.MetaLogFile), os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.WriteString(tt.tail)
+			f.Close()
+
+			s, err = Open(dir, core.MetadataConfig{})
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Open() = %v, want %v", err, tt.want)
+			}
+			if err != nil {
+				return
+			}
+			defer s.Close()
+
+			if got := state(s); !reflect.DeepEqual(got, want) {
+				t.Errorf("replayed state = %v, want %v", got, want)
+			}
+			// The records were folded into the snapshots, the torn one dropped
+			if size := logSize(t, dir); size != 0 {
+				t.Errorf("log left with %d bytes after opening", size)
+			}
+			size, count, _ := s.Usage("photos")
+			if size != 0+99+20+40 || count != 4 {
+				t.Errorf("Usage() = %d, %d, want 159, 4", size, count)
+			}
+		})
+	}
+}
+
+func TestStoreCompaction(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStore(t, dir, 3)
+	populate(t, s)
+	want := state(s)
+
+	// Compacted every 3 records, the rest is only in the log
+	if s.log.records >= 3 {
+		t.Errorf("%d records logged past the threshold", s.log.records)
+	}
+	crash(s)
+
+	s = openTestStore(t, dir, 3)
+	if got := state(s); !reflect.DeepEqual(got, want) {
+		t.Errorf("state after reopening = %v, want %v", got, want)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read from the snapshots alone
+	if size := logSize(t, dir); size != 0 {
+		t.Errorf("log left with %d bytes after closing", size)
+	}
+	s, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := state(s); !reflect.DeepEqual(got, want) {
+		t.Errorf("state from the snapshots = %v, want %v", got, want)
+	}
+}
+
+func TestStoreCrashDuringCompaction(t *testing.T) {
+	// A crash after the snapshots were written but before the log was
+	// cleared replays the log over the newer snapshots
+	dir := t.TempDir()
+	s := openTestStore(t, dir, 0)
+	populate(t, s)
+	want := state(s)
+
+	logPath := filepath.Join(dir, core.MetaLogFile)
+	logged, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(logPath, logged, core.FilePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openTestStore(t, dir, 0)
+	defer s.Close()
+	if got := state(s); !reflect.DeepEqual(got, want) {
+		t.Errorf("state = %v, want %v", got, want)
+	}
+}
+
+func TestStoreConcurrentChanges(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStore(t, dir, 10)
+	if err := s.PutBucket(core.Bucket{Name: "photos", Status: core.BucketActive}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each writer puts its keys, deletes the odd ones and rewrites the rest
+	const writers, keys = 8, 50
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range keys {
+				key := fmt.Sprintf("w%d/k%02d", w, k)
+				if _, _, err := s.PutObject("photos", testObject(key, 1)); err != nil {
+					t.Error(err)
+					return
+				}
+				if k%2 == 1 {
+					if _, err := s.DeleteObject("photos", key); err != nil {
+						t.Error(err)
+						return
+					}
+				} else if _, _, err := s.PutObject("photos", testObject(key, 2)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	check := func(s *Store) {
+		t.Helper()
+		size, count, err := s.Usage("photos")
+		if err != nil || count != writers*keys/2 || size != 2*writers*keys/2 {
+			t.Errorf("Usage() = %d, %d, %v, want %d, %d", size, count, err, 2*writers*keys/2, writers*keys/2)
+		}
+		objects, _, _ := s.List("photos", "", "", 0)
+		if len(objects) != writers*keys/2 {
+			t.Errorf("List() returned %d objects, want %d", len(objects), writers*keys/2)
+		}
+		for _, object := range objects {
+			if object.ContentLength != "2" {
+				t.Errorf("object %s has length %s, want 2", object.Name, object.ContentLength)
+			}
+		}
+	}
+	check(s)
+	crash(s)
+
+	s = openTestStore(t, dir, 10)
+	defer s.Close()
+	check(s)
+}
+
+func TestDeleteObjectIf(t *testing.T) {
+	errLocked := errors.New("locked")
+	locked := func(object core.Object) error {
+		if object.LegalHold == core.LegalHoldOn {
+			return errLocked
+		}
+		return nil
+	}
+
+	dir := t.TempDir()
+	s := openTestStore(t, dir, 0)
+	defer s.Close()
+	populate(t, s)
+	if _, err := s.UpdateObject("photos", "p0", func(object *core.Object) {
+		object.LegalHold = core.LegalHoldOn
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.DeleteObjectIf("photos", "p0", locked); !errors.Is(err, errLocked) {
+		t.Errorf("DeleteObjectIf() of a held object = %v, want %v", err, errLocked)
+	}
+	if _, err := s.DeleteObjectIf("photos", "p2", locked); err != nil {
+		t.Errorf("DeleteObjectIf() = %v", err)
+	}
+
+	// A refused delete fails the whole batch
+	var b Batch
+	b.DeleteObjectIf("photos", "p4", locked)
+	b.DeleteObjectIf("photos", "p0", locked)
+	if err := s.Apply(&b); !errors.Is(err, errLocked) {
+		t.Errorf("Apply() = %v, want %v", err, errLocked)
+	}
+	for _, key := range []string{"p0", "p4"} {
+		if _, err := s.Object("photos", key); err != nil {
+			t.Errorf("object %s deleted: %v", key, err)
+		}
+	}
+	if _, err := s.Object("photos", "p2"); !errors.Is(err, ErrNoSuchKey) {
+		t.Errorf("Object() of the deleted object = %v", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	object := func(key, contentType string, size int) core.Object {
+		o := testObject(key, size)
+		o.ContentType = contentType
+		return o
+	}
+	tests := []struct {
+		name    string
+		change  func(b *Batch)
+		objects int64
+		bytes   int64
+		largest *core.LargestObject
+		types   []core.ContentTypeStats
+	}{
+		{
+			name:   "empty",
+			change: func(b *Batch) {},
+			types:  []core.ContentTypeStats{},
+		},
+		{
+			name: "puts",
+			change: func(b *Batch) {
+				b.PutObject("photos", object("a", "image/png", 10))
+				b.PutObject("photos", object("b", "text/plain", 30))
+				b.PutObject("photos", object("c", "image/png", 5))
+			},
+			objects: 3, bytes: 45,
+			largest: &core.LargestObject{Key: "b", Size: 30},
+			types:   []core.ContentTypeStats{{Type: "image/png", Objects: 2, Bytes: 15}, {Type: "text/plain", Objects: 1, Bytes: 30}},
+		},
+		{
+			name: "largest deleted",
+			change: func(b *Batch) {
+				b.PutObject("photos", object("a", "image/png", 10))
+				b.PutObject("photos", object("b", "text/plain", 30))
+				b.DeleteObject("photos", "b")
+			},
+			objects: 1, bytes: 10,
+			largest: &core.LargestObject{Key: "a", Size: 10},
+			types:   []core.ContentTypeStats{{Type: "image/png", Objects: 1, Bytes: 10}},
+		},
+		{
+			name: "largest shrank",
+			change: func(b *Batch) {
+				b.PutObject("photos", object("a", "image/png", 10))
+				b.PutObject("photos", object("b", "text/plain", 30))
+				b.PutObject("photos", object("b", "text/plain", 1))
+			},
+			objects: 2, bytes: 11,
+			largest: &core.LargestObject{Key: "a", Size: 10},
+			types:   []core.ContentTypeStats{{Type: "image/png", Objects: 1, Bytes: 10}, {Type: "text/plain", Objects: 1, Bytes: 1}},
+		},
+		{
+			name: "content type changed",
+			change: func(b *Batch) {
+				b.PutObject("photos", object("a", "text/plain", 10))
+				b.PutObject("photos", object("a", "text/csv", 12))
+			},
+			objects: 1, bytes: 12,
+			largest: &core.LargestObject{Key: "a", Size: 12},
+			types:   []core.ContentTypeStats{{Type: "text/csv", Objects: 1, Bytes: 12}},
+		},
+		{
+			name: "all deleted",
+			change: func(b *Batch) {
+				b.PutObject("photos", object("a", "text/plain", 10))
+				b.DeleteObject("photos", "a")
+			},
+			types: []core.ContentTypeStats{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := openTestStore(t, dir, 0)
+			if err := s.PutBucket(core.Bucket{Name: "photos", Status: core.BucketActive}); err != nil {
+				t.Fatal(err)
+			}
+			var b Batch
+			tt.change(&b)
+			if err := s.Apply(&b); err != nil {
+				t.Fatal(err)
+			}
+			want := core.BucketStats{Objects: tt.objects, Bytes: tt.bytes, LargestObject: tt.largest, ContentTypes: tt.types}
+
+			// Kept up to date by the changes, and rebuilt from the log and
+			// from the snapshots
+			stats, err := s.Stats("photos")
+			if err != nil || !reflect.DeepEqual(stats, want) {
+				t.Errorf("Stats() = %+v, %v, want %+v", stats, err, want)
+			}
+			crash(s)
+			s = openTestStore(t, dir, 0)
+			defer s.Close()
+			if stats, err := s.Stats("photos"); err != nil || !reflect.DeepEqual(stats, want) {
+				t.Errorf("Stats() after reopening = %+v, %v, want %+v", stats, err, want)
+			}
+		})
+	}
+}
+
+func TestLastUpdated(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStore(t, dir, 0)
+	if err := s.PutBucket(core.Bucket{Name: "photos", Status: core.BucketActive, LastUpdated: "2024-01-01T00:00:00Z"}); err != nil {
+		t.Fatal(err)
+	}
+	lastUpdated := func() string {
+		bucket, _ := s.Bucket("photos")
+		return bucket.LastUpdated
+	}
+
+	changes := []struct {
+		name   string
+		change func() error
+	}{
+		{"put", func() error { _, _, err := s.PutObject("photos", testObject("a", 1)); return err }},
+		{"update", func() error {
+			_, err := s.UpdateObject("photos", "a", func(o *core.Object) { o.ContentType = "text/csv" })
+			return err
+		}},
+		{"delete", func() error { _, err := s.DeleteObject("photos", "a"); return err }},
+	}
+	previous := lastUpdated()
+	for _, c := range changes {
+		if err := c.change(); err != nil {
+			t.Fatal(err)
+		}
+		got, err := time.Parse(time.RFC3339Nano, lastUpdated())
+		before, _ := time.Parse(time.RFC3339Nano, previous)
+		if err != nil || !got.After(before) {
+			t.Errorf("LastUpdated after %s = %s, want after %s", c.name, lastUpdated(), previous)
+		}
+		previous = lastUpdated()
+	}
+
+	// A failed change leaves it alone
+	if _, err := s.DeleteObject("photos", "missing"); !errors.Is(err, ErrNoSuchKey) {
+		t.Fatalf("DeleteObject() = %v", err)
+	}
+	if got := lastUpdated(); got != previous {
+		t.Errorf("LastUpdated after a failed delete = %s, want %s", got, previous)
+	}
+
+	crash(s)
+	s = openTestStore(t, dir, 0)
+	defer s.Close()
+	if got := lastUpdated(); got != previous {
+		t.Errorf("LastUpdated after replay = %s, want %s", got, previous)
+	}
+
+	// Records logged before they carried a time leave it as it was
+	s.apply([]Op{{Type: OpPutObject, Bucket: "photos", Object: &core.Object{Name: "old", ContentLength: "1"}}})
+	if got := lastUpdated(); got != previous {
+		t.Errorf("LastUpdated after an untimed record = %s, want %s", got, previous)
+	}
+}
@@ -0,0 +1,130 @@
+package metrics
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds of the request latency histogram, in seconds
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type requestKey struct {
+	operation string
+	status    string
+}
+
+type histogram struct {
+	counts []uint64 // one per latency bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// Metrics holds the in-process counters exported on /metrics
+type Metrics struct {
+	mu       sync.Mutex
+	requests map[requestKey]*histogram
+	bytesIn  map[string]uint64
+	bytesOut map[string]uint64
+
+	activeUploads atomic.Int64
+}
+
+func New() *Metrics {
+	return &Metrics{
+		requests: make(map[requestKey]*histogram),
+		bytesIn:  make(map[string]uint64),
+		bytesOut: make(map[string]uint64),
+	}
+}
+
+// ObserveRequest records a served request
+func (m *Metrics) ObserveRequest(operation string, status int, duration time.Duration, bytesIn, bytesOut int64) {
+	key := requestKey{operation: operation, status: strconv.Itoa(status)}
+	seconds := duration.Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.requests[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.requests[key] = h
+	}
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+
+	m.bytesIn[operation] += uint64(bytesIn)
+	m.bytesOut[operation] += uint64(bytesOut)
+}
+
+// UploadStarted marks an upload as in progress and returns the function
+// that marks it as finished.
+func (m *Metrics) UploadStarted() (done func()) {
+	m.activeUploads.Add(1)
+	return func() { m.activeUploads.Add(-1) }
+}
+
+// Write renders the request metrics in the Prometheus text format
+func (m *Metrics) Write(w *Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].operation != keys[j].operation {
+			return keys[i].operation < keys[j].operation
+		}
+		return keys[i].status < keys[j].status
+	})
+
+	w.Header("triples_http_requests_total", "Total number of HTTP requests by operation and status.", "counter")
+	for _, key := range keys {
+		w.Sample("triples_http_requests_total", float64(m.requests[key].count), "operation", key.operation, "status", key.status)
+	}
+
+	w.Header("triples_http_request_duration_seconds", "HTTP request latency by operation and status.", "histogram")
+	for _, key := range keys {
+		h := m.requests[key]
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += h.counts[i]
+			w.Sample("triples_http_request_duration_seconds_bucket", float64(cumulative),
+				"operation", key.operation, "status", key.status, "le", formatFloat(bound))
+		}
+		w.Sample("triples_http_request_duration_seconds_bucket", float64(h.count),
+			"operation", key.operation, "status", key.status, "le", "+Inf")
+		w.Sample("triples_http_request_duration_seconds_sum", h.sum, "operation", key.operation, "status", key.status)
+		w.Sample("triples_http_request_duration_seconds_count", float64(h.count), "operation", key.operation, "status", key.status)
+	}
+
+	writeByOperation(w, "triples_http_request_bytes_total", "Bytes received in request bodies by operation.", m.bytesIn)
+	writeByOperation(w, "triples_http_response_bytes_total", "Bytes sent in response bodies by operation.", m.bytesOut)
+
+	w.Header("triples_active_uploads", "Number of object uploads in progress.", "gauge")
+	w.Sample("triples_active_uploads", float64(m.activeUploads.Load()))
+}
+
+func writeByOperation(w *Writer, name, help string, values map[string]uint64) {
+	operations := make([]string, 0, len(values))
+	for op := range values {
+		operations = append(operations, op)
+	}
+	sort.Strings(operations)
+
+	w.Header(name, help, "counter")
+	for _, op := range operations {
+		w.Sample(name, float64(values[op]), "operation", op)
+	}
+}
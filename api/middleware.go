@@ -0,0 +1,154 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/handlers"
+	"github.com/ab-dauletkhan/triple-s/api/metrics"
+)
+
+var (
+	ErrAdminDisabled     = errors.New("admin API is disabled, set admin.token to enable it")
+	ErrAdminUnauthorized = errors.New("missing or invalid admin token")
+	ErrSlowDown          = errors.New("please reduce your request rate")
+)
+
+// statusRecorder captures the status code and the number of bytes written
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// countingReader counts the bytes read from the request body
+type countingReader struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	cr.bytes += int64(n)
+	return n, err
+}
+
+// newRequestID returns a random identifier for correlating log lines
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// AccessLog attaches a request scoped logger to every request and, when
+// enabled, writes one log line per request once it has been served.
+func AccessLog(cfg core.LogConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		requestID := r.Header.Get("X-Request-Id")
+		if requestID == "" {
+			requestID = newRequestID()
+		}
+		w.Header().Set("X-Request-Id", requestID)
+		w.Header().Set("x-amz-request-id", requestID)
+
+		logger := slog.Default().With(slog.String("request_id", requestID))
+		r = r.WithContext(core.WithLogger(r.Context(), logger))
+
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		rec := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rec, r)
+
+		if !cfg.Access {
+			return
+		}
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		logger.LogAttrs(r.Context(), slog.LevelInfo, "request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("bucket", r.PathValue("BucketName")),
+			slog.String("key", r.PathValue("ObjectKey")),
+			slog.Int("status", rec.status),
+			slog.Int64("bytes_in", body.bytes),
+			slog.Int64("bytes_out", rec.bytes),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("remote_addr", r.RemoteAddr),
+		)
+	})
+}
+
+// Instrument records the count, latency and transferred bytes of every
+// request, labelled with the S3 operation it was dispatched to.
+func Instrument(m *metrics.Metrics, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		rec := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		m.ObserveRequest(operation(r), rec.status, time.Since(start), body.bytes, rec.bytes)
+	})
+}
+
+// AdminOnly rejects requests that do not carry the admin bearer token.
+// The admin API is disabled altogether when no token is configured.
+func AdminOnly(cfg core.AdminConfig, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg.Token == "" {
+			handlers.XMLErrResponse(w, http.StatusForbidden, ErrAdminDisabled.Error())
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Token)) != 1 {
+			core.Logger(r.Context()).Warn("rejected admin request")
+			handlers.XMLErrResponse(w, http.StatusUnauthorized, ErrAdminUnauthorized.Error())
+			return
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,194 @@
+// Package migrate upgrades data directories written by older versions of
+// triple-s to the current format. Every change to the on-disk layout bumps
+// core.FormatVersion and adds a migration to the registry.
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/meta"
+	"github.com/ab-dauletkhan/triple-s/api/util"
+)
+
+// Migration upgrades a data directory to format Version from any format
+// after the Version of the previous migration
+type Migration struct {
+	Version     int
+	Description string
+	// Run applies the migration or, with dryRun, only reports what it
+	// would change. It returns one line per change.
+	Run func(dir string, dryRun bool) ([]string, error)
+}
+
+// Step is the outcome of one migration
+type Step struct {
+	Version     int      `json:"version"`
+	Description string   `json:"description"`
+	Changes     []string `json:"changes"`
+}
+
+// Result is the outcome of a migration run
+type Result struct {
+	From   int    `json:"from"`
+	To     int    `json:"to"`
+	DryRun bool   `json:"dry_run"`
+	Backup string `json:"backup,omitempty"` // directory of the metadata backup
+	Steps  []Step `json:"steps"`
+	// Buckets created before their name was reserved for a server endpoint
+	Reserved []string `json:"reserved_buckets,omitempty"`
+}
+
+type Options struct {
+	DryRun   bool // report the changes without making them
+	NoBackup bool // skip copying the metadata files before migrating
+}
+
+var ErrRegistry = errors.New("migration registry is inconsistent")
+
+// Pending returns the migrations that upgrade a directory in the given
+// format to the current one, in order
+func Pending(version int) ([]Migration, error) {
+	var pending []Migration
+	last := 1
+	for i, m := range migrations {
+		if m.Version <= last {
+			return nil, fmt.Errorf("%w: migration %d has version %d after %d", ErrRegistry, i, m.Version, last)
+		}
+		last = m.Version
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+
+	if last != core.FormatVersion {
+		return nil, fmt.Errorf("%w: migrations end at %d, format is %d", ErrRegistry, last, core.FormatVersion)
+	}
+	return pending, nil
+}
+
+// Run migrates dir to the current format. The format marker is updated
+// after every migration, so a failed run resumes where it stopped. The
+// directory must not be in use while it is migrated.
+func Run(dir string, opts Options) (*Result, error) {
+	version, err := util.ReadFormatVersion(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{From: version, To: version, DryRun: opts.DryRun, Steps: []Step{}}
+	if version == 0 {
+		// A new directory is written in the current format from the start
+		result.From, result.To = core.FormatVersion, core.FormatVersion
+		return result, nil
+	}
+	if version > core.FormatVersion {
+		return nil, fmt.Errorf("%w: format %d, supported up to %d", util.ErrFormatTooNew, version, core.FormatVersion)
+	}
+
+	result.Reserved, err = reservedBuckets(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	pending, err := Pending(version)
+	if err != nil || len(pending) == 0 {
+		return result, err
+	}
+
+	if !opts.DryRun && !opts.NoBackup {
+		result.Backup, err = backup(dir, version)
+		if err != nil {
+			return nil, fmt.Errorf("backup: %w", err)
+		}
+	}
+
+	for _, m := range pending {
+		changes, err := m.Run(dir, opts.DryRun)
+		if err != nil {
+			return result, fmt.Errorf("migration to format %d: %w", m.Version, err)
+		}
+		if !opts.DryRun {
+			if err := util.WriteFormatVersion(dir, m.Version); err != nil {
+				return result, err
+			}
+		}
+
+		result.To = m.Version
+		result.Steps = append(result.Steps, Step{Version: m.Version, Description: m.Description, Changes: changes})
+	}
+	return result, nil
+}
+
+// backup copies the metadata files of dir, but not the object data, to a
+// new directory under .backups and returns its path
+func backup(dir string, version int) (string, error) {
+	name := fmt.Sprintf("%s-v%d", time.Now().UTC().Format("20060102T150405Z"), version)
+	backupDir := filepath.Join(dir, core.BackupsDir, name)
+
+	files := []string{core.FormatFile, core.BucketsFile, core.MetaLogFile, core.JournalFile}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && (util.ValidateBucketName(entry.Name()) == nil || util.ReservedBucketName(entry.Name())) {
+			files = append(files, filepath.Join(entry.Name(), core.ObjectsFile))
+		}
+	}
+
+	for _, file := range files {
+		err := copyFile(filepath.Join(dir, file), filepath.Join(backupDir, file))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+	}
+	return backupDir, nil
+}
+
+// reservedBuckets returns the buckets of dir named like a server endpoint.
+// Names are the first column of buckets.csv in every format.
+func reservedBuckets(dir string) ([]string, error) {
+	buckets, err := meta.ReadBucketsFile(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, bucket := range buckets.List {
+		if util.ReservedBucketName(bucket.Name) {
+			names = append(names, bucket.Name)
+		}
+	}
+	return names, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), core.DirPerm); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, core.FilePerm)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Sync()
+}
@@ -0,0 +1,309 @@
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/meta"
+	"github.com/ab-dauletkhan/triple-s/api/util"
+)
+
+// newV1Dir returns a data directory in the original layout, holding the
+// bucket photos with the object a.txt stored next to objects.csv
+func newV1Dir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string]string{
+		core.BucketsFile: "Name,Status,CreationDate,LastUpdated\nphotos,Active,2024-10-17T22:47:06Z,2024-10-17T22:47:06Z\n",
+		filepath.Join("photos", core.ObjectsFile): "ObjectKey,ContentType,ContentLength,LastModified\na.txt,text/plain,7,2024-10-17T22:48:00Z\n",
+		filepath.Join("photos", "a.txt"):          "content",
+	}
+	for name, content := range files {
+		writeFile(t, filepath.Join(dir, name), content)
+	}
+	return dir
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), core.DirPerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), core.FilePerm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func versions(steps []Step) []int {
+	var list []int
+	for _, step := range steps {
+		list = append(list, step.Version)
+	}
+	return list
+}
+
+// checkMigrated fails unless dir holds photos/a.txt in the current format
+func checkMigrated(t *testing.T, dir string) {
+	t.Helper()
+	if version, err := util.ReadFormatVersion(dir); err != nil || version != core.FormatVersion {
+		t.Errorf("format = %d, %v, want %d", version, err, core.FormatVersion)
+	}
+	for path, header := range map[string][]string{
+		filepath.Join(dir, core.BucketsFile):           core.BucketsCSVHeader,
+		filepath.Join(dir, "photos", core.ObjectsFile): core.ObjectsCSVHeader,
+	} {
+		if outdated, err := headerOutdated(path, header); err != nil || outdated {
+			t.Errorf("%s header outdated: %v", path, err)
+		}
+	}
+
+	objects, err := meta.ReadObjectsFile(dir, "photos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects.List) != 1 || objects.List[0].ETag == "" || objects.List[0].Digest == "" {
+		t.Errorf("objects = %+v, want a.txt with its checksums", objects.List)
+	}
+	if got := readFile(t, util.ObjectPath(dir, "photos", "a.txt")); got != "content" {
+		t.Errorf("object file = %q", got)
+	}
+}
+
+func TestPending(t *testing.T) {
+	tests := []struct {
+		version int
+		want    []int
+	}{
+		{1, []int{2, 3, 8}},
+		{2, []int{3, 8}},
+		{3, []int{8}},
+		{5, []int{8}},
+		{7, []int{8}},
+		{8, nil},
+	}
+	for _, tt := range tests {
+		pending, err := Pending(tt.version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []int
+		for _, m := range pending {
+			got = append(got, m.Version)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("Pending(%d) = %v, want %v", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir := newV1Dir(t)
+	result, err := Run(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.From != 1 || result.To != core.FormatVersion || !slices.Equal(versions(result.Steps), []int{2, 3, 8}) {
+		t.Errorf("Run() = %+v", result)
+	}
+	checkMigrated(t, dir)
+
+	// A migrated directory is left alone
+	result, err = Run(dir, Options{})
+	if err != nil || len(result.Steps) != 0 || result.Backup != "" {
+		t.Errorf("second Run() = %+v, %v", result, err)
+	}
+}
+
+// Directories in any of the formats that only lacked columns are upgraded by
+// one header rewrite
+func TestRunAddsColumns(t *testing.T) {
+	tests := []struct {
+		version       int
+		bucketColumns int // columns of buckets.csv in that format
+		objectColumns int
+	}{
+		{3, 7, 8},
+		{4, 8, 8},
+		{5, 11, 11},
+		{6, 12, 11},
+		{7, 13, 12},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("format %d", tt.version), func(t *testing.T) {
+			dir := newV1Dir(t)
+			if _, err := encodeObjectPaths(dir, false); err != nil {
+				t.Fatal(err)
+			}
+			writeFile(t, filepath.Join(dir, core.BucketsFile), strings.Join(core.BucketsCSVHeader[:tt.bucketColumns], ",")+
+				"\nphotos,Active,2024-10-17T22:47:06Z,2024-10-17T22:47:06Z,,,\n")
+			writeFile(t, filepath.Join(dir, "photos", core.ObjectsFile), strings.Join(core.ObjectsCSVHeader[:tt.objectColumns], ",")+
+				"\na.txt,text/plain,7,2024-10-17T22:48:00Z,digest,file,etag,\n")
+			if err := util.WriteFormatVersion(dir, tt.version); err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := Run(dir, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(versions(result.Steps), []int{8}) || len(result.Steps[0].Changes) != 2 {
+				t.Errorf("Run() steps = %+v, want both files rewritten by migration 8", result.Steps)
+			}
+			checkMigrated(t, dir)
+			buckets, err := meta.ReadBucketsFile(dir)
+			if err != nil || len(buckets.List) != 1 || buckets.List[0].DeletedAt != "" || len(buckets.List[0].Lifecycle) != 0 {
+				t.Errorf("buckets = %+v, %v, want photos without the new settings", buckets.List, err)
+			}
+		})
+	}
+}
+
+func TestBackup(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"backup", Options{}},
+		{"no backup", Options{NoBackup: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := newV1Dir(t)
+			buckets := readFile(t, filepath.Join(dir, core.BucketsFile))
+			objects := readFile(t, filepath.Join(dir, "photos", core.ObjectsFile))
+
+			result, err := Run(dir, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.opts.NoBackup {
+				if _, err := os.Stat(filepath.Join(dir, core.BackupsDir)); result.Backup != "" || !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("backup taken: %q, %v", result.Backup, err)
+				}
+				return
+			}
+
+			if filepath.Dir(result.Backup) != filepath.Join(dir, core.BackupsDir) || !strings.HasSuffix(result.Backup, "-v1") {
+				t.Fatalf("backup = %q", result.Backup)
+			}
+			// The metadata files are copied as they were, the object data is not
+			if got := readFile(t, filepath.Join(result.Backup, core.BucketsFile)); got != buckets {
+				t.Errorf("backup of %s = %q, want %q", core.BucketsFile, got, buckets)
+			}
+			if got := readFile(t, filepath.Join(result.Backup, "photos", core.ObjectsFile)); got != objects {
+				t.Errorf("backup of %s = %q, want %q", core.ObjectsFile, got, objects)
+			}
+			if _, err := os.Stat(filepath.Join(result.Backup, "photos", "a.txt")); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("object data backed up: %v", err)
+			}
+		})
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	dir := newV1Dir(t)
+	before := map[string]string{}
+	for _, name := range []string{core.BucketsFile, filepath.Join("photos", core.ObjectsFile), filepath.Join("photos", "a.txt")} {
+		before[name] = readFile(t, filepath.Join(dir, name))
+	}
+
+	result, err := Run(dir, Options{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.DryRun || result.Backup != "" || !slices.Equal(versions(result.Steps), []int{2, 3, 8}) {
+		t.Errorf("Run() = %+v", result)
+	}
+	if len(result.Steps[0].Changes) != 1 || !strings.Contains(result.Steps[0].Changes[0], "a.txt") {
+		t.Errorf("changes of migration 2 = %q, want the move of a.txt", result.Steps[0].Changes)
+	}
+
+	for name, content := range before {
+		if got := readFile(t, filepath.Join(dir, name)); got != content {
+			t.Errorf("%s changed by a dry run", name)
+		}
+	}
+	for _, name := range []string{core.FormatFile, core.BackupsDir} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s written by a dry run: %v", name, err)
+		}
+	}
+}
+
+func TestInterruptedRun(t *testing.T) {
+	dir := newV1Dir(t)
+
+	// The run stops at migration 3, after migration 2 was recorded
+	registry := migrations
+	t.Cleanup(func() { migrations = registry })
+	migrations = slices.Clone(registry)
+	errInterrupted := errors.New("interrupted")
+	migrations[1].Run = func(string, bool) ([]string, error) { return nil, errInterrupted }
+
+	result, err := Run(dir, Options{})
+	if !errors.Is(err, errInterrupted) {
+		t.Fatalf("Run() = %v, want %v", err, errInterrupted)
+	}
+	if result.To != 2 || !slices.Equal(versions(result.Steps), []int{2}) {
+		t.Errorf("interrupted Run() = %+v", result)
+	}
+	if version, _ := util.ReadFormatVersion(dir); version != 2 {
+		t.Errorf("format after the interruption = %d, want 2", version)
+	}
+
+	// The next run resumes where it stopped
+	migrations = registry
+	result, err = Run(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.From != 2 || !slices.Equal(versions(result.Steps), []int{3, 8}) || !strings.HasSuffix(result.Backup, "-v2") {
+		t.Errorf("resumed Run() = %+v", result)
+	}
+	checkMigrated(t, dir)
+}
+
+func TestRunReportsReservedBuckets(t *testing.T) {
+	for _, dryRun := range []bool{true, false} {
+		t.Run(fmt.Sprintf("dry run %v", dryRun), func(t *testing.T) {
+			dir := newV1Dir(t)
+			// Created before the name was reserved
+			buckets := readFile(t, filepath.Join(dir, core.BucketsFile))
+			writeFile(t, filepath.Join(dir, core.BucketsFile), buckets+"metrics,Active,2024-10-17T22:47:06Z,2024-10-17T22:47:06Z\n")
+			objects := "ObjectKey,ContentType,ContentLength,LastModified\n"
+			writeFile(t, filepath.Join(dir, "metrics", core.ObjectsFile), objects)
+
+			result, err := Run(dir, Options{DryRun: dryRun})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(result.Reserved, []string{"metrics"}) {
+				t.Errorf("reserved buckets = %v, want [metrics]", result.Reserved)
+			}
+			if dryRun {
+				return
+			}
+			if got := readFile(t, filepath.Join(result.Backup, "metrics", core.ObjectsFile)); got != objects {
+				t.Errorf("backup of the reserved bucket = %q, want %q", got, objects)
+			}
+			if outdated, err := headerOutdated(filepath.Join(dir, "metrics", core.ObjectsFile), core.ObjectsCSVHeader); err != nil || outdated {
+				t.Errorf("reserved bucket not migrated: %v", err)
+			}
+		})
+	}
+}
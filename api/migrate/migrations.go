@@ -0,0 +1,253 @@
+package migrate
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/meta"
+	"github.com/ab-dauletkhan/triple-s/api/storage"
+	"github.com/ab-dauletkhan/triple-s/api/util"
+)
+
+// The registry of migrations, in order. Format 1 is the original layout:
+// four columns per CSV file and object files named after their raw key, next
+// to objects.csv.
+var migrations = []Migration{
+	{
+		Version:     2,
+		Description: "move object files to the data directory of their bucket, under encoded names",
+		Run:         encodeObjectPaths,
+	},
+	{
+		Version:     3,
+		Description: "write the current CSV columns and fill in the storage, ETag and digest of older objects",
+		Run:         completeColumns,
+	},
+	// Formats 4 to 8 only appended columns: DeletedAt (4), the object lock
+	// columns (5), Notifications (6), the replication columns (7) and the
+	// lifecycle and storage class columns (8). An empty value means the
+	// feature does not apply, which is what every existing bucket and object
+	// gets, so one header rewrite upgrades any of them.
+	{
+		Version:     8,
+		Description: "add the trash, object lock, notification, replication, lifecycle and storage class columns to buckets.csv and every objects.csv",
+		Run:         addColumns,
+	},
+}
+
+// encodeObjectPaths moves object files stored directly in the bucket
+// directory, named after their raw key, to their encoded path
+func encodeObjectPaths(dir string, dryRun bool) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []string
+	for _, bucket := range entries {
+		if !bucket.IsDir() {
+			continue
+		}
+
+		bucketPath := filepath.Join(dir, bucket.Name())
+		if _, err := os.Stat(filepath.Join(bucketPath, core.ObjectsFile)); err != nil {
+			continue
+		}
+
+		files, err := os.ReadDir(bucketPath)
+		if err != nil {
+			return changes, err
+		}
+
+		for _, file := range files {
+			if !file.Type().IsRegular() || file.Name() == core.ObjectsFile {
+				continue
+			}
+
+			changes = append(changes, fmt.Sprintf("%s/%s: move to %s", bucket.Name(), file.Name(), core.DataDir))
+			if dryRun {
+				continue
+			}
+
+			newPath := util.ObjectPath(dir, bucket.Name(), file.Name())
+			if err := os.MkdirAll(filepath.Dir(newPath), core.DirPerm); err != nil {
+				return changes, err
+			}
+			if err := os.Rename(filepath.Join(bucketPath, file.Name()), newPath); err != nil {
+				return changes, err
+			}
+		}
+	}
+
+	return changes, nil
+}
+
+// completeColumns rewrites the CSV files with the current header. Objects
+// stored before their storage kind was recorded are plain files, and their
+// ETag and digest are computed from them.
+func completeColumns(dir string, dryRun bool) ([]string, error) {
+	var changes []string
+
+	bucketsPath := filepath.Join(dir, core.BucketsFile)
+	outdated, err := headerOutdated(bucketsPath, core.BucketsCSVHeader)
+	if err != nil {
+		return nil, err
+	}
+	bucketsData, err := meta.ReadBucketsFile(dir)
+	if err != nil {
+		return nil, err
+	}
+	if outdated {
+		changes = append(changes, core.BucketsFile+": write the current columns")
+		if !dryRun {
+			if err := meta.WriteBucketsFile(dir, bucketsData); err != nil {
+				return changes, err
+			}
+		}
+	}
+
+	for _, bucket := range bucketsData.List {
+		objectsPath := filepath.Join(dir, bucket.Name, core.ObjectsFile)
+		outdated, err := headerOutdated(objectsPath, core.ObjectsCSVHeader)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return changes, err
+		}
+
+		objectsData, err := meta.ReadObjectsFile(dir, bucket.Name)
+		if err != nil {
+			return changes, err
+		}
+
+		filled := 0
+		for i, object := range objectsData.List {
+			if object.Storage != "" && object.ETag != "" && object.Digest != "" {
+				continue
+			}
+			if object.Storage == "" {
+				objectsData.List[i].Storage = storage.KindFile
+			}
+			if object.ETag == "" || object.Digest == "" {
+				etag, digest, err := checksums(util.ObjectPath(dir, bucket.Name, object.Name))
+				if err != nil && !os.IsNotExist(err) {
+					return changes, err
+				}
+				// Objects without data are left for fsck to report
+				objectsData.List[i].ETag, objectsData.List[i].Digest = etag, digest
+			}
+			filled++
+		}
+
+		if !outdated && filled == 0 {
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("%s/%s: write the current columns, fill in %d objects",
+			bucket.Name, core.ObjectsFile, filled))
+		if !dryRun {
+			if err := meta.WriteObjectsFile(dir, bucket.Name, objectsData); err != nil {
+				return changes, err
+			}
+		}
+	}
+
+	return changes, nil
+}
+
+// headerOutdated reports whether the header of a CSV file differs from header
+func headerOutdated(path string, header []string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	record, err := csv.NewReader(f).Read()
+	if err == io.EOF {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !slices.Equal(record, header), nil
+}
+
+// checksums returns the hex MD5 and SHA-256 of a file
+func checksums(path string) (etag, digest string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	md5Hash, sha256Hash := md5.New(), sha256.New()
+	if _, err := io.Copy(io.MultiWriter(md5Hash, sha256Hash), f); err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(md5Hash.Sum(nil)), hex.EncodeToString(sha256Hash.Sum(nil)), nil
+}
+
+// addBucketsColumns rewrites buckets.csv with the current header, the new
+// columns are empty
+func addBucketsColumns(dir string, dryRun bool) ([]string, error) {
+	outdated, err := headerOutdated(filepath.Join(dir, core.BucketsFile), core.BucketsCSVHeader)
+	if err != nil || !outdated {
+		return nil, err
+	}
+
+	changes := []string{core.BucketsFile + ": write the current columns"}
+	if dryRun {
+		return changes, nil
+	}
+
+	bucketsData, err := meta.ReadBucketsFile(dir)
+	if err != nil {
+		return nil, err
+	}
+	return changes, meta.WriteBucketsFile(dir, bucketsData)
+}
+
+// addColumns rewrites buckets.csv and the objects.csv of every bucket with
+// the current header, the new columns are empty
+func addColumns(dir string, dryRun bool) ([]string, error) {
+	changes, err := addBucketsColumns(dir, dryRun)
+	if err != nil {
+		return changes, err
+	}
+
+	bucketsData, err := meta.ReadBucketsFile(dir)
+	if err != nil {
+		return changes, err
+	}
+	for _, bucket := range bucketsData.List {
+		outdated, err := headerOutdated(filepath.Join(dir, bucket.Name, core.ObjectsFile), core.ObjectsCSVHeader)
+		if os.IsNotExist(err) || (err == nil && !outdated) {
+			continue
+		}
+		if err != nil {
+			return changes, err
+		}
+
+		changes = append(changes, fmt.Sprintf("%s/%s: write the current columns", bucket.Name, core.ObjectsFile))
+		if dryRun {
+			continue
+		}
+		objectsData, err := meta.ReadObjectsFile(dir, bucket.Name)
+		if err != nil {
+			return changes, err
+		}
+		if err := meta.WriteObjectsFile(dir, bucket.Name, objectsData); err != nil {
+			return changes, err
+		}
+	}
+	return changes, nil
+}
@@ -0,0 +1,231 @@
+package api
+
+import (
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/handlers"
+)
+
+// Limiters unused for this long are dropped
+const limiterIdleTimeout = 10 * time.Minute
+
+// tokenBucket refills at rate tokens per second up to burst tokens
+type tokenBucket struct {
+	mu       sync.Mutex
+	rate     float64
+	burst    float64
+	tokens   float64
+	last     time.Time
+	lastUsed time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	now := time.Now()
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now, lastUsed: now}
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	tb.tokens = math.Min(tb.burst, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	tb.last = now
+	tb.lastUsed = now
+}
+
+// allow takes one token if there is one, otherwise it reports how long
+// until there will be
+func (tb *tokenBucket) allow() (bool, time.Duration) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill(time.Now())
+	if tb.tokens < 1 {
+		return false, time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second))
+	}
+	tb.tokens--
+	return true, 0
+}
+
+// take takes n tokens, going into debt if needed, and returns how long the
+// caller has to wait for the debt to be paid back
+func (tb *tokenBucket) take(n int) time.Duration {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill(time.Now())
+	tb.tokens -= float64(n)
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+// throttle waits until the bucket has paid back n bytes
+func (tb *tokenBucket) throttle(n int) {
+	if wait := tb.take(n); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+func (tb *tokenBucket) idleSince(now time.Time) time.Duration {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return now.Sub(tb.lastUsed)
+}
+
+// RateLimiter keeps a request and a bandwidth token bucket per client IP and bucket
+type RateLimiter struct {
+	cfg     core.RateLimitConfig
+	uploads chan struct{}
+
+	mu       sync.Mutex
+	requests map[string]*tokenBucket
+	bytes    map[string]*tokenBucket
+}
+
+func NewRateLimiter(cfg core.RateLimitConfig) *RateLimiter {
+	rl := &RateLimiter{
+		cfg:      cfg,
+		requests: make(map[string]*tokenBucket),
+		bytes:    make(map[string]*tokenBucket),
+	}
+	if cfg.MaxConcurrentUploads > 0 {
+		rl.uploads = make(chan struct{}, cfg.MaxConcurrentUploads)
+	}
+	go rl.sweep()
+	return rl
+}
+
+// limitsFor returns the limits applying to a bucket and the suffix that
+// separates its token buckets from the client's global ones
+func (rl *RateLimiter) limitsFor(bucket string) (core.BucketRateLimit, string) {
+	if limit, ok := rl.cfg.Buckets[bucket]; ok && bucket != "" {
+		return limit, "/" + bucket
+	}
+	return core.BucketRateLimit{
+		RequestsPerSecond: rl.cfg.RequestsPerSecond,
+		Burst:             rl.cfg.Burst,
+		BytesPerSecond:    rl.cfg.BytesPerSecond,
+	}, ""
+}
+
+func (rl *RateLimiter) bucket(m map[string]*tokenBucket, key string, rate, burst float64) *tokenBucket {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	tb, ok := m[key]
+	if !ok {
+		tb = newTokenBucket(rate, burst)
+		m[key] = tb
+	}
+	return tb
+}
+
+// sweep periodically forgets clients that have gone quiet
+func (rl *RateLimiter) sweep() {
+	for now := range time.Tick(limiterIdleTimeout) {
+		rl.mu.Lock()
+		for _, m := range []map[string]*tokenBucket{rl.requests, rl.bytes} {
+			for key, tb := range m {
+				if tb.idleSince(now) > limiterIdleTimeout {
+					delete(m, key)
+				}
+			}
+		}
+		rl.mu.Unlock()
+	}
+}
+
+// Middleware rejects clients over their request rate with 503 SlowDown,
+// throttles their bandwidth, and caps the number of concurrent uploads.
+// Clients are identified by remote IP: requests are not authenticated, so an
+// access key named by a request cannot be trusted to tell clients apart.
+func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bucketName, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		limit, suffix := rl.limitsFor(bucketName)
+		client := remoteIP(r) + suffix
+
+		if limit.RequestsPerSecond > 0 {
+			burst := float64(limit.Burst)
+			if burst < 1 {
+				burst = math.Max(1, math.Ceil(limit.RequestsPerSecond))
+			}
+			tb := rl.bucket(rl.requests, client, limit.RequestsPerSecond, burst)
+			if ok, retryAfter := tb.allow(); !ok {
+				core.Logger(r.Context()).Info("request rate limited", "client", remoteIP(r), "bucket", bucketName)
+				slowDown(w, retryAfter)
+				return
+			}
+		}
+
+		if rl.uploads != nil && isUpload(r) {
+			select {
+			case rl.uploads <- struct{}{}:
+				defer func() { <-rl.uploads }()
+			default:
+				core.Logger(r.Context()).Info("too many concurrent uploads", "max_uploads", rl.cfg.MaxConcurrentUploads)
+				slowDown(w, time.Second)
+				return
+			}
+		}
+
+		if limit.BytesPerSecond > 0 {
+			rate := float64(limit.BytesPerSecond)
+			tb := rl.bucket(rl.bytes, client, rate, rate)
+			r.Body = &throttledReader{ReadCloser: r.Body, tb: tb}
+			w = &throttledWriter{ResponseWriter: w, tb: tb}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func slowDown(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+	handlers.XMLErrResponse(w, http.StatusServiceUnavailable, ErrSlowDown.Error())
+}
+
+func isUpload(r *http.Request) bool {
+	return r.Method == http.MethodPut && strings.Count(strings.Trim(r.URL.Path, "/"), "/") >= 1
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+type throttledReader struct {
+	io.ReadCloser
+	tb *tokenBucket
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	n, err := tr.ReadCloser.Read(p)
+	tr.tb.throttle(n)
+	return n, err
+}
+
+type throttledWriter struct {
+	http.ResponseWriter
+	tb *tokenBucket
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	tw.tb.throttle(len(p))
+	return tw.ResponseWriter.Write(p)
+}
+
+func (tw *throttledWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+)
+
+func TestRateLimitByIP(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	// Two requests per client, and one for the bucket backups, refilled too
+	// slowly to matter
+	rl := NewRateLimiter(core.RateLimitConfig{
+		RequestsPerSecond: 0.001,
+		Burst:             2,
+		Buckets:           map[string]core.BucketRateLimit{"backups": {RequestsPerSecond: 0.001, Burst: 1}},
+	})
+	handler := rl.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	send := func(ip, path, key string) int {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.RemoteAddr = ip + ":1234"
+		if key != "" {
+			r.Header.Set("Authorization", "AWS "+key+":signature")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	steps := []struct {
+		ip, path, key string
+		want          int
+	}{
+		{"10.0.0.1", "/photos", "", http.StatusOK},
+		{"10.0.0.1", "/photos", "", http.StatusOK},
+		{"10.0.0.1", "/photos", "", http.StatusServiceUnavailable},
+		// Naming another access key does not bring another allowance
+		{"10.0.0.1", "/photos", "other", http.StatusServiceUnavailable},
+		// Nor does a request of another client spend the allowance of the
+		// key it names
+		{"10.0.0.2", "/photos", "other", http.StatusOK},
+		{"10.0.0.2", "/photos", "", http.StatusOK},
+		{"10.0.0.2", "/photos", "", http.StatusServiceUnavailable},
+		// A bucket with its own limits is counted apart
+		{"10.0.0.1", "/backups/a.txt", "", http.StatusOK},
+		{"10.0.0.1", "/backups/b.txt", "", http.StatusServiceUnavailable},
+	}
+	for i, step := range steps {
+		if got := send(step.ip, step.path, step.key); got != step.want {
+			t.Errorf("step %d: %s from %s with key %q = %d, want %d", i, step.path, step.ip, step.key, got, step.want)
+		}
+	}
+}
@@ -0,0 +1,645 @@
+// Package replication copies the objects of buckets to buckets of other
+// triple-s instances. Changes are queued on disk as they are made and
+// replicated in the background, so a destination that is down only delays
+// them, and the copies can serve as a warm standby.
+package replication
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/util"
+)
+
+// Subdirectories of the replication directory
+const (
+	queueDir  = "queue"  // changes still to be replicated
+	failedDir = "failed" // changes that ran out of attempts, kept for retrying
+)
+
+// Longest wait between two attempts of a change
+const maxRetryInterval = time.Hour
+
+// Operations replicated
+const (
+	OpPut    = "PUT"
+	OpDelete = "DELETE"
+)
+
+// HeaderStatus reports the replication status of objects in responses. The
+// requests of the replicator set it to REPLICA, so that the copies they
+// write are not replicated again.
+const HeaderStatus = "X-Amz-Replication-Status"
+
+// HeaderSecret carries replication.secret in the requests of the
+// replicator. A REPLICA status is only trusted along with it.
+const HeaderSecret = "X-Triple-S-Replication-Secret"
+
+var (
+	ErrObjectGone          = errors.New("object no longer exists")
+	ErrETagMismatch        = errors.New("destination stored different content")
+	ErrInvalidRuleStatus   = errors.New("status must be Enabled or Disabled")
+	ErrInvalidDestination  = errors.New("destination endpoint must be an https URL")
+	ErrReplicaDenied       = errors.New("replica writes require the replication secret")
+	ErrInvalidDestBucket   = errors.New("destination bucket name is invalid")
+	ErrDuplicateRuleID     = errors.New("rule ids must be unique")
+	ErrInvalidDeleteStatus = errors.New("delete marker replication status must be Enabled or Disabled")
+)
+
+// Source gives the replicator access to the objects of the instance
+type Source interface {
+	// Open returns the record and the content of an object, failing with
+	// ErrObjectGone when it does not exist
+	Open(bucket, key string) (core.Object, io.ReadCloser, error)
+	// SetStatus records the replication status of an object, as long as it
+	// is still the version last modified at lastModified
+	SetStatus(bucket, key, lastModified, status string)
+}
+
+// Replicator queues and replicates the changes of objects. It is safe for
+// concurrent use.
+type Replicator struct {
+	dir    string
+	cfg    core.ReplicationConfig
+	sync   bool
+	client *http.Client
+	source Source
+
+	mu        sync.Mutex
+	pending   map[string]pendingTask // queued changes, by file name
+	failed    map[string]int         // changes given up on, by bucket
+	completed map[string]uint64      // changes replicated since the start, by bucket
+
+	names atomic.Uint64 // makes queue file names unique
+	wake  chan struct{}
+}
+
+type pendingTask struct {
+	bucket   string
+	key      string
+	queuedAt time.Time
+}
+
+// task is a change waiting in the queue
+type task struct {
+	Op     string `json:"op"`
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	// Version of the object to copy, newer versions have a task of their own
+	LastModified string                      `json:"last_modified,omitempty"`
+	Rule         string                      `json:"rule"`
+	Destination  core.ReplicationDestination `json:"destination"`
+	QueuedAt     time.Time                   `json:"queued_at"`
+	Attempts     int                         `json:"attempts"`
+	NextAttempt  time.Time                   `json:"next_attempt"`
+	LastError    string                      `json:"last_error,omitempty"`
+}
+
+// Open prepares the replication queue of the data directory dir, including
+// the changes left by a previous run. Queue files are synced to disk when
+// sync is set.
+func Open(dir string, cfg core.ReplicationConfig, sync bool, source Source) (*Replicator, error) {
+	r := &Replicator{
+		dir:       filepath.Join(dir, core.ReplicationDir),
+		cfg:       cfg,
+		sync:      sync,
+		client:    &http.Client{Timeout: time.Duration(cfg.Timeout)},
+		source:    source,
+		pending:   make(map[string]pendingTask),
+		failed:    make(map[string]int),
+		completed: make(map[string]uint64),
+		wake:      make(chan struct{}, 1),
+	}
+	for _, sub := range []string{queueDir, failedDir} {
+		if err := os.MkdirAll(filepath.Join(r.dir, sub), core.DirPerm); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Inspect reports the replication backlog of the data directory dir,
+// without replicating anything
+func Inspect(dir string) (core.ReplicationStatus, error) {
+	r := &Replicator{
+		dir:     filepath.Join(dir, core.ReplicationDir),
+		pending: make(map[string]pendingTask),
+		failed:  make(map[string]int),
+	}
+	if err := r.load(); err != nil && !os.IsNotExist(err) {
+		return core.ReplicationStatus{}, err
+	}
+	return r.Status(), nil
+}
+
+// load counts the queued and failed changes
+func (r *Replicator) load() error {
+	names, err := taskNames(filepath.Join(r.dir, queueDir))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		t, err := readTask(filepath.Join(r.dir, queueDir, name))
+		if err != nil {
+			continue // moved aside by Run
+		}
+		r.pending[name] = pendingTask{bucket: t.Bucket, key: t.Key, queuedAt: t.QueuedAt}
+	}
+
+	names, err = taskNames(filepath.Join(r.dir, failedDir))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if t, err := readTask(filepath.Join(r.dir, failedDir, name)); err == nil {
+			r.failed[t.Bucket]++
+		}
+	}
+	return nil
+}
+
+// Validate checks the rules of a replication configuration and gives the
+// ones without an id a generated one
+func Validate(config *core.ReplicationConfiguration) error {
+	ids := make(map[string]bool)
+	for i := range config.Rules {
+		rule := &config.Rules[i]
+		if rule.ID == "" {
+			rule.ID = "rule-" + strconv.Itoa(i+1)
+		}
+		if ids[rule.ID] {
+			return fmt.Errorf("%w: %s", ErrDuplicateRuleID, rule.ID)
+		}
+		ids[rule.ID] = true
+
+		if rule.Status != core.RuleEnabled && rule.Status != core.RuleDisabled {
+			return fmt.Errorf("%s: %w", rule.ID, ErrInvalidRuleStatus)
+		}
+		switch rule.DeleteReplication {
+		case "":
+			rule.DeleteReplication = core.RuleDisabled
+		case core.RuleEnabled, core.RuleDisabled:
+		default:
+			return fmt.Errorf("%s: %w", rule.ID, ErrInvalidDeleteStatus)
+		}
+
+		// Storage traffic is never plaintext
+		u, err := url.Parse(rule.Destination.Endpoint)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("%s: %w", rule.ID, ErrInvalidDestination)
+		}
+		if util.ValidateBucketName(rule.Destination.Bucket) != nil {
+			return fmt.Errorf("%s: %w", rule.ID, ErrInvalidDestBucket)
+		}
+	}
+	return nil
+}
+
+// Replica reports whether r writes a copy made by the replicator of another
+// instance. The REPLICA status must come with the replication secret, any
+// client could set it otherwise to keep its change from being replicated.
+func Replica(r *http.Request, secret string) (bool, error) {
+	if r.Header.Get(HeaderStatus) != core.ReplicationReplica {
+		return false, nil
+	}
+	if secret == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get(HeaderSecret)), []byte(secret)) != 1 {
+		return false, ErrReplicaDenied
+	}
+	return true, nil
+}
+
+// Match returns the rule replicating key of bucket: the first enabled rule
+// whose prefix it starts with
+func Match(bucket core.Bucket, key string) (core.ReplicationRule, bool) {
+	for _, rule := range bucket.Replication {
+		if rule.Status == core.RuleEnabled && strings.HasPrefix(key, rule.Prefix) {
+			return rule, true
+		}
+	}
+	return core.ReplicationRule{}, false
+}
+
+// Enqueue queues the replication of a change of object of bucket, when a
+// rule of the bucket matches it. It reports whether the change was queued.
+func (r *Replicator) Enqueue(bucket core.Bucket, op string, object core.Object) (bool, error) {
+	rule, ok := Match(bucket, object.Name)
+	if !ok || (op == OpDelete && rule.DeleteReplication != core.RuleEnabled) {
+		return false, nil
+	}
+
+	now := time.Now()
+	t := task{
+		Op:          op,
+		Bucket:      bucket.Name,
+		Key:         object.Name,
+		Rule:        rule.ID,
+		Destination: rule.Destination,
+		QueuedAt:    now,
+		NextAttempt: now,
+	}
+	if op == OpPut {
+		t.LastModified = object.LastModified
+	}
+
+	name := fmt.Sprintf("%020d-%06d.json", now.UnixNano(), r.names.Add(1)%1000000)
+	if err := r.writeTask(filepath.Join(r.dir, queueDir, name), t); err != nil {
+		return false, err
+	}
+
+	r.mu.Lock()
+	r.pending[name] = pendingTask{bucket: bucket.Name, key: object.Name, queuedAt: now}
+	r.mu.Unlock()
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+	return true, nil
+}
+
+// Queued returns the keys with a queued change, as bucket/key
+func (r *Replicator) Queued() map[string]bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	keys := make(map[string]bool, len(r.pending))
+	for _, p := range r.pending {
+		keys[p.bucket+"/"+p.key] = true
+	}
+	return keys
+}
+
+// Status reports the queued, failed and replicated changes of every bucket
+// that has any
+func (r *Replicator) Status() core.ReplicationStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	byName := make(map[string]*core.BucketReplication)
+	get := func(name string) *core.BucketReplication {
+		b, ok := byName[name]
+		if !ok {
+			b = &core.BucketReplication{Name: name}
+			byName[name] = b
+		}
+		return b
+	}
+
+	oldest := make(map[string]time.Time)
+	for _, p := range r.pending {
+		get(p.bucket).Pending++
+		if t, ok := oldest[p.bucket]; !ok || p.queuedAt.Before(t) {
+			oldest[p.bucket] = p.queuedAt
+		}
+	}
+	for bucket, t := range oldest {
+		b := get(bucket)
+		b.OldestPending = t.UTC().Format(time.RFC3339)
+		b.LagSeconds = now.Sub(t).Seconds()
+	}
+	for bucket, n := range r.failed {
+		get(bucket).Failed = n
+	}
+	for bucket, n := range r.completed {
+		get(bucket).Completed = n
+	}
+
+	var status core.ReplicationStatus
+	for _, b := range byName {
+		status.Buckets = append(status.Buckets, *b)
+	}
+	sort.Slice(status.Buckets, func(i, j int) bool { return status.Buckets[i].Name < status.Buckets[j].Name })
+	return status
+}
+
+// Retry queues the failed changes of bucket again, or of every bucket when
+// bucket is empty, and returns how many were queued
+func (r *Replicator) Retry(bucket string) (int, error) {
+	failed := filepath.Join(r.dir, failedDir)
+	names, err := taskNames(failed)
+	if err != nil {
+		return 0, err
+	}
+
+	queued := 0
+	for _, name := range names {
+		t, err := readTask(filepath.Join(failed, name))
+		if err != nil || (bucket != "" && t.Bucket != bucket) {
+			continue
+		}
+
+		t.Attempts = 0
+		t.NextAttempt = time.Now()
+		if err := r.writeTask(filepath.Join(r.dir, queueDir, name), t); err != nil {
+			return queued, err
+		}
+		if err := os.Remove(filepath.Join(failed, name)); err != nil {
+			return queued, err
+		}
+		if t.Op == OpPut {
+			r.source.SetStatus(t.Bucket, t.Key, t.LastModified, core.ReplicationPending)
+		}
+
+		r.mu.Lock()
+		r.pending[name] = pendingTask{bucket: t.Bucket, key: t.Key, queuedAt: t.QueuedAt}
+		r.failed[t.Bucket]--
+		if r.failed[t.Bucket] <= 0 {
+			delete(r.failed, t.Bucket)
+		}
+		r.mu.Unlock()
+		queued++
+	}
+
+	if queued > 0 {
+		select {
+		case r.wake <- struct{}{}:
+		default:
+		}
+	}
+	return queued, nil
+}
+
+// Run replicates the queued changes until the process exits. The changes of
+// a key are replicated in the order they were made; a change that fails
+// holds back the later ones of its key and is retried with an exponential
+// backoff, until it is moved to the failed directory after the configured
+// number of attempts.
+func (r *Replicator) Run() {
+	timer := time.NewTimer(0)
+	for {
+		next := r.replicateDue()
+
+		wait := maxRetryInterval
+		if !next.IsZero() {
+			wait = max(time.Until(next), 0)
+		}
+		// Reset discards a pending expiry since Go 1.23
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-r.wake:
+		}
+	}
+}
+
+// replicateDue attempts every change that is due and returns the time the
+// next one is, zero if the queue is empty
+func (r *Replicator) replicateDue() (next time.Time) {
+	queue := filepath.Join(r.dir, queueDir)
+	names, err := taskNames(queue)
+	if err != nil {
+		slog.Error("reading the replication queue failed", "error", err)
+		return time.Now().Add(time.Duration(r.cfg.RetryInterval))
+	}
+
+	// Keys with an earlier change still waiting
+	held := make(map[string]bool)
+	for _, name := range names {
+		path := filepath.Join(queue, name)
+		t, err := readTask(path)
+		if err != nil {
+			slog.Error("moving unreadable replication task aside", "path", path, "error", err)
+			os.Rename(path, filepath.Join(r.dir, failedDir, name))
+			r.forget(name)
+			continue
+		}
+
+		key := t.Bucket + "/" + t.Key
+		if held[key] {
+			continue
+		}
+		if t.NextAttempt.After(time.Now()) {
+			held[key] = true
+			if next.IsZero() || t.NextAttempt.Before(next) {
+				next = t.NextAttempt
+			}
+			continue
+		}
+
+		if retry := r.attempt(path, name, t); !retry.IsZero() {
+			held[key] = true
+			if next.IsZero() || retry.Before(next) {
+				next = retry
+			}
+		}
+	}
+	return next
+}
+
+// attempt replicates a change and returns when it is to be retried, zero
+// when it is done with
+func (r *Replicator) attempt(path, name string, t task) time.Time {
+	logger := slog.With("bucket", t.Bucket, "key", t.Key, "op", t.Op, "rule", t.Rule,
+		"destination", t.Destination.Endpoint+"/"+t.Destination.Bucket)
+
+	copied, err := r.replicate(t)
+	if err == nil {
+		if err := os.Remove(path); err != nil {
+			logger.Error("removing replicated task failed", "error", err)
+		}
+		r.forget(name)
+		if copied {
+			r.mu.Lock()
+			r.completed[t.Bucket]++
+			r.mu.Unlock()
+			if t.Op == OpPut {
+				r.source.SetStatus(t.Bucket, t.Key, t.LastModified, core.ReplicationCompleted)
+			}
+		}
+		logger.Debug("change replicated", "attempts", t.Attempts+1, "skipped", !copied)
+		return time.Time{}
+	}
+
+	t.Attempts++
+	t.LastError = err.Error()
+	if t.Attempts >= r.cfg.MaxAttempts {
+		logger.Error("replication failed, giving up", "attempts", t.Attempts, "error", err)
+		if err := r.writeTask(filepath.Join(r.dir, failedDir, name), t); err != nil {
+			logger.Error("recording failed replication failed", "error", err)
+			return time.Now().Add(time.Duration(r.cfg.RetryInterval))
+		}
+		os.Remove(path)
+		r.forget(name)
+		r.mu.Lock()
+		r.failed[t.Bucket]++
+		r.mu.Unlock()
+		if t.Op == OpPut {
+			r.source.SetStatus(t.Bucket, t.Key, t.LastModified, core.ReplicationFailed)
+		}
+		return time.Time{}
+	}
+
+	backoff := time.Duration(r.cfg.RetryInterval)
+	for i := 1; i < t.Attempts && backoff < maxRetryInterval; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, maxRetryInterval)
+	t.NextAttempt = time.Now().Add(backoff)
+	logger.Warn("replication failed, retrying", "attempts", t.Attempts, "retry_in", backoff, "error", err)
+	if err := r.writeTask(path, t); err != nil {
+		logger.Error("updating replication task failed", "error", err)
+	}
+	return t.NextAttempt
+}
+
+func (r *Replicator) forget(name string) {
+	r.mu.Lock()
+	delete(r.pending, name)
+	r.mu.Unlock()
+}
+
+// replicate applies a change to the destination. It reports false without
+// an error for copies superseded by a newer version or a delete.
+func (r *Replicator) replicate(t task) (copied bool, err error) {
+	target, err := destinationURL(t.Destination, t.Key)
+	if err != nil {
+		return false, err
+	}
+
+	if t.Op == OpDelete {
+		req, err := http.NewRequest(http.MethodDelete, target, nil)
+		if err != nil {
+			return false, err
+		}
+		resp, err := r.do(req)
+		if err != nil {
+			return false, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+			return false, errors.New("destination responded " + strconv.Itoa(resp.StatusCode))
+		}
+		return true, nil
+	}
+
+	object, content, err := r.source.Open(t.Bucket, t.Key)
+	if errors.Is(err, ErrObjectGone) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer content.Close()
+	if object.LastModified != t.LastModified {
+		return false, nil
+	}
+
+	req, err := http.NewRequest(http.MethodPut, target, content)
+	if err != nil {
+		return false, err
+	}
+	req.ContentLength, _ = strconv.ParseInt(object.ContentLength, 10, 64)
+	req.Header.Set("Content-Type", object.ContentType)
+
+	resp, err := r.do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return false, errors.New("destination responded " + strconv.Itoa(resp.StatusCode))
+	}
+	if etag := strings.Trim(resp.Header.Get("ETag"), `"`); etag != "" && object.ETag != "" && etag != object.ETag {
+		return false, fmt.Errorf("%w: ETag %s, expected %s", ErrETagMismatch, etag, object.ETag)
+	}
+	return true, nil
+}
+
+func (r *Replicator) do(req *http.Request) (*http.Response, error) {
+	req.Header.Set(HeaderStatus, core.ReplicationReplica)
+	if r.cfg.Secret != "" {
+		req.Header.Set(HeaderSecret, r.cfg.Secret)
+	}
+	req.Header.Set("User-Agent", "triple-s/"+core.Version)
+	return r.client.Do(req)
+}
+
+// destinationURL returns the URL of key in the destination bucket
+func destinationURL(dest core.ReplicationDestination, key string) (string, error) {
+	u, err := url.Parse(strings.TrimSuffix(dest.Endpoint, "/"))
+	if err != nil {
+		return "", err
+	}
+	// Rules set before plaintext destinations were refused are not followed
+	if u.Scheme != "https" {
+		return "", ErrInvalidDestination
+	}
+	u.Path += "/" + dest.Bucket + "/" + key
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// writeTask replaces the file at path with t atomically
+func (r *Replicator) writeTask(path string, t task) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if r.sync {
+		if err := tmp.Sync(); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func readTask(path string) (task, error) {
+	var t task
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return t, err
+	}
+	return t, json.Unmarshal(data, &t)
+}
+
+// taskNames lists the tasks of a directory. Names start with the time of the
+// change, so this is the order they were made in.
+func taskNames(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".json") {
+			names = append(names, entry.Name())
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
@@ -0,0 +1,111 @@
+package replication
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+)
+
+func TestReplica(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  string
+		secret  string // sent by the request
+		config  string // replication.secret of this instance
+		replica bool
+		want    error
+	}{
+		{"client write", "", "", "s3cret", false, nil},
+		{"replica with the secret", core.ReplicationReplica, "s3cret", "s3cret", true, nil},
+		{"replica without the secret", core.ReplicationReplica, "", "s3cret", false, ErrReplicaDenied},
+		{"replica with a wrong secret", core.ReplicationReplica, "guess", "s3cret", false, ErrReplicaDenied},
+		{"replica to an instance without a secret", core.ReplicationReplica, "", "", false, ErrReplicaDenied},
+		{"other status", core.ReplicationCompleted, "", "s3cret", false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPut, "/backup/key", nil)
+			if tt.status != "" {
+				r.Header.Set(HeaderStatus, tt.status)
+			}
+			if tt.secret != "" {
+				r.Header.Set(HeaderSecret, tt.secret)
+			}
+			replica, err := Replica(r, tt.config)
+			if replica != tt.replica || !errors.Is(err, tt.want) {
+				t.Errorf("Replica() = %v, %v, want %v, %v", replica, err, tt.replica, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateDestination(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		want     error
+	}{
+		{"https://rack2:8080", nil},
+		{"http://rack2:8080", ErrInvalidDestination},
+		{"rack2:8080", ErrInvalidDestination},
+		{"https://", ErrInvalidDestination},
+	}
+	for _, tt := range tests {
+		t.Run(tt.endpoint, func(t *testing.T) {
+			config := core.ReplicationConfiguration{Rules: []core.ReplicationRule{{
+				Status:      core.RuleEnabled,
+				Destination: core.ReplicationDestination{Endpoint: tt.endpoint, Bucket: "backup"},
+			}}}
+			if err := Validate(&config); !errors.Is(err, tt.want) {
+				t.Errorf("Validate() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// source serves a single object
+type source struct {
+	object  core.Object
+	content string
+}
+
+func (s source) Open(bucket, key string) (core.Object, io.ReadCloser, error) {
+	if key != s.object.Name {
+		return core.Object{}, nil, ErrObjectGone
+	}
+	return s.object, io.NopCloser(strings.NewReader(s.content)), nil
+}
+
+func (s source) SetStatus(bucket, key, lastModified, status string) {}
+
+func TestReplicateSendsSecret(t *testing.T) {
+	var got http.Header
+	dest := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer dest.Close()
+
+	object := core.Object{Name: "key", ContentType: "text/plain", ContentLength: "4", LastModified: "2024-01-01T00:00:00Z"}
+	r := &Replicator{cfg: core.ReplicationConfig{Secret: "s3cret"}, client: dest.Client(), source: source{object, "data"}}
+
+	copied, err := r.replicate(task{Op: OpPut, Bucket: "photos", Key: "key", LastModified: object.LastModified,
+		Destination: core.ReplicationDestination{Endpoint: dest.URL, Bucket: "backup"}})
+	if err != nil || !copied {
+		t.Fatalf("replicate() = %v, %v", copied, err)
+	}
+	if got.Get(HeaderStatus) != core.ReplicationReplica || got.Get(HeaderSecret) != "s3cret" {
+		t.Errorf("destination got status %q and secret %q", got.Get(HeaderStatus), got.Get(HeaderSecret))
+	}
+
+	// A plaintext destination recorded before they were refused
+	_, err = r.replicate(task{Op: OpDelete, Bucket: "photos", Key: "key",
+		Destination: core.ReplicationDestination{Endpoint: "http://rack2:8080", Bucket: "backup"}})
+	if !errors.Is(err, ErrInvalidDestination) {
+		t.Errorf("replicate() to http = %v, want %v", err, ErrInvalidDestination)
+	}
+}
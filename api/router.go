@@ -1,24 +1,191 @@
 package api
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 
+	"github.com/ab-dauletkhan/triple-s/api/cluster"
+	"github.com/ab-dauletkhan/triple-s/api/core"
 	"github.com/ab-dauletkhan/triple-s/api/handlers"
+	"github.com/ab-dauletkhan/triple-s/api/metrics"
 )
 
-func Routes() *http.ServeMux {
+var ErrReservedBuckets = errors.New("buckets are named like server endpoints and would be unreachable, set admin_port to serve the endpoints on their own port")
+
+// Operation names reported in metrics, by route pattern
+var operations = map[string]string{
+	"PUT /{BucketName}":                   "CreateBucket",
+	"GET /":                               "ListBuckets",
+	"DELETE /{BucketName}":                "DeleteBucket",
+	"PUT /{BucketName}/{ObjectKey...}":    "PutObject",
+	"GET /{BucketName}":                   "ListObjects",
+	"GET /{BucketName}/{ObjectKey...}":    "GetObject",
+	"DELETE /{BucketName}/{ObjectKey...}": "DeleteObject",
+	"POST /{BucketName}/{ObjectKey...}":   "RestoreObject",
+	"GET /metrics":                        "Metrics",
+	"GET /healthz":                        "Healthz",
+	"GET /readyz":                         "Readyz",
+	"GET /version":                        "Version",
+
+	"GET /admin/buckets/{BucketName}/quota":          "GetBucketQuota",
+	"PUT /admin/buckets/{BucketName}/quota":          "PutBucketQuota",
+	"DELETE /admin/buckets/{BucketName}/quota":       "DeleteBucketQuota",
+	"GET /admin/buckets/{BucketName}/compression":    "GetBucketCompression",
+	"PUT /admin/buckets/{BucketName}/compression":    "PutBucketCompression",
+	"DELETE /admin/buckets/{BucketName}/compression": "DeleteBucketCompression",
+	"POST /admin/gc":                                  "RunGC",
+	"POST /admin/heal":                                "RunHeal",
+	"POST /admin/transition":                          "RunTransition",
+	"GET /admin/buckets/{BucketName}/lifecycle":       "GetBucketLifecycle",
+	"PUT /admin/buckets/{BucketName}/lifecycle":       "PutBucketLifecycle",
+	"DELETE /admin/buckets/{BucketName}/lifecycle":    "DeleteBucketLifecycle",
+	"GET /admin/disks":                                "ListDataDirs",
+	"POST /admin/disks/drain":                         "DrainDataDir",
+	"DELETE /admin/disks/drain":                       "DrainDataDir",
+	"POST /admin/rebalance":                           "Rebalance",
+	"GET /admin/trash":                                "ListTrash",
+	"POST /admin/trash/{BucketName}/restore":          "RestoreBucket",
+	"DELETE /admin/trash/{BucketName}":                "PurgeBucket",
+	"POST /admin/buckets/{BucketName}/force-delete":   "ForceDeleteBucket",
+	"GET /admin/jobs":                                 "ListJobs",
+	"GET /admin/jobs/{JobID}":                         "GetJob",
+	"DELETE /admin/jobs/{JobID}":                      "CancelJob",
+	"GET /admin/buckets/{BucketName}/object-lock":     "GetObjectLockConfiguration",
+	"PUT /admin/buckets/{BucketName}/object-lock":     "PutObjectLockConfiguration",
+	"GET /admin/buckets/{BucketName}/notification":    "GetBucketNotification",
+	"PUT /admin/buckets/{BucketName}/notification":    "PutBucketNotification",
+	"DELETE /admin/buckets/{BucketName}/notification": "DeleteBucketNotification",
+	"GET /admin/buckets/{BucketName}/replication":     "GetBucketReplication",
+	"PUT /admin/buckets/{BucketName}/replication":     "PutBucketReplication",
+	"DELETE /admin/buckets/{BucketName}/replication":  "DeleteBucketReplication",
+	"GET /admin/replication":                          "ReplicationStatus",
+	"POST /admin/replication/retry":                   "RetryReplication",
+}
+
+// queryOperation names the operation a route dispatches to when the request
+// has the query parameter param
+type queryOperation struct {
+	param     string
+	operation string
+}
+
+// Operations dispatched on a query parameter by the handler of a route, in
+// the order the handler checks them
+var queryOperations = map[string][]queryOperation{
+	"PUT /{BucketName}/{ObjectKey...}": {{"retention", "PutObjectRetention"}, {"legal-hold", "PutObjectLegalHold"}},
+	"GET /{BucketName}/{ObjectKey...}": {{"retention", "GetObjectRetention"}, {"legal-hold", "GetObjectLegalHold"}},
+	"GET /{BucketName}":                {{"stats", "GetBucketStats"}, {"events", "GetBucketEvents"}},
+}
+
+// operation returns the name of the operation a request was dispatched to
+func operation(r *http.Request) string {
+	query := r.URL.Query()
+	for _, q := range queryOperations[r.Pattern] {
+		if query.Has(q.param) {
+			return q.operation
+		}
+	}
+	if operation, ok := operations[r.Pattern]; ok {
+		return operation
+	}
+	return "Unknown"
+}
+
+// Routes returns the S3 API handler and, when an admin port is configured,
+// a separate handler for the admin endpoints. Otherwise admin is nil and the
+// admin endpoints are served by api. The background workers of the handlers
+// are started as well. It fails when the metadata of the data directory
+// cannot be loaded, or when the admin endpoints would shadow buckets created
+// before their names were reserved.
+func Routes(cfg *core.Config) (api, admin http.Handler, err error) {
 	mux := http.NewServeMux()
+	m := metrics.New()
+	h, err := handlers.New(cfg, m)
+	if err != nil {
+		return nil, nil, err
+	}
+	if reserved := h.ReservedBuckets(); len(reserved) > 0 && cfg.AdminPort == 0 {
+		return nil, nil, fmt.Errorf("%w: %v", ErrReservedBuckets, reserved)
+	}
+	h.StartWorkers()
 
 	// Bucket handling
-	mux.HandleFunc("PUT /{BucketName}", handlers.CreateBucket)
-	mux.HandleFunc("GET /", handlers.ListBuckets)
-	mux.HandleFunc("DELETE /{BucketName}", handlers.DeleteBucket)
+	mux.HandleFunc("PUT /{BucketName}", h.CreateBucket)
+	mux.HandleFunc("GET /", h.ListBuckets)
+	mux.HandleFunc("DELETE /{BucketName}", h.DeleteBucket)
 
 	// Object handling
-	mux.HandleFunc("PUT /{BucketName}/{ObjectKey}", handlers.CreateObject)
-	mux.HandleFunc("GET /{BucketName}", handlers.ListObjects)
-	mux.HandleFunc("GET /{BucketName}/{ObjectKey}", handlers.GetObject)
-	mux.HandleFunc("DELETE /{BucketName}/{ObjectKey}", handlers.DeleteObject)
+	mux.HandleFunc("PUT /{BucketName}/{ObjectKey...}", h.CreateObject)
+	mux.HandleFunc("GET /{BucketName}", h.ListObjects)
+	mux.HandleFunc("GET /{BucketName}/{ObjectKey...}", h.GetObject)
+	mux.HandleFunc("DELETE /{BucketName}/{ObjectKey...}", h.DeleteObject)
+	mux.HandleFunc("POST /{BucketName}/{ObjectKey...}", h.RestoreObject)
+
+	limited := NewRateLimiter(cfg.RateLimit).Middleware
+	served := limited(mux)
+	if cfg.Cluster.Enabled() {
+		// Client requests are sent on to the nodes they concern. Requests
+		// between the nodes were rate limited by the node they were made to.
+		coordinator, err := cluster.New(cfg, mux)
+		if err != nil {
+			return nil, nil, err
+		}
+		served = cluster.Split(cfg.Cluster, coordinator.Internal(mux), limited(coordinator))
+	}
+
+	api = AccessLog(cfg.Log, Instrument(m, served))
+	if cfg.AdminPort == 0 {
+		adminRoutes(mux, h, cfg)
+		return api, nil, nil
+	}
+
+	adminMux := http.NewServeMux()
+	adminRoutes(adminMux, h, cfg)
+	return api, AccessLog(cfg.Log, Instrument(m, adminMux)), nil
+}
+
+// adminRoutes registers the observability endpoints and the admin API. Their
+// names are reserved bucket names, and Routes refuses to serve them on the API
+// port over buckets created before the names were reserved.
+func adminRoutes(mux *http.ServeMux, h *handlers.Handler, cfg *core.Config) {
+	mux.HandleFunc("GET /metrics", h.Metrics)
+	mux.HandleFunc("GET /healthz", h.Healthz)
+	mux.HandleFunc("GET /readyz", h.Readyz)
+	mux.HandleFunc("GET /version", h.Version)
 
-	return mux
+	// Admin API
+	mux.HandleFunc("GET /admin/buckets/{BucketName}/quota", AdminOnly(cfg.Admin, h.GetBucketQuota))
+	mux.HandleFunc("PUT /admin/buckets/{BucketName}/quota", AdminOnly(cfg.Admin, h.PutBucketQuota))
+	mux.HandleFunc("DELETE /admin/buckets/{BucketName}/quota", AdminOnly(cfg.Admin, h.DeleteBucketQuota))
+	mux.HandleFunc("GET /admin/buckets/{BucketName}/compression", AdminOnly(cfg.Admin, h.GetBucketCompression))
+	mux.HandleFunc("PUT /admin/buckets/{BucketName}/compression", AdminOnly(cfg.Admin, h.PutBucketCompression))
+	mux.HandleFunc("DELETE /admin/buckets/{BucketName}/compression", AdminOnly(cfg.Admin, h.DeleteBucketCompression))
+	mux.HandleFunc("POST /admin/gc", AdminOnly(cfg.Admin, h.RunGC))
+	mux.HandleFunc("POST /admin/heal", AdminOnly(cfg.Admin, h.RunHeal))
+	mux.HandleFunc("POST /admin/transition", AdminOnly(cfg.Admin, h.RunTransition))
+	mux.HandleFunc("GET /admin/buckets/{BucketName}/lifecycle", AdminOnly(cfg.Admin, h.GetBucketLifecycle))
+	mux.HandleFunc("PUT /admin/buckets/{BucketName}/lifecycle", AdminOnly(cfg.Admin, h.PutBucketLifecycle))
+	mux.HandleFunc("DELETE /admin/buckets/{BucketName}/lifecycle", AdminOnly(cfg.Admin, h.DeleteBucketLifecycle))
+	mux.HandleFunc("GET /admin/disks", AdminOnly(cfg.Admin, h.ListDataDirs))
+	mux.HandleFunc("POST /admin/disks/drain", AdminOnly(cfg.Admin, h.DrainDataDir))
+	mux.HandleFunc("DELETE /admin/disks/drain", AdminOnly(cfg.Admin, h.DrainDataDir))
+	mux.HandleFunc("POST /admin/rebalance", AdminOnly(cfg.Admin, h.Rebalance))
+	mux.HandleFunc("GET /admin/trash", AdminOnly(cfg.Admin, h.ListTrash))
+	mux.HandleFunc("POST /admin/trash/{BucketName}/restore", AdminOnly(cfg.Admin, h.RestoreBucket))
+	mux.HandleFunc("DELETE /admin/trash/{BucketName}", AdminOnly(cfg.Admin, h.PurgeBucket))
+	mux.HandleFunc("POST /admin/buckets/{BucketName}/force-delete", AdminOnly(cfg.Admin, h.ForceDeleteBucket))
+	mux.HandleFunc("GET /admin/jobs", AdminOnly(cfg.Admin, h.ListJobs))
+	mux.HandleFunc("GET /admin/jobs/{JobID}", AdminOnly(cfg.Admin, h.GetJob))
+	mux.HandleFunc("DELETE /admin/jobs/{JobID}", AdminOnly(cfg.Admin, h.CancelJob))
+	mux.HandleFunc("GET /admin/buckets/{BucketName}/object-lock", AdminOnly(cfg.Admin, h.GetObjectLockConfiguration))
+	mux.HandleFunc("PUT /admin/buckets/{BucketName}/object-lock", AdminOnly(cfg.Admin, h.PutObjectLockConfiguration))
+	mux.HandleFunc("GET /admin/buckets/{BucketName}/notification", AdminOnly(cfg.Admin, h.GetBucketNotification))
+	mux.HandleFunc("PUT /admin/buckets/{BucketName}/notification", AdminOnly(cfg.Admin, h.PutBucketNotification))
+	mux.HandleFunc("DELETE /admin/buckets/{BucketName}/notification", AdminOnly(cfg.Admin, h.DeleteBucketNotification))
+	mux.HandleFunc("GET /admin/buckets/{BucketName}/replication", AdminOnly(cfg.Admin, h.GetBucketReplication))
+	mux.HandleFunc("PUT /admin/buckets/{BucketName}/replication", AdminOnly(cfg.Admin, h.PutBucketReplication))
+	mux.HandleFunc("DELETE /admin/buckets/{BucketName}/replication", AdminOnly(cfg.Admin, h.DeleteBucketReplication))
+	mux.HandleFunc("GET /admin/replication", AdminOnly(cfg.Admin, h.ReplicationStatus))
+	mux.HandleFunc("POST /admin/replication/retry", AdminOnly(cfg.Admin, h.RetryReplication))
 }
@@ -0,0 +1,267 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/meta"
+	"github.com/ab-dauletkhan/triple-s/api/util"
+)
+
+// newTestServer serves the API over a fresh data directory, with the
+// background workers idle
+func newTestServer(t *testing.T) (*httptest.Server, string) {
+	t.Helper()
+	cfg := newTestConfig(t)
+	apiHandler, _, err := Routes(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(apiHandler)
+	t.Cleanup(srv.Close)
+	return srv, cfg.Dir
+}
+
+// newTestConfig returns the configuration of a fresh data directory, with
+// the background workers idle
+func newTestConfig(t *testing.T) *core.Config {
+	t.Helper()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	cfg := core.DefaultConfig()
+	cfg.Dir = t.TempDir()
+	cfg.Storage.GCInterval = 0
+	cfg.Trash.PurgeInterval = 0
+	cfg.Health.MinFreeBytes = 0
+	cfg.Log.Access = false
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := util.InitDir(cfg.Dir); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func do(t *testing.T, method, url, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{
+		// A redirect to a cleaned path is a rejection, it is not followed
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(data)
+}
+
+// files lists the files under dir, relative to it
+func files(t *testing.T, dir string) map[string]bool {
+	t.Helper()
+	found := make(map[string]bool)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		found[filepath.ToSlash(rel)] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+func TestHostileObjectKeys(t *testing.T) {
+	srv, dir := newTestServer(t)
+
+	if status, body := do(t, http.MethodPut, srv.URL+"/photos", ""); status != http.StatusOK {
+		t.Fatalf("creating bucket: %d %s", status, body)
+	}
+	before := files(t, dir)
+
+	tests := []struct {
+		name   string
+		path   string // escaped, after the bucket name
+		reject bool   // whether the key must be refused rather than stored
+	}{
+		{"reserved name", "objects.csv", false},
+		{"bucket metadata", "..%2Fbuckets.csv", false},
+		{"encoded dots", "%2E%2E%2F%2E%2E%2Fbuckets.csv", false},
+		{"encoded separators", "a%2F..%2F..%2Fobjects.csv", false},
+		{"backslashes", "..%5C..%5Cbuckets.csv", false},
+		{"data directory", "data%2F..%2Fobjects.csv", false},
+		{"dot dot", "..", true},
+		{"raw traversal", "a/../../buckets.csv", true},
+		{"too long", strings.Repeat("k", util.MaxObjectKeyLength+1), true},
+		{"invalid utf8", "bad%FFkey", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url := srv.URL + "/photos/" + tt.path
+			body := "content of " + tt.name
+
+			status, resp := do(t, http.MethodPut, url, body)
+			if status >= 500 {
+				t.Fatalf("PUT %s: %d %s", tt.path, status, resp)
+			}
+			if tt.reject {
+				if status < 300 {
+					t.Fatalf("PUT %s: %d, want the key rejected", tt.path, status)
+				}
+				return
+			}
+			if status != http.StatusOK {
+				t.Fatalf("PUT %s: %d %s", tt.path, status, resp)
+			}
+
+			// The object reads back as written
+			status, resp = do(t, http.MethodGet, url, "")
+			if status != http.StatusOK || resp != body {
+				t.Errorf("GET %s: %d %q, want %q", tt.path, status, resp, body)
+			}
+		})
+	}
+
+	// The metadata still lists the bucket and its objects
+	if status, resp := do(t, http.MethodGet, srv.URL+"/", ""); status != http.StatusOK || !strings.Contains(resp, "<Name>photos</Name>") {
+		t.Errorf("listing buckets: %d %s", status, resp)
+	}
+	status, resp := do(t, http.MethodGet, srv.URL+"/photos", "")
+	if status != http.StatusOK {
+		t.Fatalf("listing objects: %d %s", status, resp)
+	}
+	for _, key := range []string{"objects.csv", "../buckets.csv", "a/../../objects.csv", `..\..\buckets.csv`} {
+		if !strings.Contains(resp, "<Name>"+key+"</Name>") {
+			t.Errorf("listing objects: %q missing from %s", key, resp)
+		}
+	}
+
+	// Object data only ever lands in the data directory of the bucket
+	dataDir := "photos/" + core.DataDir + "/"
+	for path := range files(t, dir) {
+		if !before[path] && !strings.HasPrefix(path, dataDir) {
+			t.Errorf("PUT created %s outside %s", path, dataDir)
+		}
+	}
+}
+
+func TestRoutesHaveOperations(t *testing.T) {
+	// Requests to a route missing from operations are counted as Unknown
+	src, err := os.ReadFile("router.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := regexp.MustCompile(`HandleFunc\("([^"]+)"`).FindAllStringSubmatch(string(src), -1)
+	if len(routes) == 0 {
+		t.Fatal("no routes found in router.go")
+	}
+	for _, route := range routes {
+		if _, ok := operations[route[1]]; !ok {
+			t.Errorf("route %q has no operation name", route[1])
+		}
+	}
+	for pattern := range queryOperations {
+		if _, ok := operations[pattern]; !ok {
+			t.Errorf("query operations of unknown route %q", pattern)
+		}
+	}
+}
+
+func TestReservedBuckets(t *testing.T) {
+	cfg := newTestConfig(t)
+	// Created before the name was reserved
+	store, err := meta.Open(cfg.Dir, cfg.Metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutBucket(core.Bucket{Name: "metrics", Status: core.BucketActive}); err != nil {
+		t.Fatal(err)
+	}
+	if err := errors.Join(util.InitObjectFile(cfg.Dir, "metrics"), store.Close()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The metrics endpoint would shadow the bucket
+	if _, _, err := Routes(cfg); !errors.Is(err, ErrReservedBuckets) {
+		t.Fatalf("Routes() = %v, want %v", err, ErrReservedBuckets)
+	}
+
+	cfg.AdminPort = 9001
+	apiHandler, adminHandler, err := Routes(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, adminSrv := httptest.NewServer(apiHandler), httptest.NewServer(adminHandler)
+	t.Cleanup(srv.Close)
+	t.Cleanup(adminSrv.Close)
+
+	steps := []struct {
+		url, method, body string
+		status            int
+		want              string
+	}{
+		{srv.URL + "/metrics/a.txt", http.MethodPut, "content", http.StatusOK, ""},
+		{srv.URL + "/metrics/a.txt", http.MethodGet, "", http.StatusOK, "content"},
+		{srv.URL + "/metrics", http.MethodGet, "", http.StatusOK, "<Name>a.txt</Name>"},
+		{adminSrv.URL + "/metrics", http.MethodGet, "", http.StatusOK, "triples_"},
+	}
+	for _, step := range steps {
+		status, body := do(t, step.method, step.url, step.body)
+		if status != step.status || !strings.Contains(body, step.want) {
+			t.Errorf("%s %s = %d %q, want %d with %q", step.method, step.url, status, body, step.status, step.want)
+		}
+	}
+}
+
+func TestOperationLabels(t *testing.T) {
+	srv, _ := newTestServer(t)
+	requests := []struct {
+		method, path, body string
+		operation          string
+	}{
+		{http.MethodPut, "/photos", "", "CreateBucket"},
+		{http.MethodPut, "/photos/a.txt", "a", "PutObject"},
+		{http.MethodGet, "/photos/a.txt", "", "GetObject"},
+		{http.MethodGet, "/photos", "", "ListObjects"},
+		{http.MethodGet, "/photos?stats", "", "GetBucketStats"},
+		{http.MethodGet, "/photos?events&timeout=0", "", "GetBucketEvents"},
+		{http.MethodPut, "/photos/a.txt?retention", "", "PutObjectRetention"},
+		{http.MethodPut, "/photos/a.txt?legal-hold", "", "PutObjectLegalHold"},
+		{http.MethodGet, "/photos/a.txt?retention", "", "GetObjectRetention"},
+		{http.MethodGet, "/photos/a.txt?legal-hold", "", "GetObjectLegalHold"},
+		{http.MethodPost, "/photos/a.txt?restore", "", "RestoreObject"},
+	}
+	for _, r := range requests {
+		do(t, r.method, srv.URL+r.path, r.body)
+	}
+
+	_, metrics := do(t, http.MethodGet, srv.URL+"/metrics", "")
+	for _, r := range requests {
+		sample := regexp.MustCompile(`triples_http_requests_total\{operation="` + r.operation + `",status="\d+"\} 1\n`)
+		if !sample.MatchString(metrics) {
+			t.Errorf("%s %s not counted once as %s", r.method, r.path, r.operation)
+		}
+	}
+}
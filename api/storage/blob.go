@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+)
+
+// Suffix of the file holding the reference count of a blob
+const refsSuffix = ".refs"
+
+var ErrInvalidDigest = errors.New("invalid blob digest")
+
+// blobPath returns the path of a blob, fanned out by the first digest bytes
+// to keep directories small: .blobs/ab/cd/abcd...
+func (s *Store) blobPath(digest string) string {
+	if len(digest) < 4 {
+		return filepath.Join(s.dir, core.BlobsDir, "invalid")
+	}
+	return filepath.Join(s.dir, core.BlobsDir, digest[:2], digest[2:4], digest)
+}
+
+func (s *Store) readRefs(digest string) (int, error) {
+	data, err := os.ReadFile(s.blobPath(digest) + refsSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+func (s *Store) writeRefs(digest string, refs int) error {
+	path := s.blobPath(digest) + refsSuffix
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(refs)+"\n"), core.FilePerm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// addBlob moves the file at tmp to the blob with the given digest, or drops
+// it if the blob already exists, and takes a reference on the blob.
+func (s *Store) addBlob(tmp, digest string) error {
+	if len(digest) < 4 {
+		return ErrInvalidDigest
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := s.blobPath(digest)
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		if err := os.MkdirAll(filepath.Dir(path), core.DirPerm); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	refs, err := s.readRefs(digest)
+	if err != nil {
+		return err
+	}
+	return s.writeRefs(digest, refs+1)
+}
+
+// releaseBlob drops a reference on a blob and removes it once unreferenced
+func (s *Store) releaseBlob(digest string) error {
+	if len(digest) < 4 {
+		return ErrInvalidDigest
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	refs, err := s.readRefs(digest)
+	if err != nil {
+		return err
+	}
+
+	if refs > 1 {
+		return s.writeRefs(digest, refs-1)
+	}
+	return s.removeBlob(digest)
+}
+
+func (s *Store) removeBlob(digest string) error {
+	path := s.blobPath(digest)
+	for _, p := range []string{path, path + refsSuffix} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	os.Remove(filepath.Dir(path))
+	os.Remove(filepath.Dir(filepath.Dir(path)))
+	return nil
+}
+
+// GCResult summarizes a garbage collection run
+type GCResult struct {
+	Scanned      int   // blobs found on disk
+	Removed      int   // orphaned blobs deleted
+	FreedBytes   int64 // size of the deleted blobs
+	FixedRefs    int   // blobs whose reference count was corrected
+	TempsRemoved int   // abandoned upload files deleted
+}
+
+// Sweep deletes blobs missing from refs, the number of metadata rows
+// pointing at each digest, and resets the stored reference counts to match.
+// Blobs and temporary files touched within grace are left alone, since an
+// upload may be about to reference them.
+func (s *Store) Sweep(refs map[string]int, grace time.Duration) (GCResult, error) {
+	var result GCResult
+	root := filepath.Join(s.dir, core.BlobsDir)
+	cutoff := time.Now().Add(-grace)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		name := d.Name()
+		if strings.HasPrefix(name, ".upload-") {
+			if recent(path, cutoff) {
+				return nil
+			}
+			result.TempsRemoved++
+			return os.Remove(path)
+		}
+		if strings.HasSuffix(name, refsSuffix) || strings.HasSuffix(name, ".tmp") {
+			return nil
+		}
+
+		result.Scanned++
+		digest := name
+		if recent(path, cutoff) || recent(path+refsSuffix, cutoff) {
+			return nil
+		}
+
+		count := refs[digest]
+		if count == 0 {
+			info, err := d.Info()
+			if err == nil {
+				result.FreedBytes += info.Size()
+			}
+			result.Removed++
+			return s.removeBlob(digest)
+		}
+
+		stored, err := s.readRefs(digest)
+		if err != nil || stored != count {
+			result.FixedRefs++
+			return s.writeRefs(digest, count)
+		}
+		return nil
+	})
+
+	return result, err
+}
+
+// recent reports whether the file at path was modified after cutoff
+func recent(path string, cutoff time.Time) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.ModTime().After(cutoff)
+}
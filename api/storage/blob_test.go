@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/util"
+)
+
+// newTestStore opens the store of a fresh data directory, its configuration
+// changed by configure when given
+func newTestStore(t *testing.T, configure func(*core.Config)) *Store {
+	t.Helper()
+	cfg := core.DefaultConfig()
+	cfg.Dir = t.TempDir()
+	if configure != nil {
+		configure(cfg)
+	}
+	if err := util.InitDir(cfg.Dir); err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func dedup(cfg *core.Config) {
+	cfg.Storage.Dedup = true
+}
+
+// put stores content under key in the bucket photos
+func put(t *testing.T, s *Store, key, content string) core.Object {
+	t.Helper()
+	obj := core.Object{Name: key, ContentType: "text/plain"}
+	if err := s.Put("photos", &obj, strings.NewReader(content), ""); err != nil {
+		t.Fatal(err)
+	}
+	return obj
+}
+
+// age makes the files at paths look written an hour ago
+func age(t *testing.T, paths ...string) {
+	t.Helper()
+	old := time.Now().Add(-time.Hour)
+	for _, path := range paths {
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBlobRefs(t *testing.T) {
+	tests := []struct {
+		name    string
+		puts    int // objects with the same content
+		deletes int
+	}{
+		{"single", 1, 0},
+		{"shared", 3, 0},
+		{"one released", 3, 1},
+		{"all released", 3, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore(t, dedup)
+			var objects []core.Object
+			for i := range tt.puts {
+				objects = append(objects, put(t, s, "key"+string(rune('a'+i)), "same content"))
+			}
+			digest := objects[0].Digest
+			for _, obj := range objects {
+				if obj.Storage != KindBlob || obj.Digest != digest {
+					t.Fatalf("object stored as %s %s, want one blob", obj.Storage, obj.Digest)
+				}
+			}
+			for _, obj := range objects[:tt.deletes] {
+				if err := s.Delete("photos", obj); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want := tt.puts - tt.deletes
+			if refs, err := s.readRefs(digest); err != nil || refs != want {
+				t.Errorf("readRefs() = %d, %v, want %d", refs, err, want)
+			}
+			_, err := os.Stat(s.blobPath(digest))
+			if exists := err == nil; exists != (want > 0) {
+				t.Errorf("blob exists: %v with %d references", exists, want)
+			}
+		})
+	}
+}
+
+func TestBlobReplaced(t *testing.T) {
+	s := newTestStore(t, dedup)
+	old := put(t, s, "key", "old")
+	other := put(t, s, "other", "old")
+	newObj := put(t, s, "key", "new")
+	if err := s.Replaced("photos", old, newObj); err != nil {
+		t.Fatal(err)
+	}
+
+	if refs, _ := s.readRefs(old.Digest); refs != 1 {
+		t.Errorf("replaced blob has %d references, want 1", refs)
+	}
+	if refs, _ := s.readRefs(newObj.Digest); refs != 1 {
+		t.Errorf("new blob has %d references, want 1", refs)
+	}
+	if err := s.Delete("photos", other); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(s.blobPath(old.Digest)); err == nil {
+		t.Error("unreferenced blob left")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	s := newTestStore(t, dedup)
+	kept := put(t, s, "kept", "kept")
+	put(t, s, "kept2", "kept")
+	miscounted := put(t, s, "miscounted", "miscounted")
+	orphan := put(t, s, "orphan", "orphan")
+	recentOrphan := put(t, s, "recent", "recent")
+
+	tmpDir := filepath.Join(s.dir, core.BlobsDir, "tmp")
+	staleTemp := filepath.Join(tmpDir, ".upload-stale")
+	recentTemp := filepath.Join(tmpDir, ".upload-recent")
+	for _, path := range []string{staleTemp, recentTemp} {
+		if err := os.WriteFile(path, []byte("partial"), core.FilePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, obj := range []core.Object{kept, miscounted, orphan} {
+		age(t, s.blobPath(obj.Digest), s.blobPath(obj.Digest)+refsSuffix)
+	}
+	age(t, staleTemp)
+
+	// The metadata counts: recent and orphan are not referenced, miscounted
+	// is referenced twice although stored once
+	refs := map[string]int{kept.Digest: 2, miscounted.Digest: 2}
+	result, err := s.Sweep(refs, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := GCResult{Scanned: 4, Removed: 1, FreedBytes: int64(len("orphan")), FixedRefs: 1, TempsRemoved: 1}
+	if result != want {
+		t.Errorf("Sweep() = %+v, want %+v", result, want)
+	}
+
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+	for _, obj := range []core.Object{kept, miscounted, recentOrphan} {
+		if !exists(s.blobPath(obj.Digest)) {
+			t.Errorf("blob of %s removed", obj.Name)
+		}
+	}
+	if exists(s.blobPath(orphan.Digest)) {
+		t.Error("unreferenced blob left")
+	}
+	if refs, _ := s.readRefs(miscounted.Digest); refs != 2 {
+		t.Errorf("reference count = %d, want it fixed to 2", refs)
+	}
+	if exists(staleTemp) || !exists(recentTemp) {
+		t.Errorf("temp files left: stale %v, recent %v, want only the recent one", exists(staleTemp), exists(recentTemp))
+	}
+
+	// A second run finds everything in order
+	age(t, s.blobPath(miscounted.Digest)+refsSuffix)
+	result, err = s.Sweep(refs, time.Minute)
+	if err != nil || result.Removed != 0 || result.FixedRefs != 0 {
+		t.Errorf("second Sweep() = %+v, %v", result, err)
+	}
+}
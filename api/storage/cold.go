@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/util"
+)
+
+var (
+	ErrNoColdDir           = errors.New("no cold storage directory is configured")
+	ErrUnknownStorageClass = errors.New("storage class must be STANDARD or COLD")
+	ErrDigestMismatch      = errors.New("stored data does not match its digest")
+)
+
+// ValidStorageClass reports whether class is supported, "" meaning STANDARD
+func ValidStorageClass(class string) bool {
+	switch class {
+	case "", core.StorageStandard, core.StorageCold:
+		return true
+	}
+	return false
+}
+
+// ColdEnabled reports whether objects can be stored in the COLD class
+func (s *Store) ColdEnabled() bool {
+	return s.coldWrite
+}
+
+// coldPath returns the path of the data of a cold object
+func (s *Store) coldPath(bucketName string, obj core.Object) string {
+	return digestPath(s.cold, bucketName, obj)
+}
+
+// restoredPath returns the path of the copy of a cold object restored to
+// the data directory of its bucket
+func (s *Store) restoredPath(bucketName string, obj core.Object) string {
+	return digestPath(s.BucketDir(bucketName), bucketName, obj)
+}
+
+// openCold reads a cold object from its restored copy, or from the cold
+// directory when it is not restored
+func (s *Store) openCold(bucketName string, obj core.Object) (io.ReadCloser, error) {
+	if obj.RestoreExpiryDate != "" {
+		f, err := os.Open(s.restoredPath(bucketName, obj))
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	if s.cold == "" {
+		return nil, ErrUnknownStorage
+	}
+	return os.Open(s.coldPath(bucketName, obj))
+}
+
+// deleteCold removes a cold object and its restored copy
+func (s *Store) deleteCold(bucketName string, obj core.Object) error {
+	if err := s.Unrestore(bucketName, obj); err != nil {
+		return err
+	}
+	if s.cold == "" {
+		return nil
+	}
+	path := s.coldPath(bucketName, obj)
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	util.RemoveEmptyDirs(filepath.Dir(path), util.ObjectDataDir(s.cold, bucketName))
+	return nil
+}
+
+// Transition copies the stored bytes of obj to the cold directory and
+// returns the record of the cold object. The data of obj is left in place
+// for the caller to delete once the record is replaced.
+func (s *Store) Transition(bucketName string, obj core.Object) (core.Object, error) {
+	if !s.coldWrite {
+		return obj, ErrNoColdDir
+	}
+
+	src, err := s.openStored(bucketName, obj)
+	if err != nil {
+		return obj, err
+	}
+	defer src.Close()
+
+	tmp, _, digest, err := writeTemp(filepath.Dir(s.coldPath(bucketName, obj)), src)
+	if err != nil {
+		return obj, err
+	}
+	defer os.Remove(tmp)
+	if obj.Digest != "" && digest != obj.Digest {
+		return obj, ErrDigestMismatch
+	}
+
+	cold := obj
+	cold.Digest = digest
+	cold.Storage = KindCold
+	cold.StorageClass = core.StorageCold
+	cold.RestoreExpiryDate = ""
+
+	// The original data is deleted once the copy is recorded
+	if err := syncFile(tmp); err != nil {
+		return obj, err
+	}
+	if err := os.Rename(tmp, s.coldPath(bucketName, cold)); err != nil {
+		return obj, err
+	}
+	return cold, nil
+}
+
+// Restore copies a cold object to the data directory of its bucket, from
+// which it is read until Unrestore
+func (s *Store) Restore(bucketName string, obj core.Object) error {
+	if obj.Storage != KindCold || s.cold == "" {
+		return ErrUnknownStorage
+	}
+
+	src, err := os.Open(s.coldPath(bucketName, obj))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	path := s.restoredPath(bucketName, obj)
+	tmp, _, _, err := writeTemp(filepath.Dir(path), src)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	return os.Rename(tmp, path)
+}
+
+// Unrestore removes the restored copy of a cold object
+func (s *Store) Unrestore(bucketName string, obj core.Object) error {
+	bucketDir := s.BucketDir(bucketName)
+	path := s.restoredPath(bucketName, obj)
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	util.RemoveEmptyDirs(filepath.Dir(path), util.ObjectDataDir(bucketDir, bucketName))
+	return nil
+}
+
+// SweepCold deletes the object files of the cold directory that none of the
+// cold objects, listed by bucket, points at. Files touched within grace are left
+// alone, an upload or a transition may be about to reference them.
+func (s *Store) SweepCold(objects map[string][]core.Object, grace time.Duration) (int, error) {
+	if s.cold == "" {
+		return 0, nil
+	}
+	cutoff := time.Now().Add(-grace)
+
+	keep := make(map[string]bool)
+	for bucketName, list := range objects {
+		for _, obj := range list {
+			keep[s.coldPath(bucketName, obj)] = true
+		}
+	}
+
+	return sweepDigestFiles(s.cold, ".upload-", keep, cutoff)
+}
+
+// syncFile flushes the content of a file to the disk
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+)
+
+func withCold(t *testing.T) func(*core.Config) {
+	return func(cfg *core.Config) {
+		cfg.Storage.Cold.Dir = filepath.Join(t.TempDir(), "cold")
+	}
+}
+
+// read returns the content of obj in the bucket photos
+func read(t *testing.T, s *Store, obj core.Object) string {
+	t.Helper()
+	r, err := s.Open("photos", obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestTransitionRestore(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*core.Config)
+		kind      string
+	}{
+		{"file", nil, KindFile},
+		{"blob", dedup, KindBlob},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore(t, func(cfg *core.Config) {
+				withCold(t)(cfg)
+				if tt.configure != nil {
+					tt.configure(cfg)
+				}
+			})
+			obj := put(t, s, "a.txt", "content")
+			if obj.Storage != tt.kind {
+				t.Fatalf("stored as %s, want %s", obj.Storage, tt.kind)
+			}
+
+			cold, err := s.Transition("photos", obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cold.Storage != KindCold || cold.StorageClass != core.StorageCold || cold.Digest != obj.Digest {
+				t.Errorf("cold object = %+v", cold)
+			}
+			// The original is deleted by the caller, once the record is replaced
+			if got := read(t, s, obj); got != "content" {
+				t.Errorf("original after the transition = %q", got)
+			}
+			if err := s.Delete("photos", obj); err != nil {
+				t.Fatal(err)
+			}
+			if got := read(t, s, cold); got != "content" {
+				t.Errorf("cold object = %q", got)
+			}
+
+			if err := s.Restore("photos", cold); err != nil {
+				t.Fatal(err)
+			}
+			restored := s.restoredPath("photos", cold)
+			if !exists(restored) {
+				t.Fatal("restored copy missing")
+			}
+			cold.RestoreExpiryDate = time.Now().Add(time.Hour).Format(time.RFC3339Nano)
+			if got := read(t, s, cold); got != "content" {
+				t.Errorf("restored object = %q", got)
+			}
+
+			if err := s.Unrestore("photos", cold); err != nil {
+				t.Fatal(err)
+			}
+			if exists(restored) {
+				t.Error("restored copy left")
+			}
+			// The cold copy is read while the record still says restored
+			if got := read(t, s, cold); got != "content" {
+				t.Errorf("object after the restore = %q", got)
+			}
+		})
+	}
+}
+
+func TestTransitionErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		cold   bool
+		change func(obj *core.Object)
+		want   error
+	}{
+		{"no cold directory", false, func(obj *core.Object) {}, ErrNoColdDir},
+		{"digest mismatch", true, func(obj *core.Object) { obj.Digest = strings.Repeat("0", 64) }, ErrDigestMismatch},
+		{"missing data", true, func(obj *core.Object) { obj.Name = "missing" }, os.ErrNotExist},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var configure func(*core.Config)
+			if tt.cold {
+				configure = withCold(t)
+			}
+			s := newTestStore(t, configure)
+			obj := put(t, s, "a.txt", "content")
+			tt.change(&obj)
+
+			if _, err := s.Transition("photos", obj); !errors.Is(err, tt.want) {
+				t.Errorf("Transition() = %v, want %v", err, tt.want)
+			}
+			filepath.WalkDir(s.cold, func(path string, d fs.DirEntry, err error) error {
+				if err == nil && !d.IsDir() {
+					t.Errorf("%s left after a failed transition", path)
+				}
+				return nil
+			})
+		})
+	}
+
+	// Only cold objects are restored
+	s := newTestStore(t, withCold(t))
+	if err := s.Restore("photos", put(t, s, "a.txt", "content")); !errors.Is(err, ErrUnknownStorage) {
+		t.Errorf("Restore() of a file = %v, want %v", err, ErrUnknownStorage)
+	}
+}
+
+func TestSweepCold(t *testing.T) {
+	s := newTestStore(t, withCold(t))
+	var objects []core.Object
+	for _, key := range []string{"kept", "orphan", "recent"} {
+		obj := put(t, s, key, key)
+		cold, err := s.Transition("photos", obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		objects = append(objects, cold)
+	}
+	kept, orphan, recent := objects[0], objects[1], objects[2]
+	staleTemp := filepath.Join(filepath.Dir(s.coldPath("photos", kept)), ".upload-stale")
+	if err := os.WriteFile(staleTemp, []byte("partial"), core.FilePerm); err != nil {
+		t.Fatal(err)
+	}
+	age(t, s.coldPath("photos", kept), s.coldPath("photos", orphan), staleTemp)
+
+	removed, err := s.SweepCold(map[string][]core.Object{"photos": {kept}}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Errorf("SweepCold() removed %d files, want the orphan and the temp file", removed)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		want bool
+	}{
+		{"listed", s.coldPath("photos", kept), true},
+		{"unlisted", s.coldPath("photos", orphan), false},
+		{"unlisted within grace", s.coldPath("photos", recent), true},
+		{"stale temp", staleTemp, false},
+	}
+	for _, tt := range tests {
+		if got := exists(tt.path); got != tt.want {
+			t.Errorf("%s: exists = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"mime"
+	"strings"
+)
+
+// Compression algorithms a bucket can opt in to
+const (
+	CompressionGzip    = "gzip"
+	CompressionDeflate = "deflate"
+)
+
+var ErrUnknownCompression = errors.New("unknown compression algorithm, must be gzip or deflate")
+
+// Content types that are already compressed and gain nothing from another pass
+var incompressibleTypes = map[string]bool{
+	"application/gzip":             true,
+	"application/x-gzip":           true,
+	"application/zip":              true,
+	"application/x-bzip2":          true,
+	"application/x-xz":             true,
+	"application/zstd":             true,
+	"application/x-7z-compressed":  true,
+	"application/x-rar-compressed": true,
+	"application/vnd.rar":          true,
+	"application/x-compress":       true,
+	"application/pdf":              true,
+	"image/jpeg":                   true,
+	"image/png":                    true,
+	"image/gif":                    true,
+	"image/webp":                   true,
+	"image/avif":                   true,
+	"image/heic":                   true,
+}
+
+// ValidCompression reports whether algorithm is supported, "" meaning none
+func ValidCompression(algorithm string) bool {
+	switch algorithm {
+	case "", CompressionGzip, CompressionDeflate:
+		return true
+	}
+	return false
+}
+
+// ShouldCompress reports whether content of the given type is worth compressing
+func ShouldCompress(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(contentType)
+	}
+
+	if strings.HasPrefix(mediaType, "video/") || strings.HasPrefix(mediaType, "audio/") {
+		return false
+	}
+	return !incompressibleTypes[mediaType]
+}
+
+// compressReader returns a reader yielding src compressed with algorithm.
+// Errors reading src, including limit errors, are passed on unchanged.
+func compressReader(src io.Reader, algorithm string) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	go func() {
+		var zw io.WriteCloser
+		if algorithm == CompressionDeflate {
+			zw, _ = flate.NewWriter(pw, flate.DefaultCompression)
+		} else {
+			zw = gzip.NewWriter(pw)
+		}
+
+		_, err := io.Copy(zw, src)
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return pr
+}
+
+// decompressReader wraps rc to decompress content stored with algorithm
+func decompressReader(rc io.ReadCloser, algorithm string) (io.ReadCloser, error) {
+	switch algorithm {
+	case "":
+		return rc, nil
+	case CompressionGzip:
+		zr, err := gzip.NewReader(rc)
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		return readCloser{Reader: zr, closers: []io.Closer{zr, rc}}, nil
+	case CompressionDeflate:
+		zr := flate.NewReader(rc)
+		return readCloser{Reader: zr, closers: []io.Closer{zr, rc}}, nil
+	}
+	rc.Close()
+	return nil, ErrUnknownCompression
+}
+
+// readCloser closes every closer in order
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (rc readCloser) Close() error {
+	var errs []error
+	for _, c := range rc.closers {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
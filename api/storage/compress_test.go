@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/util"
+)
+
+func TestShouldCompress(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"text/plain", true},
+		{"text/plain; charset=utf-8", true},
+		{"application/json", true},
+		{"application/octet-stream", true},
+		{"application/gzip", false},
+		{"application/zip", false},
+		{"IMAGE/JPEG", false},
+		{"image/png", false},
+		{"image/svg+xml", true},
+		{"video/mp4", false},
+		{"audio/ogg; codecs=opus", false},
+		{"application/pdf", false},
+	}
+	for _, tt := range tests {
+		if got := ShouldCompress(tt.contentType); got != tt.want {
+			t.Errorf("ShouldCompress(%q) = %v, want %v", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	contents := []string{"", "a", strings.Repeat("log line 42\n", 10000)}
+	for _, algorithm := range []string{CompressionGzip, CompressionDeflate} {
+		for _, content := range contents {
+			t.Run(algorithm+"/"+strconv.Itoa(len(content)), func(t *testing.T) {
+				compressed, err := io.ReadAll(compressReader(strings.NewReader(content), algorithm))
+				if err != nil {
+					t.Fatal(err)
+				}
+				r, err := decompressReader(io.NopCloser(bytes.NewReader(compressed)), algorithm)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer r.Close()
+				got, err := io.ReadAll(r)
+				if err != nil || string(got) != content {
+					t.Errorf("round trip of %d bytes returned %d, %v", len(content), len(got), err)
+				}
+			})
+		}
+	}
+
+	if _, err := decompressReader(io.NopCloser(strings.NewReader("")), "zstd"); !errors.Is(err, ErrUnknownCompression) {
+		t.Errorf("decompressReader(zstd) = %v, want %v", err, ErrUnknownCompression)
+	}
+}
+
+func TestCompressionSourceError(t *testing.T) {
+	// A limit error ends the compressed stream with the same error
+	errLimit := errors.New("too large")
+	src := io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(errLimit))
+	if _, err := io.ReadAll(compressReader(src, CompressionGzip)); !errors.Is(err, errLimit) {
+		t.Errorf("read = %v, want %v", err, errLimit)
+	}
+}
+
+func TestStoreCompression(t *testing.T) {
+	content := strings.Repeat("2024-01-01 GET /index.html 200\n", 2000)
+	sum := md5.Sum([]byte(content))
+	tests := []struct {
+		name        string
+		compression string
+		contentType string
+		encoding    string // of the stored bytes
+	}{
+		{"uncompressed bucket", "", "text/plain", ""},
+		{"gzip", CompressionGzip, "text/plain", CompressionGzip},
+		{"deflate", CompressionDeflate, "text/plain", CompressionDeflate},
+		{"already compressed type", CompressionGzip, "application/gzip", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore(t, nil)
+			obj := core.Object{Name: "access.log", ContentType: tt.contentType}
+			if err := s.Put("photos", &obj, strings.NewReader(content), tt.compression); err != nil {
+				t.Fatal(err)
+			}
+
+			// Size and ETag are those of the uploaded content
+			if obj.Encoding != tt.encoding || obj.ContentLength != strconv.Itoa(len(content)) || obj.ETag != hex.EncodeToString(sum[:]) {
+				t.Errorf("object = %+v, want encoding %q, the original size and ETag", obj, tt.encoding)
+			}
+			info, err := os.Stat(util.ObjectPath(s.dir, "photos", obj.Name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if compressed := info.Size() < int64(len(content)); compressed != (tt.encoding != "") {
+				t.Errorf("%d bytes stored for %d, compressed %v", info.Size(), len(content), compressed)
+			}
+
+			r, err := s.Open("photos", obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			if got, err := io.ReadAll(r); err != nil || string(got) != content {
+				t.Errorf("read %d bytes, %v, want the %d uploaded", len(got), err, len(content))
+			}
+		})
+	}
+}
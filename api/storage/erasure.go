@@ -0,0 +1,616 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+)
+
+// Erasure coded objects are cut into stripes of stripeSize stored bytes.
+// Each stripe is split into one chunk per data shard, zero padded to the
+// same length, and the parity chunks are computed from them. Shard i of an
+// object holds chunk i of every stripe, each followed by its CRC-32C, behind
+// a header, and is stored on disk i under the object path with the start
+// of the digest appended.
+const (
+	stripeSize = 1 << 20
+
+	// Magic, data shards, parity shards, shard index, an unused byte, the
+	// stored size and the CRC-32C of the preceding bytes
+	shardMagic      = "TSS1"
+	shardHeaderSize = 20
+
+	// Marks a directory as a disk holding shards. A disk without it, such
+	// as one that is not mounted, is offline.
+	diskMarker = ".triple-s-disk"
+)
+
+var (
+	ErrErasureLayout = errors.New("erasure layout differs from the one recorded in " + core.ErasureFile)
+	ErrWriteQuorum   = errors.New("too few disks online to store the object")
+	ErrBadShard      = errors.New("damaged erasure shard")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// erasureLayout is recorded in the data directory when erasure coding is
+// first enabled. Shards are found by their position in Dirs, so the layout
+// cannot change once objects were stored with it.
+type erasureLayout struct {
+	Dirs         []string `json:"dirs"`
+	DataShards   int      `json:"data_shards"`
+	ParityShards int      `json:"parity_shards"`
+}
+
+type erasure struct {
+	erasureLayout
+	codec *codec
+	write bool // new objects are erasure coded
+}
+
+// openErasure returns the configured erasure layout, recording it on first
+// use, or when none is configured the recorded one, to keep reading the
+// objects stored with it. It returns nil when there is neither.
+func openErasure(dir string, cfg core.ErasureConfig) (*erasure, error) {
+	path := filepath.Join(dir, core.ErasureFile)
+
+	var recorded *erasureLayout
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		recorded = &erasureLayout{}
+		if err := json.Unmarshal(data, recorded); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+
+	if !cfg.Enabled() {
+		if recorded == nil {
+			return nil, nil
+		}
+		return &erasure{erasureLayout: *recorded, codec: newCodec(recorded.DataShards, recorded.ParityShards)}, nil
+	}
+
+	layout := erasureLayout{}
+	layout.DataShards, layout.ParityShards = cfg.Shards()
+	for _, d := range cfg.Dirs {
+		layout.Dirs = append(layout.Dirs, filepath.Clean(d))
+	}
+
+	if recorded != nil {
+		if !slices.Equal(recorded.Dirs, layout.Dirs) || recorded.DataShards != layout.DataShards || recorded.ParityShards != layout.ParityShards {
+			return nil, fmt.Errorf("%w: %d+%d shards over %v", ErrErasureLayout, recorded.DataShards, recorded.ParityShards, recorded.Dirs)
+		}
+	} else if err := writeLayout(path, layout); err != nil {
+		return nil, err
+	}
+
+	// A disk failing here is only offline, objects are stored as long as
+	// enough disks are left
+	for _, d := range layout.Dirs {
+		marker := filepath.Join(d, diskMarker)
+		if _, err := os.Stat(marker); errors.Is(err, os.ErrNotExist) {
+			if os.MkdirAll(d, core.DirPerm) == nil {
+				os.WriteFile(marker, nil, core.FilePerm)
+			}
+		}
+	}
+
+	return &erasure{erasureLayout: layout, codec: newCodec(layout.DataShards, layout.ParityShards), write: true}, nil
+}
+
+func writeLayout(path string, layout erasureLayout) error {
+	data, err := json.MarshalIndent(layout, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), core.FilePerm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// online reports whether disk i holds its marker
+func (e *erasure) online(i int) bool {
+	_, err := os.Stat(filepath.Join(e.Dirs[i], diskMarker))
+	return err == nil
+}
+
+// quorum returns the number of shards a write must store, one more than
+// needed to read the object back
+func (e *erasure) quorum() int {
+	return e.DataShards + 1
+}
+
+func (e *erasure) shardPath(i int, bucketName string, obj core.Object) string {
+	return digestPath(e.Dirs[i], bucketName, obj)
+}
+
+func (e *erasure) shardPaths(bucketName string, obj core.Object) []string {
+	paths := make([]string, len(e.Dirs))
+	for i := range paths {
+		paths[i] = e.shardPath(i, bucketName, obj)
+	}
+	return paths
+}
+
+// chunkSize returns the length of the chunks of a stripe of n bytes
+func (e *erasure) chunkSize(n int64) int64 {
+	return (n + int64(e.DataShards) - 1) / int64(e.DataShards)
+}
+
+// stripeOffset returns where the chunk of stripe j starts in a shard
+func (e *erasure) stripeOffset(j int64) int64 {
+	return shardHeaderSize + j*(e.chunkSize(stripeSize)+4)
+}
+
+// put erasure codes the staged data of obj onto the disks online
+func (e *erasure) put(bucketName string, obj core.Object, tmp string) error {
+	f, err := os.Open(tmp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	targets := make(map[int]string)
+	for i := range e.Dirs {
+		if e.online(i) {
+			targets[i] = e.shardPath(i, bucketName, obj)
+		}
+	}
+	if len(targets) < e.quorum() {
+		return fmt.Errorf("%w: %d of %d", ErrWriteQuorum, len(targets), len(e.Dirs))
+	}
+
+	// Shards written by a failed upload are removed by the healer once no
+	// object points at them
+	written, err := e.encode(f, info.Size(), targets)
+	if err != nil {
+		return err
+	}
+	if written < e.quorum() {
+		return fmt.Errorf("%w: %d of %d shards written", ErrWriteQuorum, written, len(e.Dirs))
+	}
+	return nil
+}
+
+// encode reads size bytes from src and writes the shards with the indexes
+// of targets to their path. A shard that fails to be written is skipped,
+// the number of shards written is returned.
+func (e *erasure) encode(src io.Reader, size int64, targets map[int]string) (int, error) {
+	var outputs []*shardOutput
+	defer func() {
+		for _, out := range outputs {
+			if out.file != nil {
+				out.file.Close()
+				os.Remove(out.file.Name())
+			}
+		}
+	}()
+
+	header := e.header(size)
+	for i := range e.Dirs {
+		path, ok := targets[i]
+		if !ok {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), core.DirPerm); err != nil {
+			continue
+		}
+		f, err := os.CreateTemp(filepath.Dir(path), ".shard-*")
+		if err != nil {
+			continue
+		}
+		out := &shardOutput{index: i, path: path, file: f}
+		outputs = append(outputs, out)
+
+		header[6] = byte(i)
+		binary.BigEndian.PutUint32(header[16:], crc32.Checksum(header[:16], crcTable))
+		if err := f.Chmod(core.FilePerm); err != nil {
+			out.fail()
+		} else if _, err := f.Write(header); err != nil {
+			out.fail()
+		}
+	}
+
+	shards := make([][]byte, len(e.Dirs))
+	buf := make([]byte, int64(len(e.Dirs))*e.chunkSize(stripeSize))
+	var sum [4]byte
+	for off := int64(0); off < size; off += stripeSize {
+		n := min(stripeSize, size-off)
+		chunk := e.chunkSize(n)
+		data := buf[:int64(e.DataShards)*chunk]
+		if _, err := io.ReadFull(src, data[:n]); err != nil {
+			return 0, err
+		}
+		clear(data[n:])
+
+		for i := range shards {
+			shards[i] = buf[int64(i)*chunk : int64(i+1)*chunk]
+		}
+		e.codec.encode(shards)
+
+		for _, out := range outputs {
+			if out.file == nil {
+				continue
+			}
+			binary.BigEndian.PutUint32(sum[:], crc32.Checksum(shards[out.index], crcTable))
+			if _, err := out.file.Write(shards[out.index]); err != nil {
+				out.fail()
+			} else if _, err := out.file.Write(sum[:]); err != nil {
+				out.fail()
+			}
+		}
+	}
+
+	written := 0
+	for _, out := range outputs {
+		if out.file == nil {
+			continue
+		}
+		tmp := out.file.Name()
+		err := out.file.Close()
+		out.file = nil
+		if err == nil {
+			err = os.Rename(tmp, out.path)
+		}
+		if err != nil {
+			os.Remove(tmp)
+			continue
+		}
+		written++
+	}
+	return written, nil
+}
+
+// shardOutput is a shard being written to a temporary file next to its path
+type shardOutput struct {
+	index int
+	path  string
+	file  *os.File // nil once the shard failed
+}
+
+// fail drops a shard that could not be written
+func (out *shardOutput) fail() {
+	out.file.Close()
+	os.Remove(out.file.Name())
+	out.file = nil
+}
+
+// header returns the shard header of an object of size stored bytes, the
+// index and checksum are filled in per shard
+func (e *erasure) header(size int64) []byte {
+	header := make([]byte, shardHeaderSize)
+	copy(header, shardMagic)
+	header[4] = byte(e.DataShards)
+	header[5] = byte(e.ParityShards)
+	binary.BigEndian.PutUint64(header[8:], uint64(size))
+	return header
+}
+
+// readHeader checks the header of shard i and returns the stored size
+func (e *erasure) readHeader(f *os.File, i int) (int64, error) {
+	header := make([]byte, shardHeaderSize)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return 0, err
+	}
+	if string(header[:4]) != shardMagic ||
+		binary.BigEndian.Uint32(header[16:]) != crc32.Checksum(header[:16], crcTable) ||
+		int(header[4]) != e.DataShards || int(header[5]) != e.ParityShards || int(header[6]) != i {
+		return 0, ErrBadShard
+	}
+	return int64(binary.BigEndian.Uint64(header[8:])), nil
+}
+
+// open returns the stored bytes of obj, rebuilt from the other shards
+// where shards are missing or damaged
+func (e *erasure) open(bucketName string, obj core.Object) (*shardReader, error) {
+	return e.openShards(e.shardPaths(bucketName, obj))
+}
+
+// openShards opens the shards at paths, skipping the empty ones
+func (e *erasure) openShards(paths []string) (*shardReader, error) {
+	r := &shardReader{e: e, files: make([]*os.File, len(paths)), size: -1}
+	found := 0
+	for i, path := range paths {
+		if path == "" {
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		size, err := e.readHeader(f, i)
+		if err != nil || (r.size >= 0 && size != r.size) {
+			f.Close()
+			continue
+		}
+		r.size = size
+		r.files[i] = f
+		found++
+	}
+
+	if found < e.DataShards {
+		r.Close()
+		return nil, fmt.Errorf("%w: %d of %d found", ErrTooFewShards, found, len(paths))
+	}
+	return r, nil
+}
+
+// shardReader decodes the stripes of an object, reading the data shards and
+// only when one of them fails as many parity shards as needed
+type shardReader struct {
+	e     *erasure
+	files []*os.File // nil for the shards missing or found damaged
+	size  int64      // stored bytes
+	next  int64      // offset of the next stripe
+	buf   []byte     // rest of the current stripe
+	block []byte
+	out   []byte
+}
+
+func (r *shardReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		if r.next >= r.size {
+			return 0, io.EOF
+		}
+		if err := r.readStripe(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *shardReader) readStripe() error {
+	e := r.e
+	n := min(stripeSize, r.size-r.next)
+	chunk := e.chunkSize(n)
+	offset := e.stripeOffset(r.next / stripeSize)
+
+	stride := e.chunkSize(stripeSize) + 4
+	if r.block == nil {
+		r.block = make([]byte, int64(len(r.files))*stride)
+	}
+
+	shards := make([][]byte, len(r.files))
+	found := 0
+	for i, f := range r.files {
+		if f == nil {
+			continue
+		}
+		block := r.block[int64(i)*stride:][:chunk+4]
+		if _, err := f.ReadAt(block, offset); err != nil ||
+			binary.BigEndian.Uint32(block[chunk:]) != crc32.Checksum(block[:chunk], crcTable) {
+			r.drop(i)
+			continue
+		}
+		shards[i] = block[:chunk]
+		if found++; found == e.DataShards {
+			break
+		}
+	}
+
+	if err := e.codec.reconstruct(shards, int(chunk)); err != nil {
+		return err
+	}
+	r.out = r.out[:0]
+	for _, shard := range shards[:e.DataShards] {
+		r.out = append(r.out, shard...)
+	}
+	r.buf = r.out[:n]
+	r.next += n
+	return nil
+}
+
+// drop stops reading shard i
+func (r *shardReader) drop(i int) {
+	if r.files[i] != nil {
+		r.files[i].Close()
+		r.files[i] = nil
+	}
+}
+
+// verify checks the checksum of every chunk of shard i
+func (r *shardReader) verify(i int) error {
+	e := r.e
+	info, err := r.files[i].Stat()
+	if err != nil {
+		return err
+	}
+	full, rest := r.size/stripeSize, r.size%stripeSize
+	want := e.stripeOffset(full)
+	if rest > 0 {
+		want += e.chunkSize(rest) + 4
+	}
+	if info.Size() != want {
+		return ErrBadShard
+	}
+
+	br := bufio.NewReader(io.NewSectionReader(r.files[i], shardHeaderSize, want-shardHeaderSize))
+	block := make([]byte, e.chunkSize(stripeSize)+4)
+	for off := int64(0); off < r.size; off += stripeSize {
+		chunk := e.chunkSize(min(stripeSize, r.size-off))
+		if _, err := io.ReadFull(br, block[:chunk+4]); err != nil {
+			return err
+		}
+		if binary.BigEndian.Uint32(block[chunk:]) != crc32.Checksum(block[:chunk], crcTable) {
+			return ErrBadShard
+		}
+	}
+	return nil
+}
+
+func (r *shardReader) Close() error {
+	for i := range r.files {
+		r.drop(i)
+	}
+	return nil
+}
+
+// heal verifies every shard of obj and rebuilds the missing and damaged
+// ones on the disks online, returning how many were rebuilt
+func (e *erasure) heal(bucketName string, obj core.Object) (int, error) {
+	paths := e.shardPaths(bucketName, obj)
+	r, err := e.openShards(paths)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	targets := make(map[int]string)
+	for i, f := range r.files {
+		if f != nil && r.verify(i) == nil {
+			continue
+		}
+		r.drop(i)
+		if e.online(i) {
+			targets[i] = paths[i]
+		}
+	}
+	if len(targets) == 0 {
+		return 0, nil
+	}
+
+	left := 0
+	for _, f := range r.files {
+		if f != nil {
+			left++
+		}
+	}
+	if left < e.DataShards {
+		return 0, fmt.Errorf("%w: %d of %d intact", ErrTooFewShards, left, len(paths))
+	}
+	return e.encode(r, r.size, targets)
+}
+
+// sweep deletes the shard files on the disks online that are not in keep
+// and were not modified after cutoff: shards of deleted and replaced objects
+// and the leftovers of interrupted writes
+func (e *erasure) sweep(keep map[string]bool, cutoff time.Time) (int, error) {
+	removed := 0
+	for i, disk := range e.Dirs {
+		if !e.online(i) {
+			continue
+		}
+		n, err := sweepDigestFiles(disk, ".shard-", keep, cutoff)
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// HealResult summarizes a healing run over the erasure coded objects
+type HealResult struct {
+	Scanned        int // erasure coded objects verified
+	Healed         int // objects whose shards were rebuilt
+	RebuiltShards  int // shards written again
+	Unrecoverable  int // objects with too few intact shards left
+	OrphansRemoved int // shards no object points at deleted
+	DisksOffline   int // disks whose shards could not be healed
+}
+
+// Heal verifies every shard of the erasure coded objects, listed by bucket,
+// rebuilds the missing and damaged ones on the disks online and deletes the
+// shards no object points at. Files touched within grace are left alone,
+// an upload may be about to reference them.
+func (s *Store) Heal(objects map[string][]core.Object, grace time.Duration) (HealResult, error) {
+	var result HealResult
+	if s.erasure == nil {
+		return result, nil
+	}
+	e := s.erasure
+	cutoff := time.Now().Add(-grace)
+
+	s.healing.Lock()
+	defer s.healing.Unlock()
+
+	for i := range e.Dirs {
+		if !e.online(i) {
+			result.DisksOffline++
+		}
+	}
+
+	keep := make(map[string]bool)
+	for bucketName, list := range objects {
+		for _, obj := range list {
+			for _, path := range e.shardPaths(bucketName, obj) {
+				keep[path] = true
+			}
+
+			result.Scanned++
+			rebuilt, err := e.heal(bucketName, obj)
+			switch {
+			case errors.Is(err, ErrTooFewShards):
+				result.Unrecoverable++
+			case err != nil:
+				return result, err
+			case rebuilt > 0:
+				result.Healed++
+				result.RebuiltShards += rebuilt
+			}
+		}
+	}
+
+	removed, err := e.sweep(keep, cutoff)
+	result.OrphansRemoved = removed
+	return result, err
+}
+
+// DiskStatus describes a disk holding erasure shards
+type DiskStatus struct {
+	Dir    string
+	Online bool
+}
+
+// Disks reports the disks erasure coded objects are stored on, none when
+// erasure coding was never enabled
+func (s *Store) Disks() []DiskStatus {
+	if s.erasure == nil {
+		return nil
+	}
+	disks := make([]DiskStatus, len(s.erasure.Dirs))
+	for i, dir := range s.erasure.Dirs {
+		disks[i] = DiskStatus{Dir: dir, Online: s.erasure.online(i)}
+	}
+	return disks
+}
+
+// CheckDisks reports an error when new objects are erasure coded but too
+// few disks are online to store them
+func (s *Store) CheckDisks() error {
+	if s.erasure == nil || !s.erasure.write {
+		return nil
+	}
+	online := 0
+	for i := range s.erasure.Dirs {
+		if s.erasure.online(i) {
+			online++
+		}
+	}
+	if online < s.erasure.quorum() {
+		return fmt.Errorf("%w: %d of %d, %d needed", ErrWriteQuorum, online, len(s.erasure.Dirs), s.erasure.quorum())
+	}
+	return nil
+}
@@ -0,0 +1,317 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+)
+
+// newTestErasure opens an erasure layout over data+parity fresh disks
+func newTestErasure(t *testing.T, data, parity int) *erasure {
+	t.Helper()
+	cfg := core.ErasureConfig{DataShards: data, ParityShards: parity}
+	for i := range data + parity {
+		cfg.Dirs = append(cfg.Dirs, filepath.Join(t.TempDir(), fmt.Sprintf("disk%d", i)))
+	}
+	e, err := openErasure(t.TempDir(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// putErasure stores content under key and returns its object
+func putErasure(t *testing.T, e *erasure, key string, content []byte) (core.Object, error) {
+	t.Helper()
+	tmp := filepath.Join(t.TempDir(), "upload")
+	if err := os.WriteFile(tmp, content, core.FilePerm); err != nil {
+		t.Fatal(err)
+	}
+	obj := core.Object{Name: key, Digest: fmt.Sprintf("%016x", rand.Uint64()), Storage: KindErasure}
+	return obj, e.put("photos", obj, tmp)
+}
+
+func readErasure(t *testing.T, e *erasure, obj core.Object) ([]byte, error) {
+	t.Helper()
+	r, err := e.open("photos", obj)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// corrupt flips a byte in the first chunk of the shard at path
+func corrupt(t *testing.T, path string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, shardHeaderSize); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err := f.WriteAt(b, shardHeaderSize); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestErasureRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewPCG(7, 8))
+	sizes := []int{0, 1, 1000, stripeSize + 13}
+	layouts := [][2]int{{1, 1}, {2, 1}, {2, 2}, {3, 2}, {4, 2}}
+
+	for _, layout := range layouts {
+		data, parity := layout[0], layout[1]
+		for _, size := range sizes {
+			content := make([]byte, size)
+			for i := range content {
+				content[i] = byte(rng.IntN(256))
+			}
+
+			tests := []struct {
+				name    string
+				missing int // shards deleted
+				corrupt int // shards damaged after them
+			}{
+				{"intact", 0, 0},
+				{"parity missing", parity, 0},
+				{"parity corrupt", 0, parity},
+				{"missing and corrupt", parity - parity/2, parity / 2},
+			}
+			for _, tt := range tests {
+				t.Run(fmt.Sprintf("%d+%d/%d bytes/%s", data, parity, size, tt.name), func(t *testing.T) {
+					e := newTestErasure(t, data, parity)
+					obj, err := putErasure(t, e, "a/key", content)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					// Damage the data shards first, so that they must be rebuilt
+					paths := e.shardPaths("photos", obj)
+					for i := range tt.missing {
+						if err := os.Remove(paths[i]); err != nil {
+							t.Fatal(err)
+						}
+					}
+					for i := tt.missing; i < tt.missing+tt.corrupt && size > 0; i++ {
+						corrupt(t, paths[i])
+					}
+
+					got, err := readErasure(t, e, obj)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !bytes.Equal(got, content) {
+						t.Errorf("read %d bytes differing from the %d written", len(got), len(content))
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestErasureTooManyLost(t *testing.T) {
+	e := newTestErasure(t, 2, 1)
+	obj, err := putErasure(t, e, "key", []byte("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := e.shardPaths("photos", obj)
+	os.Remove(paths[0])
+	corrupt(t, paths[2])
+
+	if _, err := readErasure(t, e, obj); !errors.Is(err, ErrTooFewShards) {
+		t.Errorf("read = %v, want %v", err, ErrTooFewShards)
+	}
+}
+
+func TestErasureWriteQuorum(t *testing.T) {
+	tests := []struct {
+		name    string
+		offline int // disks losing their marker
+		broken  int // disks online whose shard cannot be written
+		want    error
+	}{
+		{"all disks", 0, 0, nil},
+		{"one disk offline", 1, 0, nil},
+		{"too few online", 2, 0, ErrWriteQuorum},
+		{"one write failing", 0, 1, nil},
+		{"too few written", 1, 1, ErrWriteQuorum},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 2+2 shards, a write needs 3 of them
+			e := newTestErasure(t, 2, 2)
+			for i := range tt.offline {
+				if err := os.Remove(filepath.Join(e.Dirs[i], diskMarker)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := tt.offline; i < tt.offline+tt.broken; i++ {
+				// A file where the bucket directory goes
+				if err := os.WriteFile(filepath.Join(e.Dirs[i], "photos"), nil, core.FilePerm); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			obj, err := putErasure(t, e, "key", []byte("content"))
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("put() = %v, want %v", err, tt.want)
+			}
+			if err != nil {
+				return
+			}
+			if got, err := readErasure(t, e, obj); err != nil || string(got) != "content" {
+				t.Errorf("read = %q, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestErasureHeal(t *testing.T) {
+	e := newTestErasure(t, 2, 2)
+	content := bytes.Repeat([]byte("0123456789"), stripeSize/5)
+	obj, err := putErasure(t, e, "key", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := e.shardPaths("photos", obj)
+	if err := os.Remove(paths[0]); err != nil {
+		t.Fatal(err)
+	}
+	corrupt(t, paths[3])
+
+	rebuilt, err := e.heal("photos", obj)
+	if err != nil || rebuilt != 2 {
+		t.Fatalf("heal() = %d, %v, want 2 shards rebuilt", rebuilt, err)
+	}
+
+	// Every shard is whole again, the object reads back from any two
+	r, err := e.openShards(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range paths {
+		if err := r.verify(i); err != nil {
+			t.Errorf("shard %d: %v", i, err)
+		}
+	}
+	r.Close()
+
+	os.Remove(paths[1])
+	os.Remove(paths[2])
+	if got, err := readErasure(t, e, obj); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("read from the rebuilt shards: %d bytes, %v", len(got), err)
+	}
+
+	if rebuilt, err := e.heal("photos", obj); err != nil || rebuilt != 2 {
+		t.Errorf("heal() = %d, %v, want the 2 deleted shards rebuilt", rebuilt, err)
+	}
+	if rebuilt, err := e.heal("photos", obj); err != nil || rebuilt != 0 {
+		t.Errorf("heal() of a whole object = %d, %v, want 0", rebuilt, err)
+	}
+}
+
+func TestErasureHealOfflineDisk(t *testing.T) {
+	e := newTestErasure(t, 2, 1)
+	obj, err := putErasure(t, e, "key", []byte("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := e.shardPaths("photos", obj)
+	os.Remove(paths[1])
+	os.Remove(filepath.Join(e.Dirs[1], diskMarker))
+
+	// The shard of an offline disk waits for it to come back
+	if rebuilt, err := e.heal("photos", obj); err != nil || rebuilt != 0 {
+		t.Errorf("heal() = %d, %v, want nothing rebuilt", rebuilt, err)
+	}
+	if _, err := os.Stat(paths[1]); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("shard written to the offline disk: %v", err)
+	}
+}
+
+func TestErasureSweep(t *testing.T) {
+	e := newTestErasure(t, 2, 1)
+	live, err := putErasure(t, e, "live", []byte("live"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := putErasure(t, e, "deleted", []byte("deleted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recentOrphan, err := putErasure(t, e, "recent", []byte("recent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keep := make(map[string]bool)
+	for _, path := range e.shardPaths("photos", live) {
+		keep[path] = true
+	}
+
+	old := time.Now().Add(-time.Hour)
+	dataDir := filepath.Dir(e.shardPath(0, "photos", live))
+	stale := filepath.Join(dataDir, ".shard-123")
+	foreign := filepath.Join(dataDir, "notes.txt")
+	for _, path := range []string{stale, foreign} {
+		if err := os.WriteFile(path, nil, core.FilePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range append(e.shardPaths("photos", live), append(e.shardPaths("photos", deleted), stale, foreign)...) {
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := e.sweep(keep, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != len(e.Dirs)+1 {
+		t.Errorf("sweep() removed %d files, want %d", removed, len(e.Dirs)+1)
+	}
+
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+	for i, path := range e.shardPaths("photos", live) {
+		if !exists(path) {
+			t.Errorf("live shard %d removed", i)
+		}
+	}
+	for i, path := range e.shardPaths("photos", recentOrphan) {
+		if !exists(path) {
+			t.Errorf("shard %d written within the grace period removed", i)
+		}
+	}
+	for i, path := range e.shardPaths("photos", deleted) {
+		if exists(path) {
+			t.Errorf("shard %d of the deleted object left", i)
+		}
+	}
+	if exists(stale) {
+		t.Error("stale temporary shard left")
+	}
+	if !exists(foreign) {
+		t.Error("file not written by the store removed")
+	}
+	if got, err := readErasure(t, e, live); err != nil || string(got) != "live" {
+		t.Errorf("read after sweep = %q, %v", got, err)
+	}
+}
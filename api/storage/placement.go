@@ -0,0 +1,401 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/util"
+)
+
+var (
+	ErrReadOnly     = errors.New("bucket is read-only while it is moved or its directory drained")
+	ErrUnknownDisk  = errors.New("not one of the data directories")
+	ErrDiskDraining = errors.New("data directory is drained")
+	ErrDrainPrimary = errors.New("the data directory holding the metadata cannot be drained")
+	ErrNoDisk       = errors.New("no data directory available for new buckets")
+)
+
+// placement spreads the object files of the buckets over several data
+// directories. Each bucket lives on one of them, recorded in the catalog.
+type placement struct {
+	dir   string   // holds the metadata and the catalog
+	disks []string // dir first, then the other configured directories
+
+	mu      sync.Mutex
+	cond    *sync.Cond // signaled when the writes of a bucket end
+	catalog util.Catalog
+	writes  map[string]int  // writes in progress by bucket
+	moving  map[string]bool // buckets being moved
+}
+
+func openPlacement(cfg *core.Config) (*placement, error) {
+	catalog, err := util.ReadCatalog(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Clean(cfg.Dir)
+	p := &placement{
+		dir:     dir,
+		disks:   []string{dir},
+		catalog: catalog,
+		writes:  make(map[string]int),
+		moving:  make(map[string]bool),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	for _, d := range cfg.Storage.DataDirs {
+		// A directory that cannot be created is skipped when placing buckets
+		os.MkdirAll(d, core.DirPerm)
+		p.disks = append(p.disks, filepath.Clean(d))
+	}
+
+	// Cold objects stay readable from the recorded directory when it is no
+	// longer configured
+	if cold := cfg.Storage.Cold.Dir; cold != "" && filepath.Clean(cold) != catalog.Cold {
+		if catalog.Cold != "" {
+			slog.Warn("cold directory changed, the cold objects must have been moved to it", "from", catalog.Cold, "to", cold)
+		}
+		p.catalog.Cold = filepath.Clean(cold)
+		if err := util.WriteCatalog(dir, p.catalog); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// bucketDir returns the directory holding the object files of a bucket
+func (p *placement) bucketDir(bucketName string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.catalog.BucketDir(p.dir, bucketName)
+}
+
+func (p *placement) draining(disk string) bool {
+	return slices.Contains(p.catalog.Draining, disk)
+}
+
+// pick returns the directory with the most free space that is neither
+// draining nor excluded
+func (p *placement) pick(exclude string) (string, error) {
+	var best string
+	var bestFree uint64
+	for _, disk := range p.disks {
+		if disk == exclude || p.draining(disk) {
+			continue
+		}
+		free, _, err := util.DiskUsage(disk)
+		if errors.Is(err, util.ErrDiskUsageUnsupported) {
+			free, err = 0, nil
+		}
+		if err != nil {
+			continue
+		}
+		if best == "" || free > bestFree {
+			best, bestFree = disk, free
+		}
+	}
+	if best == "" {
+		return "", ErrNoDisk
+	}
+	return best, nil
+}
+
+// BucketDir returns the directory holding the object files of a bucket
+func (s *Store) BucketDir(bucketName string) string {
+	return s.placement.bucketDir(bucketName)
+}
+
+// PlaceBucket chooses the data directory of a new bucket, the one with the
+// most free space, and records it in the catalog
+func (s *Store) PlaceBucket(bucketName string) (string, error) {
+	p := s.placement
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.disks) == 1 {
+		return p.dir, nil
+	}
+	disk, err := p.pick("")
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(util.ObjectDataDir(disk, bucketName), core.DirPerm); err != nil {
+		return "", err
+	}
+	return disk, p.setBucketDir(bucketName, disk)
+}
+
+// setBucketDir records the directory of a bucket, p.mu is held
+func (p *placement) setBucketDir(bucketName, disk string) error {
+	catalog := p.catalog
+	catalog.Buckets = make(map[string]string)
+	for name, d := range p.catalog.Buckets {
+		catalog.Buckets[name] = d
+	}
+	if disk == p.dir {
+		delete(catalog.Buckets, bucketName)
+	} else {
+		catalog.Buckets[bucketName] = disk
+	}
+
+	if err := util.WriteCatalog(p.dir, catalog); err != nil {
+		return err
+	}
+	p.catalog = catalog
+	return nil
+}
+
+// remove deletes the directory of a bucket placed elsewhere than in the
+// data directory and forgets its place
+func (p *placement) remove(bucketName string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	disk, ok := p.catalog.Buckets[bucketName]
+	if !ok {
+		return nil
+	}
+	if err := os.RemoveAll(filepath.Join(disk, bucketName)); err != nil {
+		return err
+	}
+	return p.setBucketDir(bucketName, p.dir)
+}
+
+// BeginWrite registers a change of the objects of a bucket, refused while
+// the bucket is moved or its directory drained or no longer configured.
+// The returned function ends the write.
+func (s *Store) BeginWrite(bucketName string) (func(), error) {
+	p := s.placement
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	disk := p.catalog.BucketDir(p.dir, bucketName)
+	if p.moving[bucketName] || p.draining(disk) || !slices.Contains(p.disks, disk) {
+		return nil, ErrReadOnly
+	}
+	p.writes[bucketName]++
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.writes[bucketName]--; p.writes[bucketName] == 0 {
+			delete(p.writes, bucketName)
+			p.cond.Broadcast()
+		}
+	}, nil
+}
+
+// Drained reports whether a bucket is on a drained directory, or one no
+// longer configured, and should be moved
+func (s *Store) Drained(bucketName string) bool {
+	p := s.placement
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	disk := p.catalog.BucketDir(p.dir, bucketName)
+	return p.draining(disk) || !slices.Contains(p.disks, disk)
+}
+
+// Drain marks a data directory as drained, or no longer drained. A drained
+// directory takes no new buckets and its buckets are read-only until they
+// are moved.
+func (s *Store) Drain(disk string, drain bool) error {
+	p := s.placement
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	disk = filepath.Clean(disk)
+	if !slices.Contains(p.disks, disk) && !slices.Contains(p.catalog.Draining, disk) {
+		return fmt.Errorf("%w: %s", ErrUnknownDisk, disk)
+	}
+	if disk == p.dir && drain {
+		return ErrDrainPrimary
+	}
+
+	catalog := p.catalog
+	catalog.Draining = nil
+	for _, d := range p.catalog.Draining {
+		if d != disk {
+			catalog.Draining = append(catalog.Draining, d)
+		}
+	}
+	if drain {
+		catalog.Draining = append(catalog.Draining, disk)
+	}
+
+	if err := util.WriteCatalog(p.dir, catalog); err != nil {
+		return err
+	}
+	p.catalog = catalog
+	return nil
+}
+
+// BucketMove describes a bucket moved to another data directory
+type BucketMove struct {
+	Bucket string
+	From   string
+	To     string
+	Files  int
+	Bytes  int64
+}
+
+// MoveBucket copies the object files of a bucket to another data
+// directory, to the one with the most free space when to is empty, then
+// records the new place and deletes the old files. Writes to the bucket are
+// refused meanwhile; reads use the old files until the move is recorded.
+func (s *Store) MoveBucket(bucketName, to string) (BucketMove, error) {
+	p := s.placement
+	move := BucketMove{Bucket: bucketName}
+
+	p.mu.Lock()
+	move.From = p.catalog.BucketDir(p.dir, bucketName)
+	var err error
+	if to == "" {
+		to, err = p.pick(move.From)
+	} else if to = filepath.Clean(to); !slices.Contains(p.disks, to) {
+		err = fmt.Errorf("%w: %s", ErrUnknownDisk, to)
+	} else if p.draining(to) {
+		err = fmt.Errorf("%w: %s", ErrDiskDraining, to)
+	}
+	if err == nil && p.moving[bucketName] {
+		err = ErrReadOnly
+	}
+	if err != nil || to == move.From {
+		p.mu.Unlock()
+		move.To = to
+		return move, err
+	}
+	move.To = to
+
+	p.moving[bucketName] = true
+	for p.writes[bucketName] > 0 {
+		p.cond.Wait()
+	}
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		delete(p.moving, bucketName)
+		p.mu.Unlock()
+	}()
+
+	src, dst := util.ObjectDataDir(move.From, bucketName), util.ObjectDataDir(to, bucketName)
+	if err := os.RemoveAll(dst); err != nil {
+		return move, err
+	}
+	move.Files, move.Bytes, err = copyTree(src, dst)
+	if err != nil {
+		os.RemoveAll(dst)
+		return move, err
+	}
+
+	p.mu.Lock()
+	err = p.setBucketDir(bucketName, to)
+	p.mu.Unlock()
+	if err != nil {
+		os.RemoveAll(dst)
+		return move, err
+	}
+
+	// The metadata of the bucket stays in the data directory
+	if move.From == p.dir {
+		os.RemoveAll(src)
+		return move, os.MkdirAll(src, core.DirPerm)
+	}
+	return move, os.RemoveAll(filepath.Join(move.From, bucketName))
+}
+
+// copyTree copies the files under src to dst, leaving out interrupted
+// uploads
+func copyTree(src, dst string) (files int, size int64, err error) {
+	err = filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) && path == src {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		rel, _ := filepath.Rel(src, path)
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, core.DirPerm)
+		}
+		if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), ".upload-") {
+			return nil
+		}
+
+		n, err := copyFile(path, target)
+		files++
+		size += n
+		return err
+	})
+	return files, size, err
+}
+
+// copyFile copies a file and syncs the copy, so that the original can be
+// deleted once it is recorded
+func copyFile(src, dst string) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, core.FilePerm)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	n, err := io.Copy(out, in)
+	if err != nil {
+		return n, err
+	}
+	if err := out.Sync(); err != nil {
+		return n, err
+	}
+	return n, out.Close()
+}
+
+// DataDisk describes a data directory
+type DataDisk struct {
+	Dir      string
+	Buckets  int // buckets placed on it
+	Draining bool
+}
+
+// DataDisks reports the data directories with the number of buckets placed
+// on them, out of the given ones. Directories still holding buckets after
+// they were removed from the configuration are listed too.
+func (s *Store) DataDisks(buckets []string) []DataDisk {
+	p := s.placement
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	disks := slices.Clone(p.disks)
+	for _, d := range p.catalog.Buckets {
+		if !slices.Contains(disks, d) {
+			disks = append(disks, d)
+		}
+	}
+
+	counts := make(map[string]int)
+	for _, name := range buckets {
+		counts[p.catalog.BucketDir(p.dir, name)]++
+	}
+
+	list := make([]DataDisk, len(disks))
+	for i, d := range disks {
+		list[i] = DataDisk{Dir: d, Buckets: counts[d], Draining: p.draining(d)}
+	}
+	return list
+}
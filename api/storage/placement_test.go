@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/util"
+)
+
+// newPlacedStore opens a store with two more data directories and the
+// bucket photos, holding a.txt, on the first of them
+func newPlacedStore(t *testing.T) (s *Store, disk2, disk3 string) {
+	t.Helper()
+	disk2, disk3 = filepath.Join(t.TempDir(), "disk2"), filepath.Join(t.TempDir(), "disk3")
+	s = newTestStore(t, func(cfg *core.Config) {
+		cfg.Storage.DataDirs = []string{disk2, disk3}
+	})
+	if _, err := s.MoveBucket("photos", disk2); err != nil {
+		t.Fatal(err)
+	}
+	put(t, s, "a.txt", "content")
+	return s, disk2, disk3
+}
+
+func readFile(t *testing.T, s *Store, key string) string {
+	t.Helper()
+	r, err := s.Open("photos", core.Object{Name: key, Storage: KindFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestBeginWrite(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, s *Store, disk2 string)
+		want  error
+	}{
+		{"placed", func(t *testing.T, s *Store, disk2 string) {}, nil},
+		{"drained", func(t *testing.T, s *Store, disk2 string) {
+			if err := s.Drain(disk2, true); err != nil {
+				t.Fatal(err)
+			}
+		}, ErrReadOnly},
+		{"drain lifted", func(t *testing.T, s *Store, disk2 string) {
+			s.Drain(disk2, true)
+			if err := s.Drain(disk2, false); err != nil {
+				t.Fatal(err)
+			}
+		}, nil},
+		{"directory no longer configured", func(t *testing.T, s *Store, disk2 string) {
+			s.placement.disks = s.placement.disks[:1]
+		}, ErrReadOnly},
+		{"moving", func(t *testing.T, s *Store, disk2 string) {
+			s.placement.moving["photos"] = true
+		}, ErrReadOnly},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, disk2, _ := newPlacedStore(t)
+			tt.setup(t, s, disk2)
+
+			release, err := s.BeginWrite("photos")
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("BeginWrite() = %v, want %v", err, tt.want)
+			}
+			if err == nil {
+				release()
+			}
+			if drained := s.Drained("photos"); drained != (tt.want != nil && tt.name != "moving") {
+				t.Errorf("Drained() = %v", drained)
+			}
+			// Other buckets, on the data directory, are not affected
+			if release, err := s.BeginWrite("videos"); err != nil {
+				t.Errorf("BeginWrite() of another bucket = %v", err)
+			} else {
+				release()
+			}
+		})
+	}
+}
+
+func TestMoveBucketWaitsForWrites(t *testing.T) {
+	s, disk2, disk3 := newPlacedStore(t)
+	release, err := s.BeginWrite("photos")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		move BucketMove
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		move, err := s.MoveBucket("photos", disk3)
+		done <- result{move, err}
+	}()
+
+	// The move waits for the write, refusing new ones meanwhile
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		s.placement.mu.Lock()
+		moving := s.placement.moving["photos"]
+		s.placement.mu.Unlock()
+		if moving {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("move not started")
+		}
+	}
+	if _, err := s.BeginWrite("photos"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("BeginWrite() during the move = %v, want %v", err, ErrReadOnly)
+	}
+	if _, err := s.MoveBucket("photos", disk2); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("second MoveBucket() = %v, want %v", err, ErrReadOnly)
+	}
+	select {
+	case <-done:
+		t.Fatal("move did not wait for the write in progress")
+	case <-time.After(20 * time.Millisecond):
+	}
+	// Reads still use the old files
+	if got := readFile(t, s, "a.txt"); got != "content" {
+		t.Errorf("read during the move = %q", got)
+	}
+
+	release()
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if res.move.From != disk2 || res.move.To != disk3 || res.move.Files != 1 || res.move.Bytes != int64(len("content")) {
+		t.Errorf("move = %+v", res.move)
+	}
+	if s.BucketDir("photos") != disk3 {
+		t.Errorf("BucketDir() = %s, want %s", s.BucketDir("photos"), disk3)
+	}
+	if got := readFile(t, s, "a.txt"); got != "content" {
+		t.Errorf("read after the move = %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(disk2, "photos")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("old files left: %v", err)
+	}
+	if release, err := s.BeginWrite("photos"); err != nil {
+		t.Errorf("BeginWrite() after the move = %v", err)
+	} else {
+		release()
+	}
+}
+
+func TestDrain(t *testing.T) {
+	s, disk2, disk3 := newPlacedStore(t)
+
+	if err := s.Drain(s.dir, true); !errors.Is(err, ErrDrainPrimary) {
+		t.Errorf("Drain() of the data directory = %v, want %v", err, ErrDrainPrimary)
+	}
+	if err := s.Drain(filepath.Join(t.TempDir(), "other"), true); !errors.Is(err, ErrUnknownDisk) {
+		t.Errorf("Drain() of an unknown directory = %v, want %v", err, ErrUnknownDisk)
+	}
+
+	if err := s.Drain(disk3, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.MoveBucket("photos", disk3); !errors.Is(err, ErrDiskDraining) {
+		t.Errorf("MoveBucket() to a drained directory = %v, want %v", err, ErrDiskDraining)
+	}
+	for range 3 {
+		if disk, err := s.PlaceBucket("videos"); err != nil || disk == disk3 {
+			t.Errorf("PlaceBucket() = %s, %v, want a directory not drained", disk, err)
+		}
+	}
+
+	// A drained bucket is moved to a directory that is not drained
+	if err := s.Drain(disk2, true); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Drained("photos") {
+		t.Fatal("bucket of a drained directory not reported")
+	}
+	move, err := s.MoveBucket("photos", "")
+	if err != nil || move.To != s.dir {
+		t.Fatalf("MoveBucket() = %+v, %v, want it moved to the data directory", move, err)
+	}
+	if s.Drained("photos") || readFile(t, s, "a.txt") != "content" {
+		t.Error("moved bucket still drained or unreadable")
+	}
+	// The bucket directory on the data directory keeps the metadata
+	if _, err := os.Stat(util.ObjectDataDir(s.dir, "photos")); err != nil {
+		t.Error(err)
+	}
+
+	// Moving a bucket where it is already does nothing
+	if move, err := s.MoveBucket("photos", s.dir); err != nil || move.Files != 0 {
+		t.Errorf("MoveBucket() in place = %+v, %v", move, err)
+	}
+}
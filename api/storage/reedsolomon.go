@@ -0,0 +1,191 @@
+package storage
+
+import "errors"
+
+// Reed-Solomon erasure coding over GF(2^8). The encoding matrix is a
+// Vandermonde matrix turned systematic: its top rows are the identity, so
+// the data shards are stored as they are, and any rows of it as many as
+// there are data shards form an invertible matrix, so any that many shards
+// rebuild the others.
+
+// Generator polynomial of the field, x^8 + x^4 + x^3 + x^2 + 1
+const gfPoly = 0x11d
+
+var ErrTooFewShards = errors.New("too few erasure shards left to rebuild the object")
+
+var (
+	gfExp [510]byte // doubled so that products need no modulo
+	gfLog [256]byte
+	gfMul [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := range 255 {
+		gfExp[i], gfExp[i+255] = byte(x), byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= gfPoly
+		}
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMul[a][b] = gfExp[int(gfLog[a])+int(gfLog[b])]
+		}
+	}
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])*n%255]
+}
+
+// mulAdd adds coef times in to out
+func mulAdd(out, in []byte, coef byte) {
+	if coef == 0 {
+		return
+	}
+	table := &gfMul[coef]
+	for i, b := range in {
+		out[i] ^= table[b]
+	}
+}
+
+type matrix [][]byte
+
+func newMatrix(rows, cols int) matrix {
+	m := make(matrix, rows)
+	for i := range m {
+		m[i] = make([]byte, cols)
+	}
+	return m
+}
+
+func (m matrix) mul(o matrix) matrix {
+	out := newMatrix(len(m), len(o[0]))
+	for i := range m {
+		for j := range m[i] {
+			mulAdd(out[i], o[j], m[i][j])
+		}
+	}
+	return out
+}
+
+// invert returns the inverse of a square matrix by Gauss-Jordan elimination
+func (m matrix) invert() (matrix, error) {
+	n := len(m)
+	work := newMatrix(n, 2*n)
+	for i := range m {
+		copy(work[i], m[i])
+		work[i][n+i] = 1
+	}
+
+	for col := range n {
+		pivot := col
+		for pivot < n && work[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("singular matrix")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+
+		scale := gfInv(work[col][col])
+		for j := range work[col] {
+			work[col][j] = gfMul[scale][work[col][j]]
+		}
+		for row := range n {
+			if row != col {
+				mulAdd(work[row], work[col], work[row][col])
+			}
+		}
+	}
+
+	inv := newMatrix(n, n)
+	for i := range inv {
+		copy(inv[i], work[i][n:])
+	}
+	return inv, nil
+}
+
+// codec computes the parity shards of a number of data shards and rebuilds
+// lost shards
+type codec struct {
+	data, parity int
+	matrix       matrix // data+parity rows of data columns
+}
+
+func newCodec(data, parity int) *codec {
+	v := newMatrix(data+parity, data)
+	for r := range v {
+		for c := range v[r] {
+			v[r][c] = gfPow(byte(r), c)
+		}
+	}
+	// The rows of a Vandermonde matrix with distinct points are independent
+	top, err := v[:data].invert()
+	if err != nil {
+		panic(err)
+	}
+	return &codec{data: data, parity: parity, matrix: v.mul(top)}
+}
+
+// encode computes the parity shards from the data shards, all of the same
+// length
+func (c *codec) encode(shards [][]byte) {
+	for p := range c.parity {
+		out := shards[c.data+p]
+		clear(out)
+		for d, coef := range c.matrix[c.data+p][:c.data] {
+			mulAdd(out, shards[d], coef)
+		}
+	}
+}
+
+// reconstruct rebuilds the data shards left nil from the shards present,
+// all size bytes long
+func (c *codec) reconstruct(shards [][]byte, size int) error {
+	var rows []int
+	for i, shard := range shards {
+		if shard != nil {
+			rows = append(rows, i)
+			if len(rows) == c.data {
+				break
+			}
+		}
+	}
+	if len(rows) < c.data {
+		return ErrTooFewShards
+	}
+
+	sub := newMatrix(c.data, c.data)
+	for i, r := range rows {
+		copy(sub[i], c.matrix[r])
+	}
+	dec, err := sub.invert()
+	if err != nil {
+		return err
+	}
+
+	for d := range c.data {
+		if shards[d] != nil {
+			continue
+		}
+		out := make([]byte, size)
+		for i, r := range rows {
+			mulAdd(out, shards[r], dec[d][i])
+		}
+		shards[d] = out
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"testing"
+)
+
+// subsets calls fn with every subset of 0..n-1 of at most k elements
+func subsets(n, k int, fn func([]int)) {
+	var walk func(start int, set []int)
+	walk = func(start int, set []int) {
+		fn(set)
+		if len(set) == k {
+			return
+		}
+		for i := start; i < n; i++ {
+			walk(i+1, append(set, i))
+		}
+	}
+	walk(0, nil)
+}
+
+// encodedShards returns data random shards of size bytes followed by their
+// parity shards
+func encodedShards(c *codec, size int, rng *rand.Rand) [][]byte {
+	shards := make([][]byte, c.data+c.parity)
+	for i := range shards {
+		shards[i] = make([]byte, size)
+		if i < c.data {
+			for j := range shards[i] {
+				shards[i][j] = byte(rng.IntN(256))
+			}
+		}
+	}
+	c.encode(shards)
+	return shards
+}
+
+func TestGaloisField(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if got := gfMul[a][gfInv(byte(a))]; got != 1 {
+			t.Fatalf("%d times its inverse = %d, want 1", a, got)
+		}
+		if gfMul[a][0] != 0 || gfMul[0][a] != 0 {
+			t.Fatalf("%d times 0 is not 0", a)
+		}
+	}
+}
+
+func TestCodecReconstruct(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	for data := 1; data <= 6; data++ {
+		for parity := 1; parity <= 4; parity++ {
+			t.Run(fmt.Sprintf("%d+%d", data, parity), func(t *testing.T) {
+				c := newCodec(data, parity)
+				want := encodedShards(c, 37, rng)
+
+				// Every set of up to parity shards lost or found corrupt by
+				// their checksum is rebuilt from the others
+				subsets(data+parity, parity, func(lost []int) {
+					shards := make([][]byte, len(want))
+					for i := range want {
+						shards[i] = bytes.Clone(want[i])
+					}
+					for _, i := range lost {
+						shards[i] = nil
+					}
+					if err := c.reconstruct(shards, 37); err != nil {
+						t.Fatalf("losing %v: %v", lost, err)
+					}
+					for d := range data {
+						if !bytes.Equal(shards[d], want[d]) {
+							t.Fatalf("losing %v: data shard %d rebuilt wrong", lost, d)
+						}
+					}
+				})
+			})
+		}
+	}
+}
+
+func TestCodecTooFewShards(t *testing.T) {
+	c := newCodec(4, 2)
+	shards := encodedShards(c, 8, rand.New(rand.NewPCG(3, 4)))
+	shards[0], shards[2], shards[5] = nil, nil, nil
+	if err := c.reconstruct(shards, 8); !errors.Is(err, ErrTooFewShards) {
+		t.Errorf("reconstruct() = %v, want %v", err, ErrTooFewShards)
+	}
+}
+
+func TestCodecWideLayout(t *testing.T) {
+	// The largest layout accepted by the configuration
+	rng := rand.New(rand.NewPCG(5, 6))
+	c := newCodec(200, 56)
+	want := encodedShards(c, 16, rng)
+
+	shards := make([][]byte, len(want))
+	copy(shards, want)
+	for _, i := range rng.Perm(len(shards))[:56] {
+		shards[i] = nil
+	}
+	if err := c.reconstruct(shards, 16); err != nil {
+		t.Fatal(err)
+	}
+	for d := range 200 {
+		if !bytes.Equal(shards[d], want[d]) {
+			t.Fatalf("data shard %d rebuilt wrong", d)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package storage
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/util"
+)
+
+// Storage kinds recorded in the Storage column of objects.csv
+const (
+	KindFile    = "file"    // a file in the bucket's data directory, the default
+	KindBlob    = "blob"    // a shared content-addressed blob
+	KindErasure = "erasure" // shards spread over the erasure coding disks
+	KindCold    = "cold"    // a file in the cold directory
+)
+
+var (
+	ErrUnknownStorage = errors.New("unknown object storage kind")
+	ErrUnreachable    = errors.New("directory holding the object data is missing or offline")
+)
+
+// Store keeps object data on disk, either as one file per object in the
+// bucket directory, on the data directory the bucket is placed on, with
+// deduplication enabled as blobs shared by every object with the same
+// SHA-256 digest or, with erasure coding enabled, as shards spread over
+// several disks. Objects of the COLD storage class are files in the cold
+// directory.
+type Store struct {
+	dir       string
+	dedup     bool
+	erasure   *erasure // nil when no object was ever erasure coded
+	placement *placement
+	cold      string // directory of the cold objects, empty when never configured
+	coldWrite bool   // whether objects can be stored in the cold directory
+
+	mu      sync.Mutex // guards the blob reference counts
+	healing sync.Mutex // one healing run at a time
+}
+
+// New opens the store of the data directory. The erasure layout is
+// recorded in the directory the first time erasure coding is enabled and
+// must not change afterwards.
+func New(cfg *core.Config) (*Store, error) {
+	e, err := openErasure(cfg.Dir, cfg.Storage.Erasure)
+	if err != nil {
+		return nil, err
+	}
+	p, err := openPlacement(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{
+		dir:       cfg.Dir,
+		dedup:     cfg.Storage.Dedup,
+		erasure:   e,
+		placement: p,
+		cold:      p.catalog.Cold,
+		coldWrite: cfg.Storage.Cold.Dir != "",
+	}, nil
+}
+
+// Put streams src into the store, see Stage and Commit
+func (s *Store) Put(bucketName string, obj *core.Object, src io.Reader, compression string) error {
+	tmp, err := s.Stage(bucketName, obj, src, compression)
+	if err != nil {
+		return err
+	}
+	return s.Commit(bucketName, *obj, tmp)
+}
+
+// Stage streams src into a temporary file and records in obj where it
+// will be stored, along with its size, MD5 ETag and the SHA-256 digest of
+// the stored bytes. Objects of the COLD storage class go to the cold
+// directory. The content is compressed with the given algorithm unless it is
+// empty or the content type is already compressed. Nothing is left behind
+// when src fails.
+func (s *Store) Stage(bucketName string, obj *core.Object, src io.Reader, compression string) (tmp string, err error) {
+	cold := obj.StorageClass == core.StorageCold
+	tmpDir := filepath.Dir(util.ObjectPath(s.BucketDir(bucketName), bucketName, obj.Name))
+	switch {
+	case cold && !s.coldWrite:
+		return "", ErrNoColdDir
+	case cold:
+		tmpDir = filepath.Dir(util.ObjectPath(s.cold, bucketName, obj.Name))
+	case s.dedup:
+		tmpDir = filepath.Join(s.dir, core.BlobsDir, "tmp")
+	}
+
+	// Size and ETag describe the content as uploaded
+	md5Hash := md5.New()
+	counter := &countingWriter{}
+	stored := io.TeeReader(src, io.MultiWriter(md5Hash, counter))
+
+	obj.Encoding = ""
+	if compression != "" && ShouldCompress(obj.ContentType) {
+		zr := compressReader(stored, compression)
+		defer zr.Close()
+		stored = zr
+		obj.Encoding = compression
+	}
+
+	tmp, _, digest, err := writeTemp(tmpDir, stored)
+	if err != nil {
+		return "", err
+	}
+
+	obj.ContentLength = strconv.FormatInt(counter.n, 10)
+	obj.ETag = hex.EncodeToString(md5Hash.Sum(nil))
+	obj.Digest = digest
+	switch {
+	case cold:
+		obj.Storage = KindCold
+	case s.dedup:
+		obj.Storage = KindBlob
+	case s.erasure != nil && s.erasure.write:
+		obj.Storage = KindErasure
+	default:
+		obj.Storage = KindFile
+	}
+	return tmp, nil
+}
+
+// Commit moves data staged for obj into place, replacing the data of a
+// file stored under the same key
+func (s *Store) Commit(bucketName string, obj core.Object, tmp string) error {
+	defer os.Remove(tmp)
+
+	switch obj.Storage {
+	case KindBlob:
+		return s.addBlob(tmp, obj.Digest)
+	case KindErasure:
+		return s.erasure.put(bucketName, obj, tmp)
+	case KindCold:
+		return os.Rename(tmp, s.coldPath(bucketName, obj))
+	}
+	return os.Rename(tmp, util.ObjectPath(s.BucketDir(bucketName), bucketName, obj.Name))
+}
+
+// Discard removes staged data that will not be committed
+func (s *Store) Discard(tmp string) error {
+	return os.Remove(tmp)
+}
+
+// Open returns the content of obj, decompressed if it was stored compressed
+func (s *Store) Open(bucketName string, obj core.Object) (io.ReadCloser, error) {
+	r, err := s.openStored(bucketName, obj)
+	if err != nil {
+		return nil, err
+	}
+	return decompressReader(r, obj.Encoding)
+}
+
+// openStored returns the bytes of obj as they are stored
+func (s *Store) openStored(bucketName string, obj core.Object) (io.ReadCloser, error) {
+	switch obj.Storage {
+	case "", KindFile:
+		return os.Open(util.ObjectPath(s.BucketDir(bucketName), bucketName, obj.Name))
+	case KindBlob:
+		return os.Open(s.blobPath(obj.Digest))
+	case KindErasure:
+		if s.erasure == nil {
+			return nil, ErrUnknownStorage
+		}
+		r, err := s.erasure.open(bucketName, obj)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	case KindCold:
+		return s.openCold(bucketName, obj)
+	}
+	return nil, ErrUnknownStorage
+}
+
+// Reachable returns an error wrapping ErrUnreachable when the directory
+// that should hold the data of obj is missing or offline, as is a data, cold
+// or erasure directory that is not mounted. Data missing from a directory
+// that is not reachable may still exist.
+func (s *Store) Reachable(bucketName string, obj core.Object) error {
+	var dir string
+	switch obj.Storage {
+	case "", KindFile:
+		// The data directory of a bucket is only removed with the bucket
+		if bucketDir := s.BucketDir(bucketName); bucketDir != s.placement.dir {
+			dir = util.ObjectDataDir(bucketDir, bucketName)
+		}
+	case KindCold:
+		if s.cold == "" {
+			return ErrUnknownStorage
+		}
+		dir = util.ObjectDataDir(s.cold, bucketName)
+	case KindErasure:
+		if s.erasure == nil {
+			return ErrUnknownStorage
+		}
+		online := 0
+		for i := range s.erasure.Dirs {
+			if s.erasure.online(i) {
+				online++
+			}
+		}
+		if online < s.erasure.DataShards {
+			return fmt.Errorf("%w: %d of %d erasure disks online", ErrUnreachable, online, len(s.erasure.Dirs))
+		}
+	}
+
+	if dir == "" {
+		return nil
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("%w: %v", ErrUnreachable, err)
+	}
+	return nil
+}
+
+// Delete removes the stored data of obj
+func (s *Store) Delete(bucketName string, obj core.Object) error {
+	switch obj.Storage {
+	case "", KindFile:
+		bucketDir := s.BucketDir(bucketName)
+		path := util.ObjectPath(bucketDir, bucketName, obj.Name)
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		util.RemoveEmptyDirs(filepath.Dir(path), util.ObjectDataDir(bucketDir, bucketName))
+		return nil
+	case KindBlob:
+		return s.releaseBlob(obj.Digest)
+	case KindErasure:
+		// Shards left on a failing disk are removed by the healer
+		if s.erasure != nil {
+			for i, path := range s.erasure.shardPaths(bucketName, obj) {
+				if os.Remove(path) == nil {
+					util.RemoveEmptyDirs(filepath.Dir(path), util.ObjectDataDir(s.erasure.Dirs[i], bucketName))
+				}
+			}
+		}
+		return nil
+	case KindCold:
+		return s.deleteCold(bucketName, obj)
+	}
+	return ErrUnknownStorage
+}
+
+// RemoveBucket deletes what is left of an empty bucket on the data
+// directory it is placed on and the erasure coding disks
+func (s *Store) RemoveBucket(bucketName string) error {
+	var errs []error
+	if err := s.placement.remove(bucketName); err != nil {
+		errs = append(errs, err)
+	}
+	if s.erasure != nil {
+		for _, disk := range s.erasure.Dirs {
+			errs = append(errs, os.RemoveAll(filepath.Join(disk, bucketName)))
+		}
+	}
+	if s.cold != "" {
+		errs = append(errs, os.RemoveAll(filepath.Join(s.cold, bucketName)))
+	}
+	return errors.Join(errs...)
+}
+
+// Replaced releases the data of old after newObj was stored under the same key
+func (s *Store) Replaced(bucketName string, old, newObj core.Object) error {
+	// A file is replaced in place by the rename in Commit
+	if (old.Storage == "" || old.Storage == KindFile) && newObj.Storage == KindFile {
+		return nil
+	}
+	// Shards of the same content are stored under the same paths
+	if old.Storage == KindErasure && newObj.Storage == KindErasure && old.Digest == newObj.Digest {
+		return nil
+	}
+	// So is the cold file, the new object is not restored yet
+	if old.Storage == KindCold && newObj.Storage == KindCold && old.Digest == newObj.Digest {
+		return s.Unrestore(bucketName, old)
+	}
+	return s.Delete(bucketName, old)
+}
+
+// digestPath returns the path of the data of obj in dir, named after its key
+// and digest so that a new content never replaces the data of the object
+// being read
+func digestPath(dir, bucketName string, obj core.Object) string {
+	digest := obj.Digest
+	if len(digest) > 16 {
+		digest = digest[:16]
+	}
+	return util.ObjectPath(dir, bucketName, obj.Name) + "." + digest
+}
+
+// sweepDigestFiles deletes the files named like digestPath, and the
+// temporary files starting with tmpPrefix, that are under the data directory
+// of a bucket of dir, are not in keep and were not touched after cutoff.
+// Anything else in dir is left alone, it may be another directory's file.
+func sweepDigestFiles(dir, tmpPrefix string, keep map[string]bool, cutoff time.Time) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dataDir := util.ObjectDataDir(dir, entry.Name())
+		err := filepath.WalkDir(dataDir, func(path string, d fs.DirEntry, err error) error {
+			if errors.Is(err, os.ErrNotExist) && path == dataDir {
+				return nil
+			}
+			if err != nil || d.IsDir() {
+				return err
+			}
+			name := d.Name()
+			if !isDigestName(name) && !strings.HasPrefix(name, tmpPrefix) {
+				return nil
+			}
+			if keep[path] || recent(path, cutoff) {
+				return nil
+			}
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			removed++
+			util.RemoveEmptyDirs(filepath.Dir(path), dataDir)
+			return nil
+		})
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// isDigestName reports whether name is the last element of a digestPath: an
+// encoded key followed by a dot and at most 16 hex digits
+func isDigestName(name string) bool {
+	i := strings.LastIndexByte(name, '.')
+	if i <= 0 || len(name)-i-1 > 16 {
+		return false
+	}
+	for _, c := range name[i+1:] {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.n += int64(len(p))
+	return len(p), nil
+}
+
+// writeTemp streams src into a new temporary file in dir and returns its
+// path, size and hex encoded SHA-256 digest. The file is removed on failure.
+func writeTemp(dir string, src io.Reader) (path string, size int64, digest string, err error) {
+	if err := os.MkdirAll(dir, core.DirPerm); err != nil {
+		return "", 0, "", err
+	}
+
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return "", 0, "", err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+	defer tmp.Close()
+
+	if err := tmp.Chmod(core.FilePerm); err != nil {
+		return "", 0, "", err
+	}
+
+	hash := sha256.New()
+	size, err = io.Copy(io.MultiWriter(tmp, hash), src)
+	if err != nil {
+		return "", 0, "", err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return "", 0, "", err
+	}
+
+	return tmp.Name(), size, hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,66 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+)
+
+// Catalog records where the object files of the buckets are placed when
+// there are several data directories, and where the COLD objects are.
+// Buckets missing from it keep their files in the data directory holding
+// the metadata.
+type Catalog struct {
+	Buckets  map[string]string `json:"buckets"`        // directory of each bucket placed elsewhere
+	Draining []string          `json:"draining"`       // directories emptied before their removal
+	Cold     string            `json:"cold,omitempty"` // directory of the COLD storage class
+}
+
+// ReadCatalog returns the placement catalog of the data directory, empty
+// when none was written
+func ReadCatalog(dir string) (Catalog, error) {
+	catalog := Catalog{Buckets: make(map[string]string)}
+	data, err := os.ReadFile(filepath.Join(dir, core.CatalogFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return catalog, nil
+	}
+	if err != nil {
+		return catalog, err
+	}
+
+	if err := json.Unmarshal(data, &catalog); err != nil {
+		return catalog, fmt.Errorf("%s: %w", core.CatalogFile, err)
+	}
+	if catalog.Buckets == nil {
+		catalog.Buckets = make(map[string]string)
+	}
+	return catalog, nil
+}
+
+// WriteCatalog replaces the placement catalog of the data directory
+func WriteCatalog(dir string, catalog Catalog) error {
+	data, err := json.MarshalIndent(catalog, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, core.CatalogFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), core.FilePerm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// BucketDir returns the directory holding the object files of a bucket,
+// dir unless the catalog places the bucket elsewhere
+func (c Catalog) BucketDir(dir, bucketName string) string {
+	if placed, ok := c.Buckets[bucketName]; ok {
+		return placed
+	}
+	return dir
+}
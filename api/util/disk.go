@@ -0,0 +1,5 @@
+package util
+
+import "errors"
+
+var ErrDiskUsageUnsupported = errors.New("disk usage is not supported on this platform")
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package util
+
+// DiskUsage returns the free and total bytes of the filesystem holding path.
+func DiskUsage(path string) (free, total uint64, err error) {
+	return 0, 0, ErrDiskUsageUnsupported
+}
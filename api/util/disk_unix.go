@@ -0,0 +1,15 @@
+//go:build linux || darwin
+
+package util
+
+import "syscall"
+
+// DiskUsage returns the free and total bytes of the filesystem holding path.
+// Free space is what is available to unprivileged users.
+func DiskUsage(path string) (free, total uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), uint64(st.Blocks) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,79 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+)
+
+var (
+	ErrFormatTooNew = errors.New("data directory was written by a newer version of triple-s")
+	ErrFormatTooOld = errors.New("data directory needs migrating, run triple-s migrate")
+)
+
+// Format is the content of the format marker of a data directory
+type Format struct {
+	Version int    `json:"version"`
+	Updated string `json:"updated"`
+}
+
+// ReadFormatVersion returns the format version of the data directory.
+// Directories written before the marker existed are version 1, and 0 means
+// the directory holds no data yet.
+func ReadFormatVersion(dir string) (int, error) {
+	data, err := os.ReadFile(filepath.Join(dir, core.FormatFile))
+	if errors.Is(err, os.ErrNotExist) {
+		if _, err := os.Stat(filepath.Join(dir, core.BucketsFile)); errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var format Format
+	if err := json.Unmarshal(data, &format); err != nil {
+		return 0, fmt.Errorf("%s: %w", core.FormatFile, err)
+	}
+	return format.Version, nil
+}
+
+// WriteFormatVersion records the format version of the data directory
+func WriteFormatVersion(dir string, version int) error {
+	data, err := json.Marshal(Format{Version: version, Updated: time.Now().UTC().Format(time.RFC3339)})
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, core.FormatFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), core.FilePerm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// checkFormat stamps a new data directory with the current format version
+// and refuses directories in any other version
+func checkFormat(dir string) error {
+	version, err := ReadFormatVersion(dir)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case version == 0:
+		return WriteFormatVersion(dir, core.FormatVersion)
+	case version > core.FormatVersion:
+		return fmt.Errorf("%w: format %d, supported up to %d", ErrFormatTooNew, version, core.FormatVersion)
+	case version < core.FormatVersion:
+		return fmt.Errorf("%w: format %d, current is %d", ErrFormatTooOld, version, core.FormatVersion)
+	}
+	return nil
+}
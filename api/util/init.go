@@ -1,7 +1,6 @@
 package util
 
 import (
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
@@ -12,21 +11,18 @@ import (
 func createFileWithDefaultContent(filePath string, header []string) error {
 	f, err := os.OpenFile(filePath, os.O_CREATE|os.O_RDWR, core.FilePerm)
 	if err != nil {
-		log.Println(err)
 		return err
 	}
 	defer f.Close()
 
 	fileStat, err := f.Stat()
 	if err != nil {
-		log.Println(err)
 		return err
 	}
 
 	if fileStat.Size() == 0 {
 		_, err := f.WriteString(strings.Join(header, ",") + "\n")
 		if err != nil {
-			log.Println(err)
 			return err
 		}
 	}
@@ -34,20 +30,42 @@ func createFileWithDefaultContent(filePath string, header []string) error {
 	return nil
 }
 
-func InitDir() error {
-	err := os.MkdirAll(core.Dir, core.DirPerm)
+// InitDir prepares the data directory for serving. It must be in the
+// current format, older directories are migrated beforehand.
+func InitDir(dir string) error {
+	err := os.MkdirAll(dir, core.DirPerm)
 	if err != nil {
 		return err
 	}
 
-	return createFileWithDefaultContent(filepath.Join(core.Dir, core.BucketsFile), core.BucketsCSVHeader)
+	err = checkFormat(dir)
+	if err != nil {
+		return err
+	}
+
+	err = createFileWithDefaultContent(filepath.Join(dir, core.BucketsFile), core.BucketsCSVHeader)
+	if err != nil {
+		return err
+	}
+
+	return recoverJournal(dir)
 }
 
-func InitObjectFile(bucketName string) error {
-	err := os.MkdirAll(filepath.Join(core.Dir, bucketName), core.DirPerm)
+func InitObjectFile(dir, bucketName string) error {
+	err := os.MkdirAll(ObjectDataDir(dir, bucketName), core.DirPerm)
 	if err != nil {
 		return err
 	}
 
-	return createFileWithDefaultContent(filepath.Join(core.Dir, bucketName, core.ObjectsFile), core.ObjectsCSVHeader)
+	return createFileWithDefaultContent(filepath.Join(dir, bucketName, core.ObjectsFile), core.ObjectsCSVHeader)
+}
+
+// RemoveEmptyDirs removes path and its parents while they are empty, stopping at stop
+func RemoveEmptyDirs(path, stop string) {
+	for path != stop && strings.HasPrefix(path, stop) {
+		if err := os.Remove(path); err != nil {
+			return
+		}
+		path = filepath.Dir(path)
+	}
 }
@@ -0,0 +1,310 @@
+package util
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/meta"
+)
+
+// Operations recorded in the journal
+const (
+	JournalCreateBucket = "create_bucket"
+	JournalDeleteBucket = "delete_bucket"
+	JournalPutObject    = "put_object"
+	JournalDeleteObject = "delete_object"
+)
+
+// The journal is cleared once no operation is running and it is larger than this
+const journalTruncateSize = 1 << 20
+
+// JournalEntry describes an operation that changes both the metadata and
+// the directory tree. Entries are written before the operation starts, and
+// a second entry with Done set is written when it has finished.
+type JournalEntry struct {
+	ID     uint64       `json:"id"`
+	Done   bool         `json:"done,omitempty"`
+	Op     string       `json:"op,omitempty"`
+	Bucket string       `json:"bucket,omitempty"`
+	Key    string       `json:"key,omitempty"`
+	Object *core.Object `json:"object,omitempty"` // the new record of a put
+	Temp   string       `json:"temp,omitempty"`   // staged object data, relative to the data directory
+}
+
+// Journal is the write-ahead log of the operations in progress. It is safe
+// for concurrent use.
+type Journal struct {
+	dir  string
+	sync bool
+
+	mu       sync.Mutex
+	f        *os.File
+	size     int64
+	nextID   uint64
+	inFlight map[uint64]bool
+}
+
+// OpenJournal opens the journal of dir for appending. Operations left
+// unfinished by a crash must have been recovered by InitDir before. IDs
+// start from the clock rather than 1, so that they never match the entries
+// of an earlier run that a crash kept from being cleared.
+func OpenJournal(dir string, sync bool) (*Journal, error) {
+	path := filepath.Join(dir, core.JournalFile)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, core.FilePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &Journal{
+		dir:      dir,
+		sync:     sync,
+		f:        f,
+		size:     info.Size(),
+		nextID:   uint64(time.Now().UnixNano()),
+		inFlight: make(map[uint64]bool),
+	}, nil
+}
+
+// Begin records an operation before any of its steps is applied and returns
+// its ID, to be passed to End
+func (j *Journal) Begin(entry JournalEntry) (uint64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entry.ID = j.nextID
+	entry.Done = false
+	if err := j.write(entry, j.sync); err != nil {
+		return 0, err
+	}
+	j.nextID++
+	j.inFlight[entry.ID] = true
+	return entry.ID, nil
+}
+
+// End records that the operation with the given ID has finished. The entry
+// is synced like the one of Begin: an operation whose end was lost is
+// recovered on the next start, and completing a put again would bring back
+// the record of an object deleted since.
+func (j *Journal) End(id uint64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.write(JournalEntry{ID: id, Done: true}, j.sync); err != nil {
+		slog.Warn("failed to write journal entry", "id", id, "error", err)
+	}
+	delete(j.inFlight, id)
+
+	if len(j.inFlight) == 0 && j.size > journalTruncateSize {
+		if err := j.f.Truncate(0); err != nil {
+			slog.Warn("failed to truncate journal", "error", err)
+			return
+		}
+		j.size = 0
+	}
+}
+
+func (j *Journal) write(entry JournalEntry, sync bool) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	n, err := j.f.Write(line)
+	j.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if sync {
+		return j.f.Sync()
+	}
+	return nil
+}
+
+// Close closes the journal file
+func (j *Journal) Close() error {
+	return j.f.Close()
+}
+
+// recoverJournal finishes or undoes the operations that were in progress
+// when the server stopped. An operation whose metadata change was recorded
+// is completed, any other one is rolled back.
+func recoverJournal(dir string) error {
+	path := filepath.Join(dir, core.JournalFile)
+	pending, err := readJournal(path)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return truncateJournal(path)
+	}
+
+	store, err := meta.Open(dir, core.MetadataConfig{Sync: true})
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range pending {
+		logger := slog.With("op", entry.Op, "bucket", entry.Bucket, "key", entry.Key)
+
+		action, err := recoverEntry(dir, store, entry)
+		if err != nil {
+			store.Close()
+			return err
+		}
+		logger.Info("recovered interrupted operation", "action", action)
+	}
+
+	if err := store.Close(); err != nil {
+		return err
+	}
+	return truncateJournal(path)
+}
+
+// truncateJournal clears the journal once its operations were recovered,
+// syncing it so that they are not recovered again after another crash
+func truncateJournal(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// PendingOperations returns the operations of the journal of dir that were
+// not finished, without recovering them
+func PendingOperations(dir string) ([]JournalEntry, error) {
+	return readJournal(filepath.Join(dir, core.JournalFile))
+}
+
+// readJournal returns the operations of the journal that were not marked
+// done, in the order they were started
+func readJournal(path string) ([]JournalEntry, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var order []uint64
+	started := make(map[uint64]JournalEntry)
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			break // a last line without newline was cut short by the crash
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var entry JournalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			slog.Warn("skipping malformed journal entry", "error", err)
+			continue
+		}
+		if entry.Done {
+			delete(started, entry.ID)
+			continue
+		}
+		started[entry.ID] = entry
+		order = append(order, entry.ID)
+	}
+
+	var pending []JournalEntry
+	for _, id := range order {
+		if entry, ok := started[id]; ok {
+			pending = append(pending, entry)
+		}
+	}
+	return pending, nil
+}
+
+// recoverEntry completes or rolls back one operation and reports which
+func recoverEntry(dir string, store *meta.Store, entry JournalEntry) (string, error) {
+	switch entry.Op {
+	case JournalCreateBucket:
+		if _, ok := store.Bucket(entry.Bucket); ok {
+			return "completed", InitObjectFile(dir, entry.Bucket)
+		}
+		// Only what the operation created is removed, the directory is
+		// left in place if anything else is in it
+		os.Remove(filepath.Join(dir, entry.Bucket, core.ObjectsFile))
+		os.Remove(ObjectDataDir(dir, entry.Bucket))
+		os.Remove(filepath.Join(dir, entry.Bucket))
+		return "rolled back", nil
+
+	case JournalDeleteBucket:
+		if _, ok := store.Bucket(entry.Bucket); ok {
+			return "rolled back", nil
+		}
+		return "completed", os.RemoveAll(filepath.Join(dir, entry.Bucket))
+
+	case JournalPutObject:
+		if entry.Object == nil {
+			return "skipped", nil
+		}
+		// The staged data is moved into place right before the metadata is
+		// recorded. Once it has been moved, the old data may be gone, so the
+		// upload can only be completed.
+		if entry.Temp != "" {
+			temp := entry.Temp
+			if !filepath.IsAbs(temp) {
+				temp = filepath.Join(dir, temp)
+			}
+			if _, err := os.Stat(temp); err == nil {
+				return "rolled back", os.Remove(temp)
+			}
+		}
+		_, _, err := store.PutObject(entry.Bucket, *entry.Object)
+		if errors.Is(err, meta.ErrNoSuchBucket) {
+			return "skipped", nil
+		}
+		return "completed", err
+
+	case JournalDeleteObject:
+		if _, err := store.Object(entry.Bucket, entry.Key); err == nil {
+			return "rolled back", nil
+		}
+		// Shared blobs are released by the garbage collector, which counts
+		// the references from the metadata
+		catalog, err := ReadCatalog(dir)
+		if err != nil {
+			return "", err
+		}
+		bucketDir := catalog.BucketDir(dir, entry.Bucket)
+		path := ObjectPath(bucketDir, entry.Bucket, entry.Key)
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		RemoveEmptyDirs(filepath.Dir(path), ObjectDataDir(bucketDir, entry.Bucket))
+		return "completed", nil
+	}
+
+	return "skipped", nil
+}
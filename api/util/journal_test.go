@@ -0,0 +1,300 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/meta"
+)
+
+// journalDir returns a data directory holding the bucket photos with the
+// object kept.txt, its data file included
+func journalDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := InitDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	store, err := meta.Open(dir, core.MetadataConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if err := store.PutBucket(core.Bucket{Name: "photos", Status: core.BucketActive}); err != nil {
+		t.Fatal(err)
+	}
+	if err := InitObjectFile(dir, "photos"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.PutObject("photos", core.Object{Name: "kept.txt", ContentLength: "4"}); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, ObjectPath(dir, "photos", "kept.txt"))
+	return dir
+}
+
+func writeFile(t *testing.T, path string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), core.DirPerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("data"), core.FilePerm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// writeJournal leaves entries in the journal of dir as a crash would
+func writeJournal(t *testing.T, dir string, entries ...JournalEntry) {
+	t.Helper()
+	var data []byte
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(append(data, line...), '\n')
+	}
+	if err := os.WriteFile(filepath.Join(dir, core.JournalFile), data, core.FilePerm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecoverJournal(t *testing.T) {
+	newObject := &core.Object{Name: "new.txt", ContentLength: "4"}
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, dir string, store *meta.Store) JournalEntry
+		check func(t *testing.T, dir string, store *meta.Store)
+	}{
+		{
+			name: "create bucket recorded",
+			setup: func(t *testing.T, dir string, store *meta.Store) JournalEntry {
+				if err := store.PutBucket(core.Bucket{Name: "videos", Status: core.BucketActive}); err != nil {
+					t.Fatal(err)
+				}
+				return JournalEntry{Op: JournalCreateBucket, Bucket: "videos"}
+			},
+			check: func(t *testing.T, dir string, store *meta.Store) {
+				if !exists(filepath.Join(dir, "videos", core.ObjectsFile)) || !exists(ObjectDataDir(dir, "videos")) {
+					t.Error("bucket directory not completed")
+				}
+			},
+		},
+		{
+			name: "create bucket not recorded",
+			setup: func(t *testing.T, dir string, store *meta.Store) JournalEntry {
+				if err := InitObjectFile(dir, "videos"); err != nil {
+					t.Fatal(err)
+				}
+				return JournalEntry{Op: JournalCreateBucket, Bucket: "videos"}
+			},
+			check: func(t *testing.T, dir string, store *meta.Store) {
+				if exists(filepath.Join(dir, "videos")) {
+					t.Error("bucket directory left")
+				}
+			},
+		},
+		{
+			name: "delete bucket not recorded",
+			setup: func(t *testing.T, dir string, store *meta.Store) JournalEntry {
+				return JournalEntry{Op: JournalDeleteBucket, Bucket: "photos"}
+			},
+			check: func(t *testing.T, dir string, store *meta.Store) {
+				if !exists(ObjectPath(dir, "photos", "kept.txt")) {
+					t.Error("bucket data removed")
+				}
+			},
+		},
+		{
+			name: "delete bucket recorded",
+			setup: func(t *testing.T, dir string, store *meta.Store) JournalEntry {
+				if err := InitObjectFile(dir, "videos"); err != nil {
+					t.Fatal(err)
+				}
+				return JournalEntry{Op: JournalDeleteBucket, Bucket: "videos"}
+			},
+			check: func(t *testing.T, dir string, store *meta.Store) {
+				if exists(filepath.Join(dir, "videos")) {
+					t.Error("bucket directory left")
+				}
+			},
+		},
+		{
+			name: "put object with the temp file",
+			setup: func(t *testing.T, dir string, store *meta.Store) JournalEntry {
+				writeFile(t, filepath.Join(dir, "photos", ".upload-1"))
+				return JournalEntry{Op: JournalPutObject, Bucket: "photos", Key: "new.txt", Object: newObject, Temp: filepath.Join("photos", ".upload-1")}
+			},
+			check: func(t *testing.T, dir string, store *meta.Store) {
+				if exists(filepath.Join(dir, "photos", ".upload-1")) {
+					t.Error("temp file left")
+				}
+				if _, err := store.Object("photos", "new.txt"); !errors.Is(err, meta.ErrNoSuchKey) {
+					t.Errorf("Object() = %v, want the put rolled back", err)
+				}
+			},
+		},
+		{
+			name: "put object with an absolute temp path",
+			setup: func(t *testing.T, dir string, store *meta.Store) JournalEntry {
+				temp := filepath.Join(t.TempDir(), ".upload-1")
+				writeFile(t, temp)
+				return JournalEntry{Op: JournalPutObject, Bucket: "photos", Key: "new.txt", Object: newObject, Temp: temp}
+			},
+			check: func(t *testing.T, dir string, store *meta.Store) {
+				if _, err := store.Object("photos", "new.txt"); !errors.Is(err, meta.ErrNoSuchKey) {
+					t.Errorf("Object() = %v, want the put rolled back", err)
+				}
+			},
+		},
+		{
+			name: "put object without the temp file",
+			setup: func(t *testing.T, dir string, store *meta.Store) JournalEntry {
+				writeFile(t, ObjectPath(dir, "photos", "new.txt"))
+				return JournalEntry{Op: JournalPutObject, Bucket: "photos", Key: "new.txt", Object: newObject, Temp: filepath.Join("photos", ".upload-1")}
+			},
+			check: func(t *testing.T, dir string, store *meta.Store) {
+				if _, err := store.Object("photos", "new.txt"); err != nil {
+					t.Errorf("Object() = %v, want the put completed", err)
+				}
+			},
+		},
+		{
+			name: "put object to a deleted bucket",
+			setup: func(t *testing.T, dir string, store *meta.Store) JournalEntry {
+				return JournalEntry{Op: JournalPutObject, Bucket: "videos", Key: "new.txt", Object: newObject}
+			},
+			check: func(t *testing.T, dir string, store *meta.Store) {
+				if _, ok := store.Bucket("videos"); ok {
+					t.Error("bucket created by the recovery")
+				}
+			},
+		},
+		{
+			name: "put object without a record",
+			setup: func(t *testing.T, dir string, store *meta.Store) JournalEntry {
+				return JournalEntry{Op: JournalPutObject, Bucket: "photos", Key: "new.txt"}
+			},
+			check: func(t *testing.T, dir string, store *meta.Store) {
+				if _, err := store.Object("photos", "new.txt"); !errors.Is(err, meta.ErrNoSuchKey) {
+					t.Errorf("Object() = %v, want nothing recorded", err)
+				}
+			},
+		},
+		{
+			name: "delete object not recorded",
+			setup: func(t *testing.T, dir string, store *meta.Store) JournalEntry {
+				return JournalEntry{Op: JournalDeleteObject, Bucket: "photos", Key: "kept.txt"}
+			},
+			check: func(t *testing.T, dir string, store *meta.Store) {
+				if !exists(ObjectPath(dir, "photos", "kept.txt")) {
+					t.Error("object data removed")
+				}
+			},
+		},
+		{
+			name: "delete object recorded",
+			setup: func(t *testing.T, dir string, store *meta.Store) JournalEntry {
+				if _, err := store.DeleteObject("photos", "kept.txt"); err != nil {
+					t.Fatal(err)
+				}
+				return JournalEntry{Op: JournalDeleteObject, Bucket: "photos", Key: "kept.txt"}
+			},
+			check: func(t *testing.T, dir string, store *meta.Store) {
+				if exists(ObjectPath(dir, "photos", "kept.txt")) {
+					t.Error("object data left")
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := journalDir(t)
+			store, err := meta.Open(dir, core.MetadataConfig{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			entry := tt.setup(t, dir, store)
+			if err := store.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			entry.ID = 7
+			writeJournal(t, dir, entry)
+			if err := InitDir(dir); err != nil {
+				t.Fatal(err)
+			}
+
+			store, err = meta.Load(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, dir, store)
+			if pending, err := PendingOperations(dir); err != nil || len(pending) != 0 {
+				t.Errorf("PendingOperations() = %v, %v after recovery", pending, err)
+			}
+		})
+	}
+}
+
+func TestRecoverJournalFinished(t *testing.T) {
+	dir := journalDir(t)
+	writeJournal(t, dir,
+		JournalEntry{ID: 1, Op: JournalDeleteObject, Bucket: "photos", Key: "kept.txt"},
+		JournalEntry{ID: 1, Done: true},
+		JournalEntry{ID: 2, Op: JournalDeleteBucket, Bucket: "photos"},
+	)
+	// A last entry cut short by the crash was never acted upon
+	f, err := os.OpenFile(filepath.Join(dir, core.JournalFile), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"id":2,"done":tr`)
+	f.Close()
+
+	pending, err := PendingOperations(dir)
+	if err != nil || len(pending) != 1 || pending[0].ID != 2 {
+		t.Fatalf("PendingOperations() = %v, %v, want operation 2", pending, err)
+	}
+	if err := InitDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(ObjectPath(dir, "photos", "kept.txt")) {
+		t.Error("finished operation recovered")
+	}
+}
+
+func TestJournalIDs(t *testing.T) {
+	// An entry of an earlier run that a crash kept from being cleared
+	dir := journalDir(t)
+	writeJournal(t, dir, JournalEntry{ID: 1, Op: JournalDeleteObject, Bucket: "photos", Key: "kept.txt"})
+
+	j, err := OpenJournal(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := j.Begin(JournalEntry{Op: JournalDeleteObject, Bucket: "photos", Key: "other.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.End(id)
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The end of the new operation does not finish the earlier one
+	pending, err := PendingOperations(dir)
+	if err != nil || len(pending) != 1 || pending[0].Key != "kept.txt" {
+		t.Errorf("PendingOperations() = %v, %v, want the earlier operation", pending, err)
+	}
+}
@@ -0,0 +1,89 @@
+package util
+
+import (
+	"encoding/base64"
+	"errors"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+)
+
+// Maximum object key length in bytes, as in S3
+const MaxObjectKeyLength = 1024
+
+// Object files are named after the base64url encoding of their key, split
+// into components of at most this many characters to stay under NAME_MAX.
+// Every component but the last is a directory suffixed with dirSuffix,
+// which is outside the base64url alphabet, so a file and a directory never
+// share a name.
+const (
+	nameChunkSize = 200
+	dirSuffix     = "~"
+)
+
+var (
+	ErrEmptyObjectKey       = errors.New("object key must not be empty")
+	ErrObjectKeyTooLong     = errors.New("object key must be at most 1024 bytes long")
+	ErrObjectKeyInvalidUTF8 = errors.New("object key must be valid UTF-8")
+	ErrInvalidObjectPath    = errors.New("path is not an encoded object key")
+)
+
+func ValidateObjectKey(key string) error {
+	// Step 1: Check length
+	if key == "" {
+		return ErrEmptyObjectKey
+	}
+	if len(key) > MaxObjectKeyLength {
+		return ErrObjectKeyTooLong
+	}
+
+	// Step 2: Check encoding
+	if !utf8.ValidString(key) {
+		return ErrObjectKeyInvalidUTF8
+	}
+
+	return nil
+}
+
+// ObjectDataDir returns the directory holding the object files of a bucket.
+// Keeping them apart from the metadata means no key can overwrite objects.csv.
+func ObjectDataDir(dir, bucketName string) string {
+	return filepath.Join(dir, bucketName, core.DataDir)
+}
+
+// ObjectPath returns the path of the file storing the object data. The key is
+// encoded, so separators, "..", and reserved names in it have no meaning on disk.
+func ObjectPath(dir, bucketName, objectKey string) string {
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(objectKey))
+
+	var parts []string
+	for len(encoded) > nameChunkSize {
+		parts = append(parts, encoded[:nameChunkSize]+dirSuffix)
+		encoded = encoded[nameChunkSize:]
+	}
+	parts = append(parts, encoded)
+
+	return filepath.Join(ObjectDataDir(dir, bucketName), filepath.Join(parts...))
+}
+
+// ObjectKeyFromPath reverses ObjectPath for a path relative to the data directory of the bucket
+func ObjectKeyFromPath(rel string) (string, error) {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+
+	var encoded strings.Builder
+	for i, part := range parts {
+		last := i == len(parts)-1
+		if last == strings.HasSuffix(part, dirSuffix) {
+			return "", ErrInvalidObjectPath
+		}
+		encoded.WriteString(strings.TrimSuffix(part, dirSuffix))
+	}
+
+	key, err := base64.RawURLEncoding.DecodeString(encoded.String())
+	if err != nil {
+		return "", ErrInvalidObjectPath
+	}
+	return string(key), nil
+}
@@ -0,0 +1,93 @@
+package util
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateObjectKey(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		want error
+	}{
+		{"plain", "photo.jpg", nil},
+		{"nested", "a/b/c.txt", nil},
+		{"dot dot", "..", nil},
+		{"traversal", "../../etc/passwd", nil},
+		{"reserved name", "objects.csv", nil},
+		{"encoded separator", "a%2F..%2Fobjects.csv", nil},
+		{"backslash", `..\..\buckets.csv`, nil},
+		{"max length", strings.Repeat("k", MaxObjectKeyLength), nil},
+		{"empty", "", ErrEmptyObjectKey},
+		{"too long", strings.Repeat("k", MaxObjectKeyLength+1), ErrObjectKeyTooLong},
+		{"too long multibyte", strings.Repeat("é", MaxObjectKeyLength/2+1), ErrObjectKeyTooLong},
+		{"invalid utf8", "bad\xffkey", ErrObjectKeyInvalidUTF8},
+		{"truncated rune", "\xe2\x82", ErrObjectKeyInvalidUTF8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateObjectKey(tt.key); !errors.Is(err, tt.want) {
+				t.Errorf("ValidateObjectKey(%q) = %v, want %v", tt.key, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestObjectPath(t *testing.T) {
+	dir := filepath.Join("srv", "data")
+	dataDir := ObjectDataDir(dir, "photos")
+
+	tests := []struct {
+		name string
+		key  string
+	}{
+		{"plain", "photo.jpg"},
+		{"nested", "a/b/c.txt"},
+		{"dot", "."},
+		{"dot dot", ".."},
+		{"traversal", "../../buckets.csv"},
+		{"reserved name", "objects.csv"},
+		{"encoded separator", "a%2F..%2Fobjects.csv"},
+		{"backslash", `..\..\buckets.csv`},
+		{"leading slash", "/etc/passwd"},
+		{"nul", "a\x00b"},
+		{"max length", strings.Repeat("k", MaxObjectKeyLength)},
+		{"multibyte", strings.Repeat("é", MaxObjectKeyLength/2)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := ObjectPath(dir, "photos", tt.key)
+
+			rel, err := filepath.Rel(dataDir, path)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				t.Fatalf("ObjectPath(%q) = %q, outside %q", tt.key, path, dataDir)
+			}
+			for _, part := range strings.Split(filepath.ToSlash(rel), "/") {
+				if part == "." || part == ".." || part == "objects.csv" || len(part) > 255 {
+					t.Errorf("ObjectPath(%q) has component %q", tt.key, part)
+				}
+			}
+
+			key, err := ObjectKeyFromPath(rel)
+			if err != nil || key != tt.key {
+				t.Errorf("ObjectKeyFromPath(%q) = %q, %v, want %q", rel, key, err, tt.key)
+			}
+		})
+	}
+}
+
+func TestObjectPathDistinct(t *testing.T) {
+	// Keys differing only in their encoding must not share a file
+	keys := []string{"a/b", "a%2Fb", `a\b`, "a//b", "a/./b", "A/b"}
+	seen := make(map[string]string)
+	for _, key := range keys {
+		path := ObjectPath("dir", "photos", key)
+		if other, ok := seen[path]; ok {
+			t.Errorf("keys %q and %q share the path %q", key, other, path)
+		}
+		seen[path] = key
+	}
+}
@@ -19,8 +19,25 @@ var (
 	ErrAdjacentPeriods   = errors.New("bucket name must not contain two adjacent periods")
 	ErrAdjacentDashes    = errors.New("bucket name must not contain two adjacent dashes")
 	ErrInvalidCharacters = errors.New("bucket name must only contain lowercase letters, numbers, hyphens, and periods, and must start and end with a letter or number")
+	ErrReservedName      = errors.New("bucket name is reserved by the server")
 )
 
+// Names routed to server endpoints instead of buckets
+var reservedNames = map[string]bool{
+	"metrics": true,
+	"healthz": true,
+	"readyz":  true,
+	"version": true,
+	"admin":   true,
+}
+
+// ReservedBucketName reports whether bn is routed to a server endpoint.
+// Buckets created before a name was reserved keep it, they are only
+// reachable while the endpoints are served on the admin port.
+func ReservedBucketName(bn string) bool {
+	return reservedNames[bn]
+}
+
 func ValidateBucketName(bn string) error {
 	// Step 1: Check length
 	if len(bn) < 3 || len(bn) > 63 {
@@ -47,5 +64,10 @@ func ValidateBucketName(bn string) error {
 		return ErrInvalidCharacters
 	}
 
+	// Step 6: Check that it does not shadow a server endpoint
+	if ReservedBucketName(bn) {
+		return ErrReservedName
+	}
+
 	return nil
 }
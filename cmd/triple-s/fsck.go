@@ -0,0 +1,60 @@
+package triple_s
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/fsck"
+)
+
+// runFsck checks a data directory and returns the exit status: 0 when it is
+// consistent or every issue was repaired, 1 when issues remain, 2 on errors
+func runFsck(args []string) int {
+	fs := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	dir := fs.String("dir", core.DefaultConfig().Dir, "path to the data directory")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	repair := fs.Bool("repair", false, "fix the issues found")
+	fs.Usage = func() {
+		fmt.Println(`Check that the metadata of a data directory matches its files.
+Usage:
+	triple-s fsck [--dir <S>] [--json] [--repair]
+Options:
+	--dir S    Path to the data directory (default ./data)
+	--json     Print the report as JSON
+	--repair   Fix the issues found; the server must not be running on the directory`)
+	}
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	report, err := fsck.Check(*dir, *repair)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fsck:", err)
+		return 2
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = report.WriteText(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fsck:", err)
+		return 2
+	}
+
+	if report.Unresolved() > 0 {
+		return 1
+	}
+	return 0
+}
@@ -1,40 +1,118 @@
 package triple_s
 
 import (
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
 
 	"github.com/ab-dauletkhan/triple-s/api"
 	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/migrate"
 	"github.com/ab-dauletkhan/triple-s/api/util"
 )
 
 func Run() {
-	// Parses the port, dir and help flags.
+	// Subcommands work on a data directory without starting the server
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "fsck":
+			os.Exit(runFsck(os.Args[2:]))
+		case "migrate":
+			os.Exit(runMigrate(os.Args[2:]))
+		case "replication":
+			os.Exit(runReplication(os.Args[2:]))
+		}
+	}
+
+	// Builds the configuration from the defaults, config file, environment and flags.
 	// If, help provided prints help message immediately and program stops there
-	err := core.ParseFlags()
+	cfg, printConfig, err := core.ParseFlags(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
-	if core.Help {
-		core.PrintUsage()
+	if printConfig {
+		fmt.Println(cfg)
 		return
 	}
 
-	err = util.InitDir()
+	slog.SetDefault(core.NewLogger(cfg.Log, os.Stderr))
+
+	if cfg.Metadata.AutoMigrate {
+		result, err := migrate.Run(cfg.Dir, migrate.Options{})
+		if err != nil {
+			fatal(err)
+		}
+		for _, step := range result.Steps {
+			slog.Info("migrated data directory", "format", step.Version, "migration", step.Description, "changes", len(step.Changes))
+		}
+		if result.Backup != "" {
+			slog.Info("metadata backed up before migrating", "path", result.Backup)
+		}
+		for _, name := range result.Reserved {
+			slog.Warn("bucket is named like a server endpoint, it is only reachable with admin_port set", "bucket", name)
+		}
+	}
+
+	err = util.InitDir(cfg.Dir)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
-	srv := &http.Server{
-		Addr:    fmt.Sprintf(":%d", core.Port),
-		Handler: api.Routes(),
+	var tlsConfig *tls.Config
+	if cfg.TLS.Enabled() {
+		tlsConfig, err = newTLSConfig(cfg.TLS)
+		if err != nil {
+			fatal(err)
+		}
+	} else {
+		// Only a single node gets here, the configuration of a cluster
+		// without TLS is rejected
+		slog.Warn("TLS is disabled, traffic is served in plaintext")
+	}
+
+	apiHandler, adminHandler, err := api.Routes(cfg)
+	if err != nil {
+		fatal(err)
 	}
+	if adminHandler != nil {
+		go func() {
+			slog.Info("starting the admin server", "port", cfg.AdminPort)
+			fatal(serve(newServer(cfg.AdminPort, adminHandler, tlsConfig)))
+		}()
+	}
+
+	slog.Info("starting the server", "port", cfg.Port, "dir", cfg.Dir, "tls", cfg.TLS.Enabled())
+	fatal(serve(newServer(cfg.Port, apiHandler, tlsConfig)))
+}
+
+func newServer(port int, handler http.Handler, tlsConfig *tls.Config) *http.Server {
+	return &http.Server{
+		Addr:      fmt.Sprintf(":%d", port),
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+		ErrorLog:  slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+}
+
+// serve listens with TLS when the server has a TLS configuration
+func serve(srv *http.Server) error {
+	if srv.TLSConfig == nil {
+		return srv.ListenAndServe()
+	}
+	// Certificates come from TLSConfig, so the file arguments stay empty
+	return srv.ListenAndServeTLS("", "")
+}
 
-	log.Printf("Starting the server on %d...\n", core.Port)
-	log.Printf("Data dir: %s", core.Dir)
-	err = srv.ListenAndServe()
-	log.Fatal(err)
+// fatal logs err and terminates the process
+func fatal(err error) {
+	slog.Error(err.Error())
+	os.Exit(1)
 }
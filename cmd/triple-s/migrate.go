@@ -0,0 +1,72 @@
+package triple_s
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/migrate"
+)
+
+// runMigrate upgrades a data directory to the current format and returns
+// the exit status: 0 on success, 2 on errors
+func runMigrate(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dir := fs.String("dir", core.DefaultConfig().Dir, "path to the data directory")
+	dryRun := fs.Bool("dry-run", false, "print the changes without making them")
+	noBackup := fs.Bool("no-backup", false, "do not back up the metadata files first")
+	fs.Usage = func() {
+		fmt.Println(`Upgrade a data directory to the current format.
+Usage:
+	triple-s migrate [--dir <S>] [--dry-run] [--no-backup]
+Options:
+	--dir S      Path to the data directory (default ./data)
+	--dry-run    Print the changes without making them
+	--no-backup  Do not copy the metadata files to .backups first
+The server must not be running on the directory.`)
+	}
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	result, err := migrate.Run(*dir, migrate.Options{DryRun: *dryRun, NoBackup: *noBackup})
+	if result != nil {
+		printMigration(*dir, result)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "migrate:", err)
+		return 2
+	}
+	return 0
+}
+
+func printMigration(dir string, result *migrate.Result) {
+	if result.Backup != "" {
+		fmt.Printf("metadata backed up to %s\n", result.Backup)
+	}
+	for _, step := range result.Steps {
+		fmt.Printf("format %d: %s\n", step.Version, step.Description)
+		for _, change := range step.Changes {
+			fmt.Printf("\t%s\n", change)
+		}
+	}
+
+	for _, name := range result.Reserved {
+		fmt.Printf("warning: bucket %s is named like a server endpoint, it is only reachable with admin_port set\n", name)
+	}
+
+	switch {
+	case len(result.Steps) == 0:
+		fmt.Printf("%s is at format %d, nothing to migrate\n", dir, result.From)
+	case result.DryRun:
+		fmt.Printf("%s would be migrated from format %d to %d (dry run)\n", dir, result.From, result.To)
+	default:
+		fmt.Printf("%s migrated from format %d to %d\n", dir, result.From, result.To)
+	}
+}
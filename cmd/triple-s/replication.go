@@ -0,0 +1,71 @@
+package triple_s
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+	"github.com/ab-dauletkhan/triple-s/api/replication"
+)
+
+// runReplication prints the replication backlog of a data directory and
+// returns the exit status: 0 when nothing failed, 1 when changes were given
+// up on, 2 on errors
+func runReplication(args []string) int {
+	fs := flag.NewFlagSet("replication", flag.ContinueOnError)
+	dir := fs.String("dir", core.DefaultConfig().Dir, "path to the data directory")
+	asJSON := fs.Bool("json", false, "print the backlog as JSON")
+	fs.Usage = func() {
+		fmt.Println(`Show the object changes of each bucket waiting to be replicated and given up on.
+Usage:
+	triple-s replication [--dir <S>] [--json]
+Options:
+	--dir S    Path to the data directory (default ./data)
+	--json     Print the backlog as JSON
+The server may be running on the directory. Failed changes are queued again
+with POST /admin/replication/retry.`)
+	}
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	status, err := replication.Inspect(*dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "replication:", err)
+		return 2
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(status)
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "BUCKET\tPENDING\tFAILED\tLAG")
+		for _, b := range status.Buckets {
+			lag := time.Duration(b.LagSeconds * float64(time.Second)).Round(time.Second)
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%s\n", b.Name, b.Pending, b.Failed, lag)
+		}
+		err = tw.Flush()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "replication:", err)
+		return 2
+	}
+
+	for _, b := range status.Buckets {
+		if b.Failed > 0 {
+			return 1
+		}
+	}
+	return 0
+}
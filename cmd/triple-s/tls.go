@@ -0,0 +1,194 @@
+package triple_s
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ab-dauletkhan/triple-s/api/core"
+)
+
+// How often the certificate files are checked for changes
+const certReloadInterval = 10 * time.Second
+
+var ErrNoClientCACerts = errors.New("no certificates found in client CA file")
+
+// certReloader keeps the most recently loaded key pair and swaps it
+// whenever the certificate or key file on disk is modified.
+type certReloader struct {
+	certPath string
+	keyPath  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certPath, keyPath string) (*certReloader, error) {
+	cr := &certReloader{certPath: certPath, keyPath: keyPath}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// reload reads the key pair from disk and replaces the served certificate
+func (cr *certReloader) reload() error {
+	modTime, err := cr.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certPath, cr.keyPath)
+	if err != nil {
+		return err
+	}
+
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.modTime = modTime
+	cr.mu.Unlock()
+	return nil
+}
+
+// latestModTime returns the newest modification time of the cert and key files
+func (cr *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{cr.certPath, cr.keyPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// watch polls the certificate files and reloads them when they change.
+// A failed reload keeps the previous certificate in service.
+func (cr *certReloader) watch() {
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		modTime, err := cr.latestModTime()
+		if err != nil {
+			slog.Error("error checking TLS certificate files", "error", err)
+			continue
+		}
+
+		cr.mu.RLock()
+		changed := !modTime.Equal(cr.modTime)
+		cr.mu.RUnlock()
+		if !changed {
+			continue
+		}
+
+		if err := cr.reload(); err != nil {
+			slog.Error("error reloading TLS certificate, keeping the previous one", "error", err)
+			continue
+		}
+		slog.Info("TLS certificate reloaded", "path", cr.certPath)
+	}
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// newTLSConfig builds the server TLS configuration from the TLS settings.
+// HTTP/2 is negotiated through ALPN.
+func newTLSConfig(cfg core.TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+
+	if cfg.SelfSigned {
+		cert, err := selfSignedCert()
+		if err != nil {
+			return nil, fmt.Errorf("error generating self-signed certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	} else {
+		cr, err := newCertReloader(cfg.Cert, cfg.Key)
+		if err != nil {
+			return nil, fmt.Errorf("error loading TLS key pair: %w", err)
+		}
+		go cr.watch()
+		tlsConfig.GetCertificate = cr.GetCertificate
+	}
+
+	if cfg.ClientCA != "" {
+		pem, err := os.ReadFile(cfg.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("error reading client CA file: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, ErrNoClientCACerts
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// selfSignedCert generates an in-memory ECDSA certificate valid for
+// localhost and the machine hostname.
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	dnsNames := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+		dnsNames = append(dnsNames, hostname)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"triple-s development"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              dnsNames,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	slog.Info("generated self-signed certificate", "sha256", fmt.Sprintf("%X", sha256.Sum256(der)))
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}